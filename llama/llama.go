@@ -157,6 +157,35 @@ func GetModelArch(modelPath string) (string, error) {
 	return C.GoString(arch), nil
 }
 
+// DeviceInfo describes a GPU device registered with the ggml backend
+type DeviceInfo struct {
+	Name        string
+	FreeMemory  uint64
+	TotalMemory uint64
+}
+
+// GPUDevices returns the GPU devices available to the backend, in the same
+// order used to index ModelParams.TensorSplit
+func GPUDevices() []DeviceInfo {
+	var devices []DeviceInfo
+	for i := range int(C.ggml_backend_dev_count()) {
+		dev := C.ggml_backend_dev_get(C.size_t(i))
+		if C.ggml_backend_dev_type(dev) != C.GGML_BACKEND_DEVICE_TYPE_GPU {
+			continue
+		}
+
+		var free, total C.size_t
+		C.ggml_backend_dev_memory(dev, &free, &total)
+		devices = append(devices, DeviceInfo{
+			Name:        C.GoString(C.ggml_backend_dev_name(dev)),
+			FreeMemory:  uint64(free),
+			TotalMemory: uint64(total),
+		})
+	}
+
+	return devices
+}
+
 type ContextParams struct {
 	c C.struct_llama_context_params
 }
@@ -203,24 +232,57 @@ func (c *Context) Decode(batch *Batch) error {
 	// Positive return values does not mean a fatal error, but rather a warning.
 	//   0 - success
 	//   1 - could not find a KV slot for the batch (try reducing the size of the batch or increase the context)
+	//   2 - aborted
 	// < 0 - error
 	code := int(C.llama_decode(c.c, batch.c))
 
-	if code < 0 {
-		return fmt.Errorf("llama_decode failed with code %d", code)
+	if code == 1 {
+		return ErrKvCacheFull
 	}
 
-	if code > 0 {
-		return ErrKvCacheFull
+	if code != 0 {
+		return &DecodeError{Code: code}
 	}
 
 	return nil
 }
 
+// DecodeError is returned by Decode when llama_decode fails for a reason other
+// than a full KV cache.
+type DecodeError struct {
+	Code int
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("llama_decode failed with code %d", e.Code)
+}
+
+// Transient reports whether decoding the same batch again may succeed: the
+// computation was aborted (2) or its buffers could not be allocated (-2). In
+// both cases llama.cpp restores the KV cache to its state before the call.
+// An invalid batch (-1) or failed computation (-3) is not transient.
+func (e *DecodeError) Transient() bool {
+	return e.Code == 2 || e.Code == -2
+}
+
 func (c *Context) Model() *Model {
 	return &Model{c: C.llama_get_model(c.c)}
 }
 
+// FlashAttention reports whether the context actually uses flash attention.
+// It can be off even when requested, as llama.cpp disables it for models that
+// don't support it.
+func (c *Context) FlashAttention() bool {
+	return bool(C.context_flash_attn(c.c))
+}
+
+// PerTokenEmbeddings reports whether the context keeps an embedding for each
+// decoded token. Contexts that pool embeddings by sequence only keep the
+// pooled one.
+func (c *Context) PerTokenEmbeddings() bool {
+	return C.llama_pooling_type(c.c) == C.LLAMA_POOLING_TYPE_NONE
+}
+
 func (c *Context) KvCacheSeqAdd(seqId int, p0 int, p1 int, delta int) {
 	C.llama_kv_cache_seq_add(c.c, C.int(seqId), C.int(p0), C.int(p1), C.int(delta))
 }
@@ -260,6 +322,17 @@ func (c *Context) GetEmbeddingsIth(i int) []float32 {
 	return unsafe.Slice((*float32)(embeddings), c.Model().NEmbd())
 }
 
+// GetLogitsIth returns the logits for the ith token of the last decoded batch.
+// The slice aliases the context's buffer, so changes are seen by the sampler.
+func (c *Context) GetLogitsIth(i int) []float32 {
+	logits := unsafe.Pointer(C.llama_get_logits_ith(c.c, C.int32_t(i)))
+	if logits == nil {
+		return nil
+	}
+
+	return unsafe.Slice((*float32)(logits), c.Model().NumVocab())
+}
+
 type ModelParams struct {
 	NumGpuLayers int
 	MainGpu      int
@@ -344,26 +417,78 @@ func (m *Model) AddBOSToken() bool {
 	return bool(C.llama_add_bos_token(m.c))
 }
 
+// TokenBOS, TokenEOS, TokenEOT and TokenPad return the model's special token
+// IDs, or -1 if the vocabulary does not define one.
+func (m *Model) TokenBOS() int {
+	return int(C.llama_token_bos(m.c))
+}
+
+func (m *Model) TokenEOS() int {
+	return int(C.llama_token_eos(m.c))
+}
+
+func (m *Model) TokenEOT() int {
+	return int(C.llama_token_eot(m.c))
+}
+
+func (m *Model) TokenPad() int {
+	return int(C.llama_token_pad(m.c))
+}
+
+// TokenIsControl reports whether the token is a control token, such as the
+// markers used by chat templates.
+func (m *Model) TokenIsControl(token int) bool {
+	return C.llama_token_get_attr(m.c, C.llama_token(token))&C.LLAMA_TOKEN_ATTR_CONTROL != 0
+}
+
 func (m *Model) ApplyLoraFromFile(context *Context, loraPath string, scale float32, threads int) error {
+	loraAdapter, err := m.LoadLoraAdapter(loraPath)
+	if err != nil {
+		return err
+	}
+
+	return context.SetLoraAdapter(loraAdapter, scale)
+}
+
+// LoraAdapter is a LoRA adapter loaded into memory for a model. Loading does
+// not apply it; use Context.SetLoraAdapter to activate it.
+type LoraAdapter struct {
+	c *C.struct_llama_lora_adapter
+}
+
+func (m *Model) LoadLoraAdapter(loraPath string) (*LoraAdapter, error) {
 	cLoraPath := C.CString(loraPath)
 	defer C.free(unsafe.Pointer(cLoraPath))
 
 	loraAdapter := C.llama_lora_adapter_init(m.c, cLoraPath)
 	if loraAdapter == nil {
-		return errors.New("unable to load lora")
+		return nil, errors.New("unable to load lora")
 	}
 
-	err := -1
-	if loraAdapter != nil {
-		err = int(C.llama_lora_adapter_set(context.c, loraAdapter, C.float(scale)))
-	}
-	if err != 0 {
-		return errors.New("error applying lora from file")
+	return &LoraAdapter{c: loraAdapter}, nil
+}
+
+// Free releases the adapter's memory. It must not be active on any context.
+func (a *LoraAdapter) Free() {
+	C.llama_lora_adapter_free(a.c)
+}
+
+// SetLoraAdapter activates the adapter on the context at the given scale, or
+// updates its scale if it is already active.
+func (c *Context) SetLoraAdapter(adapter *LoraAdapter, scale float32) error {
+	if C.llama_lora_adapter_set(c.c, adapter.c, C.float(scale)) != 0 {
+		return errors.New("error applying lora adapter")
 	}
 
 	return nil
 }
 
+// RemoveLoraAdapter deactivates the adapter on the context. It is not an error
+// to remove an adapter that is not active.
+func (c *Context) RemoveLoraAdapter(adapter *LoraAdapter) {
+	C.llama_lora_adapter_remove(c.c, adapter.c)
+}
+
 type Batch struct {
 	c         C.struct_llama_batch
 	batchSize int
@@ -477,6 +602,46 @@ func (m *Model) TokenToPiece(token int) string {
 	return strings.TrimRight(string(buf), "\x00")
 }
 
+// ChatMessage is one message of a conversation formatted by ApplyChatTemplate.
+type ChatMessage struct {
+	Role    string
+	Content string
+}
+
+// ApplyChatTemplate formats messages with the model's built-in chat template,
+// ending with the start of an assistant reply. Only the templates known to
+// llama_chat_apply_template are supported.
+func (m *Model) ApplyChatTemplate(messages []ChatMessage) (string, error) {
+	if len(messages) == 0 {
+		return "", errors.New("no messages to format")
+	}
+
+	chat := make([]C.llama_chat_message, len(messages))
+	size := 0
+	for i, msg := range messages {
+		role := C.CString(msg.Role)
+		defer C.free(unsafe.Pointer(role))
+		content := C.CString(msg.Content)
+		defer C.free(unsafe.Pointer(content))
+
+		chat[i] = C.llama_chat_message{role: role, content: content}
+		size += 2 * (len(msg.Role) + len(msg.Content))
+	}
+
+	for {
+		buf := make([]byte, max(size, 1))
+		n := int(C.llama_chat_apply_template(m.c, nil, &chat[0], C.size_t(len(chat)), C.bool(true),
+			(*C.char)(unsafe.Pointer(&buf[0])), C.int32_t(len(buf))))
+		if n < 0 {
+			return "", errors.New("model does not have a supported chat template")
+		}
+		if n <= len(buf) {
+			return string(buf[:n]), nil
+		}
+		size = n
+	}
+}
+
 func (m *Model) Tokenize(text string, addSpecial bool, parseSpecial bool) ([]int, error) {
 	maxTokens := len(text) + 2
 	cTokens := make([]C.llama_token, maxTokens)
@@ -523,6 +688,11 @@ func (m *Model) NEmbd() int {
 	return int(C.llama_n_embd(m.c))
 }
 
+// NCtxTrain returns the context length the model was trained with.
+func (m *Model) NCtxTrain() int {
+	return int(C.llama_n_ctx_train(m.c))
+}
+
 func Quantize(infile, outfile string, ftype uint32) error {
 	cinfile := C.CString(infile)
 	defer C.free(unsafe.Pointer(cinfile))
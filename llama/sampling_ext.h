@@ -35,6 +35,10 @@ extern "C"
 
     int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len);
 
+    // Whether the context uses flash attention, which llama.cpp may have
+    // forced off when it isn't supported by the model
+    bool context_flash_attn(const struct llama_context *ctx);
+
 #ifdef __cplusplus
 }
 #endif
@@ -0,0 +1,104 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements the access log middleware. Each request is logged with
+// its method, path, status and duration once the handler returns. Handlers that
+// return because the client went away are logged with the nginx-style 499
+// status rather than the 200 implied by having already written headers.
+
+import (
+	"time"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// statusClientClosedRequest is the non-standard status logged when the client
+// disconnects before the handler finishes.
+const statusClientClosedRequest = 499
+
+// accessLogWriter wraps an http.ResponseWriter to record the response status
+// and size for the access log. It forwards Flush so streaming handlers keep
+// working behind the middleware.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += n
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Status returns the status to log for the request. A request whose context
+// was cancelled by the client is reported as 499 regardless of what the
+// handler managed to write.
+func (w *accessLogWriter) Status(ctx context.Context) int {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return statusClientClosedRequest
+	}
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// accessLog wraps a handler and logs every request once it completes.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &accessLogWriter{ResponseWriter: w}
+
+		next.ServeHTTP(lw, r)
+
+		slog.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", lw.Status(r.Context()),
+			"bytes", lw.bytes,
+			"duration", time.Since(start))
+	})
+}
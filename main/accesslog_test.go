@@ -0,0 +1,117 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"log"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// logLines is an io.Writer that delivers each slog record on a channel
+type logLines chan []byte
+
+func (l logLines) Write(p []byte) (int, error) {
+	l <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// captureLogs routes slog records to the returned channel until the test ends.
+// slog.SetDefault also redirects the log package, which restoring the previous
+// default logger alone does not undo.
+func captureLogs(t *testing.T) logLines {
+	lines := make(logLines, 8)
+	logger, output, flags := slog.Default(), log.Writer(), log.Flags()
+	t.Cleanup(func() {
+		slog.SetDefault(logger)
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	})
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(lines, nil)))
+	return lines
+}
+
+func TestAccessLogClientDisconnect(t *testing.T) {
+	lines := captureLogs(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	server := httptest.NewServer(accessLog(handler))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/completion", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// disconnect mid-request, after the headers have been sent
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case line := <-lines:
+		var record struct {
+			Path   string `json:"path"`
+			Status int    `json:"status"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Path != "/completion" || record.Status != statusClientClosedRequest {
+			t.Errorf("expected /completion logged with status 499, got %s", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no access log written")
+	}
+}
+
+func TestAccessLogStatus(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	})
+
+	lw := &accessLogWriter{ResponseWriter: httptest.NewRecorder()}
+	req := httptest.NewRequest(http.MethodPost, "/completion", nil)
+	handler.ServeHTTP(lw, req)
+
+	if status := lw.Status(req.Context()); status != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", status)
+	}
+}
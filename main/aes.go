@@ -24,15 +24,146 @@ package main
  * SOFTWARE.
  */
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"container/list"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"log/slog"
 	"net/http"
 )
 
+// Supported values of the "mode" field on the AES and secure endpoints. An
+// empty mode means CBC, for clients written before GCM was available.
+const (
+	AesModeCBC = "cbc"
+	AesModeGCM = "gcm"
+)
+
+var errAesMode = errors.New("unsupported AES mode, expected \"cbc\" or \"gcm\"")
+
+// Maximum number of texts in one /aes/encrypt/batch or /rsa/encrypt/batch request
+const maxCryptoBatchItems = 1024
+
+var errCryptoBatchSize = fmt.Errorf("too many texts in batch, expected at most %d", maxCryptoBatchItems)
+
+// Reports which text of a batch could not be encrypted. Encryption stops at
+// the first failure, so the texts before Index were encrypted and none after.
+type cryptoBatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *cryptoBatchError) Error() string {
+	return fmt.Sprintf("text %d: %v", e.Index, e.Err)
+}
+
+func (e *cryptoBatchError) Unwrap() error {
+	return e.Err
+}
+
+// Returned by AesDecryptGCM when the ciphertext or its tag has been modified,
+// or was encrypted under a different key
+var ErrAesAuthentication = errors.New("AES-GCM authentication failed")
+
+// Returned by AesDecryptGCM when the ciphertext is not base64 or is too short
+// to hold a nonce and tag
+var ErrAesCiphertext = errors.New("invalid AES-GCM ciphertext")
+
+// Returned when the key is not base64 or not a valid AES key. GCM also
+// requires 32 bytes, so only AES-256 is used.
+var errAesKey = errors.New("invalid AES key")
+
+// Default number of encryptions under one AES key before a warning is logged
+const defaultAesKeyUsageWarn = 1_000_000
+
+// Maximum number of distinct keys tracked; beyond it the least recently used
+// key's count is dropped
+const maxTrackedAesKeys = 10_000
+
+// Counts encryptions per AES key so that heavy reuse of a single key, which
+// raises the risk of IV/nonce collisions, is surfaced in the logs. Keys are
+// identified by their SHA-256 digest so raw key material is never retained.
+// At most size keys are tracked (maxTrackedAesKeys if zero), evicting the
+// least recently used, so a flood of one-off keys can't reset the count of a
+// key that is in heavy use.
+type aesKeyUsageTracker struct {
+	mu        sync.Mutex
+	counts    map[[sha256.Size]byte]*list.Element
+	order     *list.List // of *aesKeyUsage, most recently used first
+	size      int
+	threshold uint64
+}
+
+// The encryption count of one tracked key
+type aesKeyUsage struct {
+	digest [sha256.Size]byte
+	count  uint64
+}
+
+// Global tracker used by AesEncrypt, configured from --aes-key-usage-warn
+var AesKeyUsage = &aesKeyUsageTracker{
+	threshold: defaultAesKeyUsageWarn,
+}
+
+// Sets the warning threshold; zero disables tracking
+func (t *aesKeyUsageTracker) SetThreshold(threshold uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.threshold = threshold
+}
+
+// Records one encryption with the key and logs a warning each time the usage
+// count reaches a multiple of the threshold. Returns true if a warning was logged.
+func (t *aesKeyUsageTracker) Record(key []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.threshold == 0 {
+		return false
+	}
+
+	if t.counts == nil {
+		t.counts = make(map[[sha256.Size]byte]*list.Element)
+		t.order = list.New()
+	}
+
+	digest := sha256.Sum256(key)
+	elem, ok := t.counts[digest]
+	if ok {
+		t.order.MoveToFront(elem)
+	} else {
+		elem = t.order.PushFront(&aesKeyUsage{digest: digest})
+		t.counts[digest] = elem
+		size := t.size
+		if size <= 0 {
+			size = maxTrackedAesKeys
+		}
+		if t.order.Len() > size {
+			oldest := t.order.Back()
+			t.order.Remove(oldest)
+			delete(t.counts, oldest.Value.(*aesKeyUsage).digest)
+		}
+	}
+
+	usage := elem.Value.(*aesKeyUsage)
+	usage.count++
+	count := usage.count
+	if count%t.threshold != 0 {
+		return false
+	}
+
+	slog.Warn("AES key reused for a high number of encryptions, rotate the key to avoid IV/nonce reuse",
+		"key", hex.EncodeToString(digest[:4]), "encryptions", count)
+	return true
+}
+
 // Response structure for AES key generation
 type AesKeyResponse struct {
 	AesKey string `json:"aesKey"`
@@ -42,6 +173,7 @@ type AesKeyResponse struct {
 type AesEncryptRequest struct {
 	AesKey string `json:"aesKey"`
 	Text   string `json:"text"`
+	Mode   string `json:"mode"`
 }
 
 // Response structure for encryption
@@ -49,10 +181,23 @@ type AesEncryptResponse struct {
 	EncryptedText string `json:"encryptedText"`
 }
 
+// Request structure for batch encryption, with every text under the same key
+type AesEncryptBatchRequest struct {
+	AesKey string   `json:"aesKey"`
+	Texts  []string `json:"texts"`
+	Mode   string   `json:"mode"`
+}
+
+// Response structure for batch encryption, in the order of the request texts
+type AesEncryptBatchResponse struct {
+	EncryptedTexts []string `json:"encryptedTexts"`
+}
+
 // Request structure for decryption
 type AesDecryptRequest struct {
 	AesKey        string `json:"aesKey"`
 	EncryptedText string `json:"encryptedText"`
+	Mode          string `json:"mode"`
 }
 
 // Response structure for decryption
@@ -92,8 +237,11 @@ func AesEncryptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encryptedText, err := AesEncrypt(request.AesKey, request.Text)
-	if err != nil {
+	encryptedText, err := AesEncryptMode(request.Mode, request.AesKey, request.Text)
+	if errors.Is(err, errAesMode) || errors.Is(err, errAesKey) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Error encrypting text", http.StatusInternalServerError)
 		return
 	}
@@ -103,6 +251,53 @@ func AesEncryptHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// Handles POST requests to encrypt several texts with the provided AES key.
+// If a text fails, the error names its index and nothing is returned.
+//
+// Request:
+// {
+//   "aesKey": "<base64-AES-key>",
+//   "texts": ["first", "second"],
+//   "mode": "gcm"
+// }
+//
+// Response:
+// {
+//   "encryptedTexts": ["<base64-cipher>", "<base64-cipher>"]
+// }
+func AesEncryptBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request AesEncryptBatchRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	encryptedTexts, err := encryptBatch(request.Texts, func(text string) (string, error) {
+		return AesEncryptMode(request.Mode, request.AesKey, text)
+	})
+	var batchErr *cryptoBatchError
+	if errors.Is(err, errCryptoBatchSize) || errors.Is(err, errAesMode) || errors.Is(err, errAesKey) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.As(err, &batchErr) {
+		http.Error(w, fmt.Sprintf("Error encrypting text %d", batchErr.Index), http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		http.Error(w, "Error encrypting texts", http.StatusInternalServerError)
+		return
+	}
+
+	response := AesEncryptBatchResponse{EncryptedTexts: encryptedTexts}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // Handles POST requests to decrypt text with the provided AES key
 func AesDecryptHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -117,8 +312,11 @@ func AesDecryptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	text, err := AesDecrypt(request.AesKey, request.EncryptedText)
-	if err != nil {
+	text, err := AesDecryptMode(request.Mode, request.AesKey, request.EncryptedText)
+	if errors.Is(err, errAesMode) || errors.Is(err, errAesKey) || errors.Is(err, ErrAesAuthentication) || errors.Is(err, ErrAesCiphertext) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Error decrypting text", http.StatusInternalServerError)
 		return
 	}
@@ -142,14 +340,16 @@ func AesKey() (string, error) {
 func AesEncrypt(base64Key string, text string) (string, error) {
 	aesKey, err := base64.StdEncoding.DecodeString(base64Key)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %v", errAesKey, err)
 	}
 
 	block, err := aes.NewCipher(aesKey)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %v", errAesKey, err)
 	}
 
+	AesKeyUsage.Record(aesKey)
+
 	paddedText := pad([]byte(text), aes.BlockSize)
 
 	// Generate a new random IV
@@ -201,6 +401,114 @@ func AesDecrypt(base64key string, encryptedText string) (string, error) {
 	return string(text), nil
 }
 
+// Encrypts plaintext using AES-256-GCM. The random 12-byte nonce is prepended
+// to the ciphertext and authentication tag before base64 encoding.
+func AesEncryptGCM(base64Key string, text string) (string, error) {
+	aesKey, gcm, err := newAesGCM(base64Key)
+	if err != nil {
+		return "", err
+	}
+
+	AesKeyUsage.Record(aesKey)
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	// Seal appends the ciphertext and tag to the nonce
+	sealed := gcm.Seal(nonce, nonce, []byte(text), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts base64 encoded nonce+ciphertext+tag produced by AesEncryptGCM.
+// Returns ErrAesAuthentication if the tag does not verify and ErrAesCiphertext
+// if there is no complete nonce and tag to verify.
+func AesDecryptGCM(base64Key string, encryptedText string) (string, error) {
+	_, gcm, err := newAesGCM(base64Key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encryptedText)
+	if err != nil {
+		return "", ErrAesCiphertext
+	}
+
+	if len(sealed) < gcm.NonceSize()+gcm.Overhead() {
+		return "", fmt.Errorf("%w: too short", ErrAesCiphertext)
+	}
+
+	nonce := sealed[:gcm.NonceSize()]
+	text, err := gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", ErrAesAuthentication
+	}
+	return string(text), nil
+}
+
+// Decodes the base64 key and returns it with an AES-GCM cipher using it.
+// aes.NewCipher also accepts 16 and 24 byte keys, so the length is checked
+// here to keep GCM to AES-256.
+func newAesGCM(base64Key string) ([]byte, cipher.AEAD, error) {
+	aesKey, err := base64.StdEncoding.DecodeString(base64Key)
+	if err != nil || len(aesKey) != 32 {
+		return nil, nil, fmt.Errorf("%w: expected 32 base64 encoded bytes", errAesKey)
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aesKey, gcm, nil
+}
+
+// Encrypts with AesEncrypt or AesEncryptGCM depending on mode
+func AesEncryptMode(mode string, base64Key string, text string) (string, error) {
+	switch mode {
+	case "", AesModeCBC:
+		return AesEncrypt(base64Key, text)
+	case AesModeGCM:
+		return AesEncryptGCM(base64Key, text)
+	}
+	return "", errAesMode
+}
+
+// Decrypts with AesDecrypt or AesDecryptGCM depending on mode
+func AesDecryptMode(mode string, base64Key string, encryptedText string) (string, error) {
+	switch mode {
+	case "", AesModeCBC:
+		return AesDecrypt(base64Key, encryptedText)
+	case AesModeGCM:
+		return AesDecryptGCM(base64Key, encryptedText)
+	}
+	return "", errAesMode
+}
+
+// Encrypts each text in order with encrypt, stopping at the first failure with
+// a *cryptoBatchError for its index
+func encryptBatch(texts []string, encrypt func(text string) (string, error)) ([]string, error) {
+	if len(texts) > maxCryptoBatchItems {
+		return nil, errCryptoBatchSize
+	}
+
+	encryptedTexts := make([]string, len(texts))
+	for i, text := range texts {
+		encryptedText, err := encrypt(text)
+		if err != nil {
+			return nil, &cryptoBatchError{Index: i, Err: err}
+		}
+		encryptedTexts[i] = encryptedText
+	}
+	return encryptedTexts, nil
+}
+
 // Applies PKCS#7 padding
 func pad(data []byte, blockSize int) []byte {
 	padding := blockSize - len(data)%blockSize
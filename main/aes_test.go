@@ -0,0 +1,285 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestAesKeyUsageWarning(t *testing.T) {
+	tracker := &aesKeyUsageTracker{threshold: 3}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	other := []byte("fedcba9876543210fedcba9876543210")
+
+	var warnings []int
+	for i := 1; i <= 7; i++ {
+		if tracker.Record(key) {
+			warnings = append(warnings, i)
+		}
+		if tracker.Record(other) && i < 3 {
+			t.Errorf("unexpected warning for second key at use %d", i)
+		}
+	}
+
+	if len(warnings) != 2 || warnings[0] != 3 || warnings[1] != 6 {
+		t.Errorf("expected warnings at uses 3 and 6, got %v", warnings)
+	}
+
+	tracker.SetThreshold(0)
+	for range 10 {
+		if tracker.Record(key) {
+			t.Fatal("expected no warnings when tracking is disabled")
+		}
+	}
+}
+
+func TestAesKeyUsageEvictsLeastRecentlyUsed(t *testing.T) {
+	tracker := &aesKeyUsageTracker{size: 2, threshold: 4}
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	// one-off keys evict each other rather than the key in steady use
+	for i := range 3 {
+		tracker.Record(key)
+		tracker.Record([]byte(fmt.Sprintf("one-off key %d", i)))
+	}
+	if len(tracker.counts) != 2 {
+		t.Errorf("expected 2 tracked keys, got %d", len(tracker.counts))
+	}
+	if !tracker.Record(key) {
+		t.Error("expected the 4th use of the key to warn")
+	}
+
+	// once it is the least recently used, the key is dropped
+	tracker.Record([]byte("one-off key 3"))
+	tracker.Record([]byte("one-off key 4"))
+	if _, ok := tracker.counts[sha256.Sum256(key)]; ok {
+		t.Error("expected the least recently used key to be evicted")
+	}
+}
+
+func TestAesEncryptDecryptRoundTrip(t *testing.T) {
+	key, err := AesKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := AesEncrypt(key, "hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := AesDecrypt(key, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "hello world" {
+		t.Errorf("expected %q, got %q", "hello world", text)
+	}
+}
+
+func TestAesGCMRoundTripAndTampering(t *testing.T) {
+	key, err := AesKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := AesEncryptMode(AesModeGCM, key, "hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := AesDecryptGCM(key, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "hello world" {
+		t.Errorf("expected %q, got %q", "hello world", text)
+	}
+
+	// flipping any bit of the ciphertext fails authentication
+	sealed, _ := base64.StdEncoding.DecodeString(encrypted)
+	sealed[len(sealed)/2] ^= 0x01
+	_, err = AesDecryptGCM(key, base64.StdEncoding.EncodeToString(sealed))
+	if !errors.Is(err, ErrAesAuthentication) {
+		t.Errorf("expected ErrAesAuthentication for tampered input, got %v", err)
+	}
+
+	// so does decrypting under another key
+	other, _ := AesKey()
+	if _, err := AesDecryptGCM(other, encrypted); !errors.Is(err, ErrAesAuthentication) {
+		t.Errorf("expected ErrAesAuthentication for the wrong key, got %v", err)
+	}
+}
+
+func TestAesGCMTruncatedCiphertext(t *testing.T) {
+	key, err := AesKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// anything shorter than the 12-byte nonce plus 16-byte tag
+	for _, n := range []int{0, 11, 12, 27} {
+		truncated := base64.StdEncoding.EncodeToString(make([]byte, n))
+		if _, err := AesDecryptGCM(key, truncated); !errors.Is(err, ErrAesCiphertext) {
+			t.Errorf("expected ErrAesCiphertext for a %d byte ciphertext, got %v", n, err)
+		}
+	}
+}
+
+func TestAesGCMRejectsShortKeys(t *testing.T) {
+	// AES-128 and AES-192 keys are valid for aes.NewCipher but not here
+	for _, n := range []int{16, 24, 31} {
+		key := base64.StdEncoding.EncodeToString(make([]byte, n))
+		if _, err := AesEncryptGCM(key, "hello"); !errors.Is(err, errAesKey) {
+			t.Errorf("expected errAesKey for a %d byte key, got %v", n, err)
+		}
+	}
+}
+
+func TestAesDecryptHandlerClientErrors(t *testing.T) {
+	key, err := AesKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := AesEncryptGCM(key, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := base64.StdEncoding.DecodeString(encrypted)
+	sealed[len(sealed)-1] ^= 0x01
+
+	cases := map[string]AesDecryptRequest{
+		"short key":  {AesKey: base64.StdEncoding.EncodeToString(make([]byte, 16)), EncryptedText: encrypted, Mode: AesModeGCM},
+		"tampered":   {AesKey: key, EncryptedText: base64.StdEncoding.EncodeToString(sealed), Mode: AesModeGCM},
+		"truncated":  {AesKey: key, EncryptedText: base64.StdEncoding.EncodeToString(sealed[:20]), Mode: AesModeGCM},
+		"not base64": {AesKey: key, EncryptedText: "not base64!", Mode: AesModeGCM},
+	}
+	for name, request := range cases {
+		body, _ := json.Marshal(request)
+		w := httptest.NewRecorder()
+		AesDecryptHandler(w, httptest.NewRequest(http.MethodPost, "/aes/decrypt", strings.NewReader(string(body))))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestAesModes(t *testing.T) {
+	key, err := AesKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty mode keeps the original CBC behaviour
+	encrypted, err := AesEncryptMode("", key, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := AesDecrypt(key, encrypted); err != nil || text != "hello" {
+		t.Errorf("expected CBC by default, got %q, %v", text, err)
+	}
+
+	if _, err := AesEncryptMode("ecb", key, "hello"); !errors.Is(err, errAesMode) {
+		t.Errorf("expected errAesMode, got %v", err)
+	}
+	if _, err := AesDecryptMode("ecb", key, encrypted); !errors.Is(err, errAesMode) {
+		t.Errorf("expected errAesMode, got %v", err)
+	}
+}
+
+func TestAesEncryptBatchHandler(t *testing.T) {
+	key, err := AesKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := []string{"first", "second", "third"}
+
+	body, _ := json.Marshal(AesEncryptBatchRequest{AesKey: key, Texts: texts, Mode: AesModeGCM})
+	w := httptest.NewRecorder()
+	AesEncryptBatchHandler(w, httptest.NewRequest(http.MethodPost, "/aes/encrypt/batch", strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var resp AesEncryptBatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.EncryptedTexts) != len(texts) {
+		t.Fatalf("expected %d ciphertexts, got %d", len(texts), len(resp.EncryptedTexts))
+	}
+	for i, encrypted := range resp.EncryptedTexts {
+		if text, err := AesDecryptGCM(key, encrypted); err != nil || text != texts[i] {
+			t.Errorf("text %d: expected %q, got %q (%v)", i, texts[i], text, err)
+		}
+	}
+
+	// a bad mode is reported as a client error
+	body, _ = json.Marshal(AesEncryptBatchRequest{AesKey: key, Texts: texts, Mode: "ecb"})
+	w = httptest.NewRecorder()
+	AesEncryptBatchHandler(w, httptest.NewRequest(http.MethodPost, "/aes/encrypt/batch", strings.NewReader(string(body))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown mode, got %d", w.Code)
+	}
+
+	// so is a key that does not parse, in either mode
+	for _, mode := range []string{AesModeCBC, AesModeGCM} {
+		body, _ = json.Marshal(AesEncryptBatchRequest{AesKey: "not base64!", Texts: texts, Mode: mode})
+		w = httptest.NewRecorder()
+		AesEncryptBatchHandler(w, httptest.NewRequest(http.MethodPost, "/aes/encrypt/batch", strings.NewReader(string(body))))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for an invalid %s key, got %d: %s", mode, w.Code, w.Body)
+		}
+	}
+}
+
+func TestEncryptBatchReportsFailingIndex(t *testing.T) {
+	failure := errors.New("boom")
+	_, err := encryptBatch([]string{"a", "b", "bad", "c"}, func(text string) (string, error) {
+		if text == "bad" {
+			return "", failure
+		}
+		return text, nil
+	})
+
+	var batchErr *cryptoBatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 2 || !errors.Is(err, failure) {
+		t.Fatalf("expected a failure at index 2, got %v", err)
+	}
+
+	identity := func(text string) (string, error) { return text, nil }
+	if _, err := encryptBatch(make([]string, maxCryptoBatchItems+1), identity); !errors.Is(err, errCryptoBatchSize) {
+		t.Errorf("expected errCryptoBatchSize, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := []struct {
+		name   string
+		key    string
+		path   string
+		header string
+		want   int
+	}{
+		{"no key configured", "", "/completion", "", http.StatusOK},
+		{"valid token", "secret", "/completion", "Bearer secret", http.StatusOK},
+		{"scheme is case-insensitive", "secret", "/completion", "bearer secret", http.StatusOK},
+		{"missing header", "secret", "/completion", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "/rsa/keys", "Bearer secrex", http.StatusUnauthorized},
+		{"token prefix", "secret", "/completion", "Bearer secre", http.StatusUnauthorized},
+		{"basic auth", "secret", "/completion", "Basic secret", http.StatusUnauthorized},
+		{"health is open", "secret", "/health", "", http.StatusOK},
+		{"detailed health is not", "secret", "/health/detailed", "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		requireAPIKey(tc.key, ok).ServeHTTP(w, r)
+
+		if w.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, w.Code)
+			continue
+		}
+		if w.Code != http.StatusUnauthorized {
+			continue
+		}
+
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error.Message == "" {
+			t.Errorf("%s: expected a JSON error body, got %v", tc.name, err)
+		}
+	}
+}
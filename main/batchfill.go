@@ -0,0 +1,111 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements the strategies processBatch uses to share a batch
+// between the active sequences, selected with --batch-fill.
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// BatchFill is how a batch's capacity is divided among sequences.
+type BatchFill string
+
+const (
+	// BatchFillRoundRobin visits sequences in turn, starting after the one
+	// that was cut off last, and lets each add up to a batch's worth of inputs
+	BatchFillRoundRobin BatchFill = "round_robin"
+
+	// BatchFillFair gives every sequence with pending inputs an equal share
+	// of the batch
+	BatchFillFair BatchFill = "fair"
+
+	// BatchFillPriority fills the batch with the sequences that have the
+	// fewest pending inputs first, so generating (interactive) sequences are
+	// never held up by long prompts, which get what is left
+	BatchFillPriority BatchFill = "priority"
+)
+
+func (f *BatchFill) String() string {
+	return string(*f)
+}
+
+func (f *BatchFill) Set(value string) error {
+	switch BatchFill(value) {
+	case BatchFillRoundRobin, BatchFillFair, BatchFillPriority:
+		*f = BatchFill(value)
+		return nil
+	}
+
+	return fmt.Errorf("unknown batch fill strategy %q", value)
+}
+
+// order returns the indices of seqs in the order they are added to a batch,
+// starting from next. Sequences with a higher request priority always come
+// first; the strategy orders sequences of equal priority.
+func (f BatchFill) order(seqs []*Sequence, next int) []int {
+	order := make([]int, len(seqs))
+	for i := range order {
+		order[i] = (next + i) % len(seqs)
+	}
+
+	slices.SortStableFunc(order, func(a, b int) int {
+		if c := cmp.Compare(sequencePriority(seqs[b]), sequencePriority(seqs[a])); c != 0 {
+			return c
+		}
+		if f == BatchFillPriority {
+			return pendingLen(seqs[a]) - pendingLen(seqs[b])
+		}
+		return 0
+	})
+
+	return order
+}
+
+// limit returns how many inputs a sequence may add to a batch of batchSize
+// that already holds filled inputs from other sequences, with active
+// sequences having inputs to add.
+func (f BatchFill) limit(batchSize int, active int, filled int) int {
+	switch f {
+	case BatchFillFair:
+		return max(batchSize/max(active, 1), 1)
+	case BatchFillPriority:
+		return max(batchSize-filled, 0)
+	}
+
+	return batchSize
+}
+
+// pendingLen is the number of inputs seq has left to decode; empty entries sort last.
+func pendingLen(seq *Sequence) int {
+	if seq == nil {
+		return int(^uint(0) >> 1)
+	}
+	return len(seq.inputs)
+}
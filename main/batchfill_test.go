@@ -0,0 +1,100 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"slices"
+	"testing"
+
+	"llm-server/llama"
+)
+
+// fillTestBatch fills a batch of batchSize from sequences with the given
+// numbers of pending inputs and returns how many inputs each added.
+func fillTestBatch(t *testing.T, fill BatchFill, batchSize int, pending ...int) []int {
+	t.Helper()
+
+	cache, err := NewInputCache(nil, 1024, len(pending), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := llama.NewBatch(batchSize, len(pending), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Free()
+
+	s := &Server{seqs: make([]*Sequence, len(pending)), cache: cache, batchFill: fill}
+	for i, n := range pending {
+		seq := newTestSequence(tokenInputs(make([]int, n)...))
+		seq.cache = &cache.slots[i]
+		s.seqs[i] = seq
+	}
+
+	if _, _, _, err := fillBatch(s, batch, &llama.Batch{}); err != nil {
+		t.Fatal(err)
+	}
+
+	added := make([]int, len(pending))
+	for i, seq := range s.seqs {
+		added[i] = len(seq.pendingInputs)
+	}
+	return added
+}
+
+func TestBatchFillFair(t *testing.T) {
+	// three sequences with long prompts share the batch equally
+	if added := fillTestBatch(t, BatchFillFair, 12, 20, 20, 20); !slices.Equal(added, []int{4, 4, 4}) {
+		t.Errorf("expected an even split of the batch, got %v", added)
+	}
+
+	// a generating sequence only needs its one input
+	if added := fillTestBatch(t, BatchFillFair, 12, 1, 20, 20); !slices.Equal(added, []int{1, 4, 4}) {
+		t.Errorf("expected each sequence to get at most its share, got %v", added)
+	}
+}
+
+func TestBatchFillStrategies(t *testing.T) {
+	// round robin lets every sequence add up to a batch's worth
+	if added := fillTestBatch(t, BatchFillRoundRobin, 8, 20, 1, 5); !slices.Equal(added, []int{8, 1, 5}) {
+		t.Errorf("round_robin: got %v", added)
+	}
+
+	// priority serves the shortest sequences first and caps the total
+	if added := fillTestBatch(t, BatchFillPriority, 8, 20, 1, 5); !slices.Equal(added, []int{2, 1, 5}) {
+		t.Errorf("priority: got %v", added)
+	}
+}
+
+func TestBatchFillSet(t *testing.T) {
+	var fill BatchFill
+	if err := fill.Set("fair"); err != nil || fill != BatchFillFair {
+		t.Errorf("expected fair, got %q, %v", fill, err)
+	}
+	if err := fill.Set("fastest"); err == nil {
+		t.Error("expected an unknown strategy to be rejected")
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 	"time"
 	"log/slog"
 	"llm-server/llama"
@@ -37,7 +38,15 @@ type InputCache struct {
 	numCtx         int
 	slots          []InputCacheSlot
 	multiUserCache bool
+	matchTolerance int
+	shiftRatio     float64 // fraction of the context to free on each shift (see --shift-ratio)
 	lc             *llama.Context
+
+	// base is a shared prompt prefix decoded once into KV sequence baseId
+	// under the adapter scales baseLora (see --base-prompt)
+	base     []input
+	baseId   int
+	baseLora []float32
 }
 
 // InputCacheSlot represents a single KV cache slot, including cached input,
@@ -47,10 +56,57 @@ type InputCacheSlot struct {
 	Inputs   []input
 	InUse    bool
 	lastUsed time.Time
+
+	// lora is the adapter set the cached inputs were decoded with
+	lora []float32
+
+	// expiresAt is when the cached inputs are cleared if the slot is idle,
+	// set from a request's cache_ttl_ms; zero means they are kept
+	expiresAt time.Time
+
+	// selection records how the slot was chosen for its current sequence
+	selection CacheSelection
+}
+
+// Cache slot selection actions reported in CacheSelection.Action.
+const (
+	CacheActionPrefix = "prefix" // reused in place up to the common prefix
+	CacheActionFork   = "fork"   // prefix copied from another slot in use or out of tolerance
+	CacheActionEvict  = "evict"  // least recently used slot cleared for the prompt
+	CacheActionBase   = "base"   // seeded from the shared base prompt
+)
+
+// CacheSelection explains which cache slot a sequence was given and why, for
+// debugging multi-user cache behavior (see return_cache_selection).
+type CacheSelection struct {
+	Slot   int    `json:"slot"`
+	Action string `json:"action"`
+
+	// Source is the slot a forked prefix was copied from
+	Source *int `json:"source,omitempty"`
+
+	// PrefixLen is the number of prompt inputs reused from the cache
+	PrefixLen int `json:"prefix_len"`
+}
+
+// cacheExpiryInterval is how often idle slots are checked for an expired TTL
+const cacheExpiryInterval = time.Second
+
+// defaultShiftRatio frees half of the context beyond num_keep on each shift
+const defaultShiftRatio = 0.5
+
+// validateShiftRatio checks that a shift frees some, but not all, of the context.
+func validateShiftRatio(ratio float64) error {
+	if !(ratio > 0 && ratio < 1) {
+		return fmt.Errorf("shift ratio must be between 0 and 1 exclusive, got %v", ratio)
+	}
+	return nil
 }
 
 // NewInputCache initializes a new input cache with specified size and slot count.
-func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache bool) (*InputCache, error) {
+// matchTolerance is the number of trailing cached inputs that may differ from a
+// new prompt while still reusing the slot in place (multi-user cache only).
+func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache bool, matchTolerance int) (*InputCache, error) {
 	if kvSize/numSlots < 1 {
 		return nil, fmt.Errorf("must have at least one kv cache entry per parallel sequence (kv: %v parallel: %v)", kvSize, numSlots)
 	}
@@ -67,10 +123,69 @@ func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache b
 		numCtx:         kvSize / numSlots,
 		slots:          slots,
 		multiUserCache: multiUserCache,
+		matchTolerance: matchTolerance,
+		shiftRatio:     defaultShiftRatio,
 		lc:             lc,
 	}, nil
 }
 
+// SetBase registers a shared prompt prefix that has been decoded into KV
+// sequence baseId with the given adapter scales.
+func (c *InputCache) SetBase(inputs []input, baseId int, lora []float32) {
+	c.base = inputs
+	c.baseId = baseId
+	c.baseLora = lora
+}
+
+// ClearExpired clears the cached inputs of every idle slot whose TTL has passed
+// by now, removing them from the KV cache, and returns the number cleared.
+func (c *InputCache) ClearExpired(now time.Time) int {
+	var cleared int
+	for i := range c.slots {
+		slot := &c.slots[i]
+		if slot.InUse || slot.expiresAt.IsZero() || now.Before(slot.expiresAt) {
+			continue
+		}
+
+		slog.Debug("cache slot expired", "id", slot.Id, "inputs", len(slot.Inputs))
+		if c.lc != nil {
+			c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		}
+		slot.Inputs = slot.Inputs[:0]
+		slot.lora = nil
+		slot.expiresAt = time.Time{}
+		cleared++
+	}
+
+	return cleared
+}
+
+// Clear removes the cached inputs of every idle slot and the base prompt from
+// the KV cache, for when the adapters they were decoded under have changed.
+func (c *InputCache) Clear() {
+	for i := range c.slots {
+		slot := &c.slots[i]
+		if slot.InUse {
+			continue
+		}
+
+		if c.lc != nil {
+			c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		}
+		slot.Inputs = slot.Inputs[:0]
+		slot.lora = nil
+		slot.expiresAt = time.Time{}
+	}
+
+	if c.base != nil {
+		slog.Warn("dropping the base prompt, which was decoded under the previous lora adapters")
+		if c.lc != nil {
+			c.lc.KvCacheSeqRm(c.baseId, 0, -1)
+		}
+		c.base, c.baseLora = nil, nil
+	}
+}
+
 // ShiftCacheSlot removes old inputs from a slot if the total cached tokens exceed context size.
 func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int) error {
 	if numKeep >= c.numCtx {
@@ -99,8 +214,9 @@ func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int) error {
 }
 
 // ShiftDiscard computes how many tokens need to be discarded to meet target free space in the context.
+// The target is the cache's shift ratio of the context after the numKeep tokens.
 func (c *InputCache) ShiftDiscard(inputLen int, numKeep int) int {
-	targetFree := (c.numCtx - numKeep) / 2
+	targetFree := int(float64(c.numCtx-numKeep) * c.shiftRatio)
 	targetFree = max(targetFree, 1)
 
 	currentFree := c.numCtx - inputLen
@@ -113,8 +229,9 @@ func (c *InputCache) ShiftDiscard(inputLen int, numKeep int) int {
 }
 
 // LoadCacheSlot selects the best available cache slot for the given prompt,
-// trims reused tokens, and prepares the slot for inference.
-func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCacheSlot, []input, error) {
+// trims reused tokens, and prepares the slot for inference. Cached inputs are
+// only reused if they were decoded with the same LoRA adapter scales.
+func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool, lora []float32) (*InputCacheSlot, []input, error) {
 	var slot *InputCacheSlot
 	var numPast int
 	var err error
@@ -128,18 +245,123 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 		return nil, nil, err
 	}
 
-	if !cachePrompt {
+	if !cachePrompt || !slices.Equal(slot.lora, lora) {
 		numPast = 0
 	}
 
+	// Seed the slot from the shared base prompt if it covers more of the prompt
+	// than the slot's own cache
+	if cachePrompt && len(c.base) > numPast && countCommonPrefix(c.base, prompt) == len(c.base) && slices.Equal(c.baseLora, lora) {
+		slog.Debug("copying base prompt into cache slot", "id", slot.Id, "base", len(c.base))
+		if c.lc != nil {
+			c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+			c.lc.KvCacheSeqCp(c.baseId, slot.Id, 0, len(c.base))
+		}
+		slot.Inputs = slices.Clone(c.base)
+		numPast = len(c.base)
+		slot.selection = CacheSelection{Action: CacheActionBase}
+	}
+
 	slot.InUse = true
+	slot.lora = lora
 	slot.lastUsed = time.Now()
 
+	remaining := c.trimCacheSlot(slot, prompt, numPast)
+	slot.selection.Slot = slot.Id
+	slot.selection.PrefixLen = len(slot.Inputs)
+
+	return slot, remaining, nil
+}
+
+// ReserveCacheSlot claims the least recently used free slot and clears it, for
+// a prompt that is decoded incrementally (see /completion/prepare).
+func (c *InputCache) ReserveCacheSlot(lora []float32) (*InputCacheSlot, error) {
+	var oldestSlot *InputCacheSlot
+	for i, s := range c.slots {
+		if !s.InUse && (oldestSlot == nil || s.lastUsed.Before(oldestSlot.lastUsed)) {
+			oldestSlot = &c.slots[i]
+		}
+	}
+	if oldestSlot == nil {
+		return nil, errors.New("no available cache slots")
+	}
+
+	if c.lc != nil {
+		c.lc.KvCacheSeqRm(oldestSlot.Id, 0, -1)
+	}
+	oldestSlot.Inputs = oldestSlot.Inputs[:0]
+	oldestSlot.InUse = true
+	oldestSlot.lora = lora
+	oldestSlot.lastUsed = time.Now()
+	oldestSlot.selection = CacheSelection{Slot: oldestSlot.Id, Action: CacheActionEvict}
+
+	return oldestSlot, nil
+}
+
+// ShareCacheSlot claims the least recently used free slot other than src and
+// copies into it the KV cache src holds for the prompt, so that the choices of
+// an n > 1 request decode their common prompt once. The last prompt input is
+// always left to decode, since each choice samples from its own logits.
+func (c *InputCache) ShareCacheSlot(src *InputCacheSlot, prompt []input, lora []float32) (*InputCacheSlot, []input, error) {
+	var oldestSlot *InputCacheSlot
+	for i, s := range c.slots {
+		if !s.InUse && &c.slots[i] != src && (oldestSlot == nil || s.lastUsed.Before(oldestSlot.lastUsed)) {
+			oldestSlot = &c.slots[i]
+		}
+	}
+	if oldestSlot == nil {
+		return nil, nil, errors.New("no available cache slots")
+	}
+
+	numPast := 0
+	if slices.Equal(src.lora, lora) {
+		numPast = countCommonPrefix(src.Inputs, prompt)
+	}
+
+	slog.Debug("sharing cache slot", "src", src.Id, "dst", oldestSlot.Id, "inputs", numPast)
+	if c.lc != nil {
+		c.lc.KvCacheSeqRm(oldestSlot.Id, 0, -1)
+		if numPast > 0 {
+			c.lc.KvCacheSeqCp(src.Id, oldestSlot.Id, 0, numPast)
+		}
+	}
+	oldestSlot.Inputs = slices.Clone(src.Inputs[:numPast])
+	oldestSlot.InUse = true
+	oldestSlot.lora = lora
+	oldestSlot.lastUsed = time.Now()
+
+	remaining := c.trimCacheSlot(oldestSlot, prompt, numPast)
+	source := src.Id
+	oldestSlot.selection = CacheSelection{Slot: oldestSlot.Id, Action: CacheActionFork, Source: &source, PrefixLen: len(oldestSlot.Inputs)}
+
+	return oldestSlot, remaining, nil
+}
+
+// ContinueCacheSlot prepares an already reserved slot for the prompt, reusing
+// whatever prefix of it is cached, and returns the inputs left to decode.
+func (c *InputCache) ContinueCacheSlot(slot *InputCacheSlot, prompt []input, lora []float32) []input {
+	numPast := 0
+	if slices.Equal(slot.lora, lora) {
+		numPast = countCommonPrefix(slot.Inputs, prompt)
+	}
+
+	slot.lora = lora
+	slot.lastUsed = time.Now()
+
+	remaining := c.trimCacheSlot(slot, prompt, numPast)
+	slot.selection = CacheSelection{Slot: slot.Id, Action: CacheActionPrefix, PrefixLen: len(slot.Inputs)}
+
+	return remaining
+}
+
+// trimCacheSlot discards everything after the first numPast inputs from the
+// slot and returns the part of the prompt that still needs to be decoded.
+func (c *InputCache) trimCacheSlot(slot *InputCacheSlot, prompt []input, numPast int) []input {
 	if numPast == len(prompt) {
 		numPast-- // ensure we keep one input to allow sampling
 	}
 
-	if !c.lc.KvCacheSeqRm(slot.Id, numPast, -1) {
+	if c.lc != nil && !c.lc.KvCacheSeqRm(slot.Id, numPast, -1) {
 		// fallback for models not supporting partial erasure
 		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
 		numPast = 0
@@ -148,10 +370,9 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 	slog.Debug("loading cache slot", "id", slot.Id, "cache", len(slot.Inputs), "prompt", len(prompt),
 		"used", numPast, "remaining", len(prompt)-numPast)
 
-	prompt = prompt[numPast:]
 	slot.Inputs = slot.Inputs[:numPast]
 
-	return slot, prompt, nil
+	return prompt[numPast:]
 }
 
 // findLongestCacheSlot returns the slot with the longest matching prefix to the prompt.
@@ -174,10 +395,15 @@ func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int,
 		return nil, 0, errors.New("no available cache slots")
 	}
 
+	longestSlot.selection = CacheSelection{Action: CacheActionPrefix}
 	return longestSlot, longest, nil
 }
 
 // findBestCacheSlot returns a cache slot that either matches the longest prefix or is least recently used.
+//
+// The longest matching slot is reused in place when at most `matchTolerance` of its
+// cached inputs follow the common prefix. Only the true common prefix is reported
+// as reusable, so LoadCacheSlot discards the mismatched tail from the KV cache.
 func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, error) {
 	oldest := time.Now()
 	var oldestSlot *InputCacheSlot
@@ -197,11 +423,12 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 		}
 	}
 
-	if longest == len(longestSlot.Inputs) && !longestSlot.InUse {
+	if len(longestSlot.Inputs)-longest <= c.matchTolerance && !longestSlot.InUse {
+		longestSlot.selection = CacheSelection{Action: CacheActionPrefix}
 		return longestSlot, longest, nil
 	}
 
-	if oldestSlot.InUse {
+	if oldestSlot == nil || oldestSlot.InUse {
 		return nil, 0, errors.New("no available cache slots")
 	}
 
@@ -209,12 +436,16 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 		slog.Debug("evicting cache slot", "id", oldestSlot.Id, "inputs", len(oldestSlot.Inputs),
 			"used", oldestSlot.lastUsed)
 	}
+	oldestSlot.selection = CacheSelection{Action: CacheActionEvict}
 
 	if longest > 0 && longestSlot != oldestSlot {
 		slog.Debug("forking cache slot", "src", longestSlot.Id, "dst", oldestSlot.Id, "inputs", longest, "total",
 			len(longestSlot.Inputs))
 		oldestSlot.Inputs = make([]input, longest)
 		copy(oldestSlot.Inputs, longestSlot.Inputs[:longest])
+		oldestSlot.lora = longestSlot.lora
+		source := longestSlot.Id
+		oldestSlot.selection = CacheSelection{Action: CacheActionFork, Source: &source}
 
 		if c.lc != nil {
 			c.lc.KvCacheSeqRm(oldestSlot.Id, 0, -1)
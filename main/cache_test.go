@@ -0,0 +1,249 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func tokenInputs(ids ...int) []input {
+	inputs := make([]input, len(ids))
+	for i, id := range ids {
+		inputs[i] = input{token: id}
+	}
+	return inputs
+}
+
+func TestFindBestCacheSlotMatchTolerance(t *testing.T) {
+	prompt := tokenInputs(1, 2, 3, 9, 9, 9)
+
+	cases := []struct {
+		name      string
+		tolerance int
+		wantSlot  int
+		wantPast  int
+	}{
+		// slot 0 diverges after 3 inputs with 2 trailing mismatches, so it is
+		// forked into the least recently used slot without tolerance
+		{"exact match required", 0, 1, 3},
+		{"tolerance below mismatch", 1, 1, 3},
+		{"tolerance covers mismatch", 2, 0, 3},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &InputCache{
+				numCtx:         16,
+				multiUserCache: true,
+				matchTolerance: tc.tolerance,
+				slots: []InputCacheSlot{
+					{Id: 0, Inputs: tokenInputs(1, 2, 3, 4, 5), lastUsed: time.Now()},
+					{Id: 1, Inputs: tokenInputs(7), lastUsed: time.Now().Add(-time.Hour)},
+				},
+			}
+
+			slot, numPast, err := c.findBestCacheSlot(prompt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if slot.Id != tc.wantSlot {
+				t.Errorf("expected slot %d, got %d", tc.wantSlot, slot.Id)
+			}
+
+			// reuse never extends past the true common prefix
+			if numPast != tc.wantPast {
+				t.Errorf("expected %d reusable inputs, got %d", tc.wantPast, numPast)
+			}
+		})
+	}
+}
+
+func TestAssignSequenceReportsCacheFork(t *testing.T) {
+	c, err := NewInputCache(nil, 32, 2, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.slots[0].Inputs = tokenInputs(1, 2, 3, 4, 5)
+	c.slots[0].lastUsed = time.Now()
+	c.slots[1].Inputs = tokenInputs(7)
+	c.slots[1].lastUsed = time.Now().Add(-time.Hour)
+
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(2),
+		cache:   c,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// slot 0 diverges with trailing inputs, so its prefix is forked into slot 1
+	seq := newTestSequence(tokenInputs(1, 2, 3, 9))
+	if err := s.assignSequence(seq, true); err != nil {
+		t.Fatal(err)
+	}
+
+	got := seq.cacheSelection
+	if got.Action != CacheActionFork || got.Slot != 1 || got.Source == nil || *got.Source != 0 || got.PrefixLen != 3 {
+		t.Errorf("expected a fork of 3 inputs from slot 0 into slot 1, got %+v", got)
+	}
+}
+
+func TestLoadCacheSlotBasePrompt(t *testing.T) {
+	base := tokenInputs(1, 2, 3, 4, 5)
+
+	c, err := NewInputCache(nil, 32, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetBase(base, 2, nil)
+
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(2),
+		cache:   c,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	// a request starting with the base prompt only decodes its own suffix
+	if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	seq := newTestSequence(tokenInputs(1, 2, 3, 4, 5, 6, 7))
+	if err := s.assignSequence(seq, true); err != nil {
+		t.Fatal(err)
+	}
+	if seq.numCached != len(base) || len(seq.inputs) != 2 {
+		t.Errorf("expected base prompt reported as cached, got %d cached and %d to decode", seq.numCached, len(seq.inputs))
+	}
+
+	// the base prompt is not applied to unrelated prompts or when caching is off
+	for _, tc := range []struct {
+		prompt      []input
+		cachePrompt bool
+	}{
+		{tokenInputs(1, 2, 9, 4, 5, 6), true},
+		{tokenInputs(1, 2, 3, 4, 5, 6), false},
+	} {
+		slot, remaining, err := c.LoadCacheSlot(tc.prompt, tc.cachePrompt, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(remaining) != len(tc.prompt) {
+			t.Errorf("expected the whole prompt %v to be decoded, %d inputs remaining", tc.prompt, len(remaining))
+		}
+		slot.InUse = false
+	}
+}
+
+func TestClearExpiredCacheSlots(t *testing.T) {
+	cache, err := NewInputCache(nil, 64, 3, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cache.slots[0].Inputs = tokenInputs(1, 2, 3)
+	cache.slots[0].expiresAt = now.Add(10 * time.Millisecond)
+	cache.slots[1].Inputs = tokenInputs(4, 5, 6)
+	cache.slots[2].Inputs = tokenInputs(7, 8, 9)
+	cache.slots[2].expiresAt = now.Add(-time.Millisecond)
+	cache.slots[2].InUse = true
+
+	if n := cache.ClearExpired(now); n != 0 || len(cache.slots[0].Inputs) != 3 {
+		t.Fatalf("expected nothing cleared before the TTL passes, got %d", n)
+	}
+
+	if n := cache.ClearExpired(now.Add(time.Second)); n != 1 {
+		t.Fatalf("expected one slot cleared, got %d", n)
+	}
+	if len(cache.slots[0].Inputs) != 0 || !cache.slots[0].expiresAt.IsZero() {
+		t.Error("expected the expired slot to be cleared")
+	}
+	if len(cache.slots[1].Inputs) != 3 {
+		t.Error("expected the slot without a TTL to persist")
+	}
+	if len(cache.slots[2].Inputs) != 3 {
+		t.Error("expected a slot in use to be left until it is released")
+	}
+}
+
+func TestRemoveSequenceSetsCacheExpiry(t *testing.T) {
+	s := &Server{
+		seqs:    make([]*Sequence, 1),
+		seqsSem: semaphore.NewWeighted(1),
+	}
+	if !s.seqsSem.TryAcquire(1) {
+		t.Fatal("expected a free slot")
+	}
+
+	seq := newTestSequence(nil)
+	seq.cache = &InputCacheSlot{InUse: true}
+	seq.cacheTTL = time.Minute
+	s.seqs[0] = seq
+
+	before := time.Now()
+	removeSequence(s, 0, StopReasonStop)
+
+	if seq.cache.expiresAt.Before(before.Add(time.Minute)) || seq.cache.expiresAt.After(time.Now().Add(time.Minute)) {
+		t.Errorf("expected the slot to expire a minute after release, got %v", seq.cache.expiresAt)
+	}
+}
+
+func TestShiftDiscardRatio(t *testing.T) {
+	c, err := NewInputCache(nil, 1024, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a full context keeping 24 tokens frees half of the other 1000 by default
+	if got := c.ShiftDiscard(1024, 24); got != 500 {
+		t.Errorf("expected the default ratio to discard 500 tokens, got %d", got)
+	}
+
+	// a larger ratio discards more per shift
+	c.shiftRatio = 0.75
+	if got := c.ShiftDiscard(1024, 24); got != 750 {
+		t.Errorf("expected a ratio of 0.75 to discard 750 tokens, got %d", got)
+	}
+
+	for _, ratio := range []float64{0, 1, -0.5, 1.5} {
+		if err := validateShiftRatio(ratio); err == nil {
+			t.Errorf("expected ratio %v to be rejected", ratio)
+		}
+	}
+	if err := validateShiftRatio(0.25); err != nil {
+		t.Errorf("unexpected error for ratio 0.25: %v", err)
+	}
+}
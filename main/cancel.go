@@ -0,0 +1,156 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import(
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"encoding/json"
+	"net/http"
+)
+
+// cancel handles the `/cancel` endpoint to stop an in-flight request.
+//
+// The request ID is returned to streaming clients in the `X-Request-Id`
+// response header, or chosen by the client with the completion's `request_id`
+// field, which `request_id` here also accepts. Cancelling removes the sequence
+// from the batch, so the stream ends with an acknowledgement frame carrying
+// `finish_reason:"cancelled"` and the timings accumulated so far, instead of an
+// abrupt close.
+//
+// Request example:
+// {
+//   "id": "9f2c1e4ab07d3c55"
+// }
+//
+// Response codes:
+//   - 204 No Content: The request was cancelled
+//   - 400 Bad Request: The request body could not be decoded
+//   - 404 Not Found: No active request with the given ID
+func (s *Server) cancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	id := cmp.Or(req.ID, req.RequestID)
+	if !s.cancelSequence(id) {
+		http.Error(w, fmt.Sprintf("no active request with id %q", id), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancelSequence removes the active sequence with the given ID, flushing any
+// pending output and closing its response channel so the handler sends the
+// final frame. It returns false if no such sequence is active.
+func (s *Server) cancelSequence(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq, ok := s.requests[id]
+	if !ok {
+		return false
+	}
+
+	removeSequence(s, slices.Index(s.seqs, seq), StopReasonCancelled)
+	return true
+}
+
+// cancelSession handles the `/sessions/{id}/cancel` endpoint, which cancels
+// every in-flight request tagged with the given `session_id`, e.g. when a user
+// navigates away. Each cancelled stream ends with the same acknowledgement
+// frame as `/cancel`.
+//
+// Response codes:
+//   - 204 No Content: At least one request was cancelled
+//   - 404 Not Found: No active requests for the session
+func (s *Server) cancelSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	if s.cancelSessionSequences(id) == 0 {
+		http.Error(w, fmt.Sprintf("no active requests for session %q", id), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancelSessionSequences removes every active sequence in the session and
+// returns how many were cancelled.
+func (s *Server) cancelSessionSequences(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indices := slices.Sorted(maps.Keys(s.sessions[id]))
+	for _, i := range indices {
+		removeSequence(s, i, StopReasonCancelled)
+	}
+
+	return len(indices)
+}
+
+// trackSession records that the sequence in slot i belongs to a session.
+// The caller must hold s.mu.
+func (s *Server) trackSession(id string, i int) {
+	if id == "" {
+		return
+	}
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]map[int]struct{})
+	}
+	if s.sessions[id] == nil {
+		s.sessions[id] = make(map[int]struct{})
+	}
+	s.sessions[id][i] = struct{}{}
+}
+
+// untrackSession removes slot i from a session, dropping the session once it
+// has no active sequences. The caller must hold s.mu.
+func (s *Server) untrackSession(id string, i int) {
+	if id == "" {
+		return
+	}
+
+	delete(s.sessions[id], i)
+	if len(s.sessions[id]) == 0 {
+		delete(s.sessions, id)
+	}
+}
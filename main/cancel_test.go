@@ -0,0 +1,205 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestCancelSequenceSendsAcknowledgement(t *testing.T) {
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(2),
+	}
+	if err := s.seqsSem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	seq := &Sequence{
+		id:                  "req-1",
+		responses:           make(chan response, 10),
+		quit:                make(chan bool, 1),
+		embedding:           make(chan []float32, 1),
+		cache:               &InputCacheSlot{InUse: true},
+		pendingResponses:    []string{"partial"},
+		startProcessingTime: time.Now(),
+	}
+	s.seqs[1] = seq
+	s.trackRequest(seq)
+
+	if s.cancelSequence("unknown") {
+		t.Fatal("expected unknown id to not be cancelled")
+	}
+	if !s.cancelSequence("req-1") {
+		t.Fatal("expected active request to be cancelled")
+	}
+
+	// pending output is flushed before the stream closes
+	if resp, ok := <-seq.responses; !ok || resp.content != "partial" {
+		t.Errorf("expected flushed partial content, got %+v (open: %v)", resp, ok)
+	}
+	if _, ok := <-seq.responses; ok {
+		t.Error("expected response channel to be closed")
+	}
+
+	if seq.doneReason != StopReasonCancelled || seq.doneReason.String() != "cancelled" {
+		t.Errorf("expected cancelled finish reason, got %q", seq.doneReason)
+	}
+	if s.seqs[1] != nil || seq.cache.InUse {
+		t.Error("expected sequence slot and cache to be released")
+	}
+	if !s.seqsSem.TryAcquire(2) {
+		t.Error("expected semaphore to be released")
+	}
+}
+
+func TestCancelByClientRequestID(t *testing.T) {
+	cache, err := NewInputCache(nil, 32, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(2),
+		cache:   cache,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	start := func(id string) (*Sequence, error) {
+		if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		seq := newTestSequence(tokenInputs(1, 2, 3))
+		seq.id = id
+		return seq, s.assignSequence(seq, false)
+	}
+
+	seq, err := start("batch-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a second active request can't take the same ID
+	if _, err := start("batch-42"); !errors.Is(err, errDuplicateRequestID) {
+		t.Fatalf("expected a duplicate request_id error, got %v", err)
+	}
+	if !s.seqsSem.TryAcquire(1) {
+		t.Fatal("expected the rejected request to release its slot")
+	}
+	s.seqsSem.Release(1)
+
+	cancel := func(body string) int {
+		w := httptest.NewRecorder()
+		s.cancel(w, httptest.NewRequest(http.MethodPost, "/cancel", strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := cancel(`{"request_id": "batch-42"}`); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if _, ok := <-seq.responses; ok || seq.doneReason != StopReasonCancelled {
+		t.Errorf("expected the stream to end as cancelled, got %q", seq.doneReason)
+	}
+	if _, ok := s.requests["batch-42"]; ok {
+		t.Error("expected the request ID to be released")
+	}
+	if code := cancel(`{"request_id": "batch-42"}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 once the request ended, got %d", code)
+	}
+
+	// the ID can be reused once the request has ended
+	if _, err := start("batch-42"); err != nil {
+		t.Errorf("expected the ID to be reusable, got %v", err)
+	}
+}
+
+func TestCancelSessionCancelsAllSequences(t *testing.T) {
+	cache, err := NewInputCache(nil, 48, 3, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		seqs:    make([]*Sequence, 3),
+		seqsSem: semaphore.NewWeighted(3),
+		cache:   cache,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	start := func(session string) *Sequence {
+		if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		seq := newTestSequence(tokenInputs(1, 2, 3))
+		seq.sessionID = session
+		if err := s.assignSequence(seq, false); err != nil {
+			t.Fatal(err)
+		}
+		return seq
+	}
+
+	first, second, other := start("user-1"), start("user-1"), start("user-2")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions/{id}/cancel", s.cancelSession)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/sessions/user-1/cancel", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+
+	for _, seq := range []*Sequence{first, second} {
+		if _, ok := <-seq.responses; ok {
+			t.Error("expected session sequence response channel to be closed")
+		}
+		if seq.doneReason != StopReasonCancelled {
+			t.Errorf("expected cancelled finish reason, got %q", seq.doneReason)
+		}
+	}
+
+	// sequences from other sessions keep running
+	if other.doneReason != StopReasonNone || s.seqs[2] != other {
+		t.Error("expected other session to be unaffected")
+	}
+	if _, ok := s.sessions["user-1"]; ok {
+		t.Error("expected cancelled session to be removed from the index")
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/sessions/user-1/cancel", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a session with no active requests, got %d", w.Code)
+	}
+}
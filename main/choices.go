@@ -0,0 +1,315 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements completions with "n" > 1. The request's N sequences are
+// decoded in parallel, each in its own sequence slot, after the prompt has been
+// decoded once and its KV cache copied into every slot. Their frames are
+// interleaved on one stream tagged with the choice index. Frame indices remain
+// contiguous across the whole stream.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+var errTooFewSlots = errors.New("not enough free sequence slots")
+
+// choiceResponse is a response of one of a request's choices; ok is false
+// once that choice's sequence has finished.
+type choiceResponse struct {
+	choice int
+	resp   response
+	ok     bool
+}
+
+// choiceState is the per-choice output processing of serveChoices.
+type choiceState struct {
+	echo         *promptEchoFilter
+	filters      *filterPipeline
+	heldLogprobs []TokenLogprob
+	streamed     bool // a content frame has been sent
+	done         bool
+}
+
+// choiceSeed returns the seed for choice i: a fixed seed is offset by the
+// choice so the choices differ but stay reproducible, and a random seed (nil)
+// stays random.
+func choiceSeed(seed *uint32, i int) *uint32 {
+	if seed == nil {
+		return nil
+	}
+
+	offset := *seed + uint32(i)
+	return &offset
+}
+
+// acquireChoiceSlots claims n sequence slots at once, failing instead of
+// queueing if fewer than n are free, so a request never holds some of its
+// slots while waiting for the rest.
+func (s *Server) acquireChoiceSlots(n int) error {
+	if !s.seqsSem.TryAcquire(int64(n)) {
+		return fmt.Errorf("%w: n=%d", errTooFewSlots, n)
+	}
+	return nil
+}
+
+// assignChoices assigns every sequence of a request holding len(seqs) slots.
+// The prompt is decoded once: the first choice decodes it, and the others are
+// assigned once it has, copying its KV cache instead of decoding it again.
+// If one cannot be assigned, the sequences already running are stopped and the
+// remaining slots released; running sequences release their own slots once
+// the decode loop sees them quit.
+func (s *Server) assignChoices(ctx context.Context, seqs []*Sequence, cachePrompt bool) error {
+	// stop quits the assigned sequences and releases the slots of the
+	// sequences after them, other than a failed one, whose slot
+	// assignSequence already released
+	stop := func(assigned int, failed bool) {
+		rest := len(seqs) - assigned
+		if failed {
+			rest--
+		}
+		if rest > 0 {
+			s.seqsSem.Release(int64(rest))
+		}
+		for _, seq := range seqs[:assigned] {
+			close(seq.quit)
+		}
+	}
+
+	first := seqs[0]
+	prefilled := make(chan struct{})
+	first.prefilled = prefilled
+	if err := s.assignSequence(first, cachePrompt); err != nil {
+		stop(0, true)
+		return err
+	}
+
+	select {
+	case <-prefilled:
+	case <-ctx.Done():
+		stop(1, false)
+		return ctx.Err()
+	}
+
+	for i, seq := range seqs[1:] {
+		err := s.assignSequenceSlot(seq, func() (*InputCacheSlot, []input, error) {
+			return s.cache.ShareCacheSlot(first.cache, seq.inputs, seq.lora)
+		})
+		if err != nil {
+			stop(i+1, true)
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeChoices forwards the responses of every sequence onto one channel
+// until done is closed.
+func mergeChoices(done <-chan struct{}, seqs []*Sequence) <-chan choiceResponse {
+	merged := make(chan choiceResponse)
+	for i, seq := range seqs {
+		go func() {
+			for {
+				resp, ok := <-seq.responses
+				select {
+				case merged <- choiceResponse{choice: i, resp: resp, ok: ok}:
+				case <-done:
+					return
+				}
+				if !ok {
+					return
+				}
+			}
+		}()
+	}
+	return merged
+}
+
+// serveChoices runs a completion request with req.N > 1 and streams the
+// choices' frames as they are generated, ending each choice with its own
+// final frame. If the client disconnects, every unfinished sequence is
+// stopped so that all N slots are released.
+func (s *Server) serveChoices(w http.ResponseWriter, r *http.Request, stream *streamWriter, req *CompletionRequest, params NewSequenceParams) {
+	seqs := make([]*Sequence, req.N)
+	for i := range seqs {
+		choiceParams := params
+		choiceParams.seed = choiceSeed(params.seed, i)
+
+		seq, err := s.NewSequence(req.Prompt, req.Images, choiceParams)
+		if err != nil {
+			if writePromptTooLong(w, err) {
+				return
+			}
+			http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), sequenceErrorStatus(err))
+			return
+		}
+		seqs[i] = seq
+	}
+
+	if err := s.acquireChoiceSlots(req.N); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("X-Queue-Position", "0")
+
+	if err := s.assignChoices(r.Context(), seqs, req.CachePrompt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Every choice can be cancelled via /cancel with its own ID
+	for _, seq := range seqs {
+		w.Header().Add("X-Request-Id", seq.id)
+	}
+
+	states := make([]choiceState, req.N)
+	for i := range states {
+		if req.StripPromptEcho && !req.StreamTokenIds {
+			states[i].echo = newPromptEchoFilter(req.Prompt)
+		}
+		states[i].filters, _ = newFilterPipeline(req.Filters)
+	}
+
+	// stop quits every unfinished choice; finished ones already released their slot
+	stop := func() {
+		for i, seq := range seqs {
+			if !states[i].done {
+				close(seq.quit)
+				states[i].done = true
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	merged := mergeChoices(done, seqs)
+
+	var frames frameCounter
+	if req.PrefixUsage {
+		if err := writePromptUsage(stream, frames.next(), seqs[0]); err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+			stop()
+			return
+		}
+	}
+
+	stream.choices = req.N
+	defer stream.Flush()
+	for remaining := req.N; remaining > 0; {
+		select {
+		case <-r.Context().Done():
+			if errors.Is(r.Context().Err(), context.Canceled) {
+				slog.Info("aborting completion request due to client closing the connection", "n", req.N)
+			}
+			stop()
+			return
+		case <-stream.Deadline():
+			stream.Flush()
+		case cr := <-merged:
+			state := &states[cr.choice]
+			seq := seqs[cr.choice]
+
+			if cr.ok {
+				content := cr.resp.content
+				if state.echo != nil {
+					if content = state.echo.Push(content); content == "" {
+						continue
+					}
+				}
+				if state.filters != nil {
+					if content = state.filters.Push(content); content == "" {
+						state.heldLogprobs = append(state.heldLogprobs, cr.resp.logprobs...)
+						continue
+					}
+				}
+
+				if err := stream.Encode(&CompletionResponse{
+					Index:    frames.next(),
+					Choice:   &cr.choice,
+					Content:  content,
+					Tokens:   cr.resp.tokens,
+					Logprobs: releaseLogprobs(&state.heldLogprobs, cr.resp.logprobs),
+				}); err != nil {
+					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+					stop()
+					return
+				}
+				state.streamed = true
+				stream.MaybeFlush()
+				continue
+			}
+
+			state.done = true
+			remaining--
+
+			if err := finishChoice(stream, &frames, req, cr.choice, state, seq); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				stop()
+				return
+			}
+		}
+	}
+}
+
+// finishChoice streams the frames that end a choice whose sequence is done:
+// output still held back by its echo and output filters, an empty content
+// frame for empty_frame if the choice sent no content, and its final frame.
+func finishChoice(stream *streamWriter, frames *frameCounter, req *CompletionRequest, choice int, state *choiceState, seq *Sequence) error {
+	var content string
+	if state.echo != nil {
+		content = state.echo.Finish()
+	}
+	if state.filters != nil {
+		if content = state.filters.Push(content); state.filters.buffer {
+			content = state.filters.Finish()
+		}
+	}
+	if content != "" {
+		if err := stream.Encode(&CompletionResponse{Index: frames.next(), Choice: &choice, Content: content, Logprobs: releaseLogprobs(&state.heldLogprobs, nil)}); err != nil {
+			return fmt.Errorf("failed to encode response: %w", err)
+		}
+		state.streamed = true
+	}
+
+	if req.EmptyFrame && !state.streamed {
+		empty := emptyContentFrame(frames.next(), seq)
+		empty.Choice = &choice
+		if err := stream.Encode(empty); err != nil {
+			return fmt.Errorf("failed to encode response: %w", err)
+		}
+	}
+
+	final := finalResponse(frames.next(), req, seq)
+	final.Choice = &choice
+	if err := stream.Encode(final); err != nil {
+		return fmt.Errorf("failed to encode final response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestChoiceSeed(t *testing.T) {
+	seed := uint32(7)
+	if got := choiceSeed(&seed, 2); got == nil || *got != 9 {
+		t.Errorf("expected a fixed seed offset by the choice, got %v", got)
+	}
+	if got := choiceSeed(nil, 2); got != nil {
+		t.Errorf("expected a random seed to stay random, got %d", *got)
+	}
+
+	// no seed is reserved, so an offset may land on MaxUint32
+	seed = math.MaxUint32 - 1
+	if got := choiceSeed(&seed, 1); got == nil || *got != math.MaxUint32 {
+		t.Errorf("expected seed %d, got %v", uint32(math.MaxUint32), got)
+	}
+}
+
+func TestAcquireChoiceSlotsFailsWithoutQueueing(t *testing.T) {
+	s := &Server{seqsSem: semaphore.NewWeighted(3)}
+	if !s.seqsSem.TryAcquire(2) {
+		t.Fatal("expected free slots")
+	}
+
+	if err := s.acquireChoiceSlots(2); !errors.Is(err, errTooFewSlots) {
+		t.Fatalf("expected errTooFewSlots, got %v", err)
+	}
+
+	// nothing is held after the failure
+	if !s.seqsSem.TryAcquire(1) {
+		t.Error("expected the free slot to stay available")
+	}
+}
+
+func TestAssignChoicesReleasesSlotsOnFailure(t *testing.T) {
+	cache, err := NewInputCache(nil, 64, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three slots are acquired, but there are only two sequence entries
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(3),
+		cache:   cache,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	seqs := []*Sequence{
+		newTestSequence(tokenInputs(1)),
+		newTestSequence(tokenInputs(1)),
+		newTestSequence(tokenInputs(1)),
+	}
+	if err := s.acquireChoiceSlots(len(seqs)); err != nil {
+		t.Fatal(err)
+	}
+	go decodeFirstPrompt(s)
+
+	if err := s.assignChoices(context.Background(), seqs, true); err == nil {
+		t.Fatal("expected the third choice to fail")
+	}
+
+	// the assigned choices are told to quit and release their slots when the
+	// decode loop removes them
+	for i, seq := range seqs[:2] {
+		select {
+		case <-seq.quit:
+		default:
+			t.Errorf("expected choice %d to be stopped", i)
+		}
+		removeSequence(s, i, StopReasonConnection)
+	}
+
+	if !s.seqsSem.TryAcquire(3) {
+		t.Error("expected every slot to be released")
+	}
+}
+
+// decodeFirstPrompt stands in for the decode loop finishing the prompt of the
+// first sequence assigned to s.
+func decodeFirstPrompt(s *Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.seqs[0] == nil {
+		s.cond.Wait()
+	}
+
+	seq := s.seqs[0]
+	seq.cache.Inputs = append(seq.cache.Inputs, seq.inputs...)
+	seq.inputs = nil
+	signalPrefilled(seq)
+}
+
+func TestAssignChoicesSharesPrompt(t *testing.T) {
+	cache, err := NewInputCache(nil, 64, 3, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		seqs:    make([]*Sequence, 3),
+		seqsSem: semaphore.NewWeighted(3),
+		cache:   cache,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	seqs := []*Sequence{
+		newTestSequence(tokenInputs(1, 2, 3, 4)),
+		newTestSequence(tokenInputs(1, 2, 3, 4)),
+		newTestSequence(tokenInputs(1, 2, 3, 4)),
+	}
+	if err := s.acquireChoiceSlots(len(seqs)); err != nil {
+		t.Fatal(err)
+	}
+	go decodeFirstPrompt(s)
+
+	if err := s.assignChoices(context.Background(), seqs, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the other choices only decode the last prompt token for their own logits
+	first := seqs[0].cache
+	for i, seq := range seqs[1:] {
+		if seq.cache == first {
+			t.Fatalf("choice %d: expected its own cache slot", i+1)
+		}
+		if len(seq.inputs) != 1 || seq.numCached != 3 {
+			t.Errorf("choice %d: expected 3 cached inputs and 1 to decode, got %d and %d", i+1, seq.numCached, len(seq.inputs))
+		}
+		if sel := seq.cacheSelection; sel.Action != CacheActionFork || sel.Source == nil || *sel.Source != first.Id {
+			t.Errorf("choice %d: expected the prompt to be copied from slot %d, got %+v", i+1, first.Id, sel)
+		}
+	}
+	if seqs[1].cache == seqs[2].cache {
+		t.Error("expected every choice in a different cache slot")
+	}
+}
+
+func TestChoiceIndexIncludesZero(t *testing.T) {
+	zero := 0
+	data, err := json.Marshal(&CompletionResponse{Choice: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"choice":0`) {
+		t.Errorf("expected choice 0 in an n > 1 frame, got %s", data)
+	}
+
+	data, err = json.Marshal(&CompletionResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"choice"`) {
+		t.Errorf("expected no choice without n > 1, got %s", data)
+	}
+}
+
+func TestMergeChoices(t *testing.T) {
+	seqs := []*Sequence{newTestSequence(nil), newTestSequence(nil)}
+	done := make(chan struct{})
+	merged := mergeChoices(done, seqs)
+
+	seqs[1].responses <- response{content: "b"}
+	close(seqs[1].responses)
+	seqs[0].responses <- response{content: "a"}
+	close(seqs[0].responses)
+
+	content := map[int]string{}
+	finished := 0
+	for finished < len(seqs) {
+		cr := <-merged
+		if !cr.ok {
+			finished++
+			continue
+		}
+		content[cr.choice] += cr.resp.content
+	}
+	if content[0] != "a" || content[1] != "b" {
+		t.Errorf("expected responses keyed by choice, got %v", content)
+	}
+	close(done)
+}
+
+func TestEventStreamDoneAfterEveryChoice(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := newStreamWriter(w, w, 0, 0)
+	stream.format = formatSSE
+	stream.choices = 2
+
+	for choice := range 2 {
+		if err := stream.Encode(&CompletionResponse{Choice: &choice, Stop: true}); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(stream.buf.String(), sseDone); got != choice {
+			t.Errorf("after choice %d ended, expected %d [DONE] events, got %d", choice, choice, got)
+		}
+	}
+}
+
+func TestFinishChoiceSendsEmptyFrame(t *testing.T) {
+	cases := []struct {
+		name       string
+		emptyFrame bool
+		streamed   bool
+		want       int // frames, including the final one
+	}{
+		{"disabled", false, false, 1},
+		{"no content", true, false, 2},
+		{"content streamed", true, true, 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			stream := newStreamWriter(w, w, 0, 0)
+			var frames frameCounter
+			req := &CompletionRequest{N: 2, EmptyFrame: tc.emptyFrame}
+			seq := &Sequence{doneReason: StopReasonStop}
+
+			if err := finishChoice(stream, &frames, req, 1, &choiceState{streamed: tc.streamed}, seq); err != nil {
+				t.Fatal(err)
+			}
+			stream.Flush()
+
+			var got []CompletionResponse
+			decoder := json.NewDecoder(w.Body)
+			for decoder.More() {
+				var frame CompletionResponse
+				if err := decoder.Decode(&frame); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, frame)
+			}
+			if len(got) != tc.want {
+				t.Fatalf("expected %d frames, got %+v", tc.want, got)
+			}
+			for i, frame := range got {
+				if frame.Choice == nil || *frame.Choice != 1 || frame.Index != i {
+					t.Errorf("frame %d: expected choice 1 and index %d, got %+v", i, i, frame)
+				}
+			}
+			if tc.want == 2 && (got[0].Stop || got[0].Content != "" || got[0].FinishReason != "stop") {
+				t.Errorf("expected an empty content frame with finish_reason stop, got %+v", got[0])
+			}
+			if !got[len(got)-1].Stop {
+				t.Errorf("expected the final frame last, got %+v", got[len(got)-1])
+			}
+		})
+	}
+}
@@ -27,31 +27,66 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"log/slog"
 	"net/http"
 	"llm-server/llama"
+	"golang.org/x/sync/semaphore"
 )
 
+// decodeCompletion decodes a CompletionRequest from body, starting from the
+// server's default options so that omitted fields keep the startup defaults.
+func (s *Server) decodeCompletion(body io.Reader) (CompletionRequest, error) {
+	var req CompletionRequest
+	req.Options = s.defaults
+	err := json.NewDecoder(body).Decode(&req)
+	return req, err
+}
+
 // completion handles the /completion HTTP endpoint for LLM inference.
 //
 // It decodes the JSON request body into a CompletionRequest, initializes a
 // sampling context and sequence, acquires a slot in the global sequence pool,
 // streams completion responses as JSON chunks to the client, and sends timing
 // information in the final response.
+//
+// The framing follows the Accept header: application/x-ndjson (the default)
+// streams one JSON object per line, text/event-stream streams each object as a
+// Server-Sent Event ("data: {...}") and ends with "data: [DONE]", and
+// application/json returns a single object holding the whole completion.
 func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
-	var req CompletionRequest
-	req.Options = Options(DefaultOptions())
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	req, err := s.decodeCompletion(r.Body)
+	if err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	s.serveCompletion(w, r, req)
+}
+
+// serveCompletion runs a decoded completion request and streams its output.
+// The prompt is either req.Prompt or, if req.PromptID is set, a prompt built
+// up through /completion/prepare and /completion/append.
+func (s *Server) serveCompletion(w http.ResponseWriter, r *http.Request, req CompletionRequest) {
+	InferenceStats.Requests.Add(1)
+
+	format := negotiateFormat(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", format.ContentType())
+	if format != formatJSON {
+		w.Header().Set("Transfer-Encoding", "chunked")
+	}
+	if format == formatSSE {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -59,101 +94,272 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Map HTTP request params to llama sampling params
-	var samplingParams llama.SamplingParams
-	samplingParams.TopK = req.TopK
-	samplingParams.TopP = req.TopP
-	samplingParams.MinP = req.MinP
-	samplingParams.TypicalP = req.TypicalP
-	samplingParams.Temp = req.Temperature
-	samplingParams.RepeatLastN = req.RepeatLastN
-	samplingParams.PenaltyRepeat = req.RepeatPenalty
-	samplingParams.PenaltyFreq = req.FrequencyPenalty
-	samplingParams.PenaltyPresent = req.PresencePenalty
-	samplingParams.Mirostat = req.Mirostat
-	samplingParams.MirostatTau = req.MirostatTau
-	samplingParams.MirostatEta = req.MirostatEta
-	samplingParams.PenalizeNl = req.PenalizeNewline
-	samplingParams.Seed = uint32(req.Seed)
-	samplingParams.Grammar = req.Grammar
+	// Output is buffered up to the flush threshold, in the negotiated format
+	stream := newStreamWriter(w, flusher, s.flushBytes, s.flushLatency)
+	stream.format = format
 
-	// Create a new decoding sequence
-	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
-		numPredict:     req.NumPredict,
-		stop:           req.Stop,
-		numKeep:        req.NumKeep,
-		samplingParams: &samplingParams,
-		embedding:      false,
-	})
+	if err := validateOptions(req.Options); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkThreads(req.NumThreads); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.CacheTTLMs < 0 {
+		http.Error(w, "cache_ttl_ms must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	if req.Logprobs < 0 || req.Logprobs > maxLogprobs {
+		http.Error(w, fmt.Sprintf("logprobs must be between 0 and %d", maxLogprobs), http.StatusBadRequest)
+		return
+	}
+
+	if req.N < 0 || req.N > s.parallel {
+		http.Error(w, fmt.Sprintf("n must be between 1 and %d (--parallel)", s.parallel), http.StatusBadRequest)
+		return
+	}
+	if req.N > 1 && (req.PromptID != "" || len(req.JSONSchema) > 0 || format == formatJSON) {
+		http.Error(w, "n > 1 is not supported with prompt_id, json_schema or an application/json response", http.StatusBadRequest)
+		return
+	}
+	if req.N > 1 && req.RequestID != "" {
+		http.Error(w, "request_id is not supported with n > 1", http.StatusBadRequest)
+		return
+	}
+
+	filters, err := newFilterPipeline(req.Filters)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filters != nil && req.StreamTokenIds {
+		http.Error(w, "filters are not supported with stream_token_ids", http.StatusBadRequest)
+		return
+	}
+	if req.TokenHealing && req.StreamTokenIds {
+		http.Error(w, "token_healing is not supported with stream_token_ids", http.StatusBadRequest)
+		return
+	}
+	if req.Resumable && (req.N > 1 || filters != nil || req.StripPromptEcho || req.PrefixUsage || len(req.JSONSchema) > 0 || format == formatJSON) {
+		http.Error(w, "resumable is not supported with n > 1, filters, strip_prompt_echo, prefix_usage, json_schema or an application/json response", http.StatusBadRequest)
 		return
 	}
 
-	// Acquire sequence slot
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
-		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting completion request due to client closing the connection")
-		} else {
-			slog.Error("Failed to acquire semaphore", "error", err)
+	// A schedule's initial temperature is the one the sampler is created with
+	if req.TemperatureSchedule != nil {
+		if err := req.TemperatureSchedule.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		req.Temperature = req.TemperatureSchedule.At(0)
+	}
+
+	// Render a named template into the prompt before anything keys on it
+	if req.Template != "" {
+		if req.PromptID != "" {
+			http.Error(w, "template is not supported with prompt_id", http.StatusBadRequest)
+			return
+		}
+
+		prompt, err := s.templates.renderPrompt(req.Prompt, req.Template, req.Vars)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Prompt, req.Template, req.Vars = prompt, "", nil
+	}
+
+	// Deterministic requests may be answered from the result cache
+	resultKey, cacheable := s.results.Key(&req)
+	if result, ok := s.results.Get(resultKey); cacheable && ok {
+		writeCachedResult(stream, &req, result)
 		return
 	}
 
-	// Assign sequence to a slot
-	s.mu.Lock()
-	found := false
-	for i, sq := range s.seqs {
-		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, req.CachePrompt)
-			if err != nil {
-				s.mu.Unlock()
-				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
+	// Map HTTP request params to llama sampling params
+	samplingParams := toSamplingParams(req.Options, req.Grammar)
+
+	if len(req.JSONSchema) > 0 {
+		if req.PromptID != "" {
+			http.Error(w, "json_schema is not supported with prompt_id", http.StatusBadRequest)
+			return
+		}
+		s.schemaCompletion(w, r, stream, &req, samplingParams)
+		return
+	}
+
+	params := NewSequenceParams{
+		numPredict:      req.NumPredict,
+		stop:            req.Stop,
+		numKeep:         req.NumKeep,
+		samplingParams:  &samplingParams,
+		seed:            requestSeed(&req.Seed),
+		embedding:       false,
+		streamTokenIds:  req.StreamTokenIds,
+		allowedTokens:   req.AllowedTokens,
+		tokenHealing:    req.TokenHealing,
+		returnPrompt:    req.ReturnPromptText,
+		sessionID:       req.SessionID,
+		requestID:       req.RequestID,
+		priority:        req.Priority,
+		stopAlternative: req.ReturnStopAlternative,
+		lora:            req.Lora,
+		maxNewlines:     req.MaxNewlines,
+		cacheTTL:        time.Duration(req.CacheTTLMs) * time.Millisecond,
+		tempSchedule:    req.TemperatureSchedule,
+		logprobs:        req.Logprobs,
+		truncate:        req.Truncate,
+	}
+
+	if req.N > 1 {
+		s.serveChoices(w, r, stream, &req, params)
+		return
+	}
+
+	var seq *Sequence
+	if req.PromptID != "" {
+		// The prepared prompt already holds a sequence slot and its cache slot
+		seq, err = s.runPreparedPrompt(req.PromptID, params)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to run prepared prompt: %v", err), sequenceErrorStatus(err))
+			return
+		}
+	} else {
+		// Identical deterministic requests in flight share one sequence
+		if key, ok := dedupKey(&req, filters); ok {
+			if s.serveDeduplicated(r.Context(), w, stream, key, &req, func() (*Sequence, bool) {
+				return s.startSequence(w, r, &req, params)
+			}) {
 				return
 			}
+		}
 
-			seq.crossAttention = s.image.NeedCrossAttention(seq.cache.Inputs...)
-			s.seqs[i] = seq
-			s.cond.Signal()
-			found = true
-			break
+		var ok bool
+		if seq, ok = s.startSequence(w, r, &req, params); !ok {
+			return
 		}
 	}
-	s.mu.Unlock()
 
-	if !found {
-		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
+	// Expose the request ID so the client can cancel the stream via /cancel
+	w.Header().Set("X-Request-Id", seq.id)
+
+	// Resumable output is buffered apart from this connection, which only
+	// follows it, so the sequence outlives a disconnect
+	if req.Resumable {
+		rs := s.startResumable(seq, &req)
+		rs.attach(0)
+		if err := serveResumable(r.Context(), stream, rs, 0); err != nil {
+			slog.Info("resumable stream detached", "id", seq.id, "error", err)
+		}
 		return
 	}
 
 	// Begin streaming tokens to the client
+	var frames frameCounter
+	if req.PrefixUsage {
+		if err := writePromptUsage(stream, frames.next(), seq); err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+			close(seq.quit)
+			return
+		}
+	}
+
+	var echo *promptEchoFilter
+	if req.StripPromptEcho && !req.StreamTokenIds {
+		echo = newPromptEchoFilter(req.Prompt)
+	}
+
+	var heldLogprobs []TokenLogprob // logprobs of output held by filters
+	var result cachedResult
+	var streamed bool // a content frame has been sent
 	for {
 		select {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case <-stream.Deadline():
+			stream.Flush()
+		case resp, ok := <-seq.responses:
 			if ok {
-				if err := json.NewEncoder(w).Encode(&CompletionResponse{
-					Content: content,
+				if echo != nil {
+					if resp.content = echo.Push(resp.content); resp.content == "" {
+						continue
+					}
+				}
+
+				if filters != nil {
+					if resp.content = filters.Push(resp.content); resp.content == "" {
+						heldLogprobs = append(heldLogprobs, resp.logprobs...)
+						continue
+					}
+				}
+
+				if cacheable {
+					result.content += resp.content
+					result.tokens = append(result.tokens, resp.tokens...)
+				}
+
+				if err := stream.Encode(&CompletionResponse{
+					Index:    frames.next(),
+					Content:  resp.content,
+					Tokens:   resp.tokens,
+					Logprobs: releaseLogprobs(&heldLogprobs, resp.logprobs),
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
 					return
 				}
-				flusher.Flush()
+				streamed = true
+				stream.MaybeFlush()
 			} else {
+				// Release output still held back as a possible prompt echo,
+				// then by filters that need the whole output
+				var content string
+				if echo != nil {
+					content = echo.Finish()
+				}
+				if filters != nil {
+					if content = filters.Push(content); filters.buffer {
+						content = filters.Finish()
+					}
+				}
+				if content != "" {
+					result.content += content
+					if err := stream.Encode(&CompletionResponse{Index: frames.next(), Content: content, Logprobs: releaseLogprobs(&heldLogprobs, nil)}); err != nil {
+						http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+						return
+					}
+					streamed = true
+				}
+
+				// A generation that ended before any output still gets a
+				// content frame if the client asked for one
+				if req.EmptyFrame && !streamed {
+					if err := stream.Encode(emptyContentFrame(frames.next(), seq)); err != nil {
+						http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+						return
+					}
+				}
+
+				if cacheable && (seq.doneReason == StopReasonStop || seq.doneReason == StopReasonLimit || seq.doneReason == StopReasonNewline) {
+					result.doneReason = seq.doneReason
+					result.hitStopWord = seq.hitStopWord
+					result.promptText = seq.promptText
+					result.stopAlternative = seq.stopAlternative
+					result.seed = seq.seed
+					result.numPrompt = seq.numPromptInputs
+					result.numTruncatedFrom = seq.numTruncatedFrom
+					result.numPredicted = seq.numPredicted
+					s.results.Put(resultKey, result)
+				}
+
 				// Final response with token timings
-				if err := json.NewEncoder(w).Encode(&CompletionResponse{
-					Stop:         true,
-					StoppedLimit: seq.doneReason == "limit",
-					Timings: Timings{
-						PromptN:     seq.numPromptInputs,
-						PromptMS:    float64(seq.startGenerationTime.Sub(seq.startProcessingTime).Milliseconds()),
-						PredictedN:  seq.numDecoded,
-						PredictedMS: float64(time.Since(seq.startGenerationTime).Milliseconds()),
-					},
-				}); err != nil {
+				defer stream.Flush()
+				if err := stream.Encode(finalResponse(frames.next(), &req, seq)); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
 				}
 				return
@@ -162,10 +368,423 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// startSequence creates a sequence for req and assigns it to a slot, writing
+// an error response and returning false if either fails.
+func (s *Server) startSequence(w http.ResponseWriter, r *http.Request, req *CompletionRequest, params NewSequenceParams) (*Sequence, bool) {
+	// Create a new decoding sequence
+	seq, err := s.NewSequence(req.Prompt, req.Images, params)
+	if err != nil {
+		if writePromptTooLong(w, err) {
+			return nil, false
+		}
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), sequenceErrorStatus(err))
+		return nil, false
+	}
+
+	// Acquire sequence slot
+	if err := s.acquirePrioritySlot(w, r.Context(), req.Priority); err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting completion request due to client closing the connection")
+		} else {
+			slog.Error("Failed to acquire semaphore", "error", err)
+		}
+		return nil, false
+	}
+
+	// Assign sequence to a slot
+	if err := s.assignSequence(seq, req.CachePrompt); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errDuplicateRequestID) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return nil, false
+	}
+
+	return seq, true
+}
+
+// toSamplingParams maps request options and an optional grammar to llama
+// sampling params.
+func toSamplingParams(opts Options, grammar string) llama.SamplingParams {
+	var samplingParams llama.SamplingParams
+	samplingParams.TopK = opts.TopK
+	samplingParams.TopP = opts.TopP
+	samplingParams.MinP = opts.MinP
+	samplingParams.TypicalP = opts.TypicalP
+	samplingParams.Temp = opts.Temperature
+	samplingParams.RepeatLastN = opts.RepeatLastN
+	samplingParams.PenaltyRepeat = opts.RepeatPenalty
+	samplingParams.PenaltyFreq = opts.FrequencyPenalty
+	samplingParams.PenaltyPresent = opts.PresencePenalty
+	samplingParams.Mirostat = opts.Mirostat
+	samplingParams.MirostatTau = opts.MirostatTau
+	samplingParams.MirostatEta = opts.MirostatEta
+	samplingParams.PenalizeNl = opts.PenalizeNewline
+	samplingParams.Grammar = grammar
+	return samplingParams
+}
+
+// writeCachedResult answers a completion request from the result cache,
+// streaming the cached output as one content frame followed by the final frame.
+func writeCachedResult(stream *streamWriter, req *CompletionRequest, result cachedResult) {
+	defer stream.Flush()
+
+	var frames frameCounter
+	if req.PrefixUsage {
+		if err := stream.Encode(&PromptUsage{Index: frames.next(), PromptTokens: result.numPrompt}); err != nil {
+			http.Error(stream.w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := stream.Encode(&CompletionResponse{
+		Index:   frames.next(),
+		Content: result.content,
+		Tokens:  result.tokens,
+	}); err != nil {
+		http.Error(stream.w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := stream.Encode(&CompletionResponse{
+		Index:                frames.next(),
+		Stop:                 true,
+		FinishReason:         result.doneReason.String(),
+		PromptText:           result.promptText,
+		StopAlternative:      result.stopAlternative,
+		StopFlags:            stopFlags(result.doneReason, result.hitStopWord),
+		Seed:                 result.seed,
+		PromptTokens:         result.numPrompt,
+		Truncated:            result.numTruncatedFrom > 0,
+		PromptTokensOriginal: result.numTruncatedFrom,
+		ResultCached:         true,
+		Timings: Timings{
+			PromptN:    result.numPrompt,
+			PredictedN: result.numPredicted,
+		},
+	}); err != nil {
+		http.Error(stream.w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// sequenceTimings reports a sequence's token counts and timings. Prompt
+// processing runs until the first generated token.
+func sequenceTimings(seq *Sequence) Timings {
+	return Timings{
+		PromptN:     seq.numPromptInputs,
+		PromptMS:    float64(promptDuration(seq).Milliseconds()),
+		PredictedN:  seq.numPredicted,
+		PredictedMS: float64(generationDuration(seq).Milliseconds()),
+		TokenizeMS:  float64(seq.tokenizeDuration.Microseconds()) / 1000,
+	}
+}
+
+// Weights of the compute units a sequence is charged per token. Prompt tokens
+// are decoded many to a batch while every generated token needs a decode of
+// its own, so generated tokens cost more; cached prompt tokens cost nothing.
+const (
+	promptTokenComputeUnits    = 1.0
+	generatedTokenComputeUnits = 4.0
+)
+
+// computeUnits approximates the compute spent on seq from its token counts.
+// Sequences sharing a batch are charged for their own tokens only, so the
+// units of concurrent requests add up to the work done for all of them.
+func computeUnits(seq *Sequence) float64 {
+	decoded := max(seq.numPromptInputs-seq.numCached, 0)
+	return float64(decoded)*promptTokenComputeUnits + float64(seq.numPredicted)*generatedTokenComputeUnits
+}
+
+// promptDuration is how long seq spent processing its prompt, so far if no
+// token has been generated yet.
+func promptDuration(seq *Sequence) time.Duration {
+	if seq.startGenerationTime.IsZero() {
+		return time.Since(seq.startProcessingTime)
+	}
+	return seq.startGenerationTime.Sub(seq.startProcessingTime)
+}
+
+// generationDuration is how long seq has been generating tokens.
+func generationDuration(seq *Sequence) time.Duration {
+	if seq.startGenerationTime.IsZero() {
+		return 0
+	}
+	return time.Since(seq.startGenerationTime)
+}
+
+// finalResponse builds the final frame of a sequence, with its token timings.
+func finalResponse(index int, req *CompletionRequest, seq *Sequence) *CompletionResponse {
+	final := &CompletionResponse{
+		Index:                index,
+		Stop:                 true,
+		FinishReason:         seq.doneReason.String(),
+		PromptText:           seq.promptText,
+		StopAlternative:      seq.stopAlternative,
+		StopFlags:            stopFlags(seq.doneReason, seq.hitStopWord),
+		Seed:                 seq.seed,
+		PromptTokens:         seq.numPromptInputs,
+		Truncated:            seq.numTruncatedFrom > 0,
+		PromptTokensOriginal: seq.numTruncatedFrom,
+		ComputeUnits:         computeUnits(seq),
+		Timings: sequenceTimings(seq),
+	}
+	if req.ReturnCacheSelection {
+		final.CacheSelection = &seq.cacheSelection
+	}
+
+	return final
+}
+
+// emptyContentFrame is the content frame sent for empty_frame when seq ended
+// without producing any content, such as when the model emits EOG first.
+func emptyContentFrame(index int, seq *Sequence) *CompletionResponse {
+	return &CompletionResponse{Index: index, FinishReason: seq.doneReason.String()}
+}
+
+// writePromptUsage streams the prompt token count as the first frame and
+// flushes it immediately, so clients see it before any content is generated.
+func writePromptUsage(stream *streamWriter, index int, seq *Sequence) error {
+	if err := stream.Encode(&PromptUsage{Index: index, PromptTokens: seq.numPromptInputs}); err != nil {
+		return err
+	}
+
+	return stream.Flush()
+}
+
+// checkThreads validates a per-request thread count. llama.cpp applies the
+// thread count to the whole context, and sequences from different requests are
+// decoded together in one batch, so only the server's --threads value (or zero,
+// meaning "use the server setting") is accepted.
+func (s *Server) checkThreads(requested int) error {
+	if requested == 0 || requested == s.threads {
+		return nil
+	}
+
+	return fmt.Errorf("n_threads is process-global and fixed at %d by --threads (requested %d)", s.threads, requested)
+}
+
+// acquireSequenceSlot blocks until one of the `parallel` sequence slots is free
+// or ctx is cancelled. If the request has to wait, the number of requests queued
+// ahead of it (including itself) is reported in the X-Queue-Position header.
+//
+// The semaphore is always acquired before s.mu and released by removeSequence
+// while s.mu is held; Release never blocks, so the two cannot deadlock.
+func (s *Server) acquireSequenceSlot(w http.ResponseWriter, ctx context.Context) error {
+	return s.acquirePrioritySlot(w, ctx, 0)
+}
+
+// acquirePrioritySlot is like acquireSequenceSlot for a request of the given
+// priority: waiting requests are given slots highest priority first.
+func (s *Server) acquirePrioritySlot(w http.ResponseWriter, ctx context.Context, priority int) error {
+	return s.acquireSlot(w, ctx, s.seqsSem, &s.seqsQueue, priority)
+}
+
+// acquireEmbeddingSlot is like acquireSequenceSlot but draws from the
+// --embedding-parallel pool when one is configured. s.seqs holds parallel +
+// embeddingParallel entries, so a holder of either semaphore always finds a
+// free entry in s.seqs.
+func (s *Server) acquireEmbeddingSlot(w http.ResponseWriter, ctx context.Context) error {
+	if s.embeddingSem == nil {
+		return s.acquireSlot(w, ctx, s.seqsSem, &s.seqsQueue, 0)
+	}
+
+	return s.acquireSlot(w, ctx, s.embeddingSem, &s.embeddingQueue, 0)
+}
+
+// slotSemaphore returns the semaphore a sequence acquired its slot from.
+func (s *Server) slotSemaphore(seq *Sequence) *semaphore.Weighted {
+	if seq.embeddingOnly && s.embeddingSem != nil {
+		return s.embeddingSem
+	}
+
+	return s.seqsSem
+}
+
+func (s *Server) acquireSlot(w http.ResponseWriter, ctx context.Context, sem *semaphore.Weighted, queue *slotQueue, priority int) error {
+	if queue.tryAcquire(sem) {
+		w.Header().Set("X-Queue-Position", "0")
+		return nil
+	}
+
+	position := s.queued.Add(1)
+	defer s.queued.Add(-1)
+
+	w.Header().Set("X-Queue-Position", strconv.Itoa(int(position)))
+	slog.Debug("waiting for a free sequence slot", "position", position, "priority", priority)
+
+	return queue.acquire(ctx, sem, priority)
+}
+
+// assignSequence loads a cache slot for seq and places it in the first free
+// entry of s.seqs, waking the decode loop. The caller must hold a slot from
+// acquireSequenceSlot or acquireEmbeddingSlot; it is released again if the
+// sequence cannot be assigned.
+//
+// Cache slot selection and assignment happen under s.mu, the same lock the
+// decode loop holds while it reads and mutates slots, so two sequences can never
+// be given the same cache slot.
+func (s *Server) assignSequence(seq *Sequence, cachePrompt bool) error {
+	return s.assignSequenceSlot(seq, func() (*InputCacheSlot, []input, error) {
+		return s.cache.LoadCacheSlot(seq.inputs, cachePrompt, seq.lora)
+	})
+}
+
+// assignSequenceSlot is assignSequence with the cache slot chosen by
+// loadSlot, which is called under s.mu and returns the slot and the inputs
+// left to decode.
+func (s *Server) assignSequenceSlot(seq *Sequence, loadSlot func() (*InputCacheSlot, []input, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.loraSwapping {
+		s.cond.Wait()
+	}
+	if seq.loraGeneration != s.loraGeneration {
+		s.slotSemaphore(seq).Release(1)
+		return fmt.Errorf("%w: the loaded adapters changed while the request was waiting", errInvalidLora)
+	}
+
+	if _, ok := s.requests[seq.id]; ok {
+		s.slotSemaphore(seq).Release(1)
+		return fmt.Errorf("%w: %q", errDuplicateRequestID, seq.id)
+	}
+
+	for i, sq := range s.seqs {
+		if sq != nil {
+			continue
+		}
+
+		numInputs := len(seq.inputs)
+		cache, inputs, err := loadSlot()
+		if err != nil {
+			s.slotSemaphore(seq).Release(1)
+			return fmt.Errorf("failed to load cache: %w", err)
+		}
+
+		// text after a cached image needs its cross-attention state, so
+		// decode again from the last cached image
+		if start := s.image.CrossAttentionStart(cache.Inputs); start >= 0 {
+			inputs = s.cache.trimCacheSlot(cache, seq.inputs, start)
+			cache.selection.PrefixLen = len(cache.Inputs)
+		}
+
+		seq.cache, seq.inputs = cache, inputs
+		seq.numCached = numInputs - len(seq.inputs)
+		seq.cacheSelection = cache.selection
+		seq.crossAttention = s.image.NeedCrossAttention(seq.cache.Inputs...)
+		s.seqs[i] = seq
+		s.trackSession(seq.sessionID, i)
+		s.trackRequest(seq)
+		s.cond.Signal()
+		return nil
+	}
+
+	s.slotSemaphore(seq).Release(1)
+	return errors.New("could not find an available sequence")
+}
+
+var errPromptTooLong = errors.New("prompt exceeds the context window")
+
+// promptTooLongError is errPromptTooLong with the token counts, which
+// writePromptTooLong reports to the client.
+type promptTooLongError struct {
+	promptTokens int
+	contextLimit int
+}
+
+func (e *promptTooLongError) Error() string {
+	return fmt.Sprintf("%v (prompt: %d context: %d)", errPromptTooLong, e.promptTokens, e.contextLimit)
+}
+
+func (e *promptTooLongError) Is(target error) bool {
+	return target == errPromptTooLong
+}
+
+// writePromptTooLong answers a request whose prompt did not fit the context
+// with a 413 carrying the prompt length and context limit. It returns false,
+// writing nothing, for any other error.
+func writePromptTooLong(w http.ResponseWriter, err error) bool {
+	var tooLong *promptTooLongError
+	if !errors.As(err, &tooLong) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(&PromptTooLongResponse{
+		Error:        tooLong.Error(),
+		PromptTokens: tooLong.promptTokens,
+		ContextLimit: tooLong.contextLimit,
+	})
+	return true
+}
+
+var errDuplicateRequestID = errors.New("request_id is already in use by an active request")
+
+// sequenceErrorStatus returns the HTTP status for an error creating or running
+// a sequence: 400 when the request itself is invalid, 404 for an unknown
+// prompt_id, 409 for a request_id in use, and 500 for anything else.
+func sequenceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errTooManyImages),
+		errors.Is(err, errImageBatchSize),
+		errors.Is(err, errPromptTooLong),
+		errors.Is(err, errNoVisionModel),
+		errors.Is(err, errInvalidLora),
+		errors.Is(err, errTokenHealing),
+		errors.Is(err, errInvalidAllowedToken):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnknownPrompt):
+		return http.StatusNotFound
+	case errors.Is(err, errDuplicateRequestID):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// requestSeed maps a request's seed to the sampling seed. An absent or
+// negative seed asks for a random one and maps to nil, so every uint32 is
+// available as an explicit seed.
+func requestSeed(seed *int) *uint32 {
+	if seed == nil || *seed < 0 {
+		return nil
+	}
+	s := uint32(*seed)
+	return &s
+}
+
+// resolveSeed draws the random seed for a request that asked for one, so the
+// seed actually used can be reported back and reused to reproduce the output.
+func resolveSeed(seed *uint32) (uint32, error) {
+	if seed != nil {
+		return *seed, nil
+	}
+
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+// samplerSeed returns the seed to build a sampler with. llama.cpp draws a
+// random seed when given LLAMA_DEFAULT_SEED (MaxUint32), so that seed is moved
+// onto its neighbour to stay reproducible.
+func samplerSeed(seed uint32) uint32 {
+	if seed == math.MaxUint32 {
+		return seed - 1
+	}
+	return seed
+}
+
 // NewSequence creates a new sequence object from a prompt and optional images,
 // applying context window trimming, caching policies, and sampling configurations.
 func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequenceParams) (*Sequence, error) {
-	s.ready.Wait()
+	if err := s.waitReady(); err != nil {
+		return nil, err
+	}
 
 	startTime := time.Now()
 
@@ -176,6 +795,33 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		return nil, errors.New("no input provided")
 	}
 
+	return s.newSequence(inputs, startTime, time.Since(startTime), params)
+}
+
+// newSequence builds a sequence from an already tokenized prompt. startTime
+// marks the start of prompt processing for the reported timings.
+func (s *Server) newSequence(inputs []input, startTime time.Time, tokenizeDuration time.Duration, params NewSequenceParams) (*Sequence, error) {
+	numVocab := len(s.pieces)
+	for _, token := range params.allowedTokens {
+		if token < 0 || token >= numVocab {
+			return nil, fmt.Errorf("%w: %d (vocab size: %d)", errInvalidAllowedToken, token, numVocab)
+		}
+	}
+
+	var healingPrefix string
+	var healingTokens []int
+	if params.tokenHealing {
+		inputs, healingPrefix, healingTokens = healInputs(s.pieces, inputs)
+
+		// the first token has to satisfy allowed_tokens as well
+		if healingPrefix != "" && len(params.allowedTokens) > 0 {
+			healingTokens = intersectTokens(healingTokens, params.allowedTokens)
+			if len(healingTokens) == 0 {
+				return nil, fmt.Errorf("%w: no allowed token begins with %q", errTokenHealing, healingPrefix)
+			}
+		}
+	}
+
 	if params.numKeep < 0 {
 		params.numKeep = len(inputs)
 	}
@@ -184,8 +830,21 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 	}
 	params.numKeep = min(params.numKeep, s.cache.numCtx-1)
 
-	// Trim inputs to fit context window
+	// Trim inputs to fit context window, unless the request rejects overflow
+	numTruncatedFrom := 0
 	if len(inputs) > s.cache.numCtx {
+		policy := s.overflow.For(params.embedding)
+		if params.truncate != nil {
+			policy = OverflowError
+			if *params.truncate {
+				policy = OverflowTruncate
+			}
+		}
+		if policy == OverflowError {
+			return nil, &promptTooLongError{promptTokens: len(inputs), contextLimit: s.cache.numCtx}
+		}
+		numTruncatedFrom = len(inputs)
+
 		discard := len(inputs) - s.cache.numCtx
 		newInputs := inputs[:params.numKeep]
 		newInputs = append(newInputs, inputs[params.numKeep+discard:]...)
@@ -193,9 +852,34 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		inputs = newInputs
 	}
 
+	// /lora may change the adapters, so they are read under s.mu and the
+	// sequence is rejected at assignment if they change before then
+	s.mu.Lock()
+	lora, err := loraScales(s.loraDefaults, params.lora)
+	loraGeneration := s.loraGeneration
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var promptText string
+	if params.returnPrompt {
+		promptText = detokenize(inputs, s.model.TokenToPiece)
+	}
+
 	var sc *llama.SamplingContext
+	var seed *uint32
 	if params.samplingParams != nil {
-		sc, err = llama.NewSamplingContext(s.model, *params.samplingParams)
+		resolved, err := resolveSeed(params.seed)
+		if err != nil {
+			return nil, err
+		}
+		seed = &resolved
+
+		samplingParams := *params.samplingParams
+		samplingParams.Seed = samplerSeed(resolved)
+
+		sc, err = llama.NewSamplingContext(s.model, samplingParams)
 		if err != nil {
 			return nil, err
 		}
@@ -206,22 +890,127 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		}
 	}
 
+	id := params.requestID
+	if id == "" {
+		id, err = newRequestID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &Sequence{
+		id:                  id,
 		inputs:              inputs,
 		numPromptInputs:     len(inputs),
+		numTruncatedFrom:    numTruncatedFrom,
 		startProcessingTime: startTime,
+		tokenizeDuration:    tokenizeDuration,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		pendingTokens:       make([]int, 0),
+		responses:           make(chan response, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		samplingCtx:         sc,
+		seed:                seed,
 		embeddingOnly:       params.embedding,
+		logitsOnly:          params.logitsOnly,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
+		streamTokenIds:      params.streamTokenIds,
+		allowedTokens:       params.allowedTokens,
+		tokenEmbeddings:     params.tokenEmbeddings,
+		healingPrefix:       healingPrefix,
+		healingTokens:       healingTokens,
+		sessionID:           params.sessionID,
+		priority:            params.priority,
+		wantStopAlternative: params.stopAlternative,
+		maxNewlines:         params.maxNewlines,
+		cacheTTL:            params.cacheTTL,
+		tempSchedule:        params.tempSchedule,
+		lora:                lora,
+		loraGeneration:      loraGeneration,
+		holdPartialUTF8:     s.utf8Hold,
+		promptText:          promptText,
 	}, nil
 }
 
+// errTokenHealing is returned when token healing leaves no token that the
+// first generated token can be.
+var errTokenHealing = errors.New("token healing has no candidate tokens")
+
+// errInvalidAllowedToken is returned when allowed_tokens names a token outside
+// the model's vocabulary.
+var errInvalidAllowedToken = errors.New("invalid allowed token")
+
+// healInputs removes the last prompt token so that generation can re-create a
+// clean token boundary. It returns the trimmed inputs, the text of the removed
+// token, and every vocabulary token that begins with that text, which are the
+// only candidates allowed for the first generated token. pieces holds the text
+// of each vocabulary token. Inputs are returned unchanged if the prompt is too
+// short or ends with an image embedding.
+func healInputs(pieces []string, inputs []input) ([]input, string, []int) {
+	if len(inputs) < 2 || inputs[len(inputs)-1].embed != nil {
+		return inputs, "", nil
+	}
+
+	last := inputs[len(inputs)-1].token
+	if last < 0 || last >= len(pieces) || pieces[last] == "" {
+		return inputs, "", nil
+	}
+	prefix := pieces[last]
+
+	var candidates []int
+	for token, piece := range pieces {
+		if strings.HasPrefix(piece, prefix) {
+			candidates = append(candidates, token)
+		}
+	}
+
+	slog.Debug("token healing", "prefix", prefix, "candidates", len(candidates))
+	return inputs[:len(inputs)-1], prefix, candidates
+}
+
+// intersectTokens returns the tokens of a that are also in b, in the order
+// of a.
+func intersectTokens(a, b []int) []int {
+	set := make(map[int]bool, len(b))
+	for _, token := range b {
+		set[token] = true
+	}
+
+	var tokens []int
+	for _, token := range a {
+		if set[token] {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// detokenize converts processed prompt inputs back to text using the given
+// piece function. Image embeddings have no text form and are skipped.
+func detokenize(inputs []input, piece func(int) string) string {
+	var sb strings.Builder
+	for _, input := range inputs {
+		if input.embed == nil {
+			sb.WriteString(piece(input.token))
+		}
+	}
+
+	return sb.String()
+}
+
+// newRequestID returns a random identifier used to correlate a sequence
+// across logs and lifecycle events.
+func newRequestID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // inputs tokenizes the prompt and injects image embeddings (if present)
 // by parsing [img-n] placeholders and matching them with provided image data.
 func inputs(s *Server, prompt string, images []ImageData) ([]input, error) {
@@ -234,9 +1023,16 @@ func inputs(s *Server, prompt string, images []ImageData) ([]input, error) {
 		parts = re.Split(prompt, -1)
 		matches = re.FindAllStringSubmatch(prompt, -1)
 	} else {
+		if regexp.MustCompile(`\[img-\d+\]`).MatchString(prompt) {
+			return nil, errNoVisionModel
+		}
 		parts = []string{prompt}
 	}
 
+	if maxImages := s.image.MaxImages(s.maxImages); len(matches) > maxImages {
+		return nil, fmt.Errorf("%w: %d images exceeds the limit of %d", errTooManyImages, len(matches), maxImages)
+	}
+
 	for i, part := range parts {
 		// Tokenize text
 		tokens, err := s.lc.Model().Tokenize(part, i == 0, true)
@@ -262,16 +1058,33 @@ func inputs(s *Server, prompt string, images []ImageData) ([]input, error) {
 				return nil, fmt.Errorf("invalid image index: %d", n)
 			}
 
-			embed, err := s.image.NewEmbed(s.lc, images[imageIndex].Data, images[imageIndex].AspectRatioID)
+			embeds, err := imageInputs(s, images[imageIndex])
 			if err != nil {
 				return nil, err
 			}
-
-			for _, e := range embed {
-				inputs = append(inputs, input{embed: e})
-			}
+			inputs = append(inputs, embeds...)
 		}
 	}
 
 	return inputs, nil
 }
+
+// imageInputs computes the embeddings of an image as model inputs. An image
+// has to be decoded within a single embedding batch, so an image that needs
+// more inputs than the batch holds is rejected instead of never finishing.
+func imageInputs(s *Server, image ImageData) ([]input, error) {
+	embed, err := s.image.NewEmbed(s.lc, image.Data, image.AspectRatioID)
+	if err != nil {
+		return nil, err
+	}
+
+	if batchSize := s.image.BatchSize(s.batchSize); len(embed) > batchSize {
+		return nil, fmt.Errorf("%w: image requires batch size >= %d (batch size: %d)", errImageBatchSize, len(embed), batchSize)
+	}
+
+	inputs := make([]input, 0, len(embed))
+	for _, e := range embed {
+		inputs = append(inputs, input{embed: e})
+	}
+	return inputs, nil
+}
@@ -0,0 +1,803 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestAcquireSequenceSlotQueuesWithSingleSlot(t *testing.T) {
+	s := &Server{seqsSem: semaphore.NewWeighted(1)}
+
+	first := httptest.NewRecorder()
+	if err := s.acquireSequenceSlot(first, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := first.Header().Get("X-Queue-Position"); got != "0" {
+		t.Errorf("expected first request at position 0, got %q", got)
+	}
+
+	// the second request waits until the first releases its slot
+	second := httptest.NewRecorder()
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- s.acquireSequenceSlot(second, context.Background())
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second request acquired a slot while the first was active")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.seqsSem.Release(1)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second request did not acquire the released slot")
+	}
+
+	if got := second.Header().Get("X-Queue-Position"); got != "1" {
+		t.Errorf("expected second request at position 1, got %q", got)
+	}
+	if s.queued.Load() != 0 {
+		t.Errorf("expected empty queue, got %d", s.queued.Load())
+	}
+}
+
+func TestAcquireSequenceSlotCancelledWhileWaiting(t *testing.T) {
+	s := &Server{seqsSem: semaphore.NewWeighted(1)}
+	if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := s.acquireSequenceSlot(httptest.NewRecorder(), ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if s.queued.Load() != 0 {
+		t.Errorf("expected empty queue, got %d", s.queued.Load())
+	}
+}
+
+func TestCheckThreads(t *testing.T) {
+	s := &Server{threads: 8}
+
+	for _, requested := range []int{0, 8} {
+		if err := s.checkThreads(requested); err != nil {
+			t.Errorf("expected %d threads to be accepted, got %v", requested, err)
+		}
+	}
+
+	for _, requested := range []int{-1, 4, 16} {
+		if err := s.checkThreads(requested); err == nil {
+			t.Errorf("expected %d threads to be rejected", requested)
+		}
+	}
+}
+
+func TestDetokenizeRoundTrip(t *testing.T) {
+	prompt := "The quick brown fox jumps over the lazy dog."
+
+	// Byte-level vocabulary: each token is a single ASCII character
+	var inputs []input
+	for _, c := range []byte(prompt) {
+		inputs = append(inputs, input{token: int(c)})
+	}
+	inputs = append(inputs, input{embed: []float32{0.1, 0.2}})
+
+	text := detokenize(inputs, func(token int) string { return string(rune(token)) })
+	if text != prompt {
+		t.Errorf("expected %q, got %q", prompt, text)
+	}
+}
+
+func TestEmbeddingSlotsIndependentOfParallel(t *testing.T) {
+	s := &Server{
+		seqs:              make([]*Sequence, 1+3),
+		seqsSem:           semaphore.NewWeighted(1),
+		embeddingParallel: 3,
+		embeddingSem:      semaphore.NewWeighted(3),
+	}
+
+	// occupy the only generation slot
+	if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// more embedding requests than --parallel are admitted without queueing
+	for i := range 3 {
+		w := httptest.NewRecorder()
+		if err := s.acquireEmbeddingSlot(w, context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Header().Get("X-Queue-Position"); got != "0" {
+			t.Errorf("embedding request %d: expected position 0, got %q", i, got)
+		}
+	}
+
+	// once the embedding pool is exhausted further requests queue
+	w := httptest.NewRecorder()
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- s.acquireEmbeddingSlot(w, context.Background())
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("embedding request acquired a slot while the pool was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// completing an embedding sequence releases the embedding pool, not seqsSem
+	s.seqs[2] = &Sequence{
+		embeddingOnly: true,
+		responses:     make(chan response, 1),
+		quit:          make(chan bool, 1),
+		embedding:     make(chan []float32, 1),
+		cache:         &InputCacheSlot{InUse: true},
+	}
+	removeSequence(s, 2, StopReasonStop)
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued embedding request did not acquire the released slot")
+	}
+
+	if got := w.Header().Get("X-Queue-Position"); got != "1" {
+		t.Errorf("expected queued embedding request at position 1, got %q", got)
+	}
+	if s.seqsSem.TryAcquire(1) {
+		t.Error("expected generation slot to remain held")
+	}
+}
+
+func newTestSequence(inputs []input) *Sequence {
+	return &Sequence{
+		inputs:    inputs,
+		responses: make(chan response, 1),
+		quit:      make(chan bool, 1),
+		embedding: make(chan []float32, 1),
+	}
+}
+
+func TestAssignSequenceConcurrent(t *testing.T) {
+	for _, multiUserCache := range []bool{false, true} {
+		const slots = 4
+
+		cache, err := NewInputCache(nil, 64, slots, multiUserCache, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{
+			seqs:    make([]*Sequence, slots),
+			seqsSem: semaphore.NewWeighted(slots),
+			cache:   cache,
+		}
+		s.cond = sync.NewCond(&s.mu)
+
+		var wg sync.WaitGroup
+		for g := range 32 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 20 {
+					if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+						t.Error(err)
+						return
+					}
+
+					seq := newTestSequence(tokenInputs(1, 2, g%3, i))
+					if err := s.assignSequence(seq, true); err != nil {
+						t.Error(err)
+						return
+					}
+
+					// no other active sequence may share the cache slot
+					s.mu.Lock()
+					for _, other := range s.seqs {
+						if other != nil && other != seq && other.cache == seq.cache {
+							t.Errorf("cache slot %d assigned twice", seq.cache.Id)
+						}
+					}
+					if !seq.cache.InUse {
+						t.Error("assigned cache slot not marked in use")
+					}
+					s.mu.Unlock()
+
+					// release the sequence as the decode loop would
+					func() {
+						s.mu.Lock()
+						defer s.mu.Unlock()
+						for idx, other := range s.seqs {
+							if other == seq {
+								removeSequence(s, idx, StopReasonStop)
+							}
+						}
+					}()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if !s.seqsSem.TryAcquire(slots) {
+			t.Error("expected all sequence slots to be released")
+		}
+	}
+}
+
+func TestAssignSequenceReleasesSlotOnFailure(t *testing.T) {
+	// more sequence entries than cache slots, so the second assignment fails
+	cache, err := NewInputCache(nil, 16, 1, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(2),
+		cache:   cache,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	for i := range 2 {
+		if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		err := s.assignSequence(newTestSequence(tokenInputs(i)), true)
+		if i == 1 && err == nil {
+			t.Fatal("expected assignment without a free cache slot to fail")
+		}
+	}
+
+	if !s.seqsSem.TryAcquire(1) {
+		t.Error("expected the failed assignment to release its sequence slot")
+	}
+}
+
+func TestWritePromptUsageFirstFrame(t *testing.T) {
+	rec := &recordingWriter{}
+	stream := newStreamWriter(rec, rec, 1024, time.Hour)
+
+	seq := &Sequence{numPromptInputs: 42}
+	if err := writePromptUsage(stream, 0, seq); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.flushes) != 1 {
+		t.Fatalf("expected the usage frame to be flushed immediately, got %d flushes", len(rec.flushes))
+	}
+
+	// generated content follows the usage frame
+	if err := json.NewEncoder(stream).Encode(&CompletionResponse{Content: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	stream.Flush()
+
+	first, _, _ := bytes.Cut(rec.body.Bytes(), []byte("\n"))
+	var usage map[string]any
+	if err := json.Unmarshal(first, &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage["prompt_tokens"] != float64(42) || usage["index"] != float64(0) || len(usage) != 2 {
+		t.Errorf("expected first frame {\"index\": 0, \"prompt_tokens\": 42}, got %s", first)
+	}
+}
+
+func TestCompletionFrameIndicesContiguous(t *testing.T) {
+	s := &Server{results: NewResultCache(4), defaults: DefaultOptions()}
+
+	body := `{"prompt": "2+2=", "temperature": 0, "prefix_usage": true}`
+	key, _ := s.results.Key(decodeCompletionRequest(t, body))
+	s.results.Put(key, cachedResult{content: "4", doneReason: StopReasonStop, numPrompt: 5, numPredicted: 1})
+
+	w := httptest.NewRecorder()
+	s.completion(w, httptest.NewRequest("POST", "/completion", strings.NewReader(body)))
+
+	var indices []int
+	for _, line := range bytes.Split(bytes.TrimSpace(w.Body.Bytes()), []byte("\n")) {
+		var frame struct {
+			Index *int `json:"index"`
+		}
+		if err := json.Unmarshal(line, &frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Index == nil {
+			t.Fatalf("frame without an index: %s", line)
+		}
+		indices = append(indices, *frame.Index)
+	}
+
+	// usage, content and final frames
+	if len(indices) != 3 {
+		t.Fatalf("expected 3 frames, got %v", indices)
+	}
+	for i, index := range indices {
+		if index != i {
+			t.Errorf("expected contiguous indices from 0, got %v", indices)
+			break
+		}
+	}
+}
+
+func TestDecodeCompletionAppliesFlagDefaults(t *testing.T) {
+	config := &Config{defaultTemperature: 0.2, defaultTopP: 0.5, defaultTopK: 7}
+	s := &Server{defaults: config.requestDefaults()}
+
+	req, err := s.decodeCompletion(strings.NewReader(`{"prompt": "hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Temperature != 0.2 || req.TopP != 0.5 || req.TopK != 7 {
+		t.Errorf("expected flag defaults, got temperature=%v top_p=%v top_k=%v", req.Temperature, req.TopP, req.TopK)
+	}
+	if req.RepeatPenalty != DefaultOptions().RepeatPenalty {
+		t.Errorf("expected untouched options to keep DefaultOptions values, got repeat_penalty=%v", req.RepeatPenalty)
+	}
+
+	req, err = s.decodeCompletion(strings.NewReader(`{"prompt": "hi", "temperature": 0.9, "top_k": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Temperature != 0.9 || req.TopK != 3 || req.TopP != 0.5 {
+		t.Errorf("expected request values to override flag defaults, got temperature=%v top_p=%v top_k=%v", req.Temperature, req.TopP, req.TopK)
+	}
+}
+
+func TestResolveSeed(t *testing.T) {
+	// a request seed of -1 is resolved to a concrete seed, which reused as the
+	// request seed stays as it is and so reproduces the same sampler
+	opts := DefaultOptions()
+	resolved, err := resolveSeed(requestSeed(&opts.Seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := resolveSeed(&resolved); err != nil || again != resolved {
+		t.Errorf("expected resolved seed %d to be kept, got %d (%v)", resolved, again, err)
+	}
+
+	seed := uint32(42)
+	if got, err := resolveSeed(&seed); err != nil || got != 42 {
+		t.Errorf("expected explicit seed to be kept, got %d (%v)", got, err)
+	}
+}
+
+func TestRequestSeed(t *testing.T) {
+	// absent and -1 seeds draw a fresh seed for every request
+	random := -1
+	for _, seed := range []*int{nil, &random} {
+		first, err := resolveSeed(requestSeed(seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := resolveSeed(requestSeed(seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == second {
+			t.Errorf("expected two random seeds to differ, both were %d", first)
+		}
+	}
+
+	// a concrete seed, including 0 and MaxUint32, is passed through to
+	// reproduce output
+	for _, seed := range []int{0, 42, math.MaxUint32} {
+		got, err := resolveSeed(requestSeed(&seed))
+		if err != nil || got != uint32(seed) {
+			t.Errorf("expected seed %d to be kept, got %d (%v)", seed, got, err)
+		}
+	}
+}
+
+func TestSamplerSeed(t *testing.T) {
+	// llama.cpp would draw a random seed for MaxUint32
+	if got := samplerSeed(math.MaxUint32); got == math.MaxUint32 {
+		t.Error("expected MaxUint32 not to reach the sampler")
+	}
+	if got := samplerSeed(42); got != 42 {
+		t.Errorf("expected other seeds to be passed through, got %d", got)
+	}
+}
+
+// cachedCompletion serves body from a pre-populated result cache with the given
+// Accept header, so the response framing can be checked without a model.
+func cachedCompletion(t *testing.T, body, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	s := &Server{results: NewResultCache(4), defaults: DefaultOptions()}
+	key, _ := s.results.Key(decodeCompletionRequest(t, body))
+	s.results.Put(key, cachedResult{content: "4", tokens: []int{19}, doneReason: StopReasonStop, numPrompt: 5, numPredicted: 1})
+
+	r := httptest.NewRequest("POST", "/completion", strings.NewReader(body))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	s.completion(w, r)
+	return w
+}
+
+func TestCompletionNDJSON(t *testing.T) {
+	body := `{"prompt": "2+2=", "temperature": 0, "stream_token_ids": true}`
+	for _, accept := range []string{"", "*/*", "application/x-ndjson"} {
+		w := cachedCompletion(t, body, accept)
+		if got := w.Header().Get("Content-Type"); got != "application/x-ndjson" {
+			t.Errorf("Accept %q: expected application/x-ndjson, got %q", accept, got)
+		}
+
+		lines := bytes.Split(bytes.TrimSpace(w.Body.Bytes()), []byte("\n"))
+		if len(lines) != 2 {
+			t.Fatalf("Accept %q: expected content and final lines, got %q", accept, w.Body.String())
+		}
+		for _, line := range lines {
+			if !json.Valid(line) {
+				t.Errorf("Accept %q: expected a JSON object per line, got %s", accept, line)
+			}
+		}
+	}
+}
+
+func TestCompletionEventStream(t *testing.T) {
+	w := cachedCompletion(t, `{"prompt": "2+2=", "temperature": 0}`, "text/event-stream")
+	if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %q", got)
+	}
+
+	events := strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n")
+	if len(events) != 3 || events[2] != "data: [DONE]" {
+		t.Fatalf("expected content, final and [DONE] events, got %q", w.Body.String())
+	}
+
+	var final CompletionResponse
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(events[1], "data: ")), &final); err != nil || !final.Stop || final.Timings.PromptN != 5 {
+		t.Errorf("expected the final frame with timings before [DONE], got %q (%v)", events[1], err)
+	}
+	for _, event := range events[:2] {
+		data, ok := strings.CutPrefix(event, "data: ")
+		if !ok || !json.Valid([]byte(data)) {
+			t.Errorf("expected a data event with a JSON object, got %q", event)
+		}
+	}
+}
+
+func TestCompletionBufferedJSON(t *testing.T) {
+	w := cachedCompletion(t, `{"prompt": "2+2=", "temperature": 0, "prefix_usage": true}`, "application/json")
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected application/json, got %q", got)
+	}
+
+	var resp CompletionResponse
+	decoder := json.NewDecoder(w.Body)
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if decoder.More() {
+		t.Fatalf("expected a single object, got more: %q", w.Body.String())
+	}
+	if resp.Content != "4" || !resp.Stop || resp.Index != 0 || resp.Timings.PromptN != 5 {
+		t.Errorf("expected the whole completion in one final object, got %+v", resp)
+	}
+}
+
+func TestTimingsReportTokenizeTime(t *testing.T) {
+	start := time.Now().Add(-2 * time.Second)
+	seq := &Sequence{
+		numPromptInputs:     14,
+		numPredicted:        3,
+		startProcessingTime: start,
+		tokenizeDuration:    1500 * time.Microsecond,
+		startGenerationTime: start.Add(time.Second),
+	}
+
+	b, err := json.Marshal(finalResponse(0, &CompletionRequest{}, seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var final struct {
+		Timings map[string]float64 `json:"timings"`
+	}
+	if err := json.Unmarshal(b, &final); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenize, ok := final.Timings["tokenize_ms"]
+	if !ok || tokenize != 1.5 {
+		t.Errorf("expected tokenize_ms of 1.5, got %v in %s", tokenize, b)
+	}
+
+	// tokenizing is part of prompt processing, so it is within the total
+	if total := final.Timings["prompt_ms"] + final.Timings["predicted_ms"]; tokenize >= total {
+		t.Errorf("expected tokenize_ms below the total of %vms, got %v", total, tokenize)
+	}
+}
+
+func TestSequenceTimings(t *testing.T) {
+	start := time.Now().Add(-3 * time.Second)
+	seq := &Sequence{numPromptInputs: 14, numPredicted: 3, startProcessingTime: start}
+
+	// no token generated yet, e.g. cancelled during prompt processing
+	timings := sequenceTimings(seq)
+	if timings.PromptN != 14 || timings.PredictedN != 3 || timings.PredictedMS != 0 {
+		t.Errorf("unexpected timings before generation: %+v", timings)
+	}
+	if timings.PromptMS < 3000 {
+		t.Errorf("expected prompt processing to be timed until now, got %vms", timings.PromptMS)
+	}
+
+	seq.startGenerationTime = start.Add(time.Second)
+	if d := promptDuration(seq); d != time.Second {
+		t.Errorf("expected a 1s prompt duration, got %v", d)
+	}
+	if d := generationDuration(seq); d < 2*time.Second {
+		t.Errorf("expected at least 2s of generation, got %v", d)
+	}
+}
+
+func TestWritePromptTooLong(t *testing.T) {
+	err := fmt.Errorf("failed to create sequence: %w", &promptTooLongError{promptTokens: 5000, contextLimit: 4096})
+	if !errors.Is(err, errPromptTooLong) {
+		t.Error("expected the error to match errPromptTooLong")
+	}
+
+	w := httptest.NewRecorder()
+	if !writePromptTooLong(w, err) {
+		t.Fatal("expected the prompt too long error to be written")
+	}
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d", w.Code)
+	}
+
+	var resp PromptTooLongResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.PromptTokens != 5000 || resp.ContextLimit != 4096 || resp.Error == "" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	// other errors are left to the caller
+	if writePromptTooLong(httptest.NewRecorder(), errInvalidLora) {
+		t.Error("expected other errors not to be written")
+	}
+}
+
+func TestFinalResponseReportsTruncation(t *testing.T) {
+	req := &CompletionRequest{}
+
+	final := finalResponse(0, req, &Sequence{numPromptInputs: 4096})
+	if final.Truncated || final.PromptTokensOriginal != 0 || final.PromptTokens != 4096 {
+		t.Errorf("expected a prompt that fit not to be reported as truncated, got %+v", final)
+	}
+
+	// prompt_tokens counts the same tokens as the prefix_usage frame
+	final = finalResponse(0, req, &Sequence{numPromptInputs: 4096, numTruncatedFrom: 5000})
+	if !final.Truncated || final.PromptTokensOriginal != 5000 || final.PromptTokens != 4096 || final.Timings.PromptN != 4096 {
+		t.Errorf("expected truncation from 5000 tokens to 4096, got %+v", final)
+	}
+}
+
+func TestDecodeCompletionAliases(t *testing.T) {
+	s := &Server{defaults: DefaultOptions()}
+
+	req, err := s.decodeCompletion(strings.NewReader(`{"prompt": "hi", "max_tokens": 42, "temp": 0.3, "stop_sequences": ["\n"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.NumPredict != 42 || req.Temperature != 0.3 || len(req.Stop) != 1 || req.Stop[0] != "\n" {
+		t.Errorf("expected aliases to set n_predict, temperature and stop, got %d, %v, %q", req.NumPredict, req.Temperature, req.Stop)
+	}
+	if req.Prompt != "hi" || req.TopK != DefaultOptions().TopK {
+		t.Errorf("expected other fields to decode as usual, got prompt %q and top_k %d", req.Prompt, req.TopK)
+	}
+
+	// canonical names keep working
+	req, err = s.decodeCompletion(strings.NewReader(`{"prompt": "hi", "n_predict": 7, "temperature": 0.9}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.NumPredict != 7 || req.Temperature != 0.9 {
+		t.Errorf("expected canonical fields to decode, got %d and %v", req.NumPredict, req.Temperature)
+	}
+
+	for _, body := range []string{
+		`{"n_predict": 7, "max_tokens": 8}`,
+		`{"max_tokens": 7, "num_predict": 8}`,
+	} {
+		if _, err := s.decodeCompletion(strings.NewReader(body)); err == nil {
+			t.Errorf("expected a conflict error for %s", body)
+		}
+	}
+}
+
+func TestComputeUnits(t *testing.T) {
+	units := func(numPredicted int) float64 {
+		seq := newTestSequence(nil)
+		seq.numPromptInputs, seq.numCached, seq.numPredicted = 100, 40, numPredicted
+		return finalResponse(0, &CompletionRequest{}, seq).ComputeUnits
+	}
+
+	short, long := units(10), units(100)
+	if short != 60*promptTokenComputeUnits+10*generatedTokenComputeUnits {
+		t.Errorf("expected cached prompt tokens to be free, got %v", short)
+	}
+
+	// the longer generation costs more in proportion to its extra tokens
+	if want := 90 * generatedTokenComputeUnits; long-short != want {
+		t.Errorf("expected 90 more generated tokens to add %v units, got %v", want, long-short)
+	}
+}
+
+func TestEmptyContentFrame(t *testing.T) {
+	seq := &Sequence{doneReason: StopReasonStop}
+	frame := emptyContentFrame(0, seq)
+	if frame.Stop || frame.Content != "" || frame.FinishReason != "stop" {
+		t.Errorf("expected an empty content frame with finish_reason stop, got %+v", frame)
+	}
+}
+
+func TestEmptyFrameForZeroTokenGeneration(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		s := &Server{}
+		seq := newTestSequence(tokenInputs(1))
+		seq.id = "empty"
+
+		// the model emits EOG straight away, so no content is streamed
+		rs := s.startResumable(seq, &CompletionRequest{EmptyFrame: enabled})
+		seq.doneReason = StopReasonStop
+		close(seq.responses)
+
+		timeout := time.After(5 * time.Second)
+		frames, changed, _ := rs.since(0)
+		for len(frames) == 0 || !frames[len(frames)-1].Stop {
+			select {
+			case <-changed:
+			case <-timeout:
+				t.Fatal("timed out waiting for the final frame")
+			}
+			frames, changed, _ = rs.since(0)
+		}
+
+		if !enabled {
+			if len(frames) != 1 {
+				t.Errorf("expected only the final frame without empty_frame, got %d frames", len(frames))
+			}
+			continue
+		}
+		if len(frames) != 2 {
+			t.Fatalf("expected an empty content frame before the final frame, got %d frames", len(frames))
+		}
+		if empty := frames[0]; empty.Stop || empty.Content != "" || empty.FinishReason != "stop" {
+			t.Errorf("expected an empty content frame with finish_reason stop, got %+v", empty)
+		}
+	}
+}
+
+func TestTokenHealing(t *testing.T) {
+	pieces := []string{"", "def", " pri", " print", "nt", " private", "("}
+
+	// the prompt "def pri" ends mid-word, so its last token is a poor boundary
+	prompt := tokenInputs(1, 2)
+	logits := []float32{0, 0, 0.5, 2.0, 0.1, 1.5, 3.0}
+
+	// pick the most likely token the way a greedy sampler would and append
+	// its text, minus the prefix already in the prompt when healing
+	complete := func(inputs []input, prefix string, allowed []int) string {
+		l := slices.Clone(logits)
+		if len(allowed) > 0 {
+			maskLogits(l, allowed)
+		}
+		token := slices.Index(l, slices.Max(l))
+		return detokenize(inputs, func(t int) string { return pieces[t] }) + prefix + strings.TrimPrefix(pieces[token], prefix)
+	}
+
+	if got := complete(prompt, "", nil); got != "def pri(" {
+		t.Errorf("expected the unhealed baseline to break the word, got %q", got)
+	}
+
+	inputs, prefix, candidates := healInputs(pieces, prompt)
+	if len(inputs) != 1 || prefix != " pri" {
+		t.Fatalf("expected the last token %q to be backed up, got %d inputs and prefix %q", " pri", len(inputs), prefix)
+	}
+	if !slices.Equal(candidates, []int{2, 3, 5}) {
+		t.Errorf("expected every token beginning with the prefix as candidates, got %v", candidates)
+	}
+	if got := complete(inputs, prefix, candidates); got != "def print" {
+		t.Errorf("expected the healed completion to finish the word, got %q", got)
+	}
+
+	// allowed_tokens narrows the candidates further
+	if got := intersectTokens(candidates, []int{5, 6}); !slices.Equal(got, []int{5}) {
+		t.Errorf("expected only the allowed candidate, got %v", got)
+	}
+	if got := intersectTokens(candidates, []int{6}); len(got) != 0 {
+		t.Errorf("expected no candidates, got %v", got)
+	}
+
+	// a prompt ending in an image is left alone
+	image := []input{{token: 1}, {embed: []float32{1}}}
+	if inputs, prefix, _ := healInputs(pieces, image); len(inputs) != 2 || prefix != "" {
+		t.Errorf("expected no healing after an image, got %d inputs and prefix %q", len(inputs), prefix)
+	}
+}
+
+func TestInvalidAllowedToken(t *testing.T) {
+	cache, err := NewInputCache(nil, 64, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		seqs:     make([]*Sequence, 1),
+		seqsSem:  semaphore.NewWeighted(1),
+		cache:    cache,
+		pieces:   []string{"", "hello", " world"},
+		defaults: DefaultOptions(),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	tokenizer := &wordTokenizer{vocab: make(map[string]int)}
+	if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.newPreparedPrompt(tokenizer.Tokenize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.pending = "hello"
+
+	// token 3 is one past the end of the vocabulary
+	body := fmt.Sprintf(`{"prompt_id": %q, "allowed_tokens": [1, 3]}`, p.id)
+	w := httptest.NewRecorder()
+	s.completion(w, httptest.NewRequest("POST", "/completion", strings.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), errInvalidAllowedToken.Error()) {
+		t.Errorf("expected the invalid allowed token error, got %q", w.Body.String())
+	}
+}
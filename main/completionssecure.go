@@ -29,8 +29,6 @@ import(
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"time"
 	"encoding/json"
 	"log/slog"
 	"net/http"
@@ -42,7 +40,8 @@ import(
 //
 // It performs the following steps:
 //   - Parses the JSON request containing an encrypted prompt and symmetric key.
-//   - Decrypts the symmetric key using the server's RSA private key.
+//   - Decrypts the symmetric key using the server's RSA private key (OAEP with SHA-256,
+//     or PKCS #1 v1.5 when --rsa-pkcs1-fallback is set).
 //   - Decrypts the actual prompt using the symmetric AES key.
 //   - Initializes a new sequence with predefined sampling parameters.
 //   - Streams encrypted responses (each encrypted using the same symmetric AES key) to the client.
@@ -56,13 +55,26 @@ import(
 // {
 //   "role": "user",
 //   "EncryptedPrompt": "base64-encoded encrypted prompt",
-//   "encryptedSymmetricKey": "base64-encoded encrypted AES key"
+//   "encryptedSymmetricKey": "base64-encoded encrypted AES key",
+//   "mode": "gcm"
 // }
+//
+// `mode` selects AES-256-GCM ("gcm") or CBC ("cbc", the default) for both the
+// prompt and the streamed content. GCM is authenticated, so a tampered prompt
+// is rejected with 400 rather than decrypted; clients should prefer it.
+//
+// An optional `encryptedSystem`, encrypted like the prompt, replaces the
+// --prompt-template format's default system message.
 func (s *Server) securecompletion(w http.ResponseWriter, r *http.Request) {
+	InferenceStats.Requests.Add(1)
+
 	var req struct {
 		Role                 string `json:"role"`
 		EncryptedPrompt      string `json:"EncryptedPrompt"`
 		EncryptedSymmetricKey string `json:"encryptedSymmetricKey"`
+		EncryptedSystem      string `json:"encryptedSystem"`
+		Mode                 string `json:"mode"`
+		Seed                 *int   `json:"seed"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -75,15 +87,21 @@ func (s *Server) securecompletion(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("Key not found in cache")
 	}
 
-	symmetricKey, err := RsaDecrypt(privateKey, req.EncryptedSymmetricKey)
+	symmetricKey, err := RsaDecryptKeyExchange(privateKey, req.EncryptedSymmetricKey, s.rsaPKCS1Fallback)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decrypting symmetric key: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	prompt, err := AesDecryptMode(req.Mode, symmetricKey, req.EncryptedPrompt)
 	if err != nil {
-		log.Fatal("Error decrypting symmetric key", err)
+		http.Error(w, fmt.Sprintf("Error decrypting prompt: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	prompt, err := AesDecrypt(symmetricKey, req.EncryptedPrompt)
+	formatted, err := s.formatSecurePrompt(req.Mode, symmetricKey, req.EncryptedSystem, prompt)
 	if err != nil {
-		log.Fatal("Error decrypting prompt", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -112,25 +130,25 @@ func (s *Server) securecompletion(w http.ResponseWriter, r *http.Request) {
 		MirostatTau:    5,
 		MirostatEta:    0.1,
 		PenalizeNl:     true,
-		Seed:           uint32(0),
 		Grammar:        "false",
 	}
 
 	// Create new decoding sequence
-	seq, err := s.NewSequence(fmt.Sprintf(promptFormat, prompt), nil, NewSequenceParams{
+	seq, err := s.NewSequence(formatted, nil, NewSequenceParams{
 		numPredict:     -1,
-		stop:           nil,
+		stop:           s.promptFormat.Stop(),
 		numKeep:        4,
 		samplingParams: &samplingParams,
+		seed:           requestSeed(req.Seed),
 		embedding:      false,
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), sequenceErrorStatus(err))
 		return
 	}
 
 	// Acquire available sequence slot
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	if err := s.acquireSequenceSlot(w, r.Context()); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting securecompletion due to client disconnection")
 		} else {
@@ -140,47 +158,35 @@ func (s *Server) securecompletion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Load the sequence into the shared sequence pool
-	s.mu.Lock()
-	found := false
-	for i, sq := range s.seqs {
-		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, true)
-			if err != nil {
-				s.mu.Unlock()
-				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
-				return
-			}
-
-			seq.crossAttention = s.image.NeedCrossAttention(seq.cache.Inputs...)
-			s.seqs[i] = seq
-			s.cond.Signal()
-			found = true
-			break
-		}
-	}
-	s.mu.Unlock()
-
-	if !found {
-		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
+	if err := s.assignSequence(seq, true); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Begin streaming encrypted content
+	// Expose the request ID so the client can cancel the stream via /cancel
+	w.Header().Set("X-Request-Id", seq.id)
+
+	// Begin streaming encrypted content, buffering up to the flush threshold
+	stream := newStreamWriter(w, flusher, s.flushBytes, s.flushLatency)
+	var frames frameCounter
 	for {
 		select {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case <-stream.Deadline():
+			stream.Flush()
+		case resp, ok := <-seq.responses:
 			if ok {
-				encryptedContent, err := AesEncrypt(symmetricKey, content)
+				encryptedContent, err := AesEncryptMode(req.Mode, symmetricKey, resp.content)
 				if err != nil {
 					http.Error(w, fmt.Sprintf("Failed to encrypt content: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
 					return
 				}
 
-				if err := json.NewEncoder(w).Encode(&CompletionResponse{
+				if err := json.NewEncoder(stream).Encode(&CompletionResponse{
+					Index:   frames.next(),
 					Content: encryptedContent,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
@@ -188,18 +194,17 @@ func (s *Server) securecompletion(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
-				flusher.Flush()
+				stream.MaybeFlush()
 			} else {
 				// Final response with generation metrics
-				if err := json.NewEncoder(w).Encode(&CompletionResponse{
+				defer stream.Flush()
+				if err := json.NewEncoder(stream).Encode(&CompletionResponse{
+					Index:        frames.next(),
 					Stop:         true,
-					StoppedLimit: seq.doneReason == "limit",
-					Timings: Timings{
-						PromptN:     seq.numPromptInputs,
-						PromptMS:    float64(seq.startGenerationTime.Sub(seq.startProcessingTime).Milliseconds()),
-						PredictedN:  seq.numDecoded,
-						PredictedMS: float64(time.Since(seq.startGenerationTime).Milliseconds()),
-					},
+					FinishReason: seq.doneReason.String(),
+					StopFlags:    stopFlags(seq.doneReason, seq.hitStopWord),
+					Seed:         seq.seed,
+					Timings: sequenceTimings(seq),
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("Failed to encode final response: %v", err), http.StatusInternalServerError)
 				}
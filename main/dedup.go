@@ -0,0 +1,280 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements deduplication of identical in-flight completions. When
+// a deterministic (temperature 0) request arrives while a byte-identical one is
+// still generating, it follows the running sequence instead of starting its
+// own, and every frame is fanned out to all of the clients that sent it. This
+// keeps a burst of the same request, such as after a cache miss, down to a
+// single decode.
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// sharedStream holds the frames of a sequence followed by several identical
+// requests. Frames are kept for the life of the sequence so that a client
+// joining late receives all of them.
+type sharedStream struct {
+	mu        sync.Mutex
+	started   chan struct{} // closed once the sequence is running or has failed to start
+	failed    bool          // the first request failed before a sequence was assigned
+	changed   chan struct{} // closed and replaced when a frame is added
+	frames    []*CompletionResponse
+	done      bool // the final frame has been added
+	clients   int  // clients following the stream; the sequence stops once all have gone
+	id        string
+	quit      chan bool
+	abandoned bool
+}
+
+func newSharedStream() *sharedStream {
+	return &sharedStream{started: make(chan struct{}), changed: make(chan struct{}), clients: 1}
+}
+
+// begin records the sequence the stream follows and releases waiting clients.
+func (ss *sharedStream) begin(seq *Sequence) {
+	ss.mu.Lock()
+	ss.id, ss.quit = seq.id, seq.quit
+	ss.mu.Unlock()
+
+	close(ss.started)
+}
+
+// fail releases waiting clients to run the request on their own.
+func (ss *sharedStream) fail() {
+	ss.mu.Lock()
+	ss.failed = true
+	ss.mu.Unlock()
+
+	close(ss.started)
+}
+
+// wait blocks until the sequence has started, returning false if it failed to
+// start or ctx was cancelled first.
+func (ss *sharedStream) wait(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-ss.started:
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return !ss.failed
+}
+
+// join adds a client, unless the stream has failed or been abandoned.
+func (ss *sharedStream) join() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.failed || ss.abandoned {
+		return false
+	}
+	ss.clients++
+	return true
+}
+
+// leave removes a client. The sequence is stopped once the last one leaves
+// before the final frame.
+func (ss *sharedStream) leave() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.clients--
+	if ss.clients == 0 && !ss.done && !ss.abandoned && ss.quit != nil {
+		ss.abandoned = true
+		close(ss.quit)
+	}
+}
+
+// add numbers frame, keeps it and wakes the following clients.
+func (ss *sharedStream) add(frame *CompletionResponse) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	frame.Index = len(ss.frames)
+	ss.frames = append(ss.frames, frame)
+	ss.done = ss.done || frame.Stop
+
+	close(ss.changed)
+	ss.changed = make(chan struct{})
+}
+
+// since returns the frames from index from on, and a channel that is closed
+// when more are added.
+func (ss *sharedStream) since(from int) ([]*CompletionResponse, <-chan struct{}) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.frames[min(from, len(ss.frames)):], ss.changed
+}
+
+// inflightRequests maps request hashes to the streams of their running
+// sequences. The zero value is ready to use.
+type inflightRequests struct {
+	mu      sync.Mutex
+	streams map[string]*sharedStream
+}
+
+// join returns the stream of a running request with the given key, joined as
+// a client, or registers a new stream and reports that the caller must start
+// its sequence.
+func (f *inflightRequests) join(key string) (*sharedStream, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if ss, ok := f.streams[key]; ok && ss.join() {
+		return ss, false
+	}
+
+	if f.streams == nil {
+		f.streams = make(map[string]*sharedStream)
+	}
+	ss := newSharedStream()
+	f.streams[key] = ss
+	return ss, true
+}
+
+// remove forgets key, unless it has since been taken by another stream.
+func (f *inflightRequests) remove(key string, ss *sharedStream) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.streams[key] == ss {
+		delete(f.streams, key)
+	}
+}
+
+// dedupKey returns the key identical requests share a sequence under, or false
+// if req can't share one. Besides being deterministic, the request must not
+// have its own request ID or produce per-client output: filters, prompt echo
+// stripping, prefix usage and resumable streams are served on their own.
+func dedupKey(req *CompletionRequest, filters *filterPipeline) (string, bool) {
+	if req.RequestID != "" || req.Resumable || filters != nil || req.StripPromptEcho || req.PrefixUsage {
+		return "", false
+	}
+
+	return deterministicKey(req)
+}
+
+// serveDeduplicated streams the output of req, sharing one sequence between
+// all identical requests in flight. Only the first of them calls start, which
+// creates and assigns the sequence or writes an error response and returns
+// false. It returns false, having written nothing, if the request should be
+// served on its own because the first request failed to start.
+func (s *Server) serveDeduplicated(ctx context.Context, w http.ResponseWriter, stream *streamWriter, key string, req *CompletionRequest, start func() (*Sequence, bool)) bool {
+	ss, first := s.inflight.join(key)
+	if first {
+		seq, ok := start()
+		if !ok {
+			s.inflight.remove(key, ss)
+			ss.fail()
+			return true
+		}
+		ss.begin(seq)
+		go s.shareSequence(key, ss, seq, req)
+	} else if !ss.wait(ctx) {
+		ss.leave()
+		return ctx.Err() != nil
+	}
+
+	w.Header().Set("X-Request-Id", ss.id)
+	if err := serveShared(ctx, stream, ss); err != nil {
+		slog.Info("shared stream ended", "id", ss.id, "error", err)
+	}
+	return true
+}
+
+// shareSequence adds the output of seq to ss, storing it in the result cache
+// as /completion does, and stops sharing once the final frame is added so that
+// later requests start afresh or are answered from the cache.
+func (s *Server) shareSequence(key string, ss *sharedStream, seq *Sequence, req *CompletionRequest) {
+	resultKey, cacheable := s.results.Key(req)
+
+	var result cachedResult
+	var streamed bool
+	for resp := range seq.responses {
+		if cacheable {
+			result.content += resp.content
+			result.tokens = append(result.tokens, resp.tokens...)
+		}
+		ss.add(&CompletionResponse{Content: resp.content, Tokens: resp.tokens, Logprobs: resp.logprobs})
+		streamed = true
+	}
+	if req.EmptyFrame && !streamed {
+		ss.add(emptyContentFrame(0, seq))
+	}
+
+	if cacheable && (seq.doneReason == StopReasonStop || seq.doneReason == StopReasonLimit || seq.doneReason == StopReasonNewline) {
+		result.doneReason = seq.doneReason
+		result.hitStopWord = seq.hitStopWord
+		result.promptText = seq.promptText
+		result.stopAlternative = seq.stopAlternative
+		result.seed = seq.seed
+		result.numPrompt = seq.numPromptInputs
+		result.numTruncatedFrom = seq.numTruncatedFrom
+		result.numPredicted = seq.numPredicted
+		s.results.Put(resultKey, result)
+	}
+
+	ss.add(finalResponse(0, req, seq))
+	s.inflight.remove(key, ss)
+}
+
+// serveShared streams the frames of ss, which the caller has joined, until the
+// final frame has been written or the client goes away, then leaves.
+func serveShared(ctx context.Context, stream *streamWriter, ss *sharedStream) error {
+	defer ss.leave()
+
+	for from := 0; ; {
+		frames, changed := ss.since(from)
+		for _, frame := range frames {
+			if err := stream.Encode(frame); err != nil {
+				return err
+			}
+			from++
+
+			if frame.Stop {
+				return stream.Flush()
+			}
+		}
+		stream.MaybeFlush()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stream.Deadline():
+			stream.Flush()
+		case <-changed:
+		}
+	}
+}
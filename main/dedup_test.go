@@ -0,0 +1,128 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeduplicateIdenticalRequests(t *testing.T) {
+	s := &Server{}
+	req := &CompletionRequest{Prompt: "hello"}
+	key, ok := dedupKey(req, nil)
+	if !ok {
+		t.Fatal("expected a temperature 0 request to be deduplicated")
+	}
+
+	// the single decode, held until both clients are following it
+	seq := newTestSequence(tokenInputs(1, 2, 3))
+	seq.id = "req-1"
+	var starts atomic.Int32
+	release := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream := newStreamWriter(w, w.(http.Flusher), 0, time.Millisecond)
+		s.serveDeduplicated(r.Context(), w, stream, key, req, func() (*Sequence, bool) {
+			starts.Add(1)
+			<-release
+			return seq, true
+		})
+	}))
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	outputs := make([]string, 2)
+	ids := make([]string, 2)
+	get := func(i int) {
+		defer wg.Done()
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		ids[i] = resp.Header.Get("X-Request-Id")
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var frame CompletionResponse
+			if err := decoder.Decode(&frame); err != nil {
+				return
+			}
+			outputs[i] += frame.Content
+		}
+	}
+
+	waitFor := func(what string, cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	wg.Add(2)
+	go get(0)
+	waitFor("the first request to start", func() bool { return starts.Load() == 1 })
+	go get(1)
+	waitFor("the second request to join", func() bool {
+		s.inflight.mu.Lock()
+		defer s.inflight.mu.Unlock()
+		ss := s.inflight.streams[key]
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		return ss.clients == 2
+	})
+
+	close(release)
+	for _, content := range []string{"a", "b", "c"} {
+		seq.responses <- response{content: content}
+	}
+	close(seq.responses)
+	wg.Wait()
+
+	if n := starts.Load(); n != 1 {
+		t.Errorf("expected a single sequence for both requests, started %d", n)
+	}
+	for i := range outputs {
+		if outputs[i] != "abc" || ids[i] != "req-1" {
+			t.Errorf("client %d: expected output %q from req-1, got %q from %q", i, "abc", outputs[i], ids[i])
+		}
+	}
+
+	// once finished, the next identical request starts afresh
+	waitFor("the finished request to stop being shared", func() bool {
+		s.inflight.mu.Lock()
+		defer s.inflight.mu.Unlock()
+		return len(s.inflight.streams) == 0
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements prompt echo stripping. Some prompt templates cause the
+// model to begin its output by repeating the end of the prompt. When enabled, the
+// start of the output is held back while it could still be such an echo, and the
+// longest leading repetition of the prompt's tail is removed before it is sent.
+
+import (
+	"strings"
+)
+
+// minPromptEcho is the shortest repetition of the prompt tail that is treated
+// as an echo, so that output which merely happens to begin with the prompt's
+// last character or word is left intact.
+const minPromptEcho = 8
+
+// promptEchoFilter strips a leading echo of the prompt tail from streamed output.
+type promptEchoFilter struct {
+	prompt string
+	head   string
+	done   bool
+}
+
+func newPromptEchoFilter(prompt string) *promptEchoFilter {
+	return &promptEchoFilter{prompt: prompt}
+}
+
+// Push accepts the next chunk of output and returns the text that can be sent.
+// Output is held while it is still a substring of the prompt, since it may yet
+// turn out to be an echo of the prompt's tail.
+func (f *promptEchoFilter) Push(content string) string {
+	if f.done {
+		return content
+	}
+
+	f.head += content
+	if strings.Contains(f.prompt, f.head) {
+		return ""
+	}
+
+	return f.Finish()
+}
+
+// Finish strips any echo from the held output and returns the remainder. It
+// must be called once the output ends to release text that is still held.
+func (f *promptEchoFilter) Finish() string {
+	if f.done {
+		return ""
+	}
+
+	f.done = true
+	return stripPromptEcho(f.prompt, f.head)
+}
+
+// stripPromptEcho removes the longest prefix of output that repeats the tail
+// of prompt, provided it is at least minPromptEcho bytes long.
+func stripPromptEcho(prompt, output string) string {
+	for n := min(len(prompt), len(output)); n >= minPromptEcho; n-- {
+		if strings.HasPrefix(output, prompt[len(prompt)-n:]) {
+			return output[n:]
+		}
+	}
+
+	return output
+}
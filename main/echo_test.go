@@ -0,0 +1,63 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPromptEchoFilter(t *testing.T) {
+	prompt := "Translate to French:\nThe cat sleeps on the mat.\nFrench:"
+
+	cases := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"echo stripped", []string{"The cat ", "sleeps on the mat.\nFrench:", " Le chat dort."}, " Le chat dort."},
+		{"partial tail echo", []string{"on the mat.", "\nFrench: Le", " chat"}, " Le chat"},
+		{"no echo", []string{"Le chat ", "dort sur le tapis."}, "Le chat dort sur le tapis."},
+		{"short overlap kept", []string{"French: oui"}, "French: oui"},
+		{"held output released at end", []string{"The cat"}, "The cat"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newPromptEchoFilter(prompt)
+
+			var out strings.Builder
+			for _, chunk := range tc.chunks {
+				out.WriteString(f.Push(chunk))
+			}
+			out.WriteString(f.Finish())
+
+			if out.String() != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, out.String())
+			}
+		})
+	}
+}
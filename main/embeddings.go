@@ -29,11 +29,17 @@ import(
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"encoding/json"
 	"log/slog"
 	"net/http"
 )
 
+// maxEmbeddingPrecision is the most decimal places an embedding can be rounded
+// to; float32 values carry no more than nine significant digits.
+const maxEmbeddingPrecision = 9
+
 // embeddings handles the /embeddings endpoint to generate vector embeddings
 // for a given input text using the LLM backend.
 //
@@ -44,15 +50,31 @@ import(
 //   - Waits for the embedding to be generated.
 //   - Responds with the embedding vector as JSON.
 //
+// When `token_embeddings` is set, the prompt cache is bypassed so that every
+// input token is decoded, and the response also carries one embedding vector
+// per input token. Models that only expose pooled embeddings reject this option.
+//
+// `precision` rounds every value to at most that many decimal places (0 to 9),
+// shrinking the response at the cost of accuracy. Without it values are sent
+// at full float32 precision.
+//
+// `expected_dim` rejects the request with 400 Bad Request unless the model's
+// embeddings have that many dimensions, so that a client indexing into a vector
+// store of a fixed dimension notices a model mismatch.
+//
 // Request example:
 // {
 //   "content": "What is the capital of France?",
-//   "cachePrompt": true
+//   "cachePrompt": true,
+//   "token_embeddings": false,
+//   "precision": 4,
+//   "expected_dim": 4096
 // }
 //
 // Response example:
 // {
-//   "embedding": [0.025, -0.132, ...]
+//   "embedding": [0.025, -0.132, ...],
+//   "cached_tokens": 0
 // }
 //
 // This endpoint is useful for tasks like semantic search, similarity matching,
@@ -64,59 +86,157 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Precision != nil && (*req.Precision < 0 || *req.Precision > maxEmbeddingPrecision) {
+		http.Error(w, fmt.Sprintf("precision must be between 0 and %d", maxEmbeddingPrecision), http.StatusBadRequest)
+		return
+	}
+
+	// The model's dimension and pooling are only known once it has loaded
+	if err := s.waitReady(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Pooled embeddings don't keep the embedding of each token, so fail
+	// before decoding rather than after
+	if req.TokenEmbeddings && !s.tokenEmbeddings {
+		http.Error(w, "model does not support token-level embeddings", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkEmbeddingDim(req.ExpectedDim, s.model.NEmbd()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	slog.Debug("embedding request", "content", req.Content)
 
+	seq, embedding, ok := s.embed(w, r, req.Content, req.CachePrompt, req.TokenEmbeddings)
+	if !ok {
+		return
+	}
+
+	var tokenEmbeddings []Embedding
+	if req.TokenEmbeddings {
+		var err error
+		if tokenEmbeddings, err = tokenEmbeddingRows(seq, req.Precision); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Encode and return the response
+	if err := json.NewEncoder(w).Encode(&EmbeddingResponse{
+		Embedding:       Embedding{Values: embedding, Precision: req.Precision},
+		TokenEmbeddings: tokenEmbeddings,
+		CachedTokens:    seq.numCached,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// embed decodes content as an embedding-only sequence and waits for its
+// embedding. Token embeddings require decoding the whole prompt, so the cached
+// prefix is only used without them. If the embedding cannot be produced, an
+// error has been written to w and ok is false.
+func (s *Server) embed(w http.ResponseWriter, r *http.Request, content string, cachePrompt bool, tokenEmbeddings bool) (seq *Sequence, embedding []float32, ok bool) {
 	// Initialize an embedding-only sequence
-	seq, err := s.NewSequence(req.Content, nil, NewSequenceParams{
-		embedding: true,
+	seq, err := s.NewSequence(content, nil, NewSequenceParams{
+		embedding:       true,
+		tokenEmbeddings: tokenEmbeddings,
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
-		return
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), sequenceErrorStatus(err))
+		return nil, nil, false
 	}
 
 	// Acquire available sequence slot
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	if err := s.acquireEmbeddingSlot(w, r.Context()); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting embeddings request due to client closing the connection")
 		} else {
 			slog.Error("Failed to acquire semaphore", "error", err)
 		}
-		return
+		return nil, nil, false
 	}
 
 	// Assign sequence to the first free slot
-	s.mu.Lock()
-	found := false
-	for i, sq := range s.seqs {
-		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, req.CachePrompt)
-			if err != nil {
-				s.mu.Unlock()
-				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
-				return
-			}
-			s.seqs[i] = seq
-			s.cond.Signal()
-			found = true
-			break
-		}
+	if err := s.assignSequence(seq, cachePrompt && !tokenEmbeddings); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
 	}
-	s.mu.Unlock()
 
-	if !found {
-		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
-		return
+	// Wait for the embedding to be returned on the channel
+	return seq, <-seq.embedding, true
+}
+
+// tokenEmbeddingRows returns the embedding of each prompt token of seq, one
+// row per token, rounded to precision.
+func tokenEmbeddingRows(seq *Sequence, precision *int) ([]Embedding, error) {
+	if len(seq.tokenEmbeds) != seq.numPromptInputs {
+		return nil, fmt.Errorf("expected %d token embeddings, got %d", seq.numPromptInputs, len(seq.tokenEmbeds))
 	}
 
-	// Wait for the embedding to be returned on the channel
-	embedding := <-seq.embedding
+	rows := make([]Embedding, len(seq.tokenEmbeds))
+	for i, values := range seq.tokenEmbeds {
+		rows[i] = Embedding{Values: values, Precision: precision}
+	}
+	return rows, nil
+}
 
-	// Encode and return the response
-	if err := json.NewEncoder(w).Encode(&EmbeddingResponse{
-		Embedding: embedding,
-	}); err != nil {
-		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+// checkEmbeddingDim validates a request's expected_dim against the model's
+// embedding dimension. An expected dimension of 0 accepts any model.
+func checkEmbeddingDim(expected int, actual int) error {
+	if expected < 0 {
+		return fmt.Errorf("expected_dim must not be negative, got %d", expected)
+	}
+	if expected != 0 && expected != actual {
+		return fmt.Errorf("expected_dim %d does not match the model's embedding dimension %d", expected, actual)
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes the embedding as a JSON array, rounding each value to
+// *e.Precision decimal places with trailing zeros dropped.
+func (e Embedding) MarshalJSON() ([]byte, error) {
+	if e.Precision == nil || e.Values == nil {
+		return json.Marshal(e.Values)
+	}
+
+	precision := *e.Precision
+	b := make([]byte, 0, len(e.Values)*(precision+4)+2)
+	b = append(b, '[')
+	for i, v := range e.Values {
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return nil, fmt.Errorf("unsupported embedding value %v", v)
+		}
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendRounded(b, v, precision)
 	}
+
+	return append(b, ']'), nil
+}
+
+// appendRounded appends v rounded to precision decimal places, without
+// trailing zeros or a negative sign on zero.
+func appendRounded(b []byte, v float32, precision int) []byte {
+	start := len(b)
+	b = strconv.AppendFloat(b, float64(v), 'f', precision, 32)
+	if precision > 0 {
+		for b[len(b)-1] == '0' {
+			b = b[:len(b)-1]
+		}
+		if b[len(b)-1] == '.' {
+			b = b[:len(b)-1]
+		}
+	}
+	if string(b[start:]) == "-0" {
+		b = append(b[:start], '0')
+	}
+
+	return b
 }
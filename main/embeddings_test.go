@@ -0,0 +1,228 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestEmbeddingPrecision(t *testing.T) {
+	values := []float32{0.0123456789, -0.98765432, 1, -0.00001, 3.14159265, 0, 1e-9, -12.5}
+
+	for _, precision := range []int{0, 2, 4, 6} {
+		b, err := json.Marshal(Embedding{Values: values, Precision: &precision})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields := strings.Split(strings.Trim(string(b), "[]"), ",")
+		if len(fields) != len(values) {
+			t.Fatalf("precision %d: expected %d values, got %s", precision, len(values), b)
+		}
+		for _, field := range fields {
+			if _, decimals, ok := strings.Cut(field, "."); ok && len(decimals) > precision {
+				t.Errorf("precision %d: %s has more than %d decimal places", precision, field, precision)
+			}
+			if field == "-0" {
+				t.Errorf("precision %d: expected zero without a sign, got %s", precision, field)
+			}
+		}
+
+		var decoded []float64
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatalf("precision %d: invalid JSON %s: %v", precision, b, err)
+		}
+		tolerance := 0.5*math.Pow10(-precision) + 1e-6
+		for i, v := range decoded {
+			if math.Abs(v-float64(values[i])) > tolerance {
+				t.Errorf("precision %d: %v decoded as %v, outside %v", precision, values[i], v, tolerance)
+			}
+		}
+	}
+
+	// without a precision the encoding matches []float32
+	full, err := json.Marshal(Embedding{Values: values})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(values)
+	if string(full) != string(want) {
+		t.Errorf("expected %s at full precision, got %s", want, full)
+	}
+}
+
+func TestCheckEmbeddingDim(t *testing.T) {
+	if err := checkEmbeddingDim(0, 4096); err != nil {
+		t.Errorf("expected no dimension check without expected_dim, got %v", err)
+	}
+	if err := checkEmbeddingDim(4096, 4096); err != nil {
+		t.Errorf("expected a matching dimension to pass, got %v", err)
+	}
+
+	err := checkEmbeddingDim(768, 4096)
+	if err == nil {
+		t.Fatal("expected a mismatched dimension to fail")
+	}
+	if want := "expected_dim 768 does not match the model's embedding dimension 4096"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+
+	if err := checkEmbeddingDim(-1, 4096); err == nil {
+		t.Error("expected a negative expected_dim to fail")
+	}
+}
+
+func TestTokenEmbeddingsRequirePerTokenModel(t *testing.T) {
+	// rejected before any decoding, so the server needs no model
+	s := &Server{}
+	w := httptest.NewRecorder()
+
+	// while loading, support isn't known yet, so the request waits
+	s.ready.Add(1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.embeddings(w, httptest.NewRequest(http.MethodPost, "/embeddings", strings.NewReader(`{"content": "hi", "token_embeddings": true}`)))
+	}()
+	select {
+	case <-done:
+		t.Fatalf("expected the request to wait for the model, got %d: %s", w.Code, w.Body.String())
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.ready.Done()
+	<-done
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "token-level embeddings") {
+		t.Errorf("expected 400 for a pooling model once loaded, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTokenEmbeddingRows(t *testing.T) {
+	const rows, dim = 3, 4
+	seq := &Sequence{numPromptInputs: rows}
+	for i := range rows {
+		row := make([]float32, dim)
+		for j := range row {
+			row[j] = float32(i*dim + j)
+		}
+		seq.tokenEmbeds = append(seq.tokenEmbeds, row)
+	}
+
+	embeddings, err := tokenEmbeddingRows(seq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(&EmbeddingResponse{TokenEmbeddings: embeddings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		TokenEmbeddings [][]float32 `json:"token_embeddings"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// one row per prompt token, each of the embedding dimension
+	if len(resp.TokenEmbeddings) != rows {
+		t.Fatalf("expected %d rows, got %d", rows, len(resp.TokenEmbeddings))
+	}
+	for i, row := range resp.TokenEmbeddings {
+		if len(row) != dim || row[0] != float32(i*dim) {
+			t.Errorf("row %d: expected %d values starting at %d, got %v", i, dim, i*dim, row)
+		}
+	}
+
+	seq.tokenEmbeds = seq.tokenEmbeds[:rows-1]
+	if _, err := tokenEmbeddingRows(seq, nil); err == nil {
+		t.Error("expected an error when a token has no embedding")
+	}
+}
+
+func TestEmbeddingReportsCachedTokens(t *testing.T) {
+	cache, err := NewInputCache(nil, 64, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		seqs:    make([]*Sequence, 1),
+		seqsSem: semaphore.NewWeighted(1),
+		cache:   cache,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	// embed the same content as /embedding does, standing in for the decode
+	// loop, and return what the response reports as cached_tokens
+	embed := func() int {
+		seq := newTestSequence(tokenInputs(1, 2, 3, 4))
+		seq.embeddingOnly = true
+		if err := s.acquireEmbeddingSlot(httptest.NewRecorder(), context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.assignSequence(seq, true); err != nil {
+			t.Fatal(err)
+		}
+
+		s.mu.Lock()
+		seq.cache.Inputs = append(seq.cache.Inputs, seq.inputs...)
+		seq.inputs = nil
+		seq.embedding <- []float32{1}
+		removeSequence(s, 0, StopReasonNone)
+		s.mu.Unlock()
+
+		return seq.numCached
+	}
+
+	if cached := embed(); cached != 0 {
+		t.Errorf("expected nothing cached the first time, got %d", cached)
+	}
+
+	// everything but the last token, which is decoded again for the embedding
+	if cached := embed(); cached != 3 {
+		t.Errorf("expected 3 reused tokens the second time, got %d", cached)
+	}
+}
+
+func TestEmbeddingsWithoutModel(t *testing.T) {
+	// the model failed to load, so s.model stays nil
+	s := &Server{loadErr: errors.New("no such file")}
+
+	w := httptest.NewRecorder()
+	s.embeddings(w, httptest.NewRequest(http.MethodPost, "/embeddings", strings.NewReader(`{"content": "hi", "expected_dim": 4096}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without a model, got %d: %s", w.Code, w.Body.String())
+	}
+}
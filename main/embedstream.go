@@ -0,0 +1,157 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements incremental embeddings for live input such as a
+// transcription in progress. A client sends the text as it arrives to
+// /embedding/stream; each update returns the embedding of everything received
+// so far. The accumulated text is decoded with the prompt cache enabled, so
+// only the tokens added since the previous update need to be decoded.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// embeddingStreamTTL is how long an embedding stream may go without an update
+// before its text is discarded.
+const embeddingStreamTTL = 10 * time.Minute
+
+var errUnknownEmbeddingStream = errors.New("unknown or expired stream_id")
+
+// embeddingStream is the text received so far on one /embedding/stream.
+type embeddingStream struct {
+	mu      sync.Mutex // held for the whole of an update, so updates apply in order
+	id      string
+	content string
+	expiry  *time.Timer
+}
+
+// streamEmbedding handles the `/embedding/stream` endpoint. The first
+// request omits `stream_id` and starts a stream; later requests pass the
+// returned ID and the text added since. The response carries the embedding of
+// the whole text and the number of its tokens reused from the KV cache.
+//
+// Request example:
+// {
+//   "stream_id": "5be0c2d9a1f34e77",
+//   "content": " and then the speaker said"
+// }
+//
+// Response example:
+// {
+//   "stream_id": "5be0c2d9a1f34e77",
+//   "embedding": [0.025, -0.132, ...],
+//   "cached_tokens": 41,
+//   "tokens": 46
+// }
+//
+// A stream that receives no update for 10 minutes is discarded; updating it
+// afterwards returns 404.
+func (s *Server) streamEmbedding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req EmbeddingStreamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	stream, err := s.openEmbeddingStream(req.StreamID)
+	if errors.Is(err, errUnknownEmbeddingStream) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("failed to start embedding stream: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// The stream only advances once the embedding of the new text succeeds
+	content := stream.content + req.Content
+	seq, embedding, ok := s.embed(w, r, content, true, false)
+	if !ok {
+		return
+	}
+	stream.content = content
+	stream.expiry.Reset(embeddingStreamTTL)
+
+	if err := json.NewEncoder(w).Encode(&EmbeddingStreamResponse{
+		StreamID:     stream.id,
+		Embedding:    embedding,
+		CachedTokens: seq.numCached,
+		Tokens:       seq.numPromptInputs,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// openEmbeddingStream returns the stream with the given ID, or starts a new
+// one if id is empty.
+func (s *Server) openEmbeddingStream(id string) (*embeddingStream, error) {
+	s.embeddingStreamsMu.Lock()
+	defer s.embeddingStreamsMu.Unlock()
+
+	if id != "" {
+		stream, ok := s.embeddingStreams[id]
+		if !ok {
+			return nil, errUnknownEmbeddingStream
+		}
+		return stream, nil
+	}
+
+	id, err := newRequestID()
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &embeddingStream{id: id}
+	stream.expiry = time.AfterFunc(embeddingStreamTTL, func() {
+		slog.Info("discarding idle embedding stream", "stream_id", id)
+		s.embeddingStreamsMu.Lock()
+		delete(s.embeddingStreams, id)
+		s.embeddingStreamsMu.Unlock()
+	})
+
+	if s.embeddingStreams == nil {
+		s.embeddingStreams = make(map[string]*embeddingStream)
+	}
+	s.embeddingStreams[id] = stream
+
+	return stream, nil
+}
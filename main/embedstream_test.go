@@ -0,0 +1,74 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEmbeddingStreamReusesCachedPrefix(t *testing.T) {
+	cache, err := NewInputCache(nil, 64, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{cache: cache}
+	tokenizer := &wordTokenizer{vocab: make(map[string]int)}
+
+	stream, err := s.openEmbeddingStream("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened, err := s.openEmbeddingStream(stream.id); err != nil || reopened != stream {
+		t.Fatalf("expected the stream to be found by its ID, got %v", err)
+	}
+	if _, err := s.openEmbeddingStream("missing"); !errors.Is(err, errUnknownEmbeddingStream) {
+		t.Errorf("expected an unknown stream ID to be rejected, got %v", err)
+	}
+
+	// each update decodes the whole text so far with the prompt cache, as
+	// streamEmbedding does through embed
+	var cached []int
+	for _, text := range []string{"The speaker said", " that the meeting"} {
+		stream.content += text
+		tokens, _ := tokenizer.Tokenize(stream.content, true)
+		prompt := tokenInputs(tokens...)
+
+		slot, remaining, err := cache.LoadCacheSlot(prompt, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached = append(cached, len(prompt)-len(remaining))
+
+		slot.Inputs = append(slot.Inputs, remaining...)
+		slot.InUse = false
+	}
+
+	// BOS and three words are reused by the second update
+	if cached[0] != 0 || cached[1] != 4 {
+		t.Errorf("expected the second update to reuse the first update's 4 tokens, got cached counts %v", cached)
+	}
+}
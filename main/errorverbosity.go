@@ -0,0 +1,132 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements the --error-verbosity middleware. Handlers report
+// failures with http.Error or openAIError, often including the underlying error
+// text, which in production can leak paths and other internals. In safe mode
+// the body of every 5xx response is replaced with the generic status text and
+// the original message is logged instead.
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"log/slog"
+	"net/http"
+)
+
+// ErrorVerbosity is how much detail server error responses carry.
+type ErrorVerbosity string
+
+const (
+	// ErrorVerbosityFull returns error messages to clients as the handler
+	// wrote them, for development
+	ErrorVerbosityFull ErrorVerbosity = "full"
+
+	// ErrorVerbositySafe returns a generic message for server errors and logs
+	// the detailed one, for production
+	ErrorVerbositySafe ErrorVerbosity = "safe"
+)
+
+func (v *ErrorVerbosity) String() string {
+	return string(*v)
+}
+
+func (v *ErrorVerbosity) Set(value string) error {
+	switch ErrorVerbosity(value) {
+	case ErrorVerbosityFull, ErrorVerbositySafe:
+		*v = ErrorVerbosity(value)
+		return nil
+	}
+
+	return fmt.Errorf("unknown error verbosity %q", value)
+}
+
+// safeErrorWriter wraps an http.ResponseWriter and holds back 5xx responses,
+// collecting their body so it can be logged and replaced once the handler
+// returns. Other responses pass straight through, including Flush.
+type safeErrorWriter struct {
+	http.ResponseWriter
+	status int          // held back 5xx status, 0 if the response passed through
+	detail bytes.Buffer // body written with the held back status
+}
+
+func (w *safeErrorWriter) WriteHeader(status int) {
+	if status >= http.StatusInternalServerError && w.status == 0 {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *safeErrorWriter) Write(p []byte) (int, error) {
+	if w.status != 0 {
+		return w.detail.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *safeErrorWriter) Flush() {
+	if w.status != 0 {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// safeErrors wraps a handler so that in ErrorVerbositySafe mode clients only
+// see the generic status text of server errors, in the same JSON or plain text
+// form the handler used. The detailed message is logged with the request.
+func safeErrors(verbosity ErrorVerbosity, next http.Handler) http.Handler {
+	if verbosity != ErrorVerbositySafe {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &safeErrorWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r)
+
+		if sw.status == 0 {
+			return
+		}
+
+		slog.Error("request failed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"error", strings.TrimSpace(sw.detail.String()))
+
+		message := http.StatusText(sw.status)
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			openAIError(w, sw.status, message)
+		} else {
+			http.Error(w, message, sw.status)
+		}
+	})
+}
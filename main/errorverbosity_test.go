@@ -0,0 +1,103 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSafeErrorsHideDetails(t *testing.T) {
+	lines := captureLogs(t)
+
+	handler := safeErrors(ErrorVerbositySafe, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "failed to load cache: open /var/lib/llm/slot0: permission denied", http.StatusInternalServerError)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/completion", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, "/var/lib/llm") || !strings.Contains(body, "Internal Server Error") {
+		t.Errorf("expected a generic message, got %q", body)
+	}
+
+	var record struct {
+		Msg   string `json:"msg"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(<-lines, &record); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(record.Error, "open /var/lib/llm/slot0: permission denied") {
+		t.Errorf("expected the log to contain the internal error, got %+v", record)
+	}
+}
+
+func TestSafeErrorsPassThrough(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			http.Error(w, "bad request: missing prompt", http.StatusBadRequest)
+			return
+		}
+		openAIError(w, http.StatusServiceUnavailable, "failed to decode batch: internal detail")
+	})
+
+	// client errors keep their message in safe mode
+	w := httptest.NewRecorder()
+	safeErrors(ErrorVerbositySafe, handler).ServeHTTP(w, httptest.NewRequest("POST", "/bad", nil))
+	if !strings.Contains(w.Body.String(), "missing prompt") {
+		t.Errorf("expected client error message to pass through, got %q", w.Body.String())
+	}
+
+	// JSON server errors stay JSON with a generic message
+	captureLogs(t)
+	w = httptest.NewRecorder()
+	safeErrors(ErrorVerbositySafe, handler).ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", nil))
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Message != "Service Unavailable" {
+		t.Errorf("expected generic JSON error, got %q", body.Error.Message)
+	}
+
+	// full mode leaves the response untouched
+	w = httptest.NewRecorder()
+	safeErrors(ErrorVerbosityFull, handler).ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", nil))
+	if !strings.Contains(w.Body.String(), "internal detail") {
+		t.Errorf("expected full error in full mode, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements output post-processing filters, selected per request by
+// name with the "filters" option. Filters that give the same result on any split
+// of the output are applied to each streamed chunk; the rest need the whole
+// output, so when one is requested the output is held back and sent as a single
+// filtered frame once generation ends.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// outputFilter transforms generated text.
+type outputFilter struct {
+	apply func(string) string
+
+	// streamSafe means apply can run on each chunk independently
+	streamSafe bool
+}
+
+var (
+	whitespaceRun  = regexp.MustCompile(`[ \t]+`)
+	blankLines     = regexp.MustCompile(`\n{3,}`)
+	markdownHeader = regexp.MustCompile(`(?m)^#{1,6}[ \t]+`)
+	markdownList   = regexp.MustCompile(`(?m)^[ \t]*[-*+][ \t]+`)
+	markdownFence  = regexp.MustCompile("(?m)^```[^\\n]*\\n?")
+	markdownInline = regexp.MustCompile("\\*\\*|__|`")
+	markdownLink   = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	emailAddress   = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	phoneNumber    = regexp.MustCompile(`\+?\d[\d \-().]{7,}\d`)
+)
+
+// outputFilters is the registry of filters a request can name.
+var outputFilters = map[string]outputFilter{
+	// collapse_whitespace replaces runs of spaces and tabs with one space,
+	// limits blank lines to one and trims the output
+	"collapse_whitespace": {apply: func(s string) string {
+		s = whitespaceRun.ReplaceAllString(s, " ")
+		s = blankLines.ReplaceAllString(s, "\n\n")
+		return strings.TrimSpace(s)
+	}},
+
+	// strip_markdown removes headers, list markers, code fences, emphasis and
+	// link targets, leaving the text
+	"strip_markdown": {apply: func(s string) string {
+		s = markdownFence.ReplaceAllString(s, "")
+		s = markdownHeader.ReplaceAllString(s, "")
+		s = markdownList.ReplaceAllString(s, "")
+		s = markdownLink.ReplaceAllString(s, "$1")
+		return markdownInline.ReplaceAllString(s, "")
+	}},
+
+	"redact_emails": {apply: func(s string) string {
+		return emailAddress.ReplaceAllString(s, "[REDACTED]")
+	}},
+
+	"redact_phone_numbers": {apply: func(s string) string {
+		return phoneNumber.ReplaceAllString(s, "[REDACTED]")
+	}},
+
+	// strip_control removes control characters other than newlines and tabs
+	"strip_control": {streamSafe: true, apply: func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' && r != '\t' {
+				return -1
+			}
+			return r
+		}, s)
+	}},
+}
+
+// filterPipeline applies a request's filters, in order, to streamed output.
+type filterPipeline struct {
+	filters []outputFilter
+	buffer  bool
+	held    strings.Builder
+}
+
+// newFilterPipeline looks up the named filters. It returns nil if there are none.
+func newFilterPipeline(names []string) (*filterPipeline, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	p := &filterPipeline{}
+	for _, name := range names {
+		f, ok := outputFilters[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown output filter %q", name)
+		}
+		p.filters = append(p.filters, f)
+		p.buffer = p.buffer || !f.streamSafe
+	}
+
+	return p, nil
+}
+
+// Push accepts the next chunk of output and returns the text that can be sent,
+// which is empty while output is held for a filter that needs all of it.
+func (p *filterPipeline) Push(content string) string {
+	if p.buffer {
+		p.held.WriteString(content)
+		return ""
+	}
+
+	return p.apply(content)
+}
+
+// Finish returns the filtered held output, if any. It must be called once
+// the output ends.
+func (p *filterPipeline) Finish() string {
+	if !p.buffer {
+		return ""
+	}
+
+	content := p.held.String()
+	p.held.Reset()
+	return p.apply(content)
+}
+
+// releaseLogprobs returns the logprobs of output a filter held back followed
+// by logprobs, for the next frame sent, and clears held.
+func releaseLogprobs(held *[]TokenLogprob, logprobs []TokenLogprob) []TokenLogprob {
+	if len(*held) == 0 {
+		return logprobs
+	}
+
+	logprobs = append(*held, logprobs...)
+	*held = nil
+	return logprobs
+}
+
+func (p *filterPipeline) apply(content string) string {
+	for _, f := range p.filters {
+		content = f.apply(content)
+	}
+	return content
+}
@@ -0,0 +1,102 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterPipeline(t *testing.T) {
+	cases := []struct {
+		name    string
+		filters []string
+		chunks  []string
+		want    string
+
+		// streamed is the output sent before Finish
+		streamed string
+	}{
+		{"collapse whitespace", []string{"collapse_whitespace"}, []string{"  Hello ", "   world.\n\n\n\n", "Bye\t\t!  "}, "Hello world.\n\nBye !", ""},
+		{"strip markdown", []string{"strip_markdown"}, []string{"## Title\n", "- **bold** and [link](http://x)"}, "Title\nbold and link", ""},
+		{"redact", []string{"redact_emails"}, []string{"mail jane.doe@", "example.com now"}, "mail [REDACTED] now", ""},
+		{"stream safe", []string{"strip_control"}, []string{"a\x00b", "\x07c\n"}, "abc\n", "abc\n"},
+		{"in order", []string{"strip_markdown", "collapse_whitespace"}, []string{"**a**   b "}, "a b", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := newFilterPipeline(tc.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out strings.Builder
+			for _, chunk := range tc.chunks {
+				out.WriteString(p.Push(chunk))
+			}
+			if out.String() != tc.streamed {
+				t.Errorf("expected %q streamed, got %q", tc.streamed, out.String())
+			}
+			out.WriteString(p.Finish())
+
+			if out.String() != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, out.String())
+			}
+		})
+	}
+
+	if p, err := newFilterPipeline(nil); p != nil || err != nil {
+		t.Errorf("expected no pipeline without filters, got %v, %v", p, err)
+	}
+	if _, err := newFilterPipeline([]string{"nope"}); err == nil {
+		t.Error("expected an error for an unknown filter")
+	}
+}
+
+func TestReleaseLogprobs(t *testing.T) {
+	var held []TokenLogprob
+	if got := releaseLogprobs(&held, []TokenLogprob{{Token: "a"}}); len(got) != 1 || got[0].Token != "a" {
+		t.Errorf("expected the frame's own logprobs with nothing held, got %+v", got)
+	}
+
+	// output the filter held back keeps its logprobs for the next frame
+	held = append(held, TokenLogprob{Token: "b"}, TokenLogprob{Token: "c"})
+	got := releaseLogprobs(&held, []TokenLogprob{{Token: "d"}})
+	var tokens []string
+	for _, lp := range got {
+		tokens = append(tokens, lp.Token)
+	}
+	if strings.Join(tokens, "") != "bcd" {
+		t.Errorf("expected held logprobs before the frame's own, got %v", tokens)
+	}
+	if held != nil {
+		t.Errorf("expected held logprobs to be cleared, got %+v", held)
+	}
+	if got := releaseLogprobs(&held, nil); got != nil {
+		t.Errorf("expected no logprobs once released, got %+v", got)
+	}
+}
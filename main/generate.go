@@ -31,25 +31,19 @@ import(
 	"fmt"
 	"strings"
 	"time"
+	"unicode"
 	"encoding/json"
 	"log/slog"
 	"net/http"
 	"llm-server/llama"
 )
 
-// prompt format to passed to the llm
-const promptFormat = "<|start_header_id|>system<|end_header_id|>\n\n" + 
-    "Cutting Knowledge Date: December 2023\n\n" + 
-    "<|eot_id|><|start_header_id|>user<|end_header_id|>\n\n" + 
-    "%s" + 
-    "<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n"
-
 // generate handles the `/generate` endpoint to produce a full LLM response
 // for a given user prompt using hardcoded sampling parameters.
 //
 // Workflow:
 //   - Accepts a JSON request with a role and prompt string.
-//   - Applies a standardized prompt format that includes role tags and system instructions.
+//   - Applies the --prompt-template chat format, with an optional "system" message.
 //   - Creates a new sequence with the prompt and predefined decoding parameters.
 //   - Acquires a slot for inference and streams the full response into memory.
 //   - Sends a structured JSON response that includes metadata and timing information.
@@ -60,6 +54,20 @@ const promptFormat = "<|start_header_id|>system<|end_header_id|>\n\n" +
 //   "prompt": "Tell me about quantum physics"
 // }
 //
+// "system" replaces the prompt format's default system message for this request.
+//
+// "seed" fixes the sampling seed so a response can be reproduced; without it,
+// or with -1, every request draws a fresh random seed. The seed used is
+// returned in the final response.
+//
+// Instead of "prompt", a request may name a --templates file with "template"
+// and supply its variables in "vars", e.g. {"template": "summarize", "vars": {"text": "..."}}.
+//
+// When "stream" is true, the response is chunked: each generated piece is sent
+// as a {"delta": "..."} frame, followed by the complete response object below.
+// The final content is the exact concatenation of the deltas; in both modes it
+// has leading and trailing whitespace trimmed.
+//
 // Response format:
 // {
 //   "message": {
@@ -72,15 +80,22 @@ const promptFormat = "<|start_header_id|>system<|end_header_id|>\n\n" +
 //   "done": true,
 //   "total_duration": 123456789,
 //   "load_duration": 4567890,
-//   "prompt_eval_count": -1,
+//   "prompt_eval_count": 14,
 //   "prompt_eval_duration": 4567890,
 //   "eval_count": 52,
 //   "eval_duration": 118888899
 // }
 func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
+    InferenceStats.Requests.Add(1)
+
     var req struct {
-        Role   string `json:"role"`
-        Prompt string `json:"prompt"`
+        Role     string         `json:"role"`
+        Prompt   string         `json:"prompt"`
+        Stream   bool           `json:"stream"`
+        System   string         `json:"system"`
+        Template string         `json:"template"`
+        Vars     map[string]any `json:"vars"`
+        Seed     *int           `json:"seed"`
     }
 
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -88,8 +103,25 @@ func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    prompt, err := s.templates.renderPrompt(req.Prompt, req.Template, req.Vars)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
     w.Header().Set("Content-Type", "application/json")
 
+    var flusher http.Flusher
+    if req.Stream {
+        var ok bool
+        flusher, ok = w.(http.Flusher)
+        if !ok {
+            http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Transfer-Encoding", "chunked")
+    }
+
     // Predefined sampling parameters for generation
     samplingParams := llama.SamplingParams{
         TopK:           40,
@@ -105,25 +137,31 @@ func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
         MirostatTau:    5,
         MirostatEta:    0.1,
         PenalizeNl:     true,
-        Seed:           0,
         Grammar:        "false",
     }
 
     // Format the prompt using system/user/assistant markers
-    seq, err := s.NewSequence(fmt.Sprintf(promptFormat, req.Prompt), nil, NewSequenceParams{
+    formatted, err := s.promptFormat.Format(req.System, prompt)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Failed to format prompt: %v", err), http.StatusBadRequest)
+        return
+    }
+
+    seq, err := s.NewSequence(formatted, nil, NewSequenceParams{
         numPredict:     -1,
-        stop:           nil,
+        stop:           s.promptFormat.Stop(),
         numKeep:        4,
         samplingParams: &samplingParams,
+        seed:           requestSeed(req.Seed),
         embedding:      false,
     })
     if err != nil {
-        http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+        http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), sequenceErrorStatus(err))
         return
     }
 
     // Acquire inference slot
-    if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+    if err := s.acquireSequenceSlot(w, r.Context()); err != nil {
         if errors.Is(err, context.Canceled) {
             slog.Info("Aborting completion request due to client closing the connection")
         } else {
@@ -133,76 +171,68 @@ func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
     }
 
     // Assign sequence into the pool
-    s.mu.Lock()
-    found := false
-    for i, sq := range s.seqs {
-        if sq == nil {
-            seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, true)
-            if err != nil {
-                s.mu.Unlock()
-                http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
-                return
-            }
-            seq.crossAttention = s.image.NeedCrossAttention(seq.cache.Inputs...)
-            s.seqs[i] = seq
-            s.cond.Signal()
-            found = true
-            break
-        }
-    }
-    s.mu.Unlock()
-
-    if !found {
-        http.Error(w, "Could not find an available sequence", http.StatusInternalServerError)
+    if err := s.assignSequence(seq, true); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
-    // Collect all output content before responding
+    // Collect all output content before responding, streaming deltas if requested
     var contentBuilder strings.Builder
+    var deltas trimmedDeltas
+    var stream *streamWriter
+    if req.Stream {
+        stream = newStreamWriter(w, flusher, s.flushBytes, s.flushLatency)
+    }
 
     for {
         select {
         case <-r.Context().Done():
             close(seq.quit)
             return
-        case content, ok := <-seq.responses:
+        case <-stream.Deadline():
+            stream.Flush()
+        case resp, ok := <-seq.responses:
             if ok {
-                contentBuilder.WriteString(content)
-            } else {
-                finalContent := strings.TrimSpace(contentBuilder.String())
-
-                type Response struct {
-                    Message struct {
-                        Role    string `json:"role"`
-                        Content string `json:"content"`
-                    } `json:"message"`
-                    Model              string `json:"model"`
-                    CreatedAt          string `json:"created_at"`
-                    DoneReason         string `json:"done_reason"`
-                    Done               bool   `json:"done"`
-                    TotalDuration      int64  `json:"total_duration"`
-                    LoadDuration       int64  `json:"load_duration"`
-                    PromptEvalCount    int    `json:"prompt_eval_count"`
-                    PromptEvalDuration int64  `json:"prompt_eval_duration"`
-                    EvalCount          int    `json:"eval_count"`
-                    EvalDuration       int64  `json:"eval_duration"`
+                delta := deltas.next(resp.content)
+                if delta == "" {
+                    continue
                 }
+                contentBuilder.WriteString(delta)
+                if stream != nil {
+                    if err := json.NewEncoder(stream).Encode(&GenerateDelta{Delta: delta}); err != nil {
+                        http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+                        close(seq.quit)
+                        return
+                    }
+                    stream.MaybeFlush()
+                }
+            } else {
+                finalContent := contentBuilder.String()
 
-                response := Response{
+                response := GenerateResponse{
                     Model:              "llama3.2:3b",
                     CreatedAt:          time.Now().UTC().Format(time.RFC3339),
-                    DoneReason:         "stop",
+                    DoneReason:         seq.doneReason.String(),
                     Done:               true,
                     TotalDuration:      time.Since(seq.startProcessingTime).Nanoseconds(),
                     LoadDuration:       seq.startGenerationTime.Sub(seq.startProcessingTime).Nanoseconds(),
-                    PromptEvalCount:    -1,
-                    PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime).Nanoseconds(),
-                    EvalCount:          seq.numDecoded,
-                    EvalDuration:       time.Since(seq.startGenerationTime).Nanoseconds(),
+                    PromptEvalCount:    seq.numPromptInputs,
+                    PromptEvalDuration: promptDuration(seq).Nanoseconds(),
+                    EvalCount:          seq.numPredicted,
+                    EvalDuration:       generationDuration(seq).Nanoseconds(),
+                    Seed:               seq.seed,
                 }
                 response.Message.Role = "assistant"
                 response.Message.Content = finalContent
 
+                if stream != nil {
+                    defer stream.Flush()
+                    if err := json.NewEncoder(stream).Encode(response); err != nil {
+                        http.Error(w, fmt.Sprintf("Failed to encode final response: %v", err), http.StatusInternalServerError)
+                    }
+                    return
+                }
+
                 if err := json.NewEncoder(w).Encode(response); err != nil {
                     http.Error(w, fmt.Sprintf("Failed to encode final response: %v", err), http.StatusInternalServerError)
                 }
@@ -211,3 +241,28 @@ func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
         }
     }
 }
+
+// trimmedDeltas splits generated text into deltas whose concatenation is the
+// whole text with strings.TrimSpace applied. Whitespace at the end of a piece
+// is held back until text follows it, so none is sent at the end.
+type trimmedDeltas struct {
+    started bool
+    held    string
+}
+
+// next returns the delta to send for the next generated piece, which may be
+// empty.
+func (t *trimmedDeltas) next(content string) string {
+    if !t.started {
+        content = strings.TrimLeftFunc(content, unicode.IsSpace)
+        if content == "" {
+            return ""
+        }
+        t.started = true
+    }
+
+    content = t.held + content
+    trimmed := strings.TrimRightFunc(content, unicode.IsSpace)
+    t.held = content[len(trimmed):]
+    return trimmed
+}
@@ -29,7 +29,6 @@ import(
 	"context"
 	"errors"
 	"fmt"
-    "log"
 	"strings"
 	"time"
 	"encoding/json"
@@ -45,7 +44,8 @@ import(
 //   1. Accepts a JSON request with:
 //      - `EncryptedPrompt`: base64 AES-encrypted user prompt
 //      - `encryptedSymmetricKey`: RSA-encrypted AES key
-//   2. Decrypts the symmetric key using the server's private RSA key
+//   2. Decrypts the symmetric key using the server's private RSA key (OAEP with
+//      SHA-256, or PKCS #1 v1.5 when --rsa-pkcs1-fallback is set)
 //   3. Decrypts the user prompt using the symmetric AES key
 //   4. Applies a formatted system/user/assistant prompt structure
 //   5. Uses hardcoded decoding parameters to create a new inference sequence
@@ -56,9 +56,13 @@ import(
 // {
 //   "role": "user",
 //   "EncryptedPrompt": "<base64-AES-encrypted string>",
-//   "encryptedSymmetricKey": "<base64-RSA-encrypted key>"
+//   "encryptedSymmetricKey": "<base64-RSA-encrypted key>",
+//   "mode": "gcm"
 // }
 //
+// `mode` is the AES mode the prompt was encrypted with, "gcm" (preferred) or
+// "cbc" (the default).
+//
 // Response format:
 // {
 //   "message": {
@@ -71,7 +75,7 @@ import(
 //   "done": true,
 //   "total_duration": 123456789,
 //   "load_duration": 4567890,
-//   "prompt_eval_count": -1,
+//   "prompt_eval_count": 14,
 //   "prompt_eval_duration": 4567890,
 //   "eval_count": 42,
 //   "eval_duration": 118888899
@@ -79,14 +83,19 @@ import(
 //
 // Notes:
 // - All encryption/decryption is handled server-side before model invocation
-// - Prompt formatting is fixed using a system instruction template
+// - The prompt is wrapped in the --prompt-template chat format; an optional
+//   `encryptedSystem`, encrypted like the prompt, replaces its system message
 // - Response timing is measured and included in the output
 func (s *Server) secureGenerate(w http.ResponseWriter, r *http.Request) {
+    InferenceStats.Requests.Add(1)
     
     var req struct {
     	Role    string `json:"role"` 
         EncryptedPrompt string `json:"EncryptedPrompt"`
         EncryptedSymmetricKey string `json:"encryptedSymmetricKey"`
+        EncryptedSystem string `json:"encryptedSystem"`
+        Mode string `json:"mode"`
+        Seed *int `json:"seed"`
     }
 
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -99,15 +108,21 @@ func (s *Server) secureGenerate(w http.ResponseWriter, r *http.Request) {
         fmt.Println("Key not found in cache")
     }
 
-    symmetricKey, err := RsaDecrypt(privateKey, req.EncryptedSymmetricKey)
+    symmetricKey, err := RsaDecryptKeyExchange(privateKey, req.EncryptedSymmetricKey, s.rsaPKCS1Fallback)
     if err != nil {
-        log.Fatal("Error decrypting symmetric key", err)
+        http.Error(w, fmt.Sprintf("Error decrypting symmetric key: %v", err), http.StatusBadRequest)
         return
     }
 
-    prompt,err := AesDecrypt(symmetricKey, req.EncryptedPrompt)
+    prompt,err := AesDecryptMode(req.Mode, symmetricKey, req.EncryptedPrompt)
     if err != nil {
-        log.Fatal("Error decrypting prompt", err)
+        http.Error(w, fmt.Sprintf("Error decrypting prompt: %v", err), http.StatusBadRequest)
+        return
+    }
+
+    formatted, err := s.formatSecurePrompt(req.Mode, symmetricKey, req.EncryptedSystem, prompt)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
 
@@ -128,25 +143,25 @@ func (s *Server) secureGenerate(w http.ResponseWriter, r *http.Request) {
         MirostatTau:      5,
         MirostatEta:      0.1,
         PenalizeNl:       true,
-        Seed:             uint32(0),
         Grammar:          "false", 
     }
 
-    seq, err := s.NewSequence(fmt.Sprintf(promptFormat, prompt), nil, NewSequenceParams{
+    seq, err := s.NewSequence(formatted, nil, NewSequenceParams{
         numPredict:     -1, // Hard-coded as specified
-        stop:           nil,
+        stop:           s.promptFormat.Stop(),
         numKeep:        4,
         samplingParams: &samplingParams,
+        seed:           requestSeed(req.Seed),
         embedding:      false,
     })
 
     if err != nil {
-        http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+        http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), sequenceErrorStatus(err))
         return
     }
 
     // Ensure there is a place to put the sequence, released when removed from s.seqs
-    if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+    if err := s.acquireSequenceSlot(w, r.Context()); err != nil {
         if errors.Is(err, context.Canceled) {
             slog.Info("Aborting completion request due to client closing the connection")
         } else {
@@ -155,29 +170,8 @@ func (s *Server) secureGenerate(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    s.mu.Lock()
-    found := false
-    for i, sq := range s.seqs {
-        if sq == nil {
-            seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, true) // Always using cache_prompt as true
-            if err != nil {
-                s.mu.Unlock()
-                http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
-                return
-            }
-
-            seq.crossAttention = s.image.NeedCrossAttention(seq.cache.Inputs...)
-
-            s.seqs[i] = seq
-            s.cond.Signal()
-            found = true
-            break
-        }
-    }
-    s.mu.Unlock()
-
-    if !found {
-        http.Error(w, "Could not find an available sequence", http.StatusInternalServerError)
+    if err := s.assignSequence(seq, true); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
@@ -189,42 +183,26 @@ func (s *Server) secureGenerate(w http.ResponseWriter, r *http.Request) {
         case <-r.Context().Done():
             close(seq.quit)
             return
-        case content, ok := <-seq.responses:
+        case resp, ok := <-seq.responses:
             if ok {
-                contentBuilder.WriteString(content)
+                contentBuilder.WriteString(resp.content)
             } else {
                 // Send the final response after collecting all content
                 finalContent := strings.TrimSpace(contentBuilder.String())
 
                 // Prepare the response with the required fields
-                type Response struct {
-                    Message struct {
-                        Role    string `json:"role"`
-                        Content string `json:"content"`
-                    } `json:"message"`
-                    Model               string `json:"model"`
-                    CreatedAt           string `json:"created_at"`
-                    DoneReason          string `json:"done_reason"`
-                    Done                bool   `json:"done"`
-                    TotalDuration       int64  `json:"total_duration"`
-                    LoadDuration        int64  `json:"load_duration"`
-                    PromptEvalCount     int    `json:"prompt_eval_count"`
-                    PromptEvalDuration  int64  `json:"prompt_eval_duration"`
-                    EvalCount           int    `json:"eval_count"`
-                    EvalDuration        int64  `json:"eval_duration"`
-                }
-
-                response := Response{
+                response := GenerateResponse{
                     Model:      "llama3.2:3b",
                     CreatedAt:  time.Now().UTC().Format(time.RFC3339),
-                    DoneReason: "stop",
+                    DoneReason: seq.doneReason.String(),
                     Done:       true,
                     TotalDuration: time.Since(seq.startProcessingTime).Nanoseconds(),
                     LoadDuration:  seq.startGenerationTime.Sub(seq.startProcessingTime).Nanoseconds(),
-                    PromptEvalCount: -1, // Hard-coded as specified
-                    PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime).Nanoseconds(),
-                    EvalCount:          seq.numDecoded,
-                    EvalDuration:       time.Since(seq.startGenerationTime).Nanoseconds(),
+                    PromptEvalCount:    seq.numPromptInputs,
+                    PromptEvalDuration: promptDuration(seq).Nanoseconds(),
+                    EvalCount:          seq.numPredicted,
+                    EvalDuration:       generationDuration(seq).Nanoseconds(),
+                    Seed:               seq.seed,
                 }
 
                 response.Message.Role = "assistant"
@@ -26,9 +26,16 @@ package main
  */
 
 import(
+	"bufio"
 	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 	"encoding/json"
 	"net/http"
+	"llm-server/llama"
 )
 
 // health handles the `/health` endpoint to report the current server status.
@@ -36,6 +43,11 @@ import(
 // It returns a JSON-encoded HealthResponse that includes:
 //   - `status`: a string representation of the server's internal status
 //   - `progress`: any ongoing model loading or initialization progress
+//   - `elapsed_ms`, `eta_ms`: while loading, the time spent so far and a rough
+//     estimate of the time remaining
+//   - `error`: if the model failed to load, the reason why
+//   - `slots_total`, `slots_busy`: sequence slots, and how many are running a request
+//   - `queue_waiting`: requests waiting for a free slot
 //
 // This endpoint is typically used for:
 //   - Load balancer health checks
@@ -44,20 +56,149 @@ import(
 //
 // Example response:
 // {
-//   "status": "ready",
-//   "progress": "model loaded successfully"
+//   "status": "ok",
+//   "progress": 1,
+//   "slots_total": 4,
+//   "slots_busy": 3,
+//   "queue_waiting": 0
 // }
 //
 // Response codes:
-//   - 200 OK: Health status returned successfully
+//   - 200 OK: The model is loaded and ready
+//   - 503 Service Unavailable: The model is still loading or failed to load,
+//     so that load balancers hold traffic back
 //   - 500 Internal Server Error: Failed to encode response
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(&HealthResponse{
-		Status:   s.status.ToString(),
-		Progress: s.progress,
-	}); err != nil {
+	if s.status != ServerStatusReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(healthStatus(s, time.Now())); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// healthDetailed handles the `/health/detailed` endpoint. In addition to the
+// `/health` fields it reports memory for each GPU and for the host, so that
+// orchestrators can account for memory pressure when scheduling.
+//
+// GPU memory is queried from the ggml backend; on CPU-only builds `gpus` is an
+// empty list. Host memory is read from /proc/meminfo and is zero on platforms
+// without it.
+//
+// Example response:
+// {
+//   "status": "ok",
+//   "progress": 1,
+//   "gpus": [{"name": "CUDA0", "total": 85899345920, "free": 60129542144, "used": 25769803776}],
+//   "memory": {"total": 270582939648, "available": 201863462912, "process_heap": 8388608, "process_sys": 25165824}
+// }
+func (s *Server) healthDetailed(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	if s.status != ServerStatusReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(detailedHealth(s, llama.GPUDevices, "/proc/meminfo")); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
-}
\ No newline at end of file
+}
+
+// healthStatus builds the /health report as of now. While loading, the ETA
+// assumes progress continues at the average rate seen so far.
+func healthStatus(s *Server, now time.Time) *HealthResponse {
+	resp := &HealthResponse{
+		Status:       s.status.ToString(),
+		Progress:     s.progress,
+		QueueWaiting: s.seqsQueue.Len() + s.embeddingQueue.Len(),
+	}
+	if s.loadErr != nil {
+		resp.Error = s.loadErr.Error()
+	}
+
+	s.mu.Lock()
+	resp.SlotsTotal = len(s.seqs)
+	for _, seq := range s.seqs {
+		if seq != nil {
+			resp.SlotsBusy++
+		}
+	}
+	s.mu.Unlock()
+
+	if s.status == ServerStatusReady {
+		// the load callback may not report the last fraction
+		resp.Progress = 1
+	}
+	if s.status != ServerStatusLoadingModel || s.loadStart.IsZero() {
+		return resp
+	}
+
+	elapsed := now.Sub(s.loadStart)
+	resp.ElapsedMS = elapsed.Milliseconds()
+	if s.progress > 0 && s.progress < 1 {
+		remaining := float64(elapsed) * float64(1-s.progress) / float64(s.progress)
+		resp.EtaMS = time.Duration(remaining).Milliseconds()
+	}
+	return resp
+}
+
+// detailedHealth builds the detailed health report from the given GPU device
+// provider and meminfo file.
+func detailedHealth(s *Server, devices deviceInfoProvider, meminfo string) *DetailedHealthResponse {
+	resp := &DetailedHealthResponse{
+		HealthResponse: *healthStatus(s, time.Now()),
+		GPUs: make([]GPUMemory, 0),
+	}
+
+	for _, device := range devices() {
+		resp.GPUs = append(resp.GPUs, GPUMemory{
+			Name:  device.Name,
+			Total: device.TotalMemory,
+			Free:  device.FreeMemory,
+			Used:  device.TotalMemory - min(device.FreeMemory, device.TotalMemory),
+		})
+	}
+
+	resp.Memory.Total, resp.Memory.Available = readMemInfo(meminfo)
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	resp.Memory.ProcessHeap = stats.HeapAlloc
+	resp.Memory.ProcessSys = stats.Sys
+
+	return resp
+}
+
+// readMemInfo returns MemTotal and MemAvailable in bytes from a
+// /proc/meminfo style file, or zeros if the file cannot be read.
+func readMemInfo(path string) (uint64, uint64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	var total, available uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+
+	return total, available
+}
@@ -0,0 +1,185 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"llm-server/llama"
+)
+
+func TestDetailedHealthMemoryFields(t *testing.T) {
+	meminfo := filepath.Join(t.TempDir(), "meminfo")
+	if err := os.WriteFile(meminfo, []byte("MemTotal:       16384 kB\nMemFree:         1024 kB\nMemAvailable:    8192 kB\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	gpus := func() []llama.DeviceInfo {
+		return []llama.DeviceInfo{{Name: "CUDA0", FreeMemory: 6 << 30, TotalMemory: 8 << 30}}
+	}
+
+	resp := detailedHealth(&Server{status: ServerStatusReady, progress: 1}, gpus, meminfo)
+	if resp.Status != "ok" || resp.Progress != 1 {
+		t.Errorf("expected /health fields to be included, got %+v", resp.HealthResponse)
+	}
+	if len(resp.GPUs) != 1 || resp.GPUs[0].Used != 2<<30 || resp.GPUs[0].Free != 6<<30 {
+		t.Errorf("unexpected GPU memory: %+v", resp.GPUs)
+	}
+	if resp.Memory.Total != 16384*1024 || resp.Memory.Available != 8192*1024 {
+		t.Errorf("unexpected host memory: %+v", resp.Memory)
+	}
+	if resp.Memory.ProcessSys == 0 {
+		t.Error("expected process memory to be reported")
+	}
+}
+
+func TestDetailedHealthCPUOnly(t *testing.T) {
+	noGPUs := func() []llama.DeviceInfo { return nil }
+
+	resp := detailedHealth(&Server{}, noGPUs, filepath.Join(t.TempDir(), "missing"))
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"status", "progress", "gpus", "memory"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("expected %q in detailed health response", name)
+		}
+	}
+	if string(fields["gpus"]) != "[]" {
+		t.Errorf("expected empty GPU list, got %s", fields["gpus"])
+	}
+
+	var memory map[string]uint64
+	if err := json.Unmarshal(fields["memory"], &memory); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"total", "available", "process_heap", "process_sys"} {
+		if _, ok := memory[name]; !ok {
+			t.Errorf("expected memory.%s in detailed health response", name)
+		}
+	}
+}
+
+func TestHealthReportsLoadTiming(t *testing.T) {
+	start := time.Now()
+	s := &Server{status: ServerStatusLoadingModel, loadStart: start}
+
+	// nothing loaded yet: elapsed only, no rate to estimate from
+	first := healthStatus(s, start.Add(500*time.Millisecond))
+	if first.ElapsedMS != 500 || first.EtaMS != 0 {
+		t.Errorf("expected elapsed 500ms and no ETA, got %+v", first)
+	}
+
+	// a quarter loaded after 2s leaves roughly 6s to go
+	s.progress = 0.25
+	second := healthStatus(s, start.Add(2*time.Second))
+	if second.ElapsedMS <= first.ElapsedMS {
+		t.Errorf("expected elapsed to increase, got %d then %d", first.ElapsedMS, second.ElapsedMS)
+	}
+	if second.EtaMS != 6000 {
+		t.Errorf("expected ETA of 6000ms, got %d", second.EtaMS)
+	}
+
+	// timing is only reported while loading
+	s.status, s.progress = ServerStatusReady, 1
+	if ready := healthStatus(s, start.Add(3*time.Second)); ready.ElapsedMS != 0 || ready.EtaMS != 0 {
+		t.Errorf("expected no load timing once ready, got %+v", ready)
+	}
+}
+
+func TestHealthReportsLoadError(t *testing.T) {
+	s := &Server{
+		status:  ServerStatusError,
+		loadErr: errors.New("failed to load model from file: unable to load model: missing.gguf"),
+	}
+
+	w := httptest.NewRecorder()
+	s.health(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+
+	var resp HealthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "server error" || resp.Error != s.loadErr.Error() {
+		t.Errorf("expected the load error in the health response, got %+v", resp)
+	}
+
+	// requests waiting on the model fail rather than running without one
+	if err := s.waitReady(); !errors.Is(err, s.loadErr) {
+		t.Errorf("expected waitReady to return the load error, got %v", err)
+	}
+}
+
+func TestHealthReportsSlotsAndQueue(t *testing.T) {
+	s := &Server{
+		status:   ServerStatusLoadingModel,
+		progress: 0.5,
+		seqs:     []*Sequence{{}, nil, {}, {}},
+	}
+	w := s.seqsQueue.enqueue(0)
+	defer s.seqsQueue.remove(w)
+
+	// traffic is held back until the model is ready
+	rec := httptest.NewRecorder()
+	s.health(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 while loading, got %d", rec.Code)
+	}
+
+	s.status, s.progress = ServerStatusReady, 0.97
+	rec = httptest.NewRecorder()
+	s.health(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200 once ready, got %d", rec.Code)
+	}
+
+	var resp HealthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Progress != 1 {
+		t.Errorf("expected progress 1 once ready, got %v", resp.Progress)
+	}
+	if resp.SlotsTotal != 4 || resp.SlotsBusy != 3 || resp.QueueWaiting != 1 {
+		t.Errorf("expected 3 of 4 slots busy and 1 waiting, got %+v", resp)
+	}
+}
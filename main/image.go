@@ -26,24 +26,58 @@ package main
  */
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"slices"
+	"strconv"
 	"sync"
 	"time"
 	"hash/maphash"
 	"log/slog"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 	"llm-server/llama"
 )
 
-const imageCacheSize = 4
+// defaultImageCacheSize is the number of image embeddings cached when
+// --image-cache-size is not positive
+const defaultImageCacheSize = 4
+
+// clipMaxImages is the default per-request image limit for CLIP (llava) models
+const clipMaxImages = 8
+
+// mllamaMaxImages is the default per-request image limit for MLLama models,
+// whose images are each decoded on their own with a large embedding
+const mllamaMaxImages = 4
+
+var errTooManyImages = errors.New("too many images in request")
+
+var errNoVisionModel = errors.New("image placeholder present but no vision model loaded")
+
+var errImageBatchSize = errors.New("image does not fit in one batch")
+
+// imageEncodeParallel bounds how many images are run through the vision
+// encoder at once
+const imageEncodeParallel = 2
+
+// imageEncoder computes the embeddings of one image with the vision model.
+type imageEncoder func(llamaContext *llama.Context, data []byte, aspectRatioId int) ([][]float32, error)
 
 type ImageContext struct {
+	// mu guards the embedding cache and hash; it is not held while encoding
 	mu sync.Mutex
 	clip   *llama.ClipContext
 	mllama *llama.MllamaContext
-	images    []imageCache
+	encode imageEncoder
+	images    []imageCache // cacheSize entries, evicted least recently used first
+	cacheSize int
 	imageHash maphash.Hash
+
+	// inflight merges concurrent requests for the same uncached image, and
+	// encodeSem bounds encoding of distinct images
+	inflight  singleflight.Group
+	encodeSem *semaphore.Weighted
 }
 
 type imageCache struct {
@@ -52,9 +86,11 @@ type imageCache struct {
 	lastUsed time.Time
 }
 
-// NewImageContext initializes an ImageContext for a vision model (clip or mllama).
+// NewImageContext initializes an ImageContext for a vision model (clip or mllama)
+// that caches the embeddings of up to cacheSize images, or defaultImageCacheSize
+// if cacheSize is not positive.
 // It returns an error if the model architecture cannot be determined or is unsupported.
-func NewImageContext(llamaContext *llama.Context, modelPath string) (*ImageContext, error) {
+func NewImageContext(llamaContext *llama.Context, modelPath string, cacheSize int) (*ImageContext, error) {
 	arch, err := llama.GetModelArch(modelPath)
 	if err != nil {
 		return nil, fmt.Errorf("unable to determine vision architecture: %w (%s)", err, modelPath)
@@ -73,11 +109,30 @@ func NewImageContext(llamaContext *llama.Context, modelPath string) (*ImageConte
 		return nil, err
 	}
 
-	c.images = make([]imageCache, imageCacheSize)
+	if c.mllama != nil {
+		c.encode = c.mllama.NewEmbed
+	} else {
+		c.encode = func(llamaContext *llama.Context, data []byte, _ int) ([][]float32, error) {
+			return c.clip.NewEmbed(llamaContext, data)
+		}
+	}
+	c.cacheSize = imageCacheSize(cacheSize)
+	c.images = make([]imageCache, c.cacheSize)
+	c.encodeSem = semaphore.NewWeighted(imageEncodeParallel)
 
 	return &c, nil
 }
 
+// imageCacheSize returns the configured image cache size, falling back to
+// defaultImageCacheSize for a zero or negative value.
+func imageCacheSize(configured int) int {
+	if configured <= 0 {
+		return defaultImageCacheSize
+	}
+
+	return configured
+}
+
 // BatchSize returns the appropriate image batch size depending on the backend model.
 // For MLLama (which uses large single-token embeddings), the batch size is always 1.
 // For CLIP, it returns the configured batch size.
@@ -88,7 +143,8 @@ func (c *ImageContext) BatchSize(configuredBatchSize int) int {
 	}
 
 	// Mllama maps an image to 1 embedding token (llava creates many tokens)
-	// and doesn't support more than a single image per request.
+	// that sets the cross-attention state for the text after it, so each
+	// image of a request is decoded in its own batch as a sequential segment.
 	// The embeddings are large (100 MB), so allocating a big batch can fail
 	// on some systems
 	if c.mllama != nil {
@@ -98,6 +154,40 @@ func (c *ImageContext) BatchSize(configuredBatchSize int) int {
 	return configuredBatchSize
 }
 
+// MaxImages returns the maximum number of images accepted in a single request.
+// A positive configured value always wins; otherwise MLLama is limited to
+// mllamaMaxImages and CLIP to clipMaxImages.
+func (c *ImageContext) MaxImages(configuredMaxImages int) int {
+	if c == nil {
+		return 0
+	}
+
+	if configuredMaxImages > 0 {
+		return configuredMaxImages
+	}
+
+	if c.mllama != nil {
+		return mllamaMaxImages
+	}
+
+	return clipMaxImages
+}
+
+// Architecture returns the vision model architecture, "mllama" or "clip", or
+// an empty string if no vision model is loaded.
+func (c *ImageContext) Architecture() string {
+	switch {
+	case c == nil:
+		return ""
+	case c.mllama != nil:
+		return "mllama"
+	case c.clip != nil:
+		return "clip"
+	default:
+		return ""
+	}
+}
+
 // EmbedSize returns the dimensionality of the image embeddings for the active vision model.
 func (c *ImageContext) EmbedSize(llamaContext *llama.Context) int {
 	if c != nil && c.mllama != nil {
@@ -119,9 +209,30 @@ func (c *ImageContext) NeedCrossAttention(inputs ...input) bool {
 	})
 }
 
+// CrossAttentionStart returns the index of the last image in a cached prefix
+// of inputs, or -1 if there is none or the model has no cross attention. The
+// context only holds the cross-attention state of the image it decoded last,
+// which may belong to another request, so text following a cached MLLama
+// image can only be decoded after that image is decoded again.
+func (c *ImageContext) CrossAttentionStart(inputs []input) int {
+	if c == nil || c.mllama == nil {
+		return -1
+	}
+
+	for i := len(inputs) - 1; i >= 0; i-- {
+		if inputs[i].embed != nil {
+			return i
+		}
+	}
+
+	return -1
+}
+
 // NewEmbed generates image embeddings for the given image data.
 // It uses the internal cache to avoid recomputation and delegates to the underlying
-// vision model for embedding generation if not cached.
+// vision model for embedding generation if not cached. Distinct images are
+// encoded concurrently, while concurrent calls for the same image share a
+// single encoding.
 func (c *ImageContext) NewEmbed(llamaContext *llama.Context, data []byte, aspectRatioId int) ([][]float32, error) {
 	if c == nil {
 		return nil, nil
@@ -131,34 +242,51 @@ func (c *ImageContext) NewEmbed(llamaContext *llama.Context, data []byte, aspect
 		return nil, errors.New("received zero length image")
 	}
 
+	c.mu.Lock()
 	hash := c.hashImage(data)
+	embed, err := c.findImage(hash)
+	c.mu.Unlock()
+	if err == nil {
+		return embed, nil
+	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	v, err, _ := c.inflight.Do(strconv.FormatUint(hash, 16), func() (any, error) {
+		// another call may have finished encoding this image since the lookup
+		c.mu.Lock()
+		embed, err := c.findImage(hash)
+		c.mu.Unlock()
+		if err == nil {
+			return embed, nil
+		}
 
-	embed, err := c.findImage(hash)
-	if err != nil {
-		if c.mllama != nil {
-			embed, err = c.mllama.NewEmbed(llamaContext, data, aspectRatioId)
-			if err != nil {
-				return nil, err
-			}
-		} else if c.clip != nil {
-			embed, err = c.clip.NewEmbed(llamaContext, data)
-			if err != nil {
-				return nil, err
-			}
-		} else {
+		if c.encode == nil {
 			return nil, errors.New("received image but vision model not loaded")
 		}
 
+		if err := c.encodeSem.Acquire(context.Background(), 1); err != nil {
+			return nil, err
+		}
+		embed, err = c.encode(llamaContext, data, aspectRatioId)
+		c.encodeSem.Release(1)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
 		c.addImage(hash, embed)
+		c.mu.Unlock()
+
+		return embed, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return embed, nil
+	return v.([][]float32), nil
 }
 
 // hashImage computes a 64-bit hash of the raw image bytes using `maphash` for efficient lookup.
+// The caller must hold c.mu.
 func (c *ImageContext) hashImage(image []byte) uint64 {
 	c.imageHash.Reset()
 	_, _ = c.imageHash.Write(image)
@@ -0,0 +1,301 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"llm-server/llama"
+)
+
+func TestImageArchitecture(t *testing.T) {
+	var none *ImageContext
+	if got := none.Architecture(); got != "" {
+		t.Errorf("expected no architecture without a vision model, got %q", got)
+	}
+	if got := (&ImageContext{mllama: &llama.MllamaContext{}}).Architecture(); got != "mllama" {
+		t.Errorf("expected mllama, got %q", got)
+	}
+	if got := (&ImageContext{clip: &llama.ClipContext{}}).Architecture(); got != "clip" {
+		t.Errorf("expected clip, got %q", got)
+	}
+}
+
+func TestMaxImages(t *testing.T) {
+	cases := []struct {
+		name       string
+		image      *ImageContext
+		configured int
+		want       int
+	}{
+		{"no vision model", nil, 4, 0},
+		{"mllama default", &ImageContext{mllama: &llama.MllamaContext{}}, 0, mllamaMaxImages},
+		{"clip default", &ImageContext{clip: &llama.ClipContext{}}, 0, clipMaxImages},
+		{"configured limit", &ImageContext{clip: &llama.ClipContext{}}, 2, 2},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.image.MaxImages(tc.configured); got != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestImagePlaceholderWithoutVisionModel(t *testing.T) {
+	s := &Server{}
+
+	_, err := inputs(s, "describe this: [img-0]", nil)
+	if !errors.Is(err, errNoVisionModel) {
+		t.Fatalf("expected errNoVisionModel, got %v", err)
+	}
+	if err.Error() != "image placeholder present but no vision model loaded" {
+		t.Errorf("unexpected error message: %q", err.Error())
+	}
+}
+
+func TestImageLargerThanBatchSize(t *testing.T) {
+	image := &ImageContext{clip: &llama.ClipContext{}, images: make([]imageCache, 4)}
+	data := []byte("fake png")
+
+	// a cached CLIP embedding of 8 inputs, so no vision model is needed
+	embed := make([][]float32, 8)
+	for i := range embed {
+		embed[i] = []float32{float32(i)}
+	}
+	image.addImage(image.hashImage(data), embed)
+
+	s := &Server{image: image, batchSize: 4}
+	_, err := imageInputs(s, ImageData{Data: data})
+	if !errors.Is(err, errImageBatchSize) {
+		t.Fatalf("expected errImageBatchSize, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "image requires batch size >= 8") {
+		t.Errorf("expected the required batch size in the error, got %q", err.Error())
+	}
+
+	s.batchSize = 8
+	inputs, err := imageInputs(s, ImageData{Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != len(embed) {
+		t.Errorf("expected %d image inputs, got %d", len(embed), len(inputs))
+	}
+}
+
+func TestNewEmbedConcurrent(t *testing.T) {
+	var calls, active, maxActive atomic.Int32
+	image := &ImageContext{
+		images:    make([]imageCache, defaultImageCacheSize),
+		encodeSem: semaphore.NewWeighted(imageEncodeParallel),
+		encode: func(_ *llama.Context, data []byte, _ int) ([][]float32, error) {
+			calls.Add(1)
+			n := active.Add(1)
+			for {
+				m := maxActive.Load()
+				if n <= m || maxActive.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			active.Add(-1)
+			return [][]float32{{float32(len(data))}}, nil
+		},
+	}
+
+	// each distinct image is requested by several clients at once
+	const images, clients = 3, 4
+	var wg sync.WaitGroup
+	errs := make(chan error, images*clients)
+	for i := range images {
+		data := []byte(fmt.Sprintf("image-%d%s", i, strings.Repeat("x", i)))
+		for range clients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				embed, err := image.NewEmbed(nil, data, 0)
+				if err == nil && embed[0][0] != float32(len(data)) {
+					err = fmt.Errorf("got embedding %v for a %d byte image", embed, len(data))
+				}
+				if err != nil {
+					errs <- err
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := calls.Load(); n != images {
+		t.Errorf("expected each image encoded once, got %d encodings", n)
+	}
+	if n := maxActive.Load(); n < 2 || n > imageEncodeParallel {
+		t.Errorf("expected distinct images encoded in parallel up to %d at once, got %d", imageEncodeParallel, n)
+	}
+
+	// cached images are not encoded again
+	if _, err := image.NewEmbed(nil, []byte("image-0"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != images {
+		t.Errorf("expected a cache hit, got %d encodings", n)
+	}
+}
+
+func TestMllamaImagesAreSequentialSegments(t *testing.T) {
+	image1, image2 := input{embed: []float32{1, 1}}, input{embed: []float32{2, 2}}
+
+	cache, err := NewInputCache(nil, 64, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenBatch, err := llama.NewBatch(8, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokenBatch.Free()
+	embedBatch, err := llama.NewBatch(1, 1, len(image1.embed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer embedBatch.Free()
+
+	s := &Server{
+		seqs:  make([]*Sequence, 1),
+		cache: cache,
+		image: &ImageContext{mllama: &llama.MllamaContext{}},
+	}
+	seq := newTestSequence([]input{{token: 1}, image1, {token: 2}, {token: 3}, image2, {token: 4}})
+	seq.cache = &cache.slots[0]
+	s.seqs[0] = seq
+
+	// decode batches as processBatch does, recording each batch's inputs
+	type decoded struct {
+		inputs         int
+		embedding      bool
+		crossAttention bool
+	}
+	var got []decoded
+	for len(seq.inputs) > 0 {
+		batch, crossAttention, _, err := fillBatch(s, tokenBatch, embedBatch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, decoded{batch.NumTokens(), batch.IsEmbedding(), crossAttention})
+		seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
+		seq.pendingInputs = nil
+		tokenBatch.Clear()
+		embedBatch.Clear()
+	}
+
+	// each image is its own cross-attention segment for the text after it
+	want := []decoded{{1, false, false}, {1, true, true}, {2, false, true}, {1, true, true}, {1, false, true}}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected batches %v, got %v", want, got)
+	}
+}
+
+func TestAssignSequenceRedecodesCachedMllamaImage(t *testing.T) {
+	image1, image2 := input{embed: []float32{1}}, input{embed: []float32{2}}
+
+	cache, err := NewInputCache(nil, 64, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.slots[0].Inputs = []input{{token: 1}, image1, {token: 2}, {token: 3}}
+
+	s := &Server{
+		seqs:    make([]*Sequence, 1),
+		seqsSem: semaphore.NewWeighted(1),
+		cache:   cache,
+		image:   &ImageContext{mllama: &llama.MllamaContext{}},
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a follow-up turn adds a second image after the cached first one
+	seq := newTestSequence([]input{{token: 1}, image1, {token: 2}, {token: 3}, image2, {token: 4}})
+	if err := s.assignSequence(seq, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cached image is decoded again to restore its cross-attention state
+	if seq.numCached != 1 || len(seq.inputs) != 5 || seq.inputs[0].embed == nil {
+		t.Errorf("expected decoding to restart at the cached image, got %d cached and %d to decode", seq.numCached, len(seq.inputs))
+	}
+	if seq.crossAttention {
+		t.Error("expected cross attention to start with the restored image")
+	}
+}
+
+func TestImageCacheSize(t *testing.T) {
+	for configured, want := range map[int]int{-1: defaultImageCacheSize, 0: defaultImageCacheSize, 1: 1, 32: 32} {
+		if got := imageCacheSize(configured); got != want {
+			t.Errorf("configured %d: expected %d, got %d", configured, want, got)
+		}
+	}
+
+	// a larger cache keeps every image of a gallery, evicting the least
+	// recently used once full
+	const size = 8
+	image := &ImageContext{images: make([]imageCache, imageCacheSize(size))}
+	for i := range size + 1 {
+		if i == size {
+			// touch the first image so the second is evicted instead
+			if _, err := image.findImage(image.hashImage([]byte{0})); err != nil {
+				t.Fatal(err)
+			}
+		}
+		image.addImage(image.hashImage([]byte{byte(i)}), [][]float32{{float32(i)}})
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := range size + 1 {
+		_, err := image.findImage(image.hashImage([]byte{byte(i)}))
+		if cached := err == nil; cached != (i != 1) {
+			t.Errorf("image %d: expected cached %v, got %v", i, i != 1, cached)
+		}
+	}
+}
@@ -27,6 +27,7 @@ package main
 
 import (
 	"sync"
+	"time"
 )
 
 // KeyCache provides a thread-safe in-memory key-value store
@@ -36,35 +37,117 @@ import (
 // It supports concurrent read and write access via a read-write mutex,
 // ensuring low-latency safe reads while allowing exclusive writes.
 //
+// Entries may be given a TTL with SetWithTTL, after which they are treated as
+// missing and eventually purged by a background sweeper.
+//
 // The global variable `KeyStore` can be used as a singleton instance
 // throughout the server for temporary key caching.
 type KeyCache struct {
-	store map[string]string
+	store map[string]keyEntry
 	mutex sync.RWMutex
 }
 
-// NewKeyCache initializes and returns a new KeyCache instance.
+// keyEntry is a cached value and when it expires; a zero expiresAt never expires.
+type keyEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+// expired reports whether the entry's TTL has passed by now.
+func (e keyEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// How often the background sweeper purges expired keys
+const keyCacheSweepInterval = time.Minute
+
+// NewKeyCache initializes and returns a new KeyCache instance and starts the
+// background sweeper that purges its expired keys.
 func NewKeyCache() *KeyCache {
-	return &KeyCache{
-		store: make(map[string]string),
+	c := &KeyCache{
+		store: make(map[string]keyEntry),
 	}
+	go c.sweep(keyCacheSweepInterval)
+	return c
 }
 
 var KeyStore = NewKeyCache()
 
 // Set stores a key-value pair in the cache with write-lock protection.
-// It overwrites the value if the key already exists.
+// It overwrites the value if the key already exists. The key never expires.
 func (c *KeyCache) Set(key, value string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.store[key] = value
+	c.store[key] = keyEntry{value: value}
+}
+
+// SetWithTTL stores a key-value pair that expires after ttl, such as a
+// per-session AES key. It overwrites the value and TTL if the key already exists.
+func (c *KeyCache) SetWithTTL(key, value string, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.store[key] = keyEntry{value: value, expiresAt: time.Now().Add(ttl)}
 }
 
 // Get retrieves a value for the given key with read-lock protection.
 // It returns the value and a boolean indicating if the key was found.
+// An expired key is reported as missing and deleted.
 func (c *KeyCache) Get(key string) (string, bool) {
+	c.mutex.RLock()
+	entry, exists := c.store[key]
+	c.mutex.RUnlock()
+
+	if exists && entry.expired(time.Now()) {
+		c.mutex.Lock()
+		// the key may have been set again since it was read
+		if entry, exists := c.store[key]; exists && entry.expired(time.Now()) {
+			delete(c.store, key)
+		}
+		c.mutex.Unlock()
+		return "", false
+	}
+
+	return entry.value, exists
+}
+
+// Delete removes a key from the cache. Deleting a missing key is a no-op.
+func (c *KeyCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.store, key)
+}
+
+// Purge removes every key from the cache.
+func (c *KeyCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	clear(c.store)
+}
+
+// Len returns the number of keys in the cache, including expired keys that
+// have not been purged yet.
+func (c *KeyCache) Len() int {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
-	val, exists := c.store[key]
-	return val, exists
+	return len(c.store)
+}
+
+// purgeExpired deletes every key that has expired by now.
+func (c *KeyCache) purgeExpired(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, entry := range c.store {
+		if entry.expired(now) {
+			delete(c.store, key)
+		}
+	}
+}
+
+// sweep purges expired keys every interval for the life of the process.
+func (c *KeyCache) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.purgeExpired(now)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,111 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyCacheTTL(t *testing.T) {
+	c := NewKeyCache()
+	c.Set("privateKey", "server")
+	c.SetWithTTL("session", "aes", 20*time.Millisecond)
+
+	if v, ok := c.Get("session"); !ok || v != "aes" {
+		t.Fatalf("expected the session key before it expires, got %q (%v)", v, ok)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("session"); ok {
+		t.Error("expected the expired session key to be missing")
+	}
+	if _, ok := c.store["session"]; ok {
+		t.Error("expected Get to delete the expired key")
+	}
+	if v, ok := c.Get("privateKey"); !ok || v != "server" {
+		t.Errorf("expected a key set without a TTL to survive, got %q (%v)", v, ok)
+	}
+}
+
+func TestKeyCachePurgeExpired(t *testing.T) {
+	c := NewKeyCache()
+	c.Set("privateKey", "server")
+	c.SetWithTTL("old", "aes", time.Minute)
+	c.SetWithTTL("new", "aes", time.Hour)
+
+	c.purgeExpired(time.Now().Add(2 * time.Minute))
+
+	if _, ok := c.store["old"]; ok {
+		t.Error("expected the expired key to be purged")
+	}
+	if _, ok := c.store["new"]; !ok {
+		t.Error("expected the unexpired key to be kept")
+	}
+	if _, ok := c.store["privateKey"]; !ok {
+		t.Error("expected the key without a TTL to be kept")
+	}
+}
+
+func TestKeyCacheDeleteAndPurge(t *testing.T) {
+	c := NewKeyCache()
+	c.Set("privateKey", "server")
+	c.SetWithTTL("session", "aes", time.Hour)
+
+	c.Delete("session")
+	c.Delete("missing")
+	if _, ok := c.Get("session"); ok || c.Len() != 1 {
+		t.Errorf("expected only the deleted key to be removed, %d keys left", c.Len())
+	}
+
+	c.Purge()
+	if _, ok := c.Get("privateKey"); ok || c.Len() != 0 {
+		t.Errorf("expected an empty cache after Purge, %d keys left", c.Len())
+	}
+}
+
+func TestKeyCacheConcurrentGetDelete(t *testing.T) {
+	c := NewKeyCache()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				if i%2 == 0 {
+					c.Set("key", "value")
+					c.Delete("key")
+				} else if v, ok := c.Get("key"); ok && v != "value" {
+					t.Errorf("unexpected value %q", v)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -27,6 +27,9 @@ package main
  
 import (
 	"fmt"
+	"os"
+	"slices"
+	"log/slog"
 	"llm-server/llama"
 )
 
@@ -42,6 +45,10 @@ import (
 //   - flashAttention: whether to enable FlashAttention backend
 //   - threads: number of CPU threads to use
 //   - multiUserCache: whether to enable multi-user context caching
+//
+// If any step fails the server moves to ServerStatusError and keeps the error
+// in `server.loadErr`, so that /health reports why the model didn't load and
+// requests waiting on the model fail instead of running against a nil model.
 func (server *Server) loadModel(
 	params llama.ModelParams, 
 	mpath string, 
@@ -52,15 +59,66 @@ func (server *Server) loadModel(
 	threads int, 
 	multiUserCache bool) {
 
+	defer server.ready.Done()
+
 	initBackend()
-	loadModelFromFile(server, mpath, params)
-	ctxParams := createContextParameters(server, kvSize, threads, flashAttention)
-	setContextWithModel(server, ctxParams)
-	applyLoraFromFile(server, lpath, 1.0, threads)
-	setImageContext(server, ppath)
-	setInputCache(server, kvSize, multiUserCache)
+	err := loadModelSteps(server, params, mpath, lpath, ppath, kvSize, flashAttention, threads, multiUserCache)
+	if err != nil {
+		slog.Error("failed to load model", "model", mpath, "error", err)
+		server.loadErr = err
+		server.status = ServerStatusError
+		return
+	}
 	server.status = ServerStatusReady
-	server.ready.Done()
+}
+
+// loadModelSteps runs each stage of loadModel in order, stopping at the first
+// one that fails.
+func loadModelSteps(
+	server *Server,
+	params llama.ModelParams,
+	mpath string,
+	lpath multiLPath,
+	ppath string,
+	kvSize int,
+	flashAttention bool,
+	threads int,
+	multiUserCache bool) error {
+
+	if err := loadModelFromFile(server, mpath, params); err != nil {
+		return err
+	}
+	server.pieces = vocabPieces(server.model)
+	server.special = specialTokens(server.model, server.eogTokens)
+	if err := checkContextLength(server, kvSize); err != nil {
+		return err
+	}
+	ctxParams := createContextParameters(server, kvSize, threads, flashAttention)
+	if err := setContextWithModel(server, ctxParams); err != nil {
+		return err
+	}
+	recordFlashAttention(server, flashAttention, server.lc.FlashAttention())
+	server.tokenEmbeddings = server.lc.PerTokenEmbeddings()
+	if err := applyLoraFromFile(server, lpath, threads); err != nil {
+		return err
+	}
+	if err := setImageContext(server, ppath); err != nil {
+		return err
+	}
+	if err := setInputCache(server, kvSize, multiUserCache); err != nil {
+		return err
+	}
+	return setBasePrompt(server)
+}
+
+// waitReady blocks until loadModel has finished and returns the error that
+// stopped the model from loading, if any.
+func (s *Server) waitReady() error {
+	s.ready.Wait()
+	if s.loadErr != nil {
+		return fmt.Errorf("model failed to load: %w", s.loadErr)
+	}
+	return nil
 }
 
 // initBackend initializes low-level LLM backend (e.g., llama.cpp internal state).
@@ -68,71 +126,177 @@ func initBackend() {
 	llama.BackendInit()
 }
 
-// loadModelFromFile loads the model from the given path using the provided parameters.
-// Errors are printed (but not returned), and stored in `server.model`.
-func loadModelFromFile(server *Server, mpath string, params llama.ModelParams) {
+// loadModelFromFile loads the model from the given path using the provided
+// parameters and stores it in `server.model`.
+func loadModelFromFile(server *Server, mpath string, params llama.ModelParams) error {
 	var err error
-    server.model, err = llama.LoadModelFromFile(mpath, params)
-    if err != nil {
-        fmt.Errorf("failed to load model from file: %w", err)
-    }
+	server.model, err = llama.LoadModelFromFile(mpath, params)
+	if err != nil {
+		return fmt.Errorf("failed to load model from file: %w", err)
+	}
+	return nil
+}
+
+// vocabPieces returns the text of every vocabulary token, indexed by token ID,
+// so that requests can search the vocabulary without a cgo call per token.
+func vocabPieces(model *llama.Model) []string {
+	pieces := make([]string, model.NumVocab())
+	for token := range pieces {
+		pieces[token] = model.TokenToPiece(token)
+	}
+	return pieces
+}
+
+// checkContextLength compares the context each sequence slot gets with the
+// context length the model was trained with, since positions beyond it
+// silently degrade output. Fails instead of warning with --strict-context.
+func checkContextLength(s *Server, kvSize int) error {
+	s.trainedCtx = s.model.NCtxTrain()
+	return validateContextLength(kvSize/len(s.seqs), s.trainedCtx, s.strictContext)
+}
+
+// validateContextLength logs a warning if slotCtx exceeds the trained context
+// length, or returns an error if strict is set. A trained length of 0 means
+// the model doesn't report one.
+func validateContextLength(slotCtx int, trainedCtx int, strict bool) error {
+	if trainedCtx <= 0 || slotCtx <= trainedCtx {
+		return nil
+	}
+
+	if strict {
+		return fmt.Errorf("context per sequence (%d) exceeds the model's trained context length (%d)", slotCtx, trainedCtx)
+	}
+	slog.Warn("context per sequence exceeds the model's trained context length; output quality may degrade",
+		"n_ctx", slotCtx, "n_ctx_train", trainedCtx)
+	return nil
 }
 
 // createContextParameters returns a llama.ContextParams object
 // based on batch size, KV cache size, parallel sessions, and threading.
 func createContextParameters(server *Server, kvSize int, threads int, flashAttention bool) (llama.ContextParams) {
 	noOfContexts := kvSize
-	batchSize := server.batchSize * server.parallel
-	noOfMaxSequences := server.parallel
+	batchSize := server.batchSize * len(server.seqs)
+	noOfMaxSequences := len(server.seqs)
+	if server.basePromptPath != "" {
+		noOfMaxSequences++ // reserved KV sequence holding the base prompt
+	}
 	return llama.NewContextParams(noOfContexts, batchSize, noOfMaxSequences, threads, flashAttention, "")
 }
 
 // setContextWithModel creates a llama.Context instance tied to the loaded model
-// using the specified context parameters. Panics if initialization fails.
-func setContextWithModel(server *Server, ctxParams llama.ContextParams) {
+// using the specified context parameters.
+func setContextWithModel(server *Server, ctxParams llama.ContextParams) error {
 	var err error
 	server.lc, err = llama.NewContextWithModel(server.model, ctxParams)
 	if err != nil {
-		fmt.Errorf("failed to create new context with model: %w", err)
-		panic(err)
+		return fmt.Errorf("failed to create new context with model: %w", err)
+	}
+	return nil
+}
+
+// recordFlashAttention stores whether the context actually uses flash
+// attention, warning if it was requested but llama.cpp turned it off.
+func recordFlashAttention(server *Server, requested bool, effective bool) {
+	server.flashAttn = effective
+	if requested && !effective {
+		slog.Warn("flash attention was requested but is not supported with this model; running without it")
 	}
 }
 
 // applyLoraFromFile loads and applies LoRA adapters (if any) to the current model.
-// Each path in `lpath` is applied with a scaling factor and parallel threads.
-func applyLoraFromFile(server *Server, lpath multiLPath, scale float32, threads int) {
-	if lpath.String() != "" {
-		for _, path := range lpath {
-			err := server.model.ApplyLoraFromFile(server.lc, path, 1.0, threads)
+// Each path in `lpath` is applied with its own scale from the `--lora path:scale`
+// flag (1.0 if none was given) and parallel threads.
+// The adapters stay loaded so that requests can select them by index via the
+// `lora` option; requests that don't use the option run with every adapter at
+// its load-time scale.
+func applyLoraFromFile(server *Server, lpath multiLPath, threads int) error {
+	if len(lpath) > 0 {
+		for _, lora := range lpath {
+			adapter, err := server.model.LoadLoraAdapter(lora.path)
+			if err == nil {
+				err = server.lc.SetLoraAdapter(adapter, lora.scale)
+			}
 			if err != nil {
-				fmt.Errorf("failed to apply lora from file: %w", err)
-				panic(err)
+				return fmt.Errorf("failed to apply lora from file %s: %w", lora.path, err)
 			}
+			server.loras = append(server.loras, adapter)
+			server.loraPaths = append(server.loraPaths, lora.path)
+			server.loraDefaults = append(server.loraDefaults, lora.scale)
 		}
+		server.loraScales = slices.Clone(server.loraDefaults)
 	}
+	return nil
 }
 
 // setImageContext loads an image embedding model (e.g., CLIP or mLLaMA) for multi-modal support.
-// Panics if the model cannot be initialized from the given path.
-func setImageContext(s *Server, ppath string) {
+// Fails if the model cannot be initialized from the given path.
+func setImageContext(s *Server, ppath string) error {
 	if ppath != "" {
 		var err error
-		s.image, err = NewImageContext(s.lc, ppath)
+		s.image, err = NewImageContext(s.lc, ppath, s.imageCacheSize)
 		if err != nil {
-			fmt.Errorf("failed to create new image context: %w", err)
-			panic(err)
+			return fmt.Errorf("failed to create new image context: %w", err)
 		}
 	}
+	return nil
 }
 
 // setInputCache creates the input token cache for each user/session
 // based on KV size and concurrency configuration.
-// Panics if allocation fails.
-func setInputCache(s *Server, kvSize int, multiUserCache bool) {
+// Fails if allocation fails.
+func setInputCache(s *Server, kvSize int, multiUserCache bool) error {
 	var err error
-	s.cache, err = NewInputCache(s.lc, kvSize, s.parallel, multiUserCache)
+	s.cache, err = NewInputCache(s.lc, kvSize, len(s.seqs), multiUserCache, s.cacheMatchTolerance)
 	if err != nil {
-		fmt.Errorf("failed to create new input cache: %w", err)
-		panic(err)
+		return fmt.Errorf("failed to create new input cache: %w", err)
 	}
-}
\ No newline at end of file
+	s.cache.shiftRatio = s.shiftRatio
+	return nil
+}
+
+// setBasePrompt decodes the --base-prompt file once into a reserved KV sequence
+// after the per-slot sequences. Requests whose prompt starts with it have the
+// base KV copied into their slot instead of decoding it again.
+// Fails if the file cannot be read or decoded.
+func setBasePrompt(s *Server) error {
+	if s.basePromptPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.basePromptPath)
+	if err != nil {
+		return fmt.Errorf("failed to read base prompt: %w", err)
+	}
+
+	tokens, err := s.lc.Model().Tokenize(string(data), true, true)
+	if err != nil {
+		return fmt.Errorf("failed to tokenize base prompt: %w", err)
+	}
+	if len(tokens) >= s.cache.numCtx {
+		return fmt.Errorf("base prompt is %d tokens but each slot only holds %d", len(tokens), s.cache.numCtx)
+	}
+
+	baseId := len(s.seqs)
+	batch, err := llama.NewBatch(s.batchSize, 1, 0)
+	if err != nil {
+		return err
+	}
+	defer batch.Free()
+
+	inputs := make([]input, 0, len(tokens))
+	for i, token := range tokens {
+		batch.Add(token, nil, i, false, baseId)
+		inputs = append(inputs, input{token: token})
+
+		if batch.NumTokens() == batch.Size() || i == len(tokens)-1 {
+			if err := s.lc.Decode(batch); err != nil {
+				return fmt.Errorf("failed to decode base prompt: %w", err)
+			}
+			batch.Clear()
+		}
+	}
+
+	s.cache.SetBase(inputs, baseId, s.loraDefaults)
+	slog.Info("decoded base prompt", "tokens", len(inputs))
+	return nil
+}
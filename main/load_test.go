@@ -0,0 +1,111 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateContextLength(t *testing.T) {
+	lines := captureLogs(t)
+
+	// within the trained length, or a model that doesn't report one
+	for _, trained := range []int{4096, 0} {
+		if err := validateContextLength(4096, trained, true); err != nil {
+			t.Errorf("trained %d: unexpected error %v", trained, err)
+		}
+	}
+	if len(lines) != 0 {
+		t.Errorf("expected no warning, got %s", <-lines)
+	}
+
+	// a kv-size above the trained length warns by default
+	if err := validateContextLength(8192, 4096, false); err != nil {
+		t.Fatalf("expected a warning only, got error %v", err)
+	}
+	select {
+	case line := <-lines:
+		if !strings.Contains(string(line), `"level":"WARN"`) || !strings.Contains(string(line), `"n_ctx_train":4096`) {
+			t.Errorf("unexpected log line %s", line)
+		}
+	default:
+		t.Error("expected a warning to be logged")
+	}
+
+	// and fails with --strict-context
+	if err := validateContextLength(8192, 4096, true); err == nil {
+		t.Error("expected an error with strict context checking")
+	}
+	if len(lines) != 0 {
+		t.Errorf("expected no warning alongside the error, got %s", <-lines)
+	}
+}
+
+func TestModelsReportsEffectiveFlashAttention(t *testing.T) {
+	lines := captureLogs(t)
+
+	cache, err := NewInputCache(nil, 64, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{status: ServerStatusReady, cache: cache, flashAttnRequested: true}
+
+	report := func() ModelInfo {
+		w := httptest.NewRecorder()
+		s.models(w, httptest.NewRequest(http.MethodGet, "/models", nil))
+		var resp ModelsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Models[0]
+	}
+
+	// requested, but turned off by llama.cpp when the context was created
+	recordFlashAttention(s, true, false)
+	if info := report(); info.FlashAttention || !info.FlashAttnRequested {
+		t.Errorf("expected flash attention reported off though requested, got %+v", info)
+	}
+	select {
+	case line := <-lines:
+		if !strings.Contains(string(line), `"level":"WARN"`) {
+			t.Errorf("unexpected log line %s", line)
+		}
+	default:
+		t.Error("expected a warning that flash attention was turned off")
+	}
+
+	recordFlashAttention(s, true, true)
+	if info := report(); !info.FlashAttention {
+		t.Errorf("expected flash attention reported on, got %+v", info)
+	}
+	if len(lines) != 0 {
+		t.Errorf("expected no warning when flash attention is in use, got %s", <-lines)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import(
+	"context"
+	"errors"
+	"fmt"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// logits handles the /completion/logits debug endpoint, which decodes a prompt
+// and returns the raw logits for the next token over the full vocabulary.
+//
+// The endpoint is only registered when the server is started with
+// `--debug-logits`, since a single response can contain hundreds of thousands
+// of values.
+//
+// Workflow:
+//   - Decodes the JSON request into a LogitsRequest.
+//   - Creates a logits-only sequence with no sampling context.
+//   - Acquires a free sequence slot and loads cache if enabled.
+//   - Waits for the prompt to be decoded and the logits to be captured.
+//   - Responds with the logit vector as JSON.
+//
+// Request example:
+// {
+//   "prompt": "The capital of France is",
+//   "cache_prompt": false
+// }
+//
+// Response example:
+// {
+//   "n_vocab": 128256,
+//   "logits": [-3.12, 0.54, ...]
+// }
+func (s *Server) logits(w http.ResponseWriter, r *http.Request) {
+	var req LogitsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Initialize a logits-only sequence
+	seq, err := s.NewSequence(req.Prompt, nil, NewSequenceParams{
+		logitsOnly: true,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), sequenceErrorStatus(err))
+		return
+	}
+
+	// Acquire available sequence slot
+	if err := s.acquireSequenceSlot(w, r.Context()); err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting logits request due to client closing the connection")
+		} else {
+			slog.Error("Failed to acquire semaphore", "error", err)
+		}
+		return
+	}
+
+	// Assign sequence to the first free slot
+	if err := s.assignSequence(seq, req.CachePrompt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Wait for the logits to be returned on the channel
+	writeLogits(w, <-seq.embedding)
+}
+
+// writeLogits writes the logit vector captured by a logits-only sequence,
+// which has one value per vocabulary token.
+func writeLogits(w http.ResponseWriter, logits []float32) {
+	if logits == nil {
+		http.Error(w, "failed to capture logits", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&LogitsResponse{
+		NumVocab: len(logits),
+		Logits:   logits,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
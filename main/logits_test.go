@@ -0,0 +1,73 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogitsEndpointRequiresFlag(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		mux := http.NewServeMux()
+		registerDebugRoutes(mux, &Server{}, &Config{debugLogits: enabled})
+
+		_, pattern := mux.Handler(httptest.NewRequest(http.MethodPost, "/completion/logits", nil))
+		if registered := pattern == "/completion/logits"; registered != enabled {
+			t.Errorf("--debug-logits=%v: expected the endpoint registered to be %v, got pattern %q", enabled, enabled, pattern)
+		}
+	}
+}
+
+func TestWriteLogitsCoversVocabulary(t *testing.T) {
+	const numVocab = 32000
+	logits := make([]float32, numVocab)
+	logits[42] = 3.5
+
+	w := httptest.NewRecorder()
+	writeLogits(w, logits)
+
+	var resp LogitsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.NumVocab != numVocab || len(resp.Logits) != numVocab {
+		t.Errorf("expected %d logits, got n_vocab %d and %d values", numVocab, resp.NumVocab, len(resp.Logits))
+	}
+	if resp.Logits[42] != 3.5 {
+		t.Errorf("expected logit 3.5 for token 42, got %v", resp.Logits[42])
+	}
+
+	// a sequence that ended without capturing logits is an error
+	w = httptest.NewRecorder()
+	writeLogits(w, nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 without logits, got %d", w.Code)
+	}
+}
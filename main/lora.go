@@ -0,0 +1,278 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements per-request LoRA adapter selection. llama.cpp applies
+// adapters to the whole context rather than to individual sequences, so requests
+// are grouped by adapter set: processBatch only batches sequences with identical
+// scales and switches the context's adapters between batches. Cached prompt
+// prefixes are likewise only reused under the adapter set they were decoded with.
+//
+// The `/lora` endpoints change the loaded adapters at runtime. A change waits
+// for the running sequences to finish, holding back new ones, since switching
+// adapters under a sequence would mix its output between models.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+var errInvalidLora = errors.New("invalid lora selection")
+
+var errLoraLoad = errors.New("failed to load lora adapter")
+
+var errLoraPreparedPrompt = errors.New("prepared prompts hold cache slots decoded under the current adapters")
+
+// LoraAdapterInfo describes a loaded adapter, with the id requests select it by.
+type LoraAdapterInfo struct {
+	ID    int     `json:"id"`
+	Path  string  `json:"path"`
+	Scale float32 `json:"scale"`
+}
+
+// LoraLoadRequest is the body of POST /lora. Scale defaults to 1.0.
+type LoraLoadRequest struct {
+	Path  string   `json:"path"`
+	Scale *float32 `json:"scale"`
+}
+
+// loraScales resolves a request's `lora` option into a scale for every loaded
+// adapter. Without the option the load-time scales are used; otherwise adapters
+// that are not listed are disabled (scale 0).
+func loraScales(defaults []float32, requested []LoraRequest) ([]float32, error) {
+	if requested == nil {
+		return defaults, nil
+	}
+
+	scales := make([]float32, len(defaults))
+	seen := make(map[int]bool)
+	for _, lora := range requested {
+		if lora.ID < 0 || lora.ID >= len(defaults) {
+			return nil, fmt.Errorf("%w: adapter %d is not loaded (%d adapters)", errInvalidLora, lora.ID, len(defaults))
+		}
+		if seen[lora.ID] {
+			return nil, fmt.Errorf("%w: adapter %d listed more than once", errInvalidLora, lora.ID)
+		}
+		if math.IsNaN(float64(lora.Scale)) || math.IsInf(float64(lora.Scale), 0) {
+			return nil, fmt.Errorf("%w: adapter %d has a non-finite scale", errInvalidLora, lora.ID)
+		}
+		seen[lora.ID] = true
+		scales[lora.ID] = lora.Scale
+	}
+
+	return scales, nil
+}
+
+// applyLora switches the context's adapters to the given scales before a batch
+// is decoded. Adapters with a scale of 0 are removed. The caller must hold s.mu.
+func applyLora(s *Server, scales []float32) error {
+	if slices.Equal(scales, s.loraScales) {
+		return nil
+	}
+
+	slog.Debug("switching lora adapters", "from", s.loraScales, "to", scales)
+	for i, adapter := range s.loras {
+		if scales[i] == s.loraScales[i] {
+			continue
+		}
+
+		if scales[i] == 0 {
+			s.lc.RemoveLoraAdapter(adapter)
+		} else if err := s.lc.SetLoraAdapter(adapter, scales[i]); err != nil {
+			return err
+		}
+	}
+
+	s.loraScales = scales
+	return nil
+}
+
+// loraAdapters lists the loaded adapters. The caller must hold s.mu.
+func (s *Server) loraAdapters() []LoraAdapterInfo {
+	adapters := make([]LoraAdapterInfo, len(s.loras))
+	for i := range s.loras {
+		adapters[i] = LoraAdapterInfo{ID: i, Path: s.loraPaths[i], Scale: s.loraDefaults[i]}
+	}
+	return adapters
+}
+
+// swapLora runs change once no sequence is running, holding s.mu so that no
+// batch is decoded and no sequence is assigned until it returns. Sequences
+// created under the previous adapters are rejected when they are assigned,
+// and cached prompts decoded under them are dropped. The change is refused
+// while prepared prompts hold cache slots.
+func (s *Server) swapLora(change func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.loraSwapping {
+		s.cond.Wait()
+	}
+	s.loraSwapping = true
+	defer func() {
+		s.loraSwapping = false
+		s.cond.Broadcast()
+	}()
+
+	// removeSequence wakes us while loraSwapping is set
+	for !allNil(s) {
+		s.cond.Wait()
+	}
+
+	if slices.ContainsFunc(s.cache.slots, func(slot InputCacheSlot) bool { return slot.InUse }) {
+		return errLoraPreparedPrompt
+	}
+
+	if err := change(); err != nil {
+		return err
+	}
+
+	s.loraGeneration++
+	s.cache.Clear()
+	return nil
+}
+
+// listLora handles `GET /lora`, returning the loaded adapters with the ids
+// that the `lora` request option selects them by and their default scales.
+//
+// Example response:
+// [
+//   {"id": 0, "path": "/models/style.gguf", "scale": 0.7}
+// ]
+func (s *Server) listLora(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	adapters := s.loraAdapters()
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(adapters); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// loadLora handles `POST /lora`, loading the adapter at path and applying it
+// at scale (1.0 if omitted) to requests without a `lora` option. It waits for
+// running sequences to finish first, and responds with the loaded adapters.
+//
+// Request example:
+// {
+//   "path": "/models/style.gguf",
+//   "scale": 0.7
+// }
+//
+// Response codes:
+//   - 200 OK: The adapter is applied
+//   - 400 Bad Request: No path, a non-finite scale or an adapter that can't be loaded
+//   - 409 Conflict: Prepared prompts are in progress
+func (s *Server) loadLora(w http.ResponseWriter, r *http.Request) {
+	var req LoraLoadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.Path == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+	scale := float32(1.0)
+	if req.Scale != nil {
+		scale = *req.Scale
+	}
+	if math.IsNaN(float64(scale)) || math.IsInf(float64(scale), 0) {
+		http.Error(w, "scale must be finite", http.StatusBadRequest)
+		return
+	}
+
+	var adapters []LoraAdapterInfo
+	err := s.swapLora(func() error {
+		adapter, err := s.model.LoadLoraAdapter(req.Path)
+		if err != nil {
+			return fmt.Errorf("%w %q: %v", errLoraLoad, req.Path, err)
+		}
+		if err := s.lc.SetLoraAdapter(adapter, scale); err != nil {
+			adapter.Free()
+			return err
+		}
+
+		s.loras = append(s.loras, adapter)
+		s.loraPaths = append(s.loraPaths, req.Path)
+		s.loraDefaults = append(slices.Clip(s.loraDefaults), scale)
+		s.loraScales = append(slices.Clip(s.loraScales), scale)
+		adapters = s.loraAdapters()
+		return nil
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errLoraLoad) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, errLoraPreparedPrompt) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	slog.Info("loaded lora adapter", "path", req.Path, "scale", scale)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(adapters); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// clearLora handles `DELETE /lora`, removing every loaded adapter once the
+// running sequences have finished.
+//
+// Response codes:
+//   - 204 No Content: The adapters are removed
+//   - 409 Conflict: Prepared prompts are in progress
+func (s *Server) clearLora(w http.ResponseWriter, r *http.Request) {
+	err := s.swapLora(func() error {
+		for _, adapter := range s.loras {
+			s.lc.RemoveLoraAdapter(adapter)
+			adapter.Free()
+		}
+
+		s.loras, s.loraPaths, s.loraDefaults, s.loraScales = nil, nil, nil, nil
+		return nil
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errLoraPreparedPrompt) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	slog.Info("removed all lora adapters")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,179 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestLoraScales(t *testing.T) {
+	defaults := []float32{1, 1, 1}
+
+	scales, err := loraScales(defaults, nil)
+	if err != nil || !slices.Equal(scales, defaults) {
+		t.Errorf("expected load-time scales without a lora option, got %v (%v)", scales, err)
+	}
+
+	scales, err = loraScales(defaults, []LoraRequest{{ID: 2, Scale: 0.5}, {ID: 0, Scale: 1.5}})
+	if err != nil || !slices.Equal(scales, []float32{1.5, 0, 0.5}) {
+		t.Errorf("expected unlisted adapters to be disabled, got %v (%v)", scales, err)
+	}
+
+	invalid := [][]LoraRequest{
+		{{ID: 3, Scale: 1}},
+		{{ID: -1, Scale: 1}},
+		{{ID: 0, Scale: 1}, {ID: 0, Scale: 0.5}},
+		{{ID: 1, Scale: float32(math.NaN())}},
+	}
+	for _, requested := range invalid {
+		if _, err := loraScales(defaults, requested); !errors.Is(err, errInvalidLora) {
+			t.Errorf("expected %v to be rejected, got %v", requested, err)
+		}
+	}
+}
+
+func TestLoadCacheSlotLoraMismatch(t *testing.T) {
+	prompt := tokenInputs(1, 2, 3, 4)
+	adapterA := []float32{1, 0}
+	adapterB := []float32{0, 0.5}
+
+	c, err := NewInputCache(nil, 16, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a request under adapter A populates the slot
+	slot, remaining, err := c.LoadCacheSlot(prompt, true, adapterA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot.Inputs = append(slot.Inputs, remaining...)
+	slot.InUse = false
+
+	// the same prompt under adapter A reuses the cached prefix
+	slot, remaining, err = c.LoadCacheSlot(prompt, true, adapterA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 {
+		t.Errorf("expected cached prefix to be reused under the same adapters, %d inputs remaining", len(remaining))
+	}
+	slot.Inputs = append(slot.Inputs, remaining...)
+	slot.InUse = false
+
+	// a different adapter set must decode the whole prompt again
+	slot, remaining, err = c.LoadCacheSlot(prompt, true, adapterB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != len(prompt) || len(slot.Inputs) != 0 {
+		t.Errorf("expected no reuse across adapter sets, %d inputs remaining", len(remaining))
+	}
+	if !slices.Equal(slot.lora, adapterB) {
+		t.Errorf("expected slot to record adapter set %v, got %v", adapterB, slot.lora)
+	}
+}
+
+func TestSwapLoraWaitsForRunningSequences(t *testing.T) {
+	cache, err := NewInputCache(nil, 32, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.slots[1].Inputs = tokenInputs(7, 8)
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(2),
+		cache:   cache,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	acquire := func() {
+		if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a running sequence, and a request created before the change
+	acquire()
+	if err := s.assignSequence(newTestSequence(tokenInputs(1, 2, 3)), false); err != nil {
+		t.Fatal(err)
+	}
+	stale := newTestSequence(tokenInputs(4))
+
+	changed := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.swapLora(func() error {
+			close(changed)
+			return nil
+		})
+	}()
+
+	select {
+	case <-changed:
+		t.Fatal("expected the change to wait for the running sequence")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the change goes through once the sequence finishes
+	s.mu.Lock()
+	removeSequence(s, 0, StopReasonStop)
+	s.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s.loraGeneration != 1 || s.loraSwapping {
+		t.Errorf("expected generation 1 with the swap finished, got %d (swapping %v)", s.loraGeneration, s.loraSwapping)
+	}
+	if len(cache.slots[1].Inputs) != 0 {
+		t.Error("expected prompts cached under the old adapters to be dropped")
+	}
+
+	// the request resolved its adapters before the change, so it is rejected
+	acquire()
+	if err := s.assignSequence(stale, false); !errors.Is(err, errInvalidLora) {
+		t.Errorf("expected errInvalidLora for a stale request, got %v", err)
+	}
+	if !s.seqsSem.TryAcquire(2) {
+		t.Error("expected the rejected request to release its slot")
+	}
+	s.seqsSem.Release(2)
+
+	// a prepared prompt holding a cache slot blocks changes
+	cache.slots[0].InUse = true
+	if err := s.swapLora(func() error { return nil }); !errors.Is(err, errLoraPreparedPrompt) {
+		t.Errorf("expected errLoraPreparedPrompt, got %v", err)
+	}
+}
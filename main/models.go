@@ -0,0 +1,115 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"encoding/json"
+	"net/http"
+)
+
+// models handles the `/models` endpoint, which describes the loaded model.
+//
+// `n_ctx_train` is the context length the model was trained with and `n_ctx`
+// the context each sequence slot gets (kv-size divided by the number of
+// slots); both are 0 until the model has loaded. `flash_attn` is whether the
+// context actually uses flash attention, which llama.cpp turns off for models
+// that don't support it, and `flash_attn_requested` the --flash-attn setting.
+//
+// Example response:
+// {
+//   "models": [
+//     {"id": "llama-3.2-3b.gguf", "path": "models/llama-3.2-3b.gguf", "n_ctx_train": 131072, "n_ctx": 2048,
+//      "flash_attn": true, "flash_attn_requested": true}
+//   ]
+// }
+func (s *Server) models(w http.ResponseWriter, r *http.Request) {
+	info := ModelInfo{
+		ID:                 filepath.Base(s.modelPath),
+		Path:               s.modelPath,
+		TrainedContext:     s.trainedCtx,
+		FlashAttnRequested: s.flashAttnRequested,
+	}
+	if s.status == ServerStatusReady {
+		info.Context = s.cache.numCtx
+		info.FlashAttention = s.flashAttn
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&ModelsResponse{Models: []ModelInfo{info}}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// modelDetails handles `GET /model`, reporting what is actually loaded: the
+// model's embedding size, per-slot context, vocabulary size and whether a BOS
+// token is added, along with the vision model architecture and the paths of
+// the applied LoRA adapters. Returns 503 until the model has loaded.
+//
+// Example response:
+// {
+//   "path": "models/llama-3.2-11b-vision.gguf",
+//   "n_embd": 4096,
+//   "n_ctx": 2048,
+//   "n_ctx_train": 131072,
+//   "n_vocab": 128256,
+//   "add_bos": true,
+//   "vision": true,
+//   "vision_arch": "mllama",
+//   "loras": ["adapters/summarize.gguf"]
+// }
+func (s *Server) modelDetails(w http.ResponseWriter, r *http.Request) {
+	if s.status != ServerStatusReady {
+		http.Error(w, "model is not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.mu.Lock()
+	loras := slices.Clone(s.loraPaths)
+	s.mu.Unlock()
+	if loras == nil {
+		loras = []string{}
+	}
+
+	details := ModelDetails{
+		Path:           s.modelPath,
+		EmbeddingSize:  s.model.NEmbd(),
+		Context:        s.cache.numCtx,
+		TrainedContext: s.trainedCtx,
+		VocabSize:      s.model.NumVocab(),
+		AddBOS:         s.model.AddBOSToken(),
+		Vision:         s.image != nil,
+		VisionArch:     s.image.Architecture(),
+		Loras:          loras,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&details); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
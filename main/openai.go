@@ -0,0 +1,363 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements an OpenAI-compatible `/v1/chat/completions` endpoint so
+// that existing OpenAI SDK clients can be pointed at this server. Messages are
+// formatted with the model's chat template and generated like a /completion
+// request, with the OpenAI fields mapped onto the server's options.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"llm-server/llama"
+)
+
+// ChatCompletionRequest is the OpenAI chat completion request. Fields not
+// listed are ignored.
+type ChatCompletionRequest struct {
+	Model            string        `json:"model"`
+	Messages         []ChatMessage `json:"messages"`
+	Stream           bool          `json:"stream"`
+	MaxTokens        *int          `json:"max_tokens"`
+	Temperature      *float32      `json:"temperature"`
+	TopP             *float32      `json:"top_p"`
+	Stop             stopSequences `json:"stop"`
+	Seed             *int          `json:"seed"`
+	FrequencyPenalty *float32      `json:"frequency_penalty"`
+	PresencePenalty  *float32      `json:"presence_penalty"`
+}
+
+// ChatMessage is one message of an OpenAI conversation.
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// stopSequences accepts OpenAI's `stop`, which is either a string or an array.
+type stopSequences []string
+
+func (s *stopSequences) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = stopSequences{one}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(s))
+}
+
+// ChatCompletion is the non-streaming OpenAI response.
+type ChatCompletion struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   ChatCompletionUsage    `json:"usage"`
+}
+
+type ChatCompletionChoice struct {
+	Index        int         `json:"index"`
+	Message      ChatMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+type ChatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ChatCompletionChunk is one streamed OpenAI delta.
+type ChatCompletionChunk struct {
+	ID      string                      `json:"id"`
+	Object  string                      `json:"object"`
+	Created int64                       `json:"created"`
+	Model   string                      `json:"model"`
+	Choices []ChatCompletionChunkChoice `json:"choices"`
+}
+
+type ChatCompletionChunkChoice struct {
+	Index        int       `json:"index"`
+	Delta        ChatDelta `json:"delta"`
+	FinishReason *string   `json:"finish_reason"`
+}
+
+type ChatDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// openAIError writes an error in OpenAI's {"error": {"message", "type"}} envelope.
+func openAIError(w http.ResponseWriter, status int, message string) {
+	errType := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		errType = "server_error"
+	}
+
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	body.Error.Message = message
+	body.Error.Type = errType
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&body)
+}
+
+// chatOptions applies the OpenAI request fields to the server's default options.
+func chatOptions(req *ChatCompletionRequest, defaults Options) Options {
+	opts := defaults
+	if req.MaxTokens != nil {
+		opts.NumPredict = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		opts.Temperature = *req.Temperature
+	}
+	if req.TopP != nil {
+		opts.TopP = *req.TopP
+	}
+	if req.Seed != nil {
+		opts.Seed = *req.Seed
+	}
+	if req.FrequencyPenalty != nil {
+		opts.FrequencyPenalty = *req.FrequencyPenalty
+	}
+	if req.PresencePenalty != nil {
+		opts.PresencePenalty = *req.PresencePenalty
+	}
+	if req.Stop != nil {
+		opts.Stop = req.Stop
+	}
+	return opts
+}
+
+// chatFinishReason maps a stop reason to OpenAI's finish_reason.
+func chatFinishReason(reason StopReason) string {
+	if reason == StopReasonLimit {
+		return "length"
+	}
+	return "stop"
+}
+
+// chatCompletions handles the OpenAI-compatible `/v1/chat/completions`
+// endpoint. With "stream": true the reply is sent as Server-Sent Events of
+// chat.completion.chunk objects ending with "data: [DONE]"; otherwise a single
+// chat.completion object is returned. Errors use OpenAI's error envelope.
+//
+// Request example:
+// {
+//   "messages": [
+//     {"role": "system", "content": "You are terse."},
+//     {"role": "user", "content": "What is the capital of France?"}
+//   ],
+//   "max_tokens": 32,
+//   "temperature": 0.2,
+//   "stop": ["\n\n"]
+// }
+func (s *Server) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	InferenceStats.Requests.Add(1)
+
+	if r.Method != http.MethodPost {
+		openAIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		openAIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if len(req.Messages) == 0 {
+		openAIError(w, http.StatusBadRequest, "messages must not be empty")
+		return
+	}
+
+	opts := chatOptions(&req, s.defaults)
+	if err := validateOptions(opts); err != nil {
+		openAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.waitReady(); err != nil {
+		openAIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	messages := make([]llama.ChatMessage, len(req.Messages))
+	for i, msg := range req.Messages {
+		messages[i] = llama.ChatMessage{Role: msg.Role, Content: msg.Content}
+	}
+	prompt, err := s.model.ApplyChatTemplate(messages)
+	if err != nil {
+		openAIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	samplingParams := toSamplingParams(opts, "")
+	seq, err := s.NewSequence(prompt, nil, NewSequenceParams{
+		numPredict:     opts.NumPredict,
+		stop:           opts.Stop,
+		numKeep:        opts.NumKeep,
+		samplingParams: &samplingParams,
+		seed:           requestSeed(&opts.Seed),
+	})
+	if err != nil {
+		openAIError(w, sequenceErrorStatus(err), fmt.Sprintf("failed to create new sequence: %v", err))
+		return
+	}
+
+	if err := s.acquireSequenceSlot(w, r.Context()); err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting chat completion request due to client closing the connection")
+		} else {
+			slog.Error("Failed to acquire semaphore", "error", err)
+		}
+		return
+	}
+
+	if err := s.assignSequence(seq, true); err != nil {
+		openAIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	id := "chatcmpl-" + seq.id
+	created := time.Now().Unix()
+	model := req.Model
+	if model == "" {
+		model = filepath.Base(s.modelPath)
+	}
+
+	if req.Stream {
+		s.streamChatCompletion(w, r, seq, id, created, model)
+		return
+	}
+
+	var content []byte
+	for {
+		select {
+		case <-r.Context().Done():
+			close(seq.quit)
+			return
+		case resp, ok := <-seq.responses:
+			if ok {
+				content = append(content, resp.content...)
+				continue
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&ChatCompletion{
+				ID:      id,
+				Object:  "chat.completion",
+				Created: created,
+				Model:   model,
+				Choices: []ChatCompletionChoice{{
+					Message:      ChatMessage{Role: "assistant", Content: string(content)},
+					FinishReason: chatFinishReason(seq.doneReason),
+				}},
+				Usage: ChatCompletionUsage{
+					PromptTokens:     seq.numPromptInputs,
+					CompletionTokens: seq.numPredicted,
+					TotalTokens:      seq.numPromptInputs + seq.numPredicted,
+				},
+			}); err != nil {
+				openAIError(w, http.StatusInternalServerError, fmt.Sprintf("failed to encode response: %v", err))
+			}
+			return
+		}
+	}
+}
+
+// streamChatCompletion streams seq's output as OpenAI chat.completion.chunk
+// Server-Sent Events: a first chunk with the assistant role, one per piece of
+// content, a final empty chunk with the finish reason, and "data: [DONE]".
+func (s *Server) streamChatCompletion(w http.ResponseWriter, r *http.Request, seq *Sequence, id string, created int64, model string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		close(seq.quit)
+		openAIError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	stream := newStreamWriter(w, flusher, s.flushBytes, s.flushLatency)
+	stream.format = formatSSE
+
+	chunk := func(delta ChatDelta, finishReason *string) *ChatCompletionChunk {
+		return &ChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []ChatCompletionChunkChoice{{Delta: delta, FinishReason: finishReason}},
+		}
+	}
+
+	if err := stream.Encode(chunk(ChatDelta{Role: "assistant"}, nil)); err != nil {
+		close(seq.quit)
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			close(seq.quit)
+			return
+		case <-stream.Deadline():
+			stream.Flush()
+		case resp, ok := <-seq.responses:
+			if ok {
+				if err := stream.Encode(chunk(ChatDelta{Content: resp.content}, nil)); err != nil {
+					close(seq.quit)
+					return
+				}
+				stream.MaybeFlush()
+				continue
+			}
+
+			defer stream.Flush()
+			finishReason := chatFinishReason(seq.doneReason)
+			if err := stream.Encode(chunk(ChatDelta{}, &finishReason)); err != nil {
+				return
+			}
+			stream.Write([]byte(sseDone))
+			return
+		}
+	}
+}
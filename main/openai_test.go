@@ -0,0 +1,112 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestStopSequencesUnmarshal(t *testing.T) {
+	cases := map[string]stopSequences{
+		`{"stop": "\n"}`:       {"\n"},
+		`{"stop": ["a", "b"]}`: {"a", "b"},
+		`{"messages": []}`:     nil,
+	}
+
+	for body, want := range cases {
+		var req ChatCompletionRequest
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if !reflect.DeepEqual(req.Stop, want) {
+			t.Errorf("%s: stop = %q, want %q", body, req.Stop, want)
+		}
+	}
+}
+
+func TestChatOptions(t *testing.T) {
+	defaults := DefaultOptions()
+	maxTokens, seed := 16, 7
+	temperature, topP := float32(0.2), float32(0.5)
+	req := &ChatCompletionRequest{
+		MaxTokens:   &maxTokens,
+		Temperature: &temperature,
+		TopP:        &topP,
+		Seed:        &seed,
+		Stop:        stopSequences{"END"},
+	}
+
+	opts := chatOptions(req, defaults)
+	if opts.NumPredict != 16 || opts.Temperature != 0.2 || opts.TopP != 0.5 || opts.Seed != 7 {
+		t.Errorf("options not mapped: %+v", opts)
+	}
+	if !reflect.DeepEqual(opts.Stop, []string{"END"}) {
+		t.Errorf("stop = %q", opts.Stop)
+	}
+	if opts.TopK != defaults.TopK {
+		t.Errorf("top_k = %d, want default %d", opts.TopK, defaults.TopK)
+	}
+
+	if opts := chatOptions(&ChatCompletionRequest{}, defaults); !reflect.DeepEqual(opts, defaults) {
+		t.Errorf("empty request changed defaults: %+v", opts)
+	}
+}
+
+func TestChatFinishReason(t *testing.T) {
+	if got := chatFinishReason(StopReasonLimit); got != "length" {
+		t.Errorf("limit = %q, want length", got)
+	}
+	if got := chatFinishReason(StopReasonStop); got != "stop" {
+		t.Errorf("stop = %q, want stop", got)
+	}
+}
+
+func TestOpenAIError(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusBadRequest:          "invalid_request_error",
+		http.StatusInternalServerError: "server_error",
+	} {
+		rec := httptest.NewRecorder()
+		openAIError(rec, status, "boom")
+
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != status || body.Error.Message != "boom" || body.Error.Type != want {
+			t.Errorf("status %d: got %d %+v", status, rec.Code, body.Error)
+		}
+	}
+}
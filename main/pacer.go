@@ -0,0 +1,90 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"time"
+)
+
+// tokenPacer caps the rate at which the decode loop generates tokens across all
+// sequences (see --max-global-tps). Each generated token pushes back the time
+// the next batch may be decoded by 1/rate seconds, so the aggregate rate over
+// any window stays at or under the cap. Idle time is not banked as credit for
+// later bursts.
+//
+// A nil tokenPacer imposes no limit. It is only used by the decode loop, so it
+// needs no locking.
+type tokenPacer struct {
+	interval time.Duration // time budgeted per generated token
+	next     time.Time     // earliest time the next batch may be decoded
+}
+
+// newTokenPacer returns a pacer for the given tokens per second, or nil if
+// tps is not positive.
+func newTokenPacer(tps float64) *tokenPacer {
+	if tps <= 0 {
+		return nil
+	}
+
+	return &tokenPacer{interval: time.Duration(float64(time.Second) / tps)}
+}
+
+// Add accounts for n tokens generated at now.
+func (p *tokenPacer) Add(n int, now time.Time) {
+	if p == nil {
+		return
+	}
+
+	if p.next.Before(now) {
+		p.next = now
+	}
+	p.next = p.next.Add(time.Duration(n) * p.interval)
+}
+
+// Wait blocks until the next batch may be decoded or ctx is cancelled. It must
+// be called without holding s.mu, so that handlers can keep adding and
+// removing sequences while the decode loop is throttled.
+func (p *tokenPacer) Wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	delay := time.Until(p.next)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenPacerCapsAggregateThroughput(t *testing.T) {
+	const tps = 500
+	const sequences = 4
+	const batches = 30
+
+	pacer := newTokenPacer(tps)
+	ctx := context.Background()
+
+	// each batch samples one token for every active sequence
+	start := time.Now()
+	tokens := 0
+	for range batches {
+		if err := pacer.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+		pacer.Add(sequences, time.Now())
+		tokens += sequences
+	}
+	if err := pacer.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rate := float64(tokens) / time.Since(start).Seconds()
+	if rate > tps {
+		t.Errorf("expected at most %d tokens/s, got %.1f", tps, rate)
+	}
+	if rate < tps/2 {
+		t.Errorf("expected throttling close to the cap, got %.1f tokens/s", rate)
+	}
+}
+
+func TestTokenPacerDisabledAndCancelled(t *testing.T) {
+	pacer := newTokenPacer(0)
+	if pacer != nil {
+		t.Fatal("expected no pacer for a zero cap")
+	}
+	pacer.Add(1000, time.Now())
+	if err := pacer.Wait(context.Background()); err != nil {
+		t.Errorf("expected a nil pacer not to wait, got %v", err)
+	}
+
+	// a throttled decode loop still stops promptly on shutdown
+	pacer = newTokenPacer(1)
+	pacer.Add(60, time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pacer.Wait(ctx); err == nil {
+		t.Error("expected Wait to return the context error")
+	}
+}
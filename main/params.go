@@ -0,0 +1,197 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file declares the valid range of each sampling option. The same spec
+// backs both the /params/schema endpoint, which lets clients build UIs and
+// validate locally, and the server-side validation of completion requests, so
+// the two cannot drift apart.
+
+import(
+	"fmt"
+	"reflect"
+	"strings"
+	"encoding/json"
+	"net/http"
+)
+
+// optionSpec declares the bounds of a single Options field, keyed by its JSON
+// name. A nil bound is unbounded.
+type optionSpec struct {
+	min         *float64
+	max         *float64
+	description string
+}
+
+func bound(v float64) *float64 { return &v }
+
+// optionSpecs covers every field of Options, including the embedded Runner
+// fields, which are accepted for compatibility but fixed at load time.
+var optionSpecs = map[string]optionSpec{
+	"n_keep":            {min: bound(-1), description: "Prompt tokens kept on context shift (-1 keeps the whole prompt)"},
+	"seed":              {min: bound(-1), description: "Sampling seed (-1 for random)"},
+	"n_predict":         {min: bound(-1), description: "Maximum tokens to generate (-1 for unlimited)"},
+	"top_k":             {min: bound(0), description: "Sample from the k most likely tokens (0 disables)"},
+	"top_p":             {min: bound(0), max: bound(1), description: "Nucleus sampling probability mass"},
+	"min_p":             {min: bound(0), max: bound(1), description: "Minimum token probability relative to the most likely token"},
+	"tfs_z":             {min: bound(0), max: bound(1), description: "Tail free sampling parameter (1 disables)"},
+	"typical_p":         {min: bound(0), max: bound(1), description: "Locally typical sampling probability mass (1 disables)"},
+	"repeat_last_n":     {min: bound(-1), description: "Tokens considered for repetition penalties (-1 for the whole context)"},
+	"temperature":       {min: bound(0), description: "Sampling temperature (0 is greedy)"},
+	"repeat_penalty":    {min: bound(0), description: "Penalty for repeated tokens (1 disables)"},
+	"presence_penalty":  {min: bound(-2), max: bound(2), description: "Penalty for tokens already present"},
+	"frequency_penalty": {min: bound(-2), max: bound(2), description: "Penalty proportional to token frequency"},
+	"mirostat":          {min: bound(0), max: bound(2), description: "Mirostat version (0 disables)"},
+	"mirostat_tau":      {min: bound(0), description: "Mirostat target entropy"},
+	"mirostat_eta":      {min: bound(0), max: bound(1), description: "Mirostat learning rate"},
+	"penalize_nl":       {description: "Apply repetition penalties to newlines"},
+	"stop":              {description: "Sequences that stop generation"},
+	"lora":              {description: "Loaded LoRA adapters to activate, as {id, scale} pairs (omit to use every adapter at scale 1)"},
+
+	"num_ctx":    {min: bound(0), description: "Ignored; set by --kv-size at load time"},
+	"num_batch":  {min: bound(0), description: "Ignored; set by --batch-size at load time"},
+	"num_gpu":    {min: bound(-1), description: "Ignored; set by --gpu-layers at load time"},
+	"main_gpu":   {min: bound(0), description: "Ignored; set by --main-gpu at load time"},
+	"low_vram":   {description: "Ignored"},
+	"f16_kv":     {description: "Deprecated and ignored"},
+	"logits_all": {description: "Ignored"},
+	"vocab_only": {description: "Ignored"},
+	"use_mmap":   {description: "Ignored; set by --no-mmap at load time"},
+	"use_mlock":  {description: "Ignored; set by --mlock at load time"},
+	"num_thread": {min: bound(0), description: "Ignored; set by --threads at load time"},
+}
+
+// ParamSchema is a JSON Schema describing the accepted sampling options.
+type ParamSchema struct {
+	Type       string                     `json:"type"`
+	Properties map[string]ParamSchemaField `json:"properties"`
+}
+
+// ParamSchemaField describes one option's type, default and valid range.
+type ParamSchemaField struct {
+	Type        string   `json:"type"`
+	Default     any      `json:"default"`
+	Minimum     *float64 `json:"minimum,omitempty"`
+	Maximum     *float64 `json:"maximum,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// optionFields returns the fields of an Options value keyed by JSON name,
+// descending into embedded structs.
+func optionFields(v reflect.Value) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		if field.Anonymous {
+			for name, value := range optionFields(v.Field(i)) {
+				fields[name] = value
+			}
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		fields[name] = v.Field(i)
+	}
+	return fields
+}
+
+// schemaType maps a Go option type to its JSON Schema type name.
+func schemaType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice:
+		return "array"
+	case reflect.Pointer:
+		return schemaType(t.Elem())
+	}
+	return "string"
+}
+
+// optionsSchema builds the schema from optionSpecs, reporting defaults as the
+// values a request omitting the field would get.
+func optionsSchema(defaults Options) ParamSchema {
+	schema := ParamSchema{Type: "object", Properties: make(map[string]ParamSchemaField)}
+	for name, value := range optionFields(reflect.ValueOf(defaults)) {
+		spec := optionSpecs[name]
+		schema.Properties[name] = ParamSchemaField{
+			Type:        schemaType(value.Type()),
+			Default:     value.Interface(),
+			Minimum:     spec.min,
+			Maximum:     spec.max,
+			Description: spec.description,
+		}
+	}
+	return schema
+}
+
+// validateOptions checks every numeric option against its declared range.
+func validateOptions(opts Options) error {
+	for name, value := range optionFields(reflect.ValueOf(opts)) {
+		spec := optionSpecs[name]
+
+		var n float64
+		switch value.Kind() {
+		case reflect.Int:
+			n = float64(value.Int())
+		case reflect.Float32:
+			n = value.Float()
+		default:
+			continue
+		}
+
+		if spec.min != nil && n < *spec.min {
+			return fmt.Errorf("%s must be at least %v (got %v)", name, *spec.min, n)
+		}
+		if spec.max != nil && n > *spec.max {
+			return fmt.Errorf("%s must be at most %v (got %v)", name, *spec.max, n)
+		}
+	}
+	return nil
+}
+
+// paramsSchema handles the `/params/schema` endpoint, returning a JSON Schema
+// with the type, default and valid range of every completion option.
+//
+// Example response:
+// {
+//   "type": "object",
+//   "properties": {
+//     "temperature": {"type": "number", "default": 0.8, "minimum": 0, "description": "..."},
+//     "top_p": {"type": "number", "default": 0.9, "minimum": 0, "maximum": 1, "description": "..."},
+//     ...
+//   }
+// }
+func (s *Server) paramsSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(optionsSchema(s.defaults)); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOptionsSchemaListsAllFields(t *testing.T) {
+	schema := optionsSchema(DefaultOptions())
+
+	fields := optionFields(reflect.ValueOf(Options{}))
+	if len(schema.Properties) != len(fields) {
+		t.Errorf("expected %d properties, got %d", len(fields), len(schema.Properties))
+	}
+	for name := range fields {
+		if _, ok := optionSpecs[name]; !ok {
+			t.Errorf("option %q has no spec", name)
+		}
+		field, ok := schema.Properties[name]
+		if !ok {
+			t.Errorf("option %q missing from schema", name)
+			continue
+		}
+		if field.Minimum != nil && field.Maximum != nil && *field.Minimum > *field.Maximum {
+			t.Errorf("option %q has empty range [%v, %v]", name, *field.Minimum, *field.Maximum)
+		}
+	}
+
+	temperature := schema.Properties["temperature"]
+	if temperature.Type != "number" || temperature.Default != float32(0.8) || temperature.Minimum == nil || *temperature.Minimum != 0 {
+		t.Errorf("unexpected temperature schema: %+v", temperature)
+	}
+	if topP := schema.Properties["top_p"]; topP.Maximum == nil || *topP.Maximum != 1 {
+		t.Errorf("expected top_p to be bounded by 1, got %+v", topP)
+	}
+	if stop := schema.Properties["stop"]; stop.Type != "array" {
+		t.Errorf("expected stop to be an array, got %q", stop.Type)
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	if err := validateOptions(DefaultOptions()); err != nil {
+		t.Fatalf("expected defaults to be valid, got %v", err)
+	}
+
+	opts := DefaultOptions()
+	opts.TopP = 1.5
+	if err := validateOptions(opts); err == nil {
+		t.Error("expected top_p above 1 to be rejected")
+	}
+
+	opts = DefaultOptions()
+	opts.Temperature = -0.1
+	if err := validateOptions(opts); err == nil {
+		t.Error("expected negative temperature to be rejected")
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// preparedPromptTTL is how long a prepared prompt may sit idle between chunks
+// before its sequence slot and cache slot are released.
+const preparedPromptTTL = 10 * time.Minute
+
+var errUnknownPrompt = errors.New("unknown or expired prompt_id")
+
+// preparedPrompt is a prompt submitted in chunks. From /completion/prepare
+// until /completion/run it holds one sequence slot and one reserved cache slot,
+// into which each chunk is decoded as it arrives.
+type preparedPrompt struct {
+	mu       sync.Mutex
+	id       string
+	slot     *InputCacheSlot
+	pending  string // trailing text held back until the next chunk
+	started  bool   // whether any text has been tokenized (and BOS added)
+	done     bool   // run or expired; the slots are no longer owned
+	expiry   *time.Timer
+	tokenize func(text string, addSpecial bool) ([]int, error)
+}
+
+// prepare handles the `/completion/prepare` endpoint, the first step of
+// submitting a prompt too large to send in one request:
+//
+//  1. POST /completion/prepare reserves a slot and returns a prompt ID
+//  2. POST /completion/append adds a chunk of text, which is tokenized and
+//     decoded into the slot before the request returns; repeat as needed
+//  3. POST /completion/run is a regular completion request with `prompt_id`
+//     set instead of `prompt`, and streams the generated output
+//
+// A prepared prompt that receives no chunk for 10 minutes is discarded.
+//
+// Response example:
+// {
+//   "prompt_id": "9f2c1e4ab07d3c55",
+//   "tokens": 0
+// }
+func (s *Server) prepare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.waitReady(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := s.acquireSequenceSlot(w, r.Context()); err != nil {
+		slog.Info("aborting prepare request", "error", err)
+		return
+	}
+
+	p, err := s.newPreparedPrompt(func(text string, addSpecial bool) ([]int, error) {
+		return s.lc.Model().Tokenize(text, addSpecial, true)
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to prepare prompt: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&PreparedPromptResponse{PromptID: p.id}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// appendPrompt handles the `/completion/append` endpoint, adding a chunk of
+// text to a prepared prompt. Chunks may split the text anywhere; the text
+// after the last whitespace is held back until the next chunk so that words
+// are tokenized whole.
+//
+// Request example:
+// {
+//   "prompt_id": "9f2c1e4ab07d3c55",
+//   "content": "...next part of the prompt..."
+// }
+//
+// Response codes:
+//   - 200 OK: The chunk was decoded; the body reports the tokens decoded so far
+//   - 400 Bad Request: The body could not be decoded or the prompt no longer fits the context
+//   - 404 Not Found: No prepared prompt with the given ID
+func (s *Server) appendPrompt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AppendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	p := s.lookupPreparedPrompt(req.PromptID)
+	if p == nil {
+		http.Error(w, errUnknownPrompt.Error(), http.StatusNotFound)
+		return
+	}
+
+	tokens, err := s.appendPreparedPrompt(p, req.Content)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnknownPrompt) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, errPromptTooLong) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&PreparedPromptResponse{PromptID: p.id, Tokens: tokens}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// completionRun handles the `/completion/run` endpoint. It accepts the same
+// body as /completion, but generates from the prepared prompt named by
+// `prompt_id`, which is consumed.
+func (s *Server) completionRun(w http.ResponseWriter, r *http.Request) {
+	req, err := s.decodeCompletion(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if req.PromptID == "" {
+		http.Error(w, "prompt_id is required", http.StatusBadRequest)
+		return
+	}
+
+	s.serveCompletion(w, r, req)
+}
+
+// newPreparedPrompt reserves a cache slot for a new prepared prompt. The caller
+// must have acquired a sequence slot, which is released on failure.
+func (s *Server) newPreparedPrompt(tokenize func(string, bool) ([]int, error)) (*preparedPrompt, error) {
+	id, err := newRequestID()
+	if err != nil {
+		s.seqsSem.Release(1)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	slot, err := s.cache.ReserveCacheSlot(s.loraDefaults)
+	s.mu.Unlock()
+	if err != nil {
+		s.seqsSem.Release(1)
+		return nil, err
+	}
+
+	p := &preparedPrompt{id: id, slot: slot, tokenize: tokenize}
+	p.expiry = time.AfterFunc(preparedPromptTTL, func() {
+		if p := s.takePreparedPrompt(id); p != nil {
+			slog.Info("discarding idle prepared prompt", "prompt_id", id)
+			p.mu.Lock()
+			s.releasePreparedPrompt(p)
+			p.mu.Unlock()
+		}
+	})
+
+	s.promptsMu.Lock()
+	if s.prompts == nil {
+		s.prompts = make(map[string]*preparedPrompt)
+	}
+	s.prompts[id] = p
+	s.promptsMu.Unlock()
+
+	return p, nil
+}
+
+// lookupPreparedPrompt returns the prepared prompt with the given ID, or nil.
+func (s *Server) lookupPreparedPrompt(id string) *preparedPrompt {
+	s.promptsMu.Lock()
+	defer s.promptsMu.Unlock()
+
+	return s.prompts[id]
+}
+
+// takePreparedPrompt removes the prepared prompt with the given ID and returns
+// it, or nil. Only the caller that takes a prompt may release its slots.
+func (s *Server) takePreparedPrompt(id string) *preparedPrompt {
+	s.promptsMu.Lock()
+	defer s.promptsMu.Unlock()
+
+	p := s.prompts[id]
+	delete(s.prompts, id)
+	return p
+}
+
+// releasePreparedPrompt frees the slots held by a prepared prompt that has been
+// taken. The caller must hold p.mu.
+func (s *Server) releasePreparedPrompt(p *preparedPrompt) {
+	p.done = true
+	p.expiry.Stop()
+
+	s.mu.Lock()
+	p.slot.InUse = false
+	s.mu.Unlock()
+	s.seqsSem.Release(1)
+}
+
+// appendPreparedPrompt tokenizes a chunk of text and decodes it into the
+// prompt's cache slot, returning the number of prompt tokens decoded so far.
+func (s *Server) appendPreparedPrompt(p *preparedPrompt, text string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done {
+		return 0, errUnknownPrompt
+	}
+	p.expiry.Reset(preparedPromptTTL)
+
+	head, pending := splitChunk(p.pending + text)
+	if head == "" {
+		p.pending = pending
+		return len(p.slot.Inputs), nil
+	}
+
+	tokens, err := p.tokenize(head, !p.started)
+	if err != nil {
+		return 0, err
+	}
+
+	// leave room for at least one generated token
+	if total := len(p.slot.Inputs) + len(tokens); total >= s.cache.numCtx {
+		return 0, fmt.Errorf("%w (prompt: %d context: %d)", errPromptTooLong, total, s.cache.numCtx)
+	}
+
+	inputs := make([]input, len(tokens))
+	for i, t := range tokens {
+		inputs[i] = input{token: t}
+	}
+
+	seq := &Sequence{
+		id:                  p.id,
+		inputs:              inputs,
+		cache:               p.slot,
+		lora:                p.slot.lora,
+		prefillOnly:         true,
+		startProcessingTime: time.Now(),
+		responses:           make(chan response, 1),
+		quit:                make(chan bool, 1),
+		embedding:           make(chan []float32, 1),
+	}
+	if err := s.prefill(seq); err != nil {
+		return 0, err
+	}
+
+	// an interrupted chunk leaves the slot with part of the prompt, so the
+	// prompt cannot be continued
+	if seq.doneReason != StopReasonNone {
+		if s.takePreparedPrompt(p.id) != nil {
+			s.releasePreparedPrompt(p)
+		}
+		return 0, fmt.Errorf("decoding prompt chunk was interrupted: %s", seq.doneReason)
+	}
+
+	p.started = true
+	p.pending = pending
+	return len(p.slot.Inputs), nil
+}
+
+// prefill schedules a prefill sequence and waits until the decode loop has
+// decoded all of its inputs. The prepared prompt's sequence slot guarantees a
+// free entry in s.seqs.
+func (s *Server) prefill(seq *Sequence) error {
+	s.mu.Lock()
+	i := slices.Index(s.seqs, nil)
+	if i < 0 {
+		s.mu.Unlock()
+		return errors.New("could not find an available sequence")
+	}
+	s.seqs[i] = seq
+	s.cond.Signal()
+	s.mu.Unlock()
+
+	// removeSequence closes the channel once the chunk is in the cache
+	<-seq.embedding
+	return nil
+}
+
+// finalInputs returns the whole prepared prompt: the inputs already decoded
+// into its slot followed by any text still held back. The caller must hold p.mu.
+func (p *preparedPrompt) finalInputs() ([]input, error) {
+	inputs := slices.Clone(p.slot.Inputs)
+	if p.pending != "" {
+		tokens, err := p.tokenize(p.pending, !p.started)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tokens {
+			inputs = append(inputs, input{token: t})
+		}
+	}
+
+	if len(inputs) == 0 {
+		return nil, errors.New("no input provided")
+	}
+	return inputs, nil
+}
+
+// runPreparedPrompt consumes a prepared prompt and returns a sequence for it,
+// already assigned to the prompt's cache slot so only the held-back tail
+// needs decoding before generation starts.
+func (s *Server) runPreparedPrompt(id string, params NewSequenceParams) (*Sequence, error) {
+	p := s.takePreparedPrompt(id)
+	if p == nil {
+		return nil, errUnknownPrompt
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	startTime := time.Now()
+	inputs, err := p.finalInputs()
+	if err != nil {
+		s.releasePreparedPrompt(p)
+		return nil, err
+	}
+
+	seq, err := s.newSequence(inputs, startTime, time.Since(startTime), params)
+	if err != nil {
+		s.releasePreparedPrompt(p)
+		return nil, err
+	}
+
+	// from here on the sequence owns the slots and releases them when removed
+	p.done = true
+	p.expiry.Stop()
+	if err := s.assignPreparedSequence(seq, p.slot); err != nil {
+		return nil, err
+	}
+	return seq, nil
+}
+
+// assignPreparedSequence places seq in the decode loop using a cache slot that
+// was reserved for it, releasing the slot and the sequence slot on failure.
+func (s *Server) assignPreparedSequence(seq *Sequence, slot *InputCacheSlot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.loraSwapping {
+		s.cond.Wait()
+	}
+
+	if _, ok := s.requests[seq.id]; ok {
+		slot.InUse = false
+		s.slotSemaphore(seq).Release(1)
+		return fmt.Errorf("%w: %q", errDuplicateRequestID, seq.id)
+	}
+
+	i := slices.Index(s.seqs, nil)
+	if i < 0 {
+		slot.InUse = false
+		s.slotSemaphore(seq).Release(1)
+		return errors.New("could not find an available sequence")
+	}
+
+	numInputs := len(seq.inputs)
+	seq.cache = slot
+	seq.inputs = s.cache.ContinueCacheSlot(slot, seq.inputs, seq.lora)
+	seq.numCached = numInputs - len(seq.inputs)
+	seq.cacheSelection = slot.selection
+	s.seqs[i] = seq
+	s.trackSession(seq.sessionID, i)
+	s.trackRequest(seq)
+	s.cond.Signal()
+	return nil
+}
+
+// splitChunk splits text at the start of its last run of whitespace.
+// Tokenizers attach leading whitespace to the word that follows it, so the
+// returned tail is held back until more text arrives, instead of risking a
+// word being tokenized in two pieces.
+func splitChunk(text string) (string, string) {
+	i := strings.LastIndexFunc(text, unicode.IsSpace)
+	if i < 0 {
+		return "", text
+	}
+
+	cut := len(strings.TrimRightFunc(text[:i], unicode.IsSpace))
+	return text[:cut], text[cut:]
+}
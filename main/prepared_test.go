@@ -0,0 +1,172 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"sync"
+	"testing"
+	"net/http/httptest"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// wordTokenizer gives each word, together with its leading whitespace, its own
+// token, like the tokenizers the chunk splitting is designed around. Token 1
+// is BOS.
+type wordTokenizer struct {
+	vocab map[string]int
+}
+
+var wordPattern = regexp.MustCompile(`\s*\S+|\s+`)
+
+func (t *wordTokenizer) Tokenize(text string, addSpecial bool) ([]int, error) {
+	var tokens []int
+	if addSpecial {
+		tokens = append(tokens, 1)
+	}
+	for _, word := range wordPattern.FindAllString(text, -1) {
+		if _, ok := t.vocab[word]; !ok {
+			t.vocab[word] = len(t.vocab) + 2
+		}
+		tokens = append(tokens, t.vocab[word])
+	}
+	return tokens, nil
+}
+
+// decodePrefill stands in for the decode loop: it waits for the next prefill
+// sequence and moves its inputs into its cache slot.
+func decodePrefill(s *Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for allNil(s) {
+		s.cond.Wait()
+	}
+	for i, seq := range s.seqs {
+		if seq != nil {
+			seq.cache.Inputs = append(seq.cache.Inputs, seq.inputs...)
+			seq.inputs = nil
+			removeSequence(s, i, StopReasonNone)
+		}
+	}
+}
+
+func TestSplitChunk(t *testing.T) {
+	cases := []struct {
+		text, head, tail string
+	}{
+		{"hello", "", "hello"},
+		{"hello world", "hello", " world"},
+		{"one two  \n", "one two", "  \n"},
+		{"  lead", "", "  lead"},
+	}
+
+	for _, tc := range cases {
+		head, tail := splitChunk(tc.text)
+		if head != tc.head || tail != tc.tail {
+			t.Errorf("splitChunk(%q): expected (%q, %q), got (%q, %q)", tc.text, tc.head, tc.tail, head, tail)
+		}
+	}
+}
+
+func TestPreparedPromptAppendAndRun(t *testing.T) {
+	cache, err := NewInputCache(nil, 64, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(2),
+		cache:   cache,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	tokenizer := &wordTokenizer{vocab: make(map[string]int)}
+	if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.newPreparedPrompt(tokenizer.Tokenize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// chunk boundaries fall in the middle of words
+	chunks := []string{"The quick bro", "wn fox jumps ov", "er the lazy dog"}
+	for _, chunk := range chunks {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := s.appendPreparedPrompt(p, chunk)
+			errc <- err
+		}()
+		decodePrefill(s)
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !p.slot.InUse {
+		t.Fatal("expected the cache slot to stay reserved between chunks")
+	}
+
+	// the assembled prompt tokenizes exactly like the whole text
+	p.mu.Lock()
+	inputs, err := p.finalInputs()
+	p.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := tokenizer.Tokenize("The quick brown fox jumps over the lazy dog", true)
+	got := make([]int, len(inputs))
+	for i, in := range inputs {
+		got[i] = in.token
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected tokens %v, got %v", want, got)
+	}
+
+	// running it only decodes the held back tail
+	if s.takePreparedPrompt(p.id) != p {
+		t.Fatal("expected the prepared prompt to be registered")
+	}
+	p.expiry.Stop()
+	seq := newTestSequence(inputs)
+	if err := s.assignPreparedSequence(seq, p.slot); err != nil {
+		t.Fatal(err)
+	}
+	if seq.cache != p.slot || len(seq.inputs) != 1 || seq.numCached != len(want)-1 {
+		t.Errorf("expected one input left to decode, got %d (%d cached)", len(seq.inputs), seq.numCached)
+	}
+
+	// the finished sequence releases both slots
+	s.mu.Lock()
+	removeSequence(s, slices.Index(s.seqs, seq), StopReasonStop)
+	s.mu.Unlock()
+	if p.slot.InUse || !s.seqsSem.TryAcquire(2) {
+		t.Error("expected the cache slot and sequence slot to be released")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements per-request priority. A completion's `priority` decides
+// which waiting request is given the next free sequence slot and, once it is
+// running, which sequences a batch's capacity goes to first. Requests of equal
+// priority keep the FIFO slot order and the --batch-fill sharing.
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// slotQueue orders the requests waiting for a slot from one semaphore by
+// priority, FIFO within a priority. Only the head of the queue waits on the
+// semaphore; a higher-priority arrival interrupts it, so the next released
+// slot goes to the new head. The zero value is ready to use.
+type slotQueue struct {
+	mu      sync.Mutex
+	waiters []*slotWaiter // highest priority first
+}
+
+type slotWaiter struct {
+	priority int
+	turn     chan struct{}      // signalled when the waiter becomes the head
+	cancel   context.CancelFunc // interrupts the head's Acquire, guarded by mu
+}
+
+// Len returns the number of requests waiting for a slot.
+func (q *slotQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.waiters)
+}
+
+// tryAcquire takes a slot from sem without waiting, unless other requests are
+// already waiting for one.
+func (q *slotQueue) tryAcquire(sem *semaphore.Weighted) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.waiters) == 0 && sem.TryAcquire(1)
+}
+
+// acquire blocks until a slot from sem is free for a request of the given
+// priority, or ctx is done.
+func (q *slotQueue) acquire(ctx context.Context, sem *semaphore.Weighted, priority int) error {
+	w := q.enqueue(priority)
+	defer q.remove(w)
+
+	for {
+		select {
+		case <-w.turn:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		acquireCtx, cancel := context.WithCancel(ctx)
+		if !q.startAcquire(w, cancel) {
+			cancel()
+			continue
+		}
+
+		err := sem.Acquire(acquireCtx, 1)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		// interrupted by a higher-priority request, wait to be the head again
+	}
+}
+
+// enqueue adds a waiter behind those of the same or higher priority. A waiter
+// that becomes the head interrupts the previous one.
+func (q *slotQueue) enqueue(priority int) *slotWaiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w := &slotWaiter{priority: priority, turn: make(chan struct{}, 1)}
+	i := slices.IndexFunc(q.waiters, func(other *slotWaiter) bool {
+		return other.priority < priority
+	})
+	if i < 0 {
+		i = len(q.waiters)
+	}
+	q.waiters = slices.Insert(q.waiters, i, w)
+
+	if i == 0 {
+		if len(q.waiters) > 1 {
+			q.waiters[1].interrupt()
+		}
+		w.signal()
+	}
+	return w
+}
+
+// startAcquire records cancel as the way to interrupt w, if w is still the
+// head of the queue.
+func (q *slotQueue) startAcquire(w *slotWaiter, cancel context.CancelFunc) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiters) == 0 || q.waiters[0] != w {
+		return false
+	}
+	w.cancel = cancel
+	return true
+}
+
+// remove drops w from the queue, handing the turn to the next waiter if w was
+// the head.
+func (q *slotQueue) remove(w *slotWaiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := slices.Index(q.waiters, w)
+	q.waiters = slices.Delete(q.waiters, i, i+1)
+	if i == 0 && len(q.waiters) > 0 {
+		q.waiters[0].signal()
+	}
+}
+
+func (w *slotWaiter) signal() {
+	select {
+	case w.turn <- struct{}{}:
+	default:
+	}
+}
+
+// interrupt stops w waiting on the semaphore. The caller must hold the
+// queue's mu.
+func (w *slotWaiter) interrupt() {
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+}
+
+// sequencePriority is seq's request priority; empty entries sort last.
+func sequencePriority(seq *Sequence) int {
+	if seq == nil {
+		return math.MinInt
+	}
+	return seq.priority
+}
+
+// topPriority returns the highest priority among the sequences with inputs to
+// decode and how many sequences have it. Lower-priority sequences only get
+// what is left of a batch once those have been served.
+func topPriority(seqs []*Sequence) (int, int) {
+	top, n := math.MinInt, 0
+	for _, seq := range seqs {
+		if seq == nil || len(seq.inputs) == 0 {
+			continue
+		}
+
+		switch {
+		case seq.priority > top:
+			top, n = seq.priority, 1
+		case seq.priority == top:
+			n++
+		}
+	}
+	return top, n
+}
@@ -0,0 +1,133 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"llm-server/llama"
+)
+
+func TestSlotQueueServesHigherPriorityFirst(t *testing.T) {
+	s := &Server{seqsSem: semaphore.NewWeighted(1)}
+	if err := s.acquireSequenceSlot(httptest.NewRecorder(), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	waiting := func() int {
+		s.seqsQueue.mu.Lock()
+		defer s.seqsQueue.mu.Unlock()
+		return len(s.seqsQueue.waiters)
+	}
+	acquired := make(chan int, 3)
+	wait := func(priority int) {
+		n := waiting()
+		go func() {
+			if err := s.acquirePrioritySlot(httptest.NewRecorder(), context.Background(), priority); err != nil {
+				t.Error(err)
+			}
+			acquired <- priority
+		}()
+		for waiting() == n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// a background job queues first, then an interactive request overtakes it
+	wait(0)
+	wait(-1)
+	wait(10)
+
+	for _, want := range []int{10, 0, -1} {
+		s.seqsSem.Release(1)
+		select {
+		case got := <-acquired:
+			if got != want {
+				t.Fatalf("expected priority %d to get the slot, got %d", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("priority %d did not get the released slot", want)
+		}
+	}
+}
+
+func TestBatchFillHighPriorityProgressesFaster(t *testing.T) {
+	const batchSize, promptLen = 16, 64
+
+	cache, err := NewInputCache(nil, 1024, 3, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := llama.NewBatch(batchSize, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Free()
+
+	s := &Server{seqs: make([]*Sequence, 3), cache: cache, batchFill: BatchFillFair}
+	for i, priority := range []int{0, 5, 0} {
+		seq := newTestSequence(tokenInputs(make([]int, promptLen)...))
+		seq.cache = &cache.slots[i]
+		seq.priority = priority
+		s.seqs[i] = seq
+	}
+	high, low := s.seqs[1], s.seqs[0]
+
+	// decode batches as processBatch does until the high priority prompt is done
+	batches := 0
+	for len(high.inputs) > 0 {
+		if _, _, _, err := fillBatch(s, batch, &llama.Batch{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, seq := range s.seqs {
+			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
+			seq.pendingInputs = nil
+		}
+		batch.Clear()
+		batches++
+	}
+
+	// the high priority sequence had every batch to itself
+	if batches != promptLen/batchSize {
+		t.Errorf("expected the high priority prompt in %d batches, took %d", promptLen/batchSize, batches)
+	}
+	if len(low.cache.Inputs) >= len(high.cache.Inputs) {
+		t.Errorf("expected high priority to progress faster, high %d low %d", len(high.cache.Inputs), len(low.cache.Inputs))
+	}
+
+	// once it only needs one input per batch the rest goes to lower priorities
+	high.inputs = tokenInputs(1)
+	if _, _, _, err := fillBatch(s, batch, &llama.Batch{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(high.pendingInputs) + len(low.pendingInputs) + len(s.seqs[2].pendingInputs); got != batchSize {
+		t.Errorf("expected lower priorities to fill the batch, got %d inputs", got)
+	}
+}
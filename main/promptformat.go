@@ -0,0 +1,140 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements the chat prompt format used by /generate,
+// /secure/generate and /secure/completion to wrap a user prompt in the model's
+// chat markup. The format is selected with --prompt-template as either a
+// built-in name or a Go text/template file using {{.System}} and {{.Prompt}}.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// defaultPromptFormat is used when --prompt-template is not set.
+const defaultPromptFormat = "llama3"
+
+// builtinPromptFormats are the chat formats selectable by name. Without a
+// system message, llama3 keeps its knowledge cutoff system line.
+var builtinPromptFormats = map[string]string{
+	"llama3": "<|start_header_id|>system<|end_header_id|>\n\n" +
+		"{{if .System}}{{.System}}{{else}}Cutting Knowledge Date: December 2023{{end}}\n\n" +
+		"<|eot_id|><|start_header_id|>user<|end_header_id|>\n\n" +
+		"{{.Prompt}}" +
+		"<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n",
+	"chatml": "{{if .System}}<|im_start|>system\n{{.System}}<|im_end|>\n{{end}}" +
+		"<|im_start|>user\n{{.Prompt}}<|im_end|>\n<|im_start|>assistant\n",
+	"mistral": "[INST] {{if .System}}{{.System}}\n\n{{end}}{{.Prompt}} [/INST]",
+	"gemma": "<start_of_turn>user\n{{if .System}}{{.System}}\n\n{{end}}{{.Prompt}}<end_of_turn>\n" +
+		"<start_of_turn>model\n",
+}
+
+// builtinStopSequences are the turn-end markers of the built-in formats. They
+// are added to the stop list of formatted requests so that generation still
+// ends when a model writes the marker out as text instead of sampling its
+// end-of-generation token.
+var builtinStopSequences = map[string]string{
+	"llama3":  "<|eot_id|>",
+	"chatml":  "<|im_end|>",
+	"mistral": "</s>",
+	"gemma":   "<end_of_turn>",
+}
+
+// promptFormat wraps a system message and user prompt in a model's chat markup.
+type promptFormat struct {
+	tmpl *template.Template
+	stop string
+}
+
+// loadPromptFormat returns the built-in format named spec, or parses spec as
+// a template file. An empty spec selects the default Llama 3 format. stop
+// overrides the format's turn-end marker; template files have none unless it
+// is given.
+func loadPromptFormat(spec string, stop string) (*promptFormat, error) {
+	if spec == "" {
+		spec = defaultPromptFormat
+	}
+
+	text, ok := builtinPromptFormats[spec]
+	if !ok {
+		data, err := os.ReadFile(spec)
+		if err != nil {
+			return nil, fmt.Errorf("prompt template %q is neither a built-in format nor a readable file: %w", spec, err)
+		}
+		text = string(data)
+	}
+
+	tmpl, err := template.New(spec).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("prompt template %s: %w", spec, err)
+	}
+
+	if stop == "" {
+		stop = builtinStopSequences[spec]
+	}
+
+	return &promptFormat{tmpl: tmpl, stop: stop}, nil
+}
+
+// Stop returns the stop sequences for requests rendered with this format.
+func (f *promptFormat) Stop() []string {
+	if f.stop == "" {
+		return nil
+	}
+	return []string{f.stop}
+}
+
+// Format renders prompt with an optional system message.
+func (f *promptFormat) Format(system string, prompt string) (string, error) {
+	var b strings.Builder
+	if err := f.tmpl.Execute(&b, struct{ System, Prompt string }{system, prompt}); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// formatSecurePrompt decrypts an optional encrypted system message with the
+// request's symmetric key and formats it with prompt.
+func (s *Server) formatSecurePrompt(mode string, symmetricKey string, encryptedSystem string, prompt string) (string, error) {
+	var system string
+	if encryptedSystem != "" {
+		var err error
+		if system, err = AesDecryptMode(mode, symmetricKey, encryptedSystem); err != nil {
+			return "", fmt.Errorf("Error decrypting system message: %v", err)
+		}
+	}
+
+	formatted, err := s.promptFormat.Format(system, prompt)
+	if err != nil {
+		return "", fmt.Errorf("Failed to format prompt: %v", err)
+	}
+
+	return formatted, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPromptFormatDefault(t *testing.T) {
+	f, err := loadPromptFormat("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a system message the output matches the original hardcoded format
+	want := "<|start_header_id|>system<|end_header_id|>\n\n" +
+		"Cutting Knowledge Date: December 2023\n\n" +
+		"<|eot_id|><|start_header_id|>user<|end_header_id|>\n\n" +
+		"hello" +
+		"<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n"
+	if got, err := f.Format("", "hello"); err != nil || got != want {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	got, err := f.Format("Be terse.", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<|start_header_id|>system<|end_header_id|>\n\nBe terse.\n\n"; got[:len(want)] != want {
+		t.Errorf("system message not applied: %q", got)
+	}
+}
+
+func TestPromptFormatBuiltinAndFile(t *testing.T) {
+	f, err := loadPromptFormat("chatml", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<|im_start|>system\nsys<|im_end|>\n<|im_start|>user\nhi<|im_end|>\n<|im_start|>assistant\n"
+	if got, _ := f.Format("sys", "hi"); got != want {
+		t.Errorf("chatml: got %q", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "custom.tmpl")
+	if err := os.WriteFile(path, []byte("<s>{{.System}}|{{.Prompt}}</s>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err = loadPromptFormat(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.Format("a", "b"); got != "<s>a|b</s>" {
+		t.Errorf("file: got %q", got)
+	}
+
+	if _, err := loadPromptFormat(filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestPromptFormatStopsAtLiteralTurnEnd(t *testing.T) {
+	f, err := loadPromptFormat("llama3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(f.Stop(), []string{"<|eot_id|>"}) {
+		t.Fatalf("expected the llama3 turn-end marker as a stop sequence, got %q", f.Stop())
+	}
+
+	// a model that writes the marker out as text rather than sampling the
+	// EOG token, checked as processBatch does after each piece
+	pieces := []string{"Hello", " there", "<|", "eot", "_id|>", "<|start_header_id|>"}
+	var pending []string
+	stopped := -1
+	for i, piece := range pieces {
+		pending = append(pending, piece)
+		if ok, stop := findStop(strings.Join(pending, ""), f.Stop()); ok {
+			pending, _ = truncateStop(pending, stop)
+			stopped = i
+			break
+		}
+	}
+	if stopped != 4 {
+		t.Fatalf("expected generation to stop once the marker completed (piece 4), stopped at %d", stopped)
+	}
+	if got := strings.Join(pending, ""); got != "Hello there" {
+		t.Errorf("expected the marker to be stripped from the output, got %q", got)
+	}
+
+	// template files have no marker unless one is configured
+	path := filepath.Join(t.TempDir(), "custom.tmpl")
+	if err := os.WriteFile(path, []byte("{{.Prompt}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := loadPromptFormat(path, ""); f.Stop() != nil {
+		t.Errorf("expected no stop sequence for a template file, got %q", f.Stop())
+	}
+	if f, _ := loadPromptFormat(path, "<END>"); !slices.Equal(f.Stop(), []string{"<END>"}) {
+		t.Errorf("expected the configured stop sequence, got %q", f.Stop())
+	}
+}
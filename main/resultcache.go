@@ -0,0 +1,153 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements an optional LRU cache of completed completion results.
+// Only deterministic requests (temperature 0) are cached, keyed by a hash of the
+// full request, so a repeated request is answered without running inference.
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// cachedResult is the output of a finished deterministic completion.
+type cachedResult struct {
+	content          string
+	tokens           []int
+	doneReason       StopReason
+	hitStopWord      bool
+	promptText       string
+	stopAlternative  *TokenAlternative
+	seed             *uint32
+	numPrompt        int
+	numTruncatedFrom int
+	numPredicted     int
+}
+
+type resultCacheEntry struct {
+	key    string
+	result cachedResult
+}
+
+// ResultCache is a bounded LRU of completion results. A nil *ResultCache is
+// valid and caches nothing, which is how the cache is disabled.
+type ResultCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewResultCache creates a cache holding up to size results, or returns nil
+// if size is not positive.
+func NewResultCache(size int) *ResultCache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &ResultCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Key returns the cache key for a request and whether the request may be
+// cached at all. Requests with a non-zero temperature, whose output is
+// validated and retried against a json_schema, or whose prompt was prepared
+// in chunks (and so is not part of the request) are never cached.
+func (c *ResultCache) Key(req *CompletionRequest) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	return deterministicKey(req)
+}
+
+// deterministicKey hashes a request whose output is fully determined by it,
+// or returns false if the request may produce different output when repeated.
+func deterministicKey(req *CompletionRequest) (string, bool) {
+	if req.Temperature != 0 || len(req.JSONSchema) > 0 || req.PromptID != "" || req.Logprobs > 0 || req.N > 1 {
+		return "", false
+	}
+
+	// the request ID and priority don't change the result
+	key := *req
+	key.RequestID, key.Priority = "", 0
+
+	data, err := json.Marshal(&key)
+	if err != nil {
+		return "", false
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// Get returns the cached result for key, marking it most recently used.
+func (c *ResultCache) Get(key string) (cachedResult, bool) {
+	if c == nil {
+		return cachedResult{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return cachedResult{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*resultCacheEntry).result, true
+}
+
+// Put stores a result, evicting the least recently used entry when full.
+func (c *ResultCache) Put(key string, result cachedResult) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*resultCacheEntry).result = result
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&resultCacheEntry{key: key, result: result})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultCacheEntry).key)
+	}
+}
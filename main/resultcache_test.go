@@ -0,0 +1,116 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeCompletionRequest(t *testing.T, body string) *CompletionRequest {
+	t.Helper()
+
+	var req CompletionRequest
+	req.Options = Options(DefaultOptions())
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	return &req
+}
+
+func TestResultCacheServesDeterministicRequest(t *testing.T) {
+	// the server has no model loaded, so any attempt to decode would panic
+	s := &Server{results: NewResultCache(4), defaults: DefaultOptions()}
+
+	body := `{"prompt": "2+2=", "temperature": 0}`
+	key, ok := s.results.Key(decodeCompletionRequest(t, body))
+	if !ok {
+		t.Fatal("expected temperature 0 request to be cacheable")
+	}
+
+	// the first request stores its output once generation finishes
+	s.results.Put(key, cachedResult{content: "4", doneReason: StopReasonStop, numPrompt: 5, numPredicted: 1})
+
+	// the identical second request is answered from the cache
+	w := httptest.NewRecorder()
+	s.completion(w, httptest.NewRequest("POST", "/completion", strings.NewReader(body)))
+
+	var frames []CompletionResponse
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var frame CompletionResponse
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+
+	if len(frames) != 2 || frames[0].Content != "4" {
+		t.Fatalf("expected cached content frame and final frame, got %+v", frames)
+	}
+	final := frames[1]
+	if !final.Stop || !final.ResultCached || final.FinishReason != "stop" || final.Timings.PromptN != 5 {
+		t.Errorf("unexpected final frame: %+v", final)
+	}
+}
+
+func TestResultCacheKey(t *testing.T) {
+	c := NewResultCache(4)
+
+	if _, ok := c.Key(decodeCompletionRequest(t, `{"prompt": "hi"}`)); ok {
+		t.Error("expected default temperature request to not be cacheable")
+	}
+
+	a, _ := c.Key(decodeCompletionRequest(t, `{"prompt": "hi", "temperature": 0}`))
+	b, _ := c.Key(decodeCompletionRequest(t, `{"prompt": "hi", "temperature": 0, "top_k": 1}`))
+	if a == b {
+		t.Error("expected different sampling params to produce different keys")
+	}
+
+	if _, ok := (*ResultCache)(nil).Key(decodeCompletionRequest(t, `{"prompt": "hi", "temperature": 0}`)); ok {
+		t.Error("expected a disabled cache to cache nothing")
+	}
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	c := NewResultCache(2)
+	c.Put("a", cachedResult{content: "a"})
+	c.Put("b", cachedResult{content: "b"})
+	c.Get("a")
+	c.Put("c", cachedResult{content: "c"})
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if result, ok := c.Get(key); !ok || result.content != key {
+			t.Errorf("expected %q to be cached", key)
+		}
+	}
+}
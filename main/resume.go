@@ -0,0 +1,327 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements resumable completion streams. A request started with
+// `"resumable": true` keeps generating when its client disconnects, with its
+// most recent frames buffered so that a client reconnecting through
+// `/completion/resume` continues from the last frame it received. Each frame
+// carries a `resume_token`, the number of frames streamed so far, to pass back
+// as `resume_from`.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// resumeBufferFrames is how many of a resumable stream's most recent
+	// frames are kept for a reconnecting client
+	resumeBufferFrames = 256
+
+	// resumeTimeout is how long a resumable sequence keeps generating with no
+	// client attached, and how long its frames are kept once it has finished
+	resumeTimeout = 30 * time.Second
+)
+
+var (
+	errResumeAttached = errors.New("another client is attached to the stream")
+	errResumeExpired  = errors.New("frames from resume_from are no longer buffered")
+	errResumeAhead    = errors.New("resume_from is past the last streamed frame")
+)
+
+// resumableStream holds the recent frames of a resumable sequence. Frames are
+// added as the sequence produces them whether or not a client is attached, so
+// the decode loop is never held up by a slow or missing client.
+type resumableStream struct {
+	mu        sync.Mutex
+	changed   chan struct{}         // closed and replaced when a frame is added
+	frames    []*CompletionResponse // most recent frames, frames[0] has index first
+	first     int
+	done      bool // the final frame has been added
+	attached  bool
+	detaches  int       // counts detaches, so only the latest one's timer abandons the sequence
+	quit      chan bool // the sequence's quit channel, closed once abandoned
+	abandoned bool
+}
+
+func newResumableStream(quit chan bool) *resumableStream {
+	return &resumableStream{changed: make(chan struct{}), quit: quit}
+}
+
+// add numbers frame, buffers it and wakes the attached client.
+func (rs *resumableStream) add(frame *CompletionResponse) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	frame.Index = rs.first + len(rs.frames)
+	frame.ResumeToken = frame.Index + 1
+	rs.frames = append(rs.frames, frame)
+	if len(rs.frames) > resumeBufferFrames {
+		rs.frames[0] = nil
+		rs.frames = rs.frames[1:]
+		rs.first++
+	}
+	rs.done = rs.done || frame.Stop
+
+	close(rs.changed)
+	rs.changed = make(chan struct{})
+}
+
+// attach claims the stream for a client that has received the frames before
+// from. Only one client may be attached at a time.
+func (rs *resumableStream) attach(from int) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.attached {
+		return errResumeAttached
+	}
+	if from > rs.first+len(rs.frames) {
+		return errResumeAhead
+	}
+	if from < rs.first {
+		return errResumeExpired
+	}
+
+	rs.attached = true
+	return nil
+}
+
+// detach releases the stream. If the sequence is still running and no client
+// attaches within resumeTimeout, it is stopped.
+func (rs *resumableStream) detach() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.attached = false
+	if rs.done {
+		return
+	}
+
+	rs.detaches++
+	detach := rs.detaches
+	time.AfterFunc(resumeTimeout, func() {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+
+		if !rs.attached && !rs.done && !rs.abandoned && rs.detaches == detach {
+			rs.abandoned = true
+			close(rs.quit)
+		}
+	})
+}
+
+// since returns the buffered frames from index from on, and a channel that is
+// closed when more are added. It fails if frames from has already been dropped,
+// which happens to an attached client that falls resumeBufferFrames behind.
+func (rs *resumableStream) since(from int) ([]*CompletionResponse, <-chan struct{}, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if from < rs.first {
+		return nil, nil, errResumeExpired
+	}
+
+	return rs.frames[min(from-rs.first, len(rs.frames)):], rs.changed, nil
+}
+
+// resumeStreams maps request IDs to their resumable streams. The zero value
+// is ready to use.
+type resumeStreams struct {
+	mu      sync.Mutex
+	streams map[string]*resumableStream
+}
+
+func (r *resumeStreams) add(id string, rs *resumableStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.streams == nil {
+		r.streams = make(map[string]*resumableStream)
+	}
+	r.streams[id] = rs
+}
+
+func (r *resumeStreams) get(id string) (*resumableStream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rs, ok := r.streams[id]
+	return rs, ok
+}
+
+// remove forgets id, unless it has since been reused for another stream.
+func (r *resumeStreams) remove(id string, rs *resumableStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.streams[id] == rs {
+		delete(r.streams, id)
+	}
+}
+
+// startResumable buffers seq's frames in a new resumable stream registered
+// under its request ID. The stream is kept for resumeTimeout after the
+// sequence finishes, for a client that disconnected before the final frame.
+func (s *Server) startResumable(seq *Sequence, req *CompletionRequest) *resumableStream {
+	rs := newResumableStream(seq.quit)
+	s.resumable.add(seq.id, rs)
+
+	go func() {
+		var streamed bool
+		for resp := range seq.responses {
+			rs.add(&CompletionResponse{Content: resp.content, Tokens: resp.tokens, Logprobs: resp.logprobs})
+			streamed = true
+		}
+		if req.EmptyFrame && !streamed {
+			rs.add(emptyContentFrame(0, seq))
+		}
+		rs.add(finalResponse(0, req, seq))
+
+		time.AfterFunc(resumeTimeout, func() {
+			s.resumable.remove(seq.id, rs)
+		})
+	}()
+
+	return rs
+}
+
+// serveResumable streams the frames of rs, which the caller has attached to,
+// from index from until the final frame has been written or the client goes
+// away, then detaches.
+func serveResumable(ctx context.Context, stream *streamWriter, rs *resumableStream, from int) error {
+	defer rs.detach()
+
+	for {
+		frames, changed, err := rs.since(from)
+		if err != nil {
+			return err
+		}
+
+		for _, frame := range frames {
+			if err := stream.Encode(frame); err != nil {
+				return err
+			}
+			from++
+
+			if frame.Stop {
+				return stream.Flush()
+			}
+		}
+		stream.MaybeFlush()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stream.Deadline():
+			stream.Flush()
+		case <-changed:
+		}
+	}
+}
+
+// completionResume handles the `/completion/resume?id=&resume_from=` endpoint,
+// which reconnects to a request started with `"resumable": true` by the ID from
+// its `X-Request-Id` header. Frames are streamed from the one numbered
+// `resume_from`, the `resume_token` of the last frame received (0 if none), in
+// the format of the Accept header as for /completion.
+//
+// Response codes:
+//   - 200 OK: Frames are streamed until the final frame
+//   - 400 Bad Request: No id, an invalid resume_from or an application/json Accept header
+//   - 404 Not Found: No resumable request with the given ID
+//   - 409 Conflict: Another client is attached to the request
+//   - 410 Gone: The frames from resume_from are no longer buffered
+func (s *Server) completionResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	from := 0
+	if value := r.URL.Query().Get("resume_from"); value != "" {
+		var err error
+		if from, err = strconv.Atoi(value); err != nil || from < 0 {
+			http.Error(w, fmt.Sprintf("invalid resume_from %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	format := negotiateFormat(r.Header.Get("Accept"))
+	if format == formatJSON {
+		http.Error(w, "resumable streams do not support application/json responses", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	rs, ok := s.resumable.get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no resumable request with id %q", id), http.StatusNotFound)
+		return
+	}
+
+	if err := rs.attach(from); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errResumeAttached) {
+			status = http.StatusConflict
+		} else if errors.Is(err, errResumeExpired) {
+			status = http.StatusGone
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Transfer-Encoding", "chunked")
+	if format == formatSSE {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("X-Request-Id", id)
+
+	stream := newStreamWriter(w, flusher, s.flushBytes, s.flushLatency)
+	stream.format = format
+	if err := serveResumable(r.Context(), stream, rs, from); err != nil {
+		slog.Info("resumed stream ended", "id", id, "error", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestResumeAfterDisconnect(t *testing.T) {
+	s := &Server{}
+	seq := newTestSequence(tokenInputs(1, 2, 3))
+	seq.id = "req-1"
+
+	// the first client follows the stream as /completion does for resumable requests
+	mux := http.NewServeMux()
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		rs := s.startResumable(seq, &CompletionRequest{Resumable: true})
+		rs.attach(0)
+		serveResumable(r.Context(), newStreamWriter(w, w.(http.Flusher), 0, time.Millisecond), rs, 0)
+	})
+	mux.HandleFunc("/completion/resume", s.completionResume)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// every request gives up rather than hanging the test if a frame never comes
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	get := func(url string) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// headers are only written with the first frame, so it has to be
+	// generated before the request can return
+	seq.responses <- response{content: "a"}
+	resp := get(ts.URL + "/completion")
+
+	var frames []CompletionResponse
+	lines := bufio.NewScanner(resp.Body)
+	for i, content := range []string{"a", "b"} {
+		if i > 0 {
+			seq.responses <- response{content: content}
+		}
+		if !lines.Scan() {
+			t.Fatalf("expected a frame, got %v", lines.Err())
+		}
+		var frame CompletionResponse
+		if err := json.Unmarshal(lines.Bytes(), &frame); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+
+	// the connection drops while the sequence keeps generating
+	resp.Body.Close()
+	for _, content := range []string{"c", "d", "e"} {
+		seq.responses <- response{content: content}
+	}
+	close(seq.responses)
+
+	rs, _ := s.resumable.get("req-1")
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		rs.mu.Lock()
+		attached := rs.attached
+		rs.mu.Unlock()
+		if !attached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the first client to detach")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	resume := func(from int) *http.Response {
+		return get(ts.URL + "/completion/resume?id=req-1&resume_from=" + strconv.Itoa(from))
+	}
+
+	if resp := resume(10); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a resume_from past the stream, got %d", resp.StatusCode)
+	}
+
+	resp = resume(frames[len(frames)-1].ResumeToken)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var frame CompletionResponse
+		if err := decoder.Decode(&frame); err != nil {
+			break
+		}
+		frames = append(frames, frame)
+	}
+
+	// every frame arrives exactly once and in order
+	var content string
+	for i, frame := range frames {
+		if frame.Index != i || frame.ResumeToken != i+1 {
+			t.Errorf("frame %d: expected index %d and resume_token %d, got %d and %d", i, i, i+1, frame.Index, frame.ResumeToken)
+		}
+		content += frame.Content
+	}
+	if content != "abcde" {
+		t.Errorf("expected content %q, got %q", "abcde", content)
+	}
+	if len(frames) != 6 || !frames[5].Stop {
+		t.Errorf("expected 5 content frames and a final frame, got %d frames", len(frames))
+	}
+}
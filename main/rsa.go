@@ -26,20 +26,54 @@ package main
  */
 
 import(
+	"errors"
 	"fmt"
+	"log"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"strconv"
 	"encoding/json"
 	"net/http"
 )
 
+// Supported values of the "padding" field on the RSA endpoints. An empty
+// padding means OAEP; PKCS #1 v1.5 is kept only for older clients, as its
+// decryption errors can be used as a padding oracle.
+const (
+	RsaPaddingOAEP  = "oaep"
+	RsaPaddingPKCS1 = "pkcs1v15"
+)
+
+// Key size used when none is requested
+const defaultRsaKeyBits = 2048
+
+var errRsaKeyBits = errors.New("unsupported RSA key size, expected 2048, 3072 or 4096 bits")
+
+var errRsaPadding = errors.New("unsupported RSA padding, expected \"oaep\" or \"pkcs1v15\"")
+
+// Returned when the public key is not a base64-encoded PKIX RSA key
+var errRsaPublicKey = errors.New("invalid RSA public key")
+
+// Returned when a ciphertext cannot be decrypted, typically because it was
+// encrypted under a different key or padding scheme. The underlying error is
+// not exposed so that the two cases cannot be told apart.
+var ErrRsaDecryption = errors.New("RSA decryption failed: wrong key or padding scheme")
+
 // RsaKeyResponse represents a response payload containing
 // base64-encoded RSA private and public keys.
 type RsaKeyResponse struct {
     PrivateKey string `json:"privateKey"`
     PublicKey string `json:"publicKey"`
+    Bits int `json:"bits"`
+}
+
+// RsaPublicKeyResponse returns the server's newly generated public key.
+type RsaPublicKeyResponse struct {
+    PublicKey string `json:"publicKey"`
+    Bits int `json:"bits"`
 }
 
 // RsaEncryptRequest is the request payload for encrypting plaintext
@@ -47,6 +81,8 @@ type RsaKeyResponse struct {
 type RsaEncryptRequest struct {
     PublicKey string `json:"publicKey"`
     Text string `json:"text"`
+    Padding string `json:"padding"`
+    Label string `json:"label"`
 }
 
 // RsaEncryptResponse contains the encrypted text encoded in base64.
@@ -54,24 +90,43 @@ type RsaEncryptResponse struct {
     EncryptedText string `json:"encryptedText"`
 }
 
+// RsaEncryptBatchRequest is the request payload for encrypting several
+// plaintexts with the same public key, padding and label.
+type RsaEncryptBatchRequest struct {
+    PublicKey string `json:"publicKey"`
+    Texts []string `json:"texts"`
+    Padding string `json:"padding"`
+    Label string `json:"label"`
+}
+
+// RsaEncryptBatchResponse contains the base64-encoded ciphertexts in the
+// order of the request texts.
+type RsaEncryptBatchResponse struct {
+    EncryptedTexts []string `json:"encryptedTexts"`
+}
+
 // RsaDecryptRequest is the request payload for decrypting RSA-encrypted
 // content using a base64-encoded RSA private key.
 type RsaDecryptRequest struct {
     PrivateKey string `json:"privateKey"`
     EncryptedText string `json:"encryptedText"`
+    Padding string `json:"padding"`
+    Label string `json:"label"`
 }
 
 type RsaDecryptResponse struct {
     Text string `json:"text"`
 }
 
-// RsaKeysHandler handles GET /rsa/keys
+// RsaKeysHandler handles GET /rsa/keys[?bits=3072]
 // It generates a new RSA key pair and returns them in base64-encoded format.
+// `bits` may be 2048 (the default), 3072 or 4096.
 //
 // Response:
 // {
 //   "privateKey": "<base64-RSA-private-key>",
-//   "publicKey": "<base64-RSA-public-key>"
+//   "publicKey": "<base64-RSA-public-key>",
+//   "bits": 2048
 // }
 func RsaKeysHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -80,8 +135,20 @@ func RsaKeysHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	privateKey, publicKey, err := RsaKeys()
-	if err != nil {
+	bits := defaultRsaKeyBits
+	if param := r.URL.Query().Get("bits"); param != "" {
+		var err error
+		if bits, err = strconv.Atoi(param); err != nil {
+			http.Error(w, errRsaKeyBits.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	privateKey, publicKey, err := RsaKeys(bits)
+	if errors.Is(err, errRsaKeyBits) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Error generating RSA keys", http.StatusInternalServerError)
 		return
 	}
@@ -89,6 +156,39 @@ func RsaKeysHandler(w http.ResponseWriter, r *http.Request) {
 	response := RsaKeyResponse {
 		PrivateKey: privateKey,
 		PublicKey: publicKey,
+		Bits: bits,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RsaRotateKeysHandler handles DELETE /rsa/keys
+// It replaces the server's RSA key pair, used by the secure endpoints to
+// decrypt symmetric keys, and returns the new public key. Keys wrapped with
+// the previous public key can no longer be decrypted.
+//
+// Response:
+// {
+//   "publicKey": "<base64-RSA-public-key>",
+//   "bits": 2048
+// }
+func RsaRotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+
+	privateKey, publicKey, err := RsaKeys(defaultRsaKeyBits)
+	if err != nil {
+		http.Error(w, "Error generating RSA keys", http.StatusInternalServerError)
+		return
+	}
+
+	// Set replaces the old key under the write lock, so concurrent secure
+	// requests see either the old key or the new one, never neither
+	KeyStore.Set("privateKey", privateKey)
+	log.Println("RSA key pair rotated\n-----BEGIN PUBLIC KEY-----\n" + publicKey + "\n-----END PUBLIC KEY-----")
+
+	response := RsaPublicKeyResponse {
+		PublicKey: publicKey,
+		Bits: defaultRsaKeyBits,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -101,9 +201,14 @@ func RsaKeysHandler(w http.ResponseWriter, r *http.Request) {
 // Request:
 // {
 //   "publicKey": "<base64-RSA-public-key>",
-//   "text": "hello"
+//   "text": "hello",
+//   "padding": "oaep",
+//   "label": ""
 // }
 //
+// `padding` selects OAEP with SHA-256 ("oaep", the default) or PKCS #1 v1.5
+// ("pkcs1v15"). `label` is an optional OAEP label that must match on decrypt.
+//
 // Response:
 // {
 //   "encryptedText": "<base64-encrypted-bytes>"
@@ -122,8 +227,11 @@ func RsaEncryptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encryptedText, err := RsaEncrypt(request.PublicKey, request.Text)
-	if err != nil {
+	encryptedText, err := RsaEncryptPadding(request.Padding, request.PublicKey, request.Text, request.Label)
+	if errors.Is(err, errRsaPadding) || errors.Is(err, errRsaPublicKey) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Error encrypting text", http.StatusInternalServerError)
 		return
 	}
@@ -136,15 +244,74 @@ func RsaEncryptHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// RsaEncryptBatchHandler handles POST /rsa/encrypt/batch
+// It encrypts each of the given plaintexts as /rsa/encrypt does. If a text
+// fails, for example because it is too long for the key, the error names its
+// index and nothing is returned.
+//
+// Request:
+// {
+//   "publicKey": "<base64-RSA-public-key>",
+//   "texts": ["first", "second"],
+//   "padding": "oaep",
+//   "label": ""
+// }
+//
+// Response:
+// {
+//   "encryptedTexts": ["<base64-encrypted-bytes>", "<base64-encrypted-bytes>"]
+// }
+func RsaEncryptBatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request RsaEncryptBatchRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	encryptedTexts, err := encryptBatch(request.Texts, func(text string) (string, error) {
+		return RsaEncryptPadding(request.Padding, request.PublicKey, text, request.Label)
+	})
+	var batchErr *cryptoBatchError
+	if errors.Is(err, errCryptoBatchSize) || errors.Is(err, errRsaPadding) || errors.Is(err, errRsaPublicKey) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.As(err, &batchErr) {
+		http.Error(w, fmt.Sprintf("Error encrypting text %d", batchErr.Index), http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		http.Error(w, "Error encrypting texts", http.StatusInternalServerError)
+		return
+	}
+
+	response := RsaEncryptBatchResponse {
+		EncryptedTexts: encryptedTexts,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // RsaDecryptHandler handles POST /rsa/decrypt
 // It decrypts base64-encoded RSA ciphertext using the provided private key.
 //
 // Request:
 // {
 //   "privateKey": "<base64-RSA-private-key>",
-//   "encryptedText": "<base64-cipher>"
+//   "encryptedText": "<base64-cipher>",
+//   "padding": "oaep",
+//   "label": ""
 // }
 //
+// `padding` and `label` must match those used to encrypt; a mismatch is
+// rejected with 400 rather than returning garbage bytes.
+//
 // Response:
 // {
 //   "text": "hello"
@@ -163,8 +330,11 @@ func RsaDecryptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	text, err := RsaDecrypt(request.PrivateKey, request.EncryptedText)
-	if err != nil {
+	text, err := RsaDecryptPadding(request.Padding, request.PrivateKey, request.EncryptedText, request.Label)
+	if errors.Is(err, errRsaPadding) || errors.Is(err, ErrRsaDecryption) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Error decrypting text", http.StatusInternalServerError)
 		return
 	}
@@ -177,11 +347,16 @@ func RsaDecryptHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// RsaKeys generates a new 2048-bit RSA private-public key pair,
-// returning both as base64-encoded strings.
-func RsaKeys() (string, string, error) {
+// RsaKeys generates a new RSA private-public key pair of the given size,
+// returning both as base64-encoded strings. Only 2048, 3072 and 4096-bit
+// keys are allowed.
+func RsaKeys(bits int) (string, string, error) {
+
+	if bits != 2048 && bits != 3072 && bits != 4096 {
+		return "", "", errRsaKeyBits
+	}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return "", "", err
 	}
@@ -202,21 +377,11 @@ func RsaKeys() (string, string, error) {
 // returning the ciphertext as a base64-encoded string.
 func RsaEncrypt(base64PublicKey string, text string) (string, error) {
 
-	rsaPublicKeyBytes, err := base64.StdEncoding.DecodeString(base64PublicKey)
+	rsaPublicKey, err := parseRsaPublicKey(base64PublicKey)
 	if err != nil {
 		return "", err
 	}
 
-	publicKey, err := x509.ParsePKIXPublicKey(rsaPublicKeyBytes)
-	if err != nil {
-		return "", err
-	}
-
-	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-	if !ok {
-		return "", fmt.Errorf("Not a RSA public key")
-	}
-
 	encryptedText, err := rsa.EncryptPKCS1v15(rand.Reader, rsaPublicKey, []byte(text))
 	if err != nil {
 		return "", err
@@ -230,25 +395,129 @@ func RsaEncrypt(base64PublicKey string, text string) (string, error) {
 // base64-encoded RSA private key and returns the plaintext.
 func RsaDecrypt(base64PrivateKey string, encryptedText string) (string, error) {
 
-	privateKeyBytes, err := base64.StdEncoding.DecodeString(base64PrivateKey)
+	rsaPrivateKey, encryptedBytes, err := parseRsaCiphertext(base64PrivateKey, encryptedText)
 	if err != nil {
 		return "", err
 	}
 
-	rsaPrivateKey, err := x509.ParsePKCS1PrivateKey(privateKeyBytes)
+	textBytes, err := rsa.DecryptPKCS1v15(rand.Reader, rsaPrivateKey, encryptedBytes)
 	if err != nil {
-		return "", fmt.Errorf("error parsing private key: %v", err)
+		return "", ErrRsaDecryption
 	}
 
-	encryptedBytes, err := base64.StdEncoding.DecodeString(encryptedText)
+	return string(textBytes), nil
+}
+
+// RsaEncryptOAEP encrypts plaintext with RSA-OAEP using SHA-256 and the given
+// label (which may be empty), returning the ciphertext as a base64-encoded string.
+func RsaEncryptOAEP(base64PublicKey string, text string, label string) (string, error) {
+
+	rsaPublicKey, err := parseRsaPublicKey(base64PublicKey)
 	if err != nil {
 		return "", err
 	}
 
-	textBytes, err := rsa.DecryptPKCS1v15(rand.Reader, rsaPrivateKey, encryptedBytes)
+	encryptedText, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPublicKey, []byte(text), []byte(label))
 	if err != nil {
 		return "", err
 	}
 
+	return base64.StdEncoding.EncodeToString(encryptedText), nil
+}
+
+// RsaDecryptOAEP decrypts a base64-encoded RSA-OAEP (SHA-256) ciphertext. It
+// returns ErrRsaDecryption if the key, padding scheme or label do not match.
+func RsaDecryptOAEP(base64PrivateKey string, encryptedText string, label string) (string, error) {
+
+	rsaPrivateKey, encryptedBytes, err := parseRsaCiphertext(base64PrivateKey, encryptedText)
+	if err != nil {
+		return "", err
+	}
+
+	textBytes, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaPrivateKey, encryptedBytes, []byte(label))
+	if err != nil {
+		return "", ErrRsaDecryption
+	}
+
 	return string(textBytes), nil
+}
+
+// RsaEncryptPadding encrypts with the padding scheme named by padding. The
+// label is only used by OAEP.
+func RsaEncryptPadding(padding string, base64PublicKey string, text string, label string) (string, error) {
+	switch padding {
+	case "", RsaPaddingOAEP:
+		return RsaEncryptOAEP(base64PublicKey, text, label)
+	case RsaPaddingPKCS1:
+		return RsaEncrypt(base64PublicKey, text)
+	}
+	return "", errRsaPadding
+}
+
+// RsaDecryptPadding decrypts with the padding scheme named by padding. The
+// label is only used by OAEP.
+func RsaDecryptPadding(padding string, base64PrivateKey string, encryptedText string, label string) (string, error) {
+	switch padding {
+	case "", RsaPaddingOAEP:
+		return RsaDecryptOAEP(base64PrivateKey, encryptedText, label)
+	case RsaPaddingPKCS1:
+		return RsaDecrypt(base64PrivateKey, encryptedText)
+	}
+	return "", errRsaPadding
+}
+
+// RsaDecryptKeyExchange decrypts the symmetric key sent to the secure
+// endpoints. OAEP is tried first; PKCS #1 v1.5 is only attempted when
+// allowPKCS1 is set (--rsa-pkcs1-fallback) for clients that predate OAEP.
+func RsaDecryptKeyExchange(base64PrivateKey string, encryptedKey string, allowPKCS1 bool) (string, error) {
+
+	key, err := RsaDecryptOAEP(base64PrivateKey, encryptedKey, "")
+	if errors.Is(err, ErrRsaDecryption) && allowPKCS1 {
+		return RsaDecrypt(base64PrivateKey, encryptedKey)
+	}
+
+	return key, err
+}
+
+// parseRsaPublicKey decodes a base64-encoded PKIX RSA public key.
+func parseRsaPublicKey(base64PublicKey string) (*rsa.PublicKey, error) {
+
+	rsaPublicKeyBytes, err := base64.StdEncoding.DecodeString(base64PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRsaPublicKey, err)
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(rsaPublicKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRsaPublicKey, err)
+	}
+
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an RSA key", errRsaPublicKey)
+	}
+
+	return rsaPublicKey, nil
+}
+
+// parseRsaCiphertext decodes a base64-encoded PKCS #1 private key and the
+// base64-encoded ciphertext to be decrypted with it.
+func parseRsaCiphertext(base64PrivateKey string, encryptedText string) (*rsa.PrivateKey, []byte, error) {
+
+	privateKeyBytes, err := base64.StdEncoding.DecodeString(base64PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rsaPrivateKey, err := x509.ParsePKCS1PrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing private key: %v", err)
+	}
+
+	encryptedBytes, err := base64.StdEncoding.DecodeString(encryptedText)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rsaPrivateKey, encryptedBytes, nil
 }
\ No newline at end of file
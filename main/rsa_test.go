@@ -0,0 +1,222 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func TestRsaOAEPRoundTrip(t *testing.T) {
+	privateKey, publicKey, err := RsaKeys(defaultRsaKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := RsaEncryptPadding("", publicKey, "symmetric key", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := RsaDecryptOAEP(privateKey, encrypted, "session")
+	if err != nil || text != "symmetric key" {
+		t.Fatalf("expected round trip, got %q (%v)", text, err)
+	}
+
+	if _, err := RsaDecryptOAEP(privateKey, encrypted, "other"); !errors.Is(err, ErrRsaDecryption) {
+		t.Errorf("expected a mismatched label to be rejected, got %v", err)
+	}
+	if _, err := RsaEncryptPadding("none", publicKey, "x", ""); !errors.Is(err, errRsaPadding) {
+		t.Errorf("expected unknown padding to be rejected, got %v", err)
+	}
+}
+
+func TestRsaWrongPaddingFails(t *testing.T) {
+	privateKey, publicKey, err := RsaKeys(defaultRsaKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oaep, err := RsaEncryptOAEP(publicKey, "symmetric key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1, err := RsaEncrypt(publicKey, "symmetric key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text, err := RsaDecrypt(privateKey, oaep); !errors.Is(err, ErrRsaDecryption) {
+		t.Errorf("expected PKCS1v15 decryption of OAEP ciphertext to fail, got %q (%v)", text, err)
+	}
+	if text, err := RsaDecryptOAEP(privateKey, pkcs1, ""); !errors.Is(err, ErrRsaDecryption) {
+		t.Errorf("expected OAEP decryption of PKCS1v15 ciphertext to fail, got %q (%v)", text, err)
+	}
+}
+
+func TestRsaDecryptKeyExchangeFallback(t *testing.T) {
+	privateKey, publicKey, err := RsaKeys(defaultRsaKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oaep, _ := RsaEncryptOAEP(publicKey, "oaep key", "")
+	pkcs1, _ := RsaEncrypt(publicKey, "legacy key")
+
+	for _, fallback := range []bool{false, true} {
+		if key, err := RsaDecryptKeyExchange(privateKey, oaep, fallback); err != nil || key != "oaep key" {
+			t.Errorf("fallback=%v: expected OAEP key, got %q (%v)", fallback, key, err)
+		}
+	}
+
+	if _, err := RsaDecryptKeyExchange(privateKey, pkcs1, false); !errors.Is(err, ErrRsaDecryption) {
+		t.Errorf("expected PKCS1v15 key to be rejected without fallback, got %v", err)
+	}
+	if key, err := RsaDecryptKeyExchange(privateKey, pkcs1, true); err != nil || key != "legacy key" {
+		t.Errorf("expected PKCS1v15 key with fallback, got %q (%v)", key, err)
+	}
+}
+
+func TestRsaKeysHandlerBits(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		bits   int
+		status int
+	}{
+		{"", 2048, http.StatusOK},
+		{"?bits=3072", 3072, http.StatusOK},
+		{"?bits=1024", 0, http.StatusBadRequest},
+		{"?bits=2047", 0, http.StatusBadRequest},
+		{"?bits=big", 0, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		RsaKeysHandler(w, httptest.NewRequest("GET", "/rsa/keys"+tc.query, nil))
+		if w.Code != tc.status {
+			t.Errorf("%q: expected status %d, got %d", tc.query, tc.status, w.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		var resp RsaKeyResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		der, _ := base64.StdEncoding.DecodeString(resp.PrivateKey)
+		key, err := x509.ParsePKCS1PrivateKey(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Bits != tc.bits || key.N.BitLen() != tc.bits {
+			t.Errorf("%q: expected a %d-bit key, got %d reported and %d generated", tc.query, tc.bits, resp.Bits, key.N.BitLen())
+		}
+	}
+}
+
+func TestRsaRotateKeysHandler(t *testing.T) {
+	old := KeyStore.store
+	KeyStore = &KeyCache{store: make(map[string]keyEntry)}
+	t.Cleanup(func() { KeyStore = &KeyCache{store: old} })
+
+	KeyStore.Set("privateKey", "previous")
+
+	w := httptest.NewRecorder()
+	RsaRotateKeysHandler(w, httptest.NewRequest("DELETE", "/rsa/keys", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var resp RsaPublicKeyResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, ok := KeyStore.Get("privateKey")
+	if !ok || privateKey == "previous" {
+		t.Fatal("expected the server private key to be replaced")
+	}
+
+	// the stored private key pairs with the returned public key
+	encrypted, err := RsaEncryptOAEP(resp.PublicKey, "symmetric key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := RsaDecryptKeyExchange(privateKey, encrypted, false); err != nil || key != "symmetric key" {
+		t.Errorf("expected the new key pair to round trip, got %q (%v)", key, err)
+	}
+}
+
+func TestRsaEncryptBatchHandler(t *testing.T) {
+	privateKey, publicKey, err := RsaKeys(defaultRsaKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(publicKey string, texts []string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(RsaEncryptBatchRequest{PublicKey: publicKey, Texts: texts})
+		w := httptest.NewRecorder()
+		RsaEncryptBatchHandler(w, httptest.NewRequest(http.MethodPost, "/rsa/encrypt/batch", strings.NewReader(string(body))))
+		return w
+	}
+
+	texts := []string{"first", "second", "third"}
+	w := post(publicKey, texts)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp RsaEncryptBatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.EncryptedTexts) != len(texts) {
+		t.Fatalf("expected %d ciphertexts, got %d", len(texts), len(resp.EncryptedTexts))
+	}
+	for i, encrypted := range resp.EncryptedTexts {
+		if text, err := RsaDecryptOAEP(privateKey, encrypted, ""); err != nil || text != texts[i] {
+			t.Errorf("text %d: expected %q, got %q (%v)", i, texts[i], text, err)
+		}
+	}
+
+	// a text too long for the key fails the batch at its index
+	w = post(publicKey, []string{"ok", strings.Repeat("x", 1024)})
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "text 1") {
+		t.Errorf("expected the failing index in a 500, got %d: %s", w.Code, w.Body)
+	}
+
+	// a key that does not parse is a client error
+	for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("not a key"))} {
+		if w := post(key, texts); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for public key %q, got %d: %s", key, w.Code, w.Body)
+		}
+	}
+}
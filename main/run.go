@@ -35,9 +35,12 @@ package main
 // This engine supports multi-session inference, caching, and efficient token streaming.
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"strings"
 	"time"
 	"log/slog"
@@ -49,7 +52,9 @@ import (
 // for either tokens or image embeddings, until the context is cancelled.
 func (server *Server) run(ctx context.Context) {
 	
-	server.ready.Wait()
+	if err := server.waitReady(); err != nil {
+		return
+	}
 
 	tokenBatch := createTokenBatch(server)
 	defer tokenBatch.Free()
@@ -61,9 +66,19 @@ func (server *Server) run(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			default:
+				// throttle outside processBatch, which holds server.mu
+				if err := server.pacer.Wait(ctx); err != nil {
+					return
+				}
+
 				err := processBatch(server, tokenBatch, embedBatch)
 				if err != nil {
-					panic(err)
+					// only the sequences in the failed batch are affected, the
+					// rest keep generating
+					slog.Error("failed to process batch", "error", err)
+					server.mu.Lock()
+					failBatch(server)
+					server.mu.Unlock()
 				}
 
 				tokenBatch.Clear()
@@ -72,6 +87,29 @@ func (server *Server) run(ctx context.Context) {
 	}
 }
 
+// expireCacheSlots clears cached prompts whose cache_ttl_ms has passed,
+// checking every cacheExpiryInterval until the context is cancelled.
+func (server *Server) expireCacheSlots(ctx context.Context) {
+
+	if err := server.waitReady(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(cacheExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				server.mu.Lock()
+				server.cache.ClearExpired(now)
+				server.mu.Unlock()
+		}
+	}
+}
+
 // createTokenBatch creates a new llama.Batch instance used for token decoding
 // across active sequences. Panics if allocation fails.
 func createTokenBatch(server *Server) *llama.Batch {
@@ -109,92 +147,51 @@ func createEmbedBatch(server *Server) *llama.Batch {
 // It alternates between embedding and token batches based on the input type.
 // Handles embedding-only outputs, stop-sequence truncation, and streaming output.
 //
-// Returns an error only in case of decoding failure or KV cache mismanagement.
+// Returns an error only in case of decoding failure or KV cache mismanagement,
+// leaving the pending inputs of the failed batch in place for failBatch.
 func processBatch(s *Server, tokenBatch *llama.Batch, embedBatch *llama.Batch) error {
 
 	s.mu.Lock()
-	for allNil(s) {
-		s.cond.Wait() // Wait until an item is added
+	for allNil(s) && !s.shuttingDown {
+		s.cond.Wait() // Wait until an item is added or the server shuts down
 	}
 	defer s.mu.Unlock()
 
-	var batch *llama.Batch
-	crossAttention := false
-
-	seqIdx := s.nextSeq - 1
-	for range s.seqs {
-		seqIdx = (seqIdx + 1) % len(s.seqs)
-		seq := s.seqs[seqIdx]
-
-		if seq == nil {
-			continue
-		}
-
-		// if past the num predict limit
-		if seq.numPredict > 0 && seq.numPredicted >= seq.numPredict {
-			removeSequence(s, seqIdx, "limit")
-			continue
-		}
-
-		for i, input := range seq.inputs {
-			if len(seq.cache.Inputs)+len(seq.pendingInputs)+1 > s.cache.numCtx {
-				if len(seq.pendingInputs) == 0 {
-					err := s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
-					if err != nil {
-						return err
-					}
-				} else {
-					break
-				}
-			}
-
-			embedding := input.embed != nil
-
-			// If we don't currently have a batch, use one of the correct type and
-			// fill it up as much as possible across all sequences. If we encounter an
-			// input of the opppsite type, stop for that sequence but then pick up from
-			// there for the next batch, ensuring that we alternate types
-			if batch == nil {
-				if !embedding {
-					batch = tokenBatch
-				} else {
-					batch = embedBatch
-					seq.crossAttention = s.image.NeedCrossAttention(input)
-				}
-			} else if embedding != batch.IsEmbedding() || crossAttention != seq.crossAttention {
-				s.nextSeq = seqIdx
-				break
-			}
-
-			if i >= batch.Size() {
-				break
-			}
-
-			crossAttention = seq.crossAttention
-			batch.Add(input.token, input.embed, len(seq.cache.Inputs)+len(seq.pendingInputs), i+1 == len(seq.inputs), seq.cache.Id)
-			seq.pendingInputs = append(seq.pendingInputs, input)
-			seq.iBatch = batch.NumTokens() - 1
-		}
-
-		seq.inputs = seq.inputs[len(seq.pendingInputs):]
+	batch, crossAttention, batchLora, err := fillBatch(s, tokenBatch, embedBatch)
+	if err != nil {
+		return err
 	}
 
 	if batch == nil || batch.NumTokens() == 0 {
 		return nil
 	}
 
+	if err := applyLora(s, batchLora); err != nil {
+		return fmt.Errorf("failed to apply lora adapters: %w", err)
+	}
+
 	s.lc.SetCrossAttention(crossAttention)
 
-	err := s.lc.Decode(batch)
-	if err != nil {
+	err = retryDecode(func() error {
+		err := s.lc.Decode(batch)
 		if errors.Is(err, llama.ErrKvCacheFull) {
+			InferenceStats.KvCacheFull.Add(1)
 			slog.Debug("defragmenting kv cache")
 			s.cache.lc.KvCacheDefrag()
+			InferenceStats.KvCacheDefrags.Add(1)
 			err = s.lc.Decode(batch)
 		}
-		if err != nil {
+		return err
+	}, s.decodeRetries, s.decodeRetryDelay)
+	if err != nil {
+		if !isRetryableDecodeError(err) {
 			return fmt.Errorf("failed to decode batch: %w", err)
 		}
+
+		// the KV cache is unchanged, so only the sequences in this batch fail
+		slog.Error("giving up on batch after decode retries", "error", err)
+		failBatch(s)
+		return nil
 	}
 
 	if crossAttention {
@@ -215,6 +212,11 @@ func processBatch(s *Server, tokenBatch *llama.Batch, embedBatch *llama.Batch) e
 			seq.pendingInputs = []input{}
 		}
 
+		// Capture per-token embeddings before the next batch overwrites them
+		if seq.tokenEmbeddings {
+			collectTokenEmbeddings(s, seq)
+		}
+
 		// don't sample prompt processing
 		if len(seq.inputs) != 0 {
 			continue
@@ -223,6 +225,7 @@ func processBatch(s *Server, tokenBatch *llama.Batch, embedBatch *llama.Batch) e
 		seq.numDecoded += 1
 		if seq.numDecoded == 1 {
 			seq.startGenerationTime = time.Now()
+			signalPrefilled(seq)
 		}
 
 		// if done processing the prompt, generate an embedding and return
@@ -233,40 +236,99 @@ func processBatch(s *Server, tokenBatch *llama.Batch, embedBatch *llama.Batch) e
 			}
 
 			seq.embedding <- embed
-			removeSequence(s, i, "")
+			removeSequence(s, i, StopReasonNone)
+			continue
+		}
+
+		// prepared prompt chunks only fill the KV cache; the slot stays
+		// reserved until the next chunk or /completion/run
+		if seq.prefillOnly {
+			removeSequence(s, i, StopReasonNone)
 			continue
 		}
 
+		// debug requests only want the raw logits of the final prompt position
+		if seq.logitsOnly {
+			seq.embedding <- slices.Clone(s.lc.GetLogitsIth(seq.iBatch))
+			removeSequence(s, i, StopReasonNone)
+			continue
+		}
+
+		// restrict the vocabulary before sampling if requested; when token
+		// healing, the first token must complete the removed prompt token
+		// (healingTokens is already limited to allowed_tokens)
+		allowed := seq.allowedTokens
+		healing := seq.numPredicted == 0 && len(seq.healingTokens) > 0
+		if healing {
+			allowed = seq.healingTokens
+		}
+		if len(allowed) > 0 {
+			maskLogits(s.lc.GetLogitsIth(seq.iBatch), allowed)
+		}
+
+		// the sampler runs at the schedule's initial temperature, so rescale
+		// the logits to sample at the current one
+		if seq.tempSchedule != nil {
+			scaleLogits(s.lc.GetLogitsIth(seq.iBatch), seq.tempSchedule.At(0)/seq.tempSchedule.At(seq.numPredicted))
+		}
+
 		// sample a token
 		token := seq.samplingCtx.Sample(s.lc, seq.iBatch)
 		seq.samplingCtx.Accept(token, true)
+		now := time.Now()
+		s.pacer.Add(1, now)
+		s.throughput.Add(1, now)
+		InferenceStats.TokensGenerated.Add(1)
 		piece := s.model.TokenToPiece(token)
 
+		// the healed prefix is already part of the prompt, so don't repeat it
+		if healing {
+			piece = strings.TrimPrefix(piece, seq.healingPrefix)
+		}
+
 		seq.numPredicted++
+		if seq.numPredicted == 1 {
+			s.webhook.SequenceEvent(WebhookEventFirstToken, seq, "")
+		}
 
 		// if it's an end of sequence token, break
-		if s.model.TokenIsEog(token) {
+		if isEog(s, token) {
+			recordStopAlternative(s, seq, token)
+
 			// TODO (jmorganca): we should send this back
 			// as it's important for the /api/generate context
 			// seq.responses <- piece
 
-			removeSequence(s, i, "stop")
+			removeSequence(s, i, StopReasonStop)
 			continue
 		}
 
 		seq.inputs = []input{{token: token}}
 
 		seq.pendingResponses = append(seq.pendingResponses, piece)
+		seq.pendingTokens = append(seq.pendingTokens, token)
+		if seq.logprobs > 0 {
+			seq.pendingLogprobs = append(seq.pendingLogprobs, tokenLogprob(s, seq, token))
+		}
 		sequence := strings.Join(seq.pendingResponses, "")
 
 		if ok, stop := findStop(sequence, seq.stop); ok {
 			slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+			recordStopAlternative(s, seq, token)
 
 			var tokenTruncated bool
 			origLen := len(seq.pendingResponses)
 			seq.pendingResponses, tokenTruncated = truncateStop(seq.pendingResponses, stop)
 			newLen := len(seq.pendingResponses)
 
+			// Only stream token IDs whose pieces survived truncation intact
+			keepTokens := newLen
+			if tokenTruncated {
+				keepTokens--
+			}
+			seq.pendingTokens = seq.pendingTokens[:keepTokens]
+			seq.pendingLogprobs = seq.pendingLogprobs[:min(keepTokens, len(seq.pendingLogprobs))]
+
 			// Update the cache based on the tokens that will be returned:
 			// - We have 1 token more than is currently in the cache because
 			// the last one generated wasn't submitted to Decode
@@ -281,26 +343,229 @@ func processBatch(s *Server, tokenBatch *llama.Batch, embedBatch *llama.Batch) e
 			}
 			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
 
-			removeSequence(s, i, "stop")
+			seq.hitStopWord = true
+			removeSequence(s, i, StopReasonStop)
 			continue
 		}
 
-		if containsStopSuffix(sequence, seq.stop) {
+		if hitNewlineLimit(seq, piece) {
+			removeSequence(s, i, StopReasonNewline)
 			continue
 		}
 
-		if incompleteUnicode(sequence) {
+		if holdPending(seq, sequence) {
 			continue
 		}
 
-		if !flushPending(seq) {
-			removeSequence(s, i, "connection")
+		if !flushPending(seq, false) {
+			removeSequence(s, i, StopReasonConnection)
 		}
 	}
 
 	return nil
 }
 
+// fillBatch adds the pending inputs of the active sequences to a batch, as
+// the --batch-fill strategy allows, and returns it along with whether it needs
+// cross attention and the LoRA scales it must be decoded with. The batch is
+// nil if no sequence has inputs. The caller must hold s.mu.
+func fillBatch(s *Server, tokenBatch *llama.Batch, embedBatch *llama.Batch) (*llama.Batch, bool, []float32, error) {
+	var batch *llama.Batch
+	crossAttention := false
+
+	// LoRA adapters apply to the whole context, so a batch only contains
+	// sequences using the same adapter scales
+	var batchLora []float32
+	haveLora := false
+
+	// the strategy shares the batch between the sequences of the top priority
+	top, active := topPriority(s.seqs)
+	for _, seqIdx := range s.batchFill.order(s.seqs, s.nextSeq) {
+		seq := s.seqs[seqIdx]
+
+		if seq == nil {
+			continue
+		}
+
+		if !seq.started {
+			seq.started = true
+			s.webhook.SequenceEvent(WebhookEventStarted, seq, "")
+		}
+
+		// if past the num predict limit
+		if seq.numPredict > 0 && seq.numPredicted >= seq.numPredict {
+			removeSequence(s, seqIdx, StopReasonLimit)
+			continue
+		}
+
+		if haveLora && !slices.Equal(seq.lora, batchLora) {
+			s.nextSeq = seqIdx
+			continue
+		}
+
+		for i, input := range seq.inputs {
+			if len(seq.cache.Inputs)+len(seq.pendingInputs)+1 > s.cache.numCtx {
+				if len(seq.pendingInputs) == 0 {
+					err := s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
+					if err != nil {
+						// this sequence can't continue, the rest of the batch is
+						// failed by the caller
+						removeSequence(s, seqIdx, StopReasonError)
+						return nil, false, nil, fmt.Errorf("failed to shift context: %w", err)
+					}
+				} else {
+					break
+				}
+			}
+
+			embedding := input.embed != nil
+
+			// If we don't currently have a batch, use one of the correct type and
+			// fill it up as much as possible across all sequences. If we encounter an
+			// input of the opppsite type, stop for that sequence but then pick up from
+			// there for the next batch, ensuring that we alternate types
+			if batch == nil {
+				if !embedding {
+					batch = tokenBatch
+				} else {
+					batch = embedBatch
+					seq.crossAttention = s.image.NeedCrossAttention(input)
+				}
+			} else if embedding != batch.IsEmbedding() || crossAttention != seq.crossAttention {
+				s.nextSeq = seqIdx
+				break
+			}
+
+			// the batch holds i inputs of this sequence on top of those of
+			// the sequences before it
+			filled := batch.NumTokens() - i
+			limit := s.batchFill.limit(batch.Size(), active, filled)
+			if seq.priority < top {
+				limit = min(limit, max(batch.Size()-filled, 0))
+			}
+			if i >= limit {
+				break
+			}
+
+			crossAttention = seq.crossAttention
+			outputs := i+1 == len(seq.inputs) || seq.tokenEmbeddings
+			batch.Add(input.token, input.embed, len(seq.cache.Inputs)+len(seq.pendingInputs), outputs, seq.cache.Id)
+			seq.pendingInputs = append(seq.pendingInputs, input)
+			seq.iBatch = batch.NumTokens() - 1
+			if seq.tokenEmbeddings {
+				seq.pendingBatchIdx = append(seq.pendingBatchIdx, seq.iBatch)
+			}
+		}
+
+		seq.inputs = seq.inputs[len(seq.pendingInputs):]
+		if len(seq.pendingInputs) > 0 && !haveLora {
+			batchLora, haveLora = seq.lora, true
+		}
+	}
+
+	return batch, crossAttention, batchLora, nil
+}
+
+// retryDecode calls decode, retrying transient failures and a full KV cache up
+// to retries times. The delay before each retry starts at delay and doubles.
+// The decode loop holds s.mu while it waits, so delays should stay short.
+func retryDecode(decode func() error, retries int, delay time.Duration) error {
+	err := decode()
+	for attempt := 1; attempt <= retries && isRetryableDecodeError(err); attempt++ {
+		slog.Warn("transient decode failure, retrying", "error", err, "attempt", attempt, "delay", delay)
+		time.Sleep(delay)
+		delay *= 2
+		err = decode()
+	}
+	return err
+}
+
+// isTransientDecodeError reports whether decoding the same batch again may succeed.
+func isTransientDecodeError(err error) bool {
+	var decodeErr *llama.DecodeError
+	return errors.As(err, &decodeErr) && decodeErr.Transient()
+}
+
+// isRetryableDecodeError reports whether a failed decode left the KV cache
+// unchanged, so the batch can be retried or failed on its own: the error is
+// transient, or no KV cache slot could be found for the batch.
+func isRetryableDecodeError(err error) bool {
+	return isTransientDecodeError(err) || errors.Is(err, llama.ErrKvCacheFull)
+}
+
+// failBatch finalizes every sequence with inputs in the batch that could not be
+// decoded, so their clients get a final frame with finish_reason "error".
+func failBatch(s *Server) {
+	for i, seq := range s.seqs {
+		if seq != nil && len(seq.pendingInputs) > 0 {
+			seq.pendingInputs = []input{}
+			removeSequence(s, i, StopReasonError)
+		}
+	}
+}
+
+// hitNewlineLimit counts the newlines in the latest piece towards the
+// sequence's max_newlines. When the limit is reached it drops the limiting
+// newline and anything after it from the pending output, along with the token
+// ID of the piece since its text is no longer returned whole, and returns true.
+func hitNewlineLimit(seq *Sequence, piece string) bool {
+	if seq.maxNewlines <= 0 {
+		return false
+	}
+
+	for i := 0; i < len(piece); i++ {
+		if piece[i] != '\n' {
+			continue
+		}
+
+		seq.numNewlines++
+		if seq.numNewlines == seq.maxNewlines {
+			seq.pendingResponses[len(seq.pendingResponses)-1] = piece[:i]
+			seq.pendingTokens = seq.pendingTokens[:len(seq.pendingTokens)-1]
+			if len(seq.pendingLogprobs) > 0 {
+				seq.pendingLogprobs = seq.pendingLogprobs[:len(seq.pendingLogprobs)-1]
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// holdPending reports whether pending output must be held back, either because
+// it ends with a partial stop sequence or with an incomplete UTF-8 character,
+// and counts each case in StreamStats.
+func holdPending(seq *Sequence, sequence string) bool {
+	if containsStopSuffix(sequence, seq.stop) {
+		StreamStats.StopSuffixDelays.Add(1)
+		return true
+	}
+
+	// token IDs are detokenized by the client, so partial characters are fine
+	if !seq.streamTokenIds && incompleteUnicode(sequence) {
+		StreamStats.IncompleteUnicodeHolds.Add(1)
+		return true
+	}
+
+	return false
+}
+
+// collectTokenEmbeddings copies the embedding of every input decoded for the
+// sequence in the last batch. Models that only produce pooled embeddings
+// return nil for individual tokens, in which case the matrix is discarded.
+func collectTokenEmbeddings(s *Server, seq *Sequence) {
+	for _, idx := range seq.pendingBatchIdx {
+		embed := s.lc.GetEmbeddingsIth(idx)
+		if embed == nil {
+			seq.tokenEmbeddings = false
+			seq.tokenEmbeds = nil
+			break
+		}
+		seq.tokenEmbeds = append(seq.tokenEmbeds, slices.Clone(embed))
+	}
+	seq.pendingBatchIdx = []int{}
+}
+
 // allNil returns true if no active sequences are in the server's sequence pool.
 func allNil(s *Server) bool {
 	for _, item := range s.seqs {
@@ -313,16 +578,176 @@ func allNil(s *Server) bool {
 
 // removeSequence finalizes a sequence by marking its reason for completion,
 // flushing pending tokens, closing channels, and releasing the cache slot.
-func removeSequence(s *Server, seqIndex int, reason string) {
+// Prefill sequences leave their cache slot and sequence slot reserved for the
+// prepared prompt they belong to.
+func removeSequence(s *Server, seqIndex int, reason StopReason) {
 	seq := s.seqs[seqIndex]
 
-	flushPending(seq)
+	flushPending(seq, true)
 	seq.doneReason = reason
+	InferenceStats.ObserveTimings(sequenceTimings(seq))
+	s.webhook.SequenceEvent(WebhookEventCompleted, seq, reason.String())
 	close(seq.responses)
 	close(seq.embedding)
-	seq.cache.InUse = false
+	signalPrefilled(seq)
 	s.seqs[seqIndex] = nil
-	s.seqsSem.Release(1)
+	s.untrackSession(seq.sessionID, seqIndex)
+	s.untrackRequest(seq)
+	if s.loraSwapping {
+		s.cond.Broadcast()
+	}
+	if !seq.prefillOnly {
+		if seq.cacheTTL > 0 {
+			seq.cache.expiresAt = time.Now().Add(seq.cacheTTL)
+		}
+		seq.cache.InUse = false
+		s.slotSemaphore(seq).Release(1)
+	}
+}
+
+// signalPrefilled tells a waiter on seq.prefilled that the prompt is in the
+// KV cache, or that it never will be because seq was removed.
+func signalPrefilled(seq *Sequence) {
+	if seq.prefilled != nil {
+		close(seq.prefilled)
+		seq.prefilled = nil
+	}
+}
+
+// recordStopAlternative captures the runner-up to the token that stopped
+// generation, if the request asked for it. It must be called before the next
+// decode overwrites the logits for seq.iBatch.
+func recordStopAlternative(s *Server, seq *Sequence, token int) {
+	if !seq.wantStopAlternative {
+		return
+	}
+
+	alt, prob, sampledProb := runnerUp(s.lc.GetLogitsIth(seq.iBatch), token)
+	if alt < 0 {
+		return
+	}
+
+	seq.stopAlternative = &TokenAlternative{
+		Token:       alt,
+		Piece:       s.model.TokenToPiece(alt),
+		Prob:        prob,
+		SampledProb: sampledProb,
+	}
+}
+
+// runnerUp returns the most likely token other than chosen, its probability,
+// and the probability of chosen, from a softmax over logits. It returns -1 if
+// there is no other token.
+func runnerUp(logits []float32, chosen int) (int, float32, float32) {
+	if len(logits) < 2 || chosen < 0 || chosen >= len(logits) {
+		return -1, 0, 0
+	}
+
+	maxLogit := float32(math.Inf(-1))
+	alt := -1
+	for i, l := range logits {
+		maxLogit = max(maxLogit, l)
+		if i != chosen && (alt < 0 || l > logits[alt]) {
+			alt = i
+		}
+	}
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l - maxLogit))
+	}
+
+	prob := func(i int) float32 {
+		return float32(math.Exp(float64(logits[i]-maxLogit)) / sum)
+	}
+	return alt, prob(alt), prob(chosen)
+}
+
+// maxLogprobs is the largest number of top alternatives a request may ask for
+const maxLogprobs = 20
+
+// tokenLogprob returns the logprob of the sampled token and the request's
+// number of most likely alternatives. It must be called before the next decode
+// overwrites the logits for seq.iBatch.
+func tokenLogprob(s *Server, seq *Sequence, token int) TokenLogprob {
+	logprob, top := topLogprobs(s.lc.GetLogitsIth(seq.iBatch), token, seq.logprobs)
+
+	lp := TokenLogprob{ID: token, Token: s.model.TokenToPiece(token), Logprob: logprob}
+	for _, t := range top {
+		t.Token = s.model.TokenToPiece(t.ID)
+		lp.TopLogprobs = append(lp.TopLogprobs, t)
+	}
+	return lp
+}
+
+// topLogprobs returns the log-softmax of chosen over logits and the n most
+// likely tokens with their logprobs, most likely first. Token pieces are left
+// for the caller to fill in.
+func topLogprobs(logits []float32, chosen int, n int) (float32, []TokenLogprob) {
+	if chosen < 0 || chosen >= len(logits) {
+		return float32(math.Inf(-1)), nil
+	}
+
+	maxLogit := float32(math.Inf(-1))
+	for _, l := range logits {
+		maxLogit = max(maxLogit, l)
+	}
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l - maxLogit))
+	}
+	logSum := float32(math.Log(sum))
+
+	logprob := func(i int) float32 {
+		return logits[i] - maxLogit - logSum
+	}
+
+	// n is small, so keep the top n with an insertion into a sorted slice
+	top := make([]int, 0, n+1)
+	for i, l := range logits {
+		if len(top) == n && (n == 0 || l <= logits[top[n-1]]) {
+			continue
+		}
+		j, _ := slices.BinarySearchFunc(top, l, func(t int, l float32) int {
+			return cmp.Compare(l, logits[t])
+		})
+		top = slices.Insert(top, j, i)
+		if len(top) > n {
+			top = top[:n]
+		}
+	}
+
+	alternatives := make([]TokenLogprob, len(top))
+	for i, t := range top {
+		alternatives[i] = TokenLogprob{ID: t, Logprob: logprob(t)}
+	}
+	return logprob(chosen), alternatives
+}
+
+// isEog reports whether the token ends generation, either because the model
+// marks it as end-of-generation or because it was configured via --eog-tokens.
+func isEog(s *Server, token int) bool {
+	return s.model.TokenIsEog(token) || s.eogTokens.Contains(token)
+}
+
+// maskLogits sets the logit of every token not in `allowed` to -inf so that
+// the sampler can only pick from the allowed set.
+func maskLogits(logits []float32, allowed []int) {
+	kept := make(map[int]float32, len(allowed))
+	for _, token := range allowed {
+		if token >= 0 && token < len(logits) {
+			kept[token] = logits[token]
+		}
+	}
+
+	for i := range logits {
+		logits[i] = float32(math.Inf(-1))
+	}
+
+	for token, logit := range kept {
+		logits[token] = logit
+	}
 }
 
 // incompleteUnicode checks if the last bytes in a string form an incomplete
@@ -358,11 +783,33 @@ func incompleteUnicode(token string) bool {
 }
 
 // flushPending sends all buffered string tokens (`pendingResponses`) as a
-// single output string, trimming invalid UTF-8 if present. It returns false
-// if the client has disconnected.
-func flushPending(seq *Sequence) bool {
-	joined := strings.Join(seq.pendingResponses, "")
+// single output string, trimming invalid UTF-8 if present. When the sequence
+// streams token IDs, the buffered IDs (`pendingTokens`) are sent instead.
+//
+// If the sequence holds partial UTF-8 (`--utf8-hold`) and this is not the
+// final flush, a trailing partial character is kept and prepended to the next
+// flush instead of being discarded. It returns false if the client has disconnected.
+func flushPending(seq *Sequence, final bool) bool {
+	joined := seq.heldBytes + strings.Join(seq.pendingResponses, "")
+	tokens := seq.pendingTokens
+	logprobs := seq.pendingLogprobs
+	seq.heldBytes = ""
 	seq.pendingResponses = []string{}
+	seq.pendingTokens = []int{}
+	seq.pendingLogprobs = nil
+
+	if seq.streamTokenIds {
+		if len(tokens) == 0 {
+			return true
+		}
+
+		select {
+		case seq.responses <- response{tokens: tokens, logprobs: logprobs}:
+			return true
+		case <-seq.quit:
+			return false
+		}
+	}
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -370,16 +817,24 @@ func flushPending(seq *Sequence) bool {
 	// - Sequence is ending, e.g. generation limit has been hit
 	// - Invalid characters in the middle of a string
 	// This is a stricter check to ensure we never output invalid Unicode.
-	for !utf8.ValidString(joined) {
-		joined = joined[:len(joined)-1]
+	valid := joined
+	for !utf8.ValidString(valid) {
+		valid = valid[:len(valid)-1]
 	}
 
+	// A partial character is at most utf8.UTFMax-1 bytes; anything longer is
+	// genuinely invalid and is discarded as before.
+	if held := joined[len(valid):]; seq.holdPartialUTF8 && !final && len(held) < utf8.UTFMax {
+		seq.heldBytes = held
+	}
+	joined = valid
+
 	if len(joined) == 0 {
 		return true
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{content: joined, logprobs: logprobs}:
 		return true
 	case <-seq.quit:
 		return false
@@ -433,6 +888,10 @@ func truncateStop(pieces []string, stop string) ([]string, bool) {
 		start = end
 	}
 
+	if tokenTruncated {
+		StreamStats.MidTokenTruncations.Add(1)
+	}
+
 	return result, tokenTruncated
 }
 
@@ -0,0 +1,392 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"encoding/json"
+
+	"golang.org/x/sync/semaphore"
+
+	"llm-server/llama"
+)
+
+func TestMaskLogits(t *testing.T) {
+	logits := []float32{0.1, 2.5, -1.0, 3.7, 0.0, 1.2}
+	allowed := []int{0, 2, 5}
+
+	maskLogits(logits, allowed)
+
+	for i, logit := range logits {
+		if slices.Contains(allowed, i) {
+			if math.IsInf(float64(logit), -1) {
+				t.Errorf("allowed token %d was masked", i)
+			}
+		} else if !math.IsInf(float64(logit), -1) {
+			t.Errorf("token %d should be masked, got %v", i, logit)
+		}
+	}
+
+	// greedy selection can only land on an allowed token
+	best := 0
+	for i := range logits {
+		if logits[i] > logits[best] {
+			best = i
+		}
+	}
+	if best != 5 {
+		t.Errorf("expected greedy pick of token 5, got %d", best)
+	}
+}
+
+func TestFlushPendingHoldsPartialUTF8(t *testing.T) {
+	euro := "€" // 3 bytes: e2 82 ac
+
+	cases := []struct {
+		name string
+		hold bool
+		want []string
+	}{
+		{"hold", true, []string{"price: ", euro + "5", "!"}},
+		{"discard", false, []string{"price: ", "!"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			seq := &Sequence{
+				responses:       make(chan response, 10),
+				quit:            make(chan bool, 1),
+				holdPartialUTF8: tc.hold,
+			}
+
+			// the character is split across two flushes
+			seq.pendingResponses = []string{"price: ", euro[:2]}
+			flushPending(seq, false)
+			seq.pendingResponses = []string{euro[2:] + "5"}
+			flushPending(seq, false)
+			seq.pendingResponses = []string{"!"}
+			flushPending(seq, true)
+			close(seq.responses)
+
+			var got []string
+			for resp := range seq.responses {
+				got = append(got, resp.content)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestStreamedTokenIdsDetokenizeToText(t *testing.T) {
+	euro := "€" // split across two tokens
+	vocab := []string{"The", " price", " is", " 5", euro[:1], euro[1:], "."}
+	generated := []int{0, 1, 2, 3, 4, 5, 6}
+
+	// feed the pieces as processBatch would, holding back partial output
+	stream := func(streamTokenIds bool) []response {
+		seq := &Sequence{
+			responses:      make(chan response, 10),
+			quit:           make(chan bool, 1),
+			streamTokenIds: streamTokenIds,
+		}
+		for _, token := range generated {
+			seq.pendingResponses = append(seq.pendingResponses, vocab[token])
+			seq.pendingTokens = append(seq.pendingTokens, token)
+			if !holdPending(seq, strings.Join(seq.pendingResponses, "")) {
+				flushPending(seq, false)
+			}
+		}
+		flushPending(seq, true)
+		close(seq.responses)
+
+		var frames []response
+		for resp := range seq.responses {
+			frames = append(frames, resp)
+		}
+		return frames
+	}
+
+	var text string
+	for _, resp := range stream(false) {
+		text += resp.content
+	}
+
+	var ids []int
+	for _, resp := range stream(true) {
+		if resp.content != "" {
+			t.Errorf("expected only token IDs, got content %q", resp.content)
+		}
+		ids = append(ids, resp.tokens...)
+	}
+	if !slices.Equal(ids, generated) {
+		t.Errorf("expected every generated token to be streamed, got %v", ids)
+	}
+
+	var detokenized string
+	for _, id := range ids {
+		detokenized += vocab[id]
+	}
+	if detokenized != text || text != "The price is 5"+euro+"." {
+		t.Errorf("expected the detokenized IDs %q to equal the text output %q", detokenized, text)
+	}
+}
+
+func TestFlushPendingDiscardsHeldBytesOnFinalFlush(t *testing.T) {
+	seq := &Sequence{
+		responses:        make(chan response, 10),
+		quit:             make(chan bool, 1),
+		holdPartialUTF8:  true,
+		pendingResponses: []string{"ok", "\xe2\x82"},
+	}
+
+	flushPending(seq, true)
+	if resp := <-seq.responses; resp.content != "ok" {
+		t.Errorf("expected %q, got %q", "ok", resp.content)
+	}
+	if seq.heldBytes != "" {
+		t.Errorf("expected no held bytes after final flush, got %q", seq.heldBytes)
+	}
+}
+
+func TestHitNewlineLimit(t *testing.T) {
+	seq := &Sequence{
+		responses:   make(chan response, 10),
+		quit:        make(chan bool, 1),
+		maxNewlines: 1,
+	}
+
+	// feed pieces as processBatch would until the limit stops generation
+	pieces := []string{"First", " line", ".\nSecond", " line"}
+	stopped := -1
+	for i, piece := range pieces {
+		seq.pendingResponses = append(seq.pendingResponses, piece)
+		seq.pendingTokens = append(seq.pendingTokens, i)
+		if hitNewlineLimit(seq, piece) {
+			stopped = i
+			break
+		}
+	}
+	if stopped != 2 {
+		t.Fatalf("expected generation to stop at the first newline (piece 2), stopped at %d", stopped)
+	}
+	if !slices.Equal(seq.pendingTokens, []int{0, 1}) {
+		t.Errorf("expected the token holding the newline to be dropped, got %v", seq.pendingTokens)
+	}
+
+	flushPending(seq, true)
+	close(seq.responses)
+	var got string
+	for resp := range seq.responses {
+		got += resp.content
+	}
+	if got != "First line." {
+		t.Errorf("expected output to end with the first line, got %q", got)
+	}
+
+	// without a limit newlines are just output
+	seq = &Sequence{pendingResponses: []string{"a\nb"}, pendingTokens: []int{0}}
+	if hitNewlineLimit(seq, "a\nb") {
+		t.Error("expected no limit when max_newlines is unset")
+	}
+}
+
+func TestRunnerUpAtStopStep(t *testing.T) {
+	// token 3 (e.g. EOG) was sampled, token 1 came closest
+	logits := []float32{0, 2, -1, 2.5}
+
+	alt, prob, sampledProb := runnerUp(logits, 3)
+	if alt != 1 {
+		t.Fatalf("expected runner-up token 1, got %d", alt)
+	}
+	if prob <= 0 || sampledProb <= prob || prob+sampledProb >= 1 {
+		t.Errorf("unexpected probabilities: runner-up %v sampled %v", prob, sampledProb)
+	}
+
+	// the runner-up is reported even when the sampled token was not the argmax
+	if alt, _, _ := runnerUp(logits, 1); alt != 3 {
+		t.Errorf("expected runner-up token 3, got %d", alt)
+	}
+
+	if alt, _, _ := runnerUp([]float32{1}, 0); alt != -1 {
+		t.Errorf("expected no runner-up for a single-token vocabulary, got %d", alt)
+	}
+
+	// the final frame carries the captured alternative
+	seq := &Sequence{stopAlternative: &TokenAlternative{Token: alt, Piece: " yes", Prob: prob, SampledProb: sampledProb}}
+	data, err := json.Marshal(&CompletionResponse{Stop: true, StopAlternative: seq.stopAlternative})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var final struct {
+		StopAlternative *TokenAlternative `json:"stop_alternative"`
+	}
+	if err := json.Unmarshal(data, &final); err != nil {
+		t.Fatal(err)
+	}
+	if final.StopAlternative == nil || final.StopAlternative.Token != 1 || final.StopAlternative.Piece != " yes" {
+		t.Errorf("expected stop_alternative in final frame, got %s", data)
+	}
+}
+
+func TestTopLogprobs(t *testing.T) {
+	logits := []float32{0, 2, -1, 2.5, 1}
+
+	logprob, top := topLogprobs(logits, 1, 3)
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l))
+	}
+	if want := float32(2 - math.Log(sum)); math.Abs(float64(logprob-want)) > 1e-5 {
+		t.Errorf("expected logprob %v, got %v", want, logprob)
+	}
+
+	ids := make([]int, len(top))
+	for i, lp := range top {
+		ids[i] = lp.ID
+	}
+	if !slices.Equal(ids, []int{3, 1, 4}) {
+		t.Fatalf("expected top tokens [3 1 4], got %v", ids)
+	}
+	if top[1].Logprob != logprob || top[0].Logprob <= top[1].Logprob {
+		t.Errorf("unexpected top logprobs %+v", top)
+	}
+
+	if _, top := topLogprobs(logits, 0, 0); len(top) != 0 {
+		t.Errorf("expected no alternatives, got %+v", top)
+	}
+}
+
+func TestFlushPendingSendsLogprobs(t *testing.T) {
+	seq := &Sequence{
+		responses:        make(chan response, 1),
+		quit:             make(chan bool),
+		pendingResponses: []string{"a", "b"},
+		pendingTokens:    []int{1, 2},
+		pendingLogprobs:  []TokenLogprob{{ID: 1, Token: "a", Logprob: -0.5}, {ID: 2, Token: "b", Logprob: -1}},
+	}
+
+	if !flushPending(seq, false) {
+		t.Fatal("flush failed")
+	}
+	resp := <-seq.responses
+	if resp.content != "ab" || len(resp.logprobs) != 2 || resp.logprobs[1].ID != 2 {
+		t.Errorf("expected both logprobs with the content, got %+v", resp)
+	}
+	if seq.pendingLogprobs != nil {
+		t.Error("expected pending logprobs to be cleared")
+	}
+}
+
+func TestRetryDecodeTransientError(t *testing.T) {
+	// the first decode runs out of compute memory, the retry succeeds
+	calls := 0
+	err := retryDecode(func() error {
+		calls++
+		if calls == 1 {
+			return &llama.DecodeError{Code: -2}
+		}
+		return nil
+	}, 3, time.Millisecond)
+	if err != nil || calls != 2 {
+		t.Fatalf("expected success on the first retry, got %v after %d calls", err, calls)
+	}
+
+	// fatal errors are not retried
+	calls = 0
+	err = retryDecode(func() error {
+		calls++
+		return &llama.DecodeError{Code: -3}
+	}, 3, time.Millisecond)
+	if calls != 1 || isTransientDecodeError(err) {
+		t.Errorf("expected a single attempt for a fatal error, got %d calls (%v)", calls, err)
+	}
+
+	// transient errors give up after the configured retries
+	calls = 0
+	err = retryDecode(func() error {
+		calls++
+		return &llama.DecodeError{Code: 2}
+	}, 3, time.Millisecond)
+	if calls != 4 || !isTransientDecodeError(err) {
+		t.Errorf("expected 1 attempt and 3 retries, got %d calls (%v)", calls, err)
+	}
+	if isTransientDecodeError(errors.New("other")) || isTransientDecodeError(llama.ErrKvCacheFull) {
+		t.Error("expected only transient DecodeErrors to be transient")
+	}
+
+	// a full KV cache is retried beyond the defrag attempt
+	calls = 0
+	err = retryDecode(func() error {
+		calls++
+		if calls < 3 {
+			return llama.ErrKvCacheFull
+		}
+		return nil
+	}, 3, time.Millisecond)
+	if err != nil || calls != 3 {
+		t.Errorf("expected success once the KV cache had room, got %v after %d calls", err, calls)
+	}
+	if !isRetryableDecodeError(llama.ErrKvCacheFull) || isRetryableDecodeError(&llama.DecodeError{Code: -1}) {
+		t.Error("expected a full KV cache to be retryable and an invalid batch not")
+	}
+}
+
+func TestFailBatchFinalizesBatchedSequences(t *testing.T) {
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(2),
+	}
+	if !s.seqsSem.TryAcquire(2) {
+		t.Fatal("expected both slots to be free")
+	}
+
+	batched := newTestSequence(nil)
+	batched.cache = &InputCacheSlot{InUse: true}
+	batched.pendingInputs = tokenInputs(1, 2)
+	waiting := newTestSequence(tokenInputs(3))
+	waiting.cache = &InputCacheSlot{InUse: true}
+	s.seqs[0], s.seqs[1] = batched, waiting
+
+	failBatch(s)
+
+	if _, ok := <-batched.responses; ok || batched.doneReason != StopReasonError {
+		t.Errorf("expected the batched sequence to finish with an error, got %q", batched.doneReason)
+	}
+	if s.seqs[0] != nil || batched.cache.InUse || !s.seqsSem.TryAcquire(1) {
+		t.Error("expected the failed sequence's slots to be released")
+	}
+	if s.seqs[1] != waiting {
+		t.Error("expected sequences outside the batch to keep running")
+	}
+}
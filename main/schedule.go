@@ -0,0 +1,128 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements per-token temperature schedules. The llama.cpp sampler
+// fixes its temperature when it is created, so a sequence with a schedule is
+// sampled at the schedule's initial temperature and each step's logits are
+// rescaled by initial/current temperature before sampling, which gives the
+// same distribution as sampling at the current temperature.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Supported temperature schedule types
+const (
+	ScheduleLinear = "linear"
+	ScheduleStep   = "step"
+)
+
+var errTemperatureSchedule = errors.New("invalid temperature_schedule")
+
+// TemperatureSchedule varies the sampling temperature over generated tokens.
+//
+// A "linear" schedule moves from Start to End over the first Tokens tokens and
+// then stays at End:
+//
+//	{"type": "linear", "start": 1.2, "end": 0.4, "tokens": 100}
+//
+// A "step" schedule starts at Start and switches to each step's temperature
+// once After tokens have been generated:
+//
+//	{"type": "step", "start": 1.0, "steps": [{"after": 20, "temperature": 0.5}]}
+type TemperatureSchedule struct {
+	Type   string            `json:"type"`
+	Start  float32           `json:"start"`
+	End    float32           `json:"end"`
+	Tokens int               `json:"tokens"`
+	Steps  []TemperatureStep `json:"steps"`
+}
+
+// TemperatureStep switches a step schedule to Temperature after the given
+// number of generated tokens.
+type TemperatureStep struct {
+	After       int     `json:"after"`
+	Temperature float32 `json:"temperature"`
+}
+
+// Validate checks the schedule is well formed. Every temperature must be
+// positive, since the logits are rescaled relative to the initial temperature.
+func (t *TemperatureSchedule) Validate() error {
+	if t.Start <= 0 {
+		return fmt.Errorf("%w: start must be positive", errTemperatureSchedule)
+	}
+
+	switch t.Type {
+	case ScheduleLinear:
+		if t.End <= 0 || t.Tokens <= 0 {
+			return fmt.Errorf("%w: linear schedules need a positive end and tokens", errTemperatureSchedule)
+		}
+	case ScheduleStep:
+		after := 0
+		for _, step := range t.Steps {
+			if step.Temperature <= 0 || step.After < after {
+				return fmt.Errorf("%w: steps need positive temperatures in order of after", errTemperatureSchedule)
+			}
+			after = step.After
+		}
+	default:
+		return fmt.Errorf("%w: type must be %q or %q", errTemperatureSchedule, ScheduleLinear, ScheduleStep)
+	}
+
+	// The decode loop scales the logits by At(0)/At(n), whichever entry the
+	// first temperature comes from
+	if t.At(0) <= 0 {
+		return fmt.Errorf("%w: the first temperature must be positive", errTemperatureSchedule)
+	}
+
+	return nil
+}
+
+// At returns the temperature for sampling the token after n generated tokens.
+func (t *TemperatureSchedule) At(n int) float32 {
+	if t.Type == ScheduleLinear {
+		progress := float32(min(n, t.Tokens)) / float32(t.Tokens)
+		return t.Start + (t.End-t.Start)*progress
+	}
+
+	temp := t.Start
+	for _, step := range t.Steps {
+		if n < step.After {
+			break
+		}
+		temp = step.Temperature
+	}
+	return temp
+}
+
+// scaleLogits multiplies every logit by scale, in place.
+func scaleLogits(logits []float32, scale float32) {
+	for i := range logits {
+		logits[i] *= scale
+	}
+}
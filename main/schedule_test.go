@@ -0,0 +1,93 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestTemperatureScheduleAt(t *testing.T) {
+	linear := &TemperatureSchedule{Type: ScheduleLinear, Start: 1.2, End: 0.4, Tokens: 4}
+	step := &TemperatureSchedule{Type: ScheduleStep, Start: 1.0, Steps: []TemperatureStep{
+		{After: 2, Temperature: 0.5},
+		{After: 5, Temperature: 0.2},
+	}}
+
+	cases := []struct {
+		schedule *TemperatureSchedule
+		want     []float32 // temperature for tokens 0, 1, ...
+	}{
+		{linear, []float32{1.2, 1.0, 0.8, 0.6, 0.4, 0.4}},
+		{step, []float32{1.0, 1.0, 0.5, 0.5, 0.5, 0.2, 0.2}},
+	}
+
+	for _, tc := range cases {
+		if err := tc.schedule.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		for n, want := range tc.want {
+			if got := tc.schedule.At(n); math.Abs(float64(got-want)) > 1e-6 {
+				t.Errorf("%s schedule: expected temperature %v at token %d, got %v", tc.schedule.Type, want, n, got)
+			}
+		}
+	}
+}
+
+func TestTemperatureScheduleValidate(t *testing.T) {
+	for _, schedule := range []*TemperatureSchedule{
+		{Type: "cosine", Start: 1},
+		{Type: ScheduleLinear, Start: 0, End: 1, Tokens: 10},
+		{Type: ScheduleLinear, Start: 1, End: 0.5},
+		{Type: ScheduleStep, Start: 1, Steps: []TemperatureStep{{After: 5, Temperature: 0.5}, {After: 2, Temperature: 0.2}}},
+		{Type: ScheduleStep, Start: 1, Steps: []TemperatureStep{{After: 5, Temperature: 0}}},
+		{Type: ScheduleStep, Start: 1, Steps: []TemperatureStep{{After: 0, Temperature: 0}}},
+	} {
+		if err := schedule.Validate(); !errors.Is(err, errTemperatureSchedule) {
+			t.Errorf("expected %+v to be rejected, got %v", schedule, err)
+		}
+	}
+}
+
+func TestScaleLogitsMatchesScheduledTemperature(t *testing.T) {
+	schedule := &TemperatureSchedule{Type: ScheduleLinear, Start: 1.0, End: 0.25, Tokens: 3}
+	logits := []float32{2.0, 1.0, -0.5}
+
+	// the sampler divides by the initial temperature; after rescaling this must
+	// equal dividing the raw logits by the scheduled temperature
+	for n := range 4 {
+		scaled := append([]float32(nil), logits...)
+		scaleLogits(scaled, schedule.At(0)/schedule.At(n))
+		for i := range logits {
+			effective := scaled[i] / schedule.At(0)
+			want := logits[i] / schedule.At(n)
+			if math.Abs(float64(effective-want)) > 1e-5 {
+				t.Errorf("token %d: expected logit %d at temperature %v to be %v, got %v", n, i, schedule.At(n), want, effective)
+			}
+		}
+	}
+}
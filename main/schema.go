@@ -0,0 +1,321 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements validate-and-retry completions. When a request carries a
+// `json_schema`, the full output of each attempt is collected and validated
+// against the schema; on failure the sequence is re-run with an incremented seed
+// up to `max_retries` times. Unlike grammar-constrained decoding, sampling is
+// left unconstrained and only the finished output is checked.
+//
+// The validator supports the commonly used subset of JSON Schema: type, enum,
+// properties, required, additionalProperties (boolean), items, minimum,
+// maximum, minLength, maxLength, minItems and maxItems.
+
+import (
+	"math"
+	"time"
+	"context"
+	"errors"
+	"fmt"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"llm-server/llama"
+)
+
+var errSchemaViolation = errors.New("output does not match json_schema")
+
+// validateJSONSchema parses output as JSON and validates it against schema.
+func validateJSONSchema(schema map[string]any, output string) error {
+	var value any
+	if err := json.Unmarshal([]byte(output), &value); err != nil {
+		return fmt.Errorf("%w: invalid JSON: %v", errSchemaViolation, err)
+	}
+
+	if err := validateSchemaValue(schema, value, "$"); err != nil {
+		return fmt.Errorf("%w: %v", errSchemaViolation, err)
+	}
+	return nil
+}
+
+// validateSchemaValue checks a decoded JSON value against a schema node.
+// path identifies the value in error messages.
+func validateSchemaValue(schema map[string]any, value any, path string) error {
+	if t, ok := schema["type"]; ok && !matchesSchemaType(t, value) {
+		return fmt.Errorf("%s: expected type %v", path, t)
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value %v not in enum", path, value)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if _, ok := v[fmt.Sprint(name)]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+		for name, field := range v {
+			sub, ok := properties[name].(map[string]any)
+			if !ok {
+				if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := validateSchemaValue(sub, field, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s: expected at least %v items", path, n)
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s: expected at most %v items", path, n)
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validateSchemaValue(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if n, ok := schema["minLength"].(float64); ok && length < n {
+			return fmt.Errorf("%s: expected at least %v characters", path, n)
+		}
+		if n, ok := schema["maxLength"].(float64); ok && length > n {
+			return fmt.Errorf("%s: expected at most %v characters", path, n)
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && v < n {
+			return fmt.Errorf("%s: %v is less than minimum %v", path, v, n)
+		}
+		if n, ok := schema["maximum"].(float64); ok && v > n {
+			return fmt.Errorf("%s: %v is greater than maximum %v", path, v, n)
+		}
+	}
+
+	return nil
+}
+
+// matchesSchemaType reports whether value satisfies a schema "type", which may
+// be a single type name or a list of them.
+func matchesSchemaType(t any, value any) bool {
+	if types, ok := t.([]any); ok {
+		for _, name := range types {
+			if matchesSchemaType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch t {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+// schemaAttempt is the collected output of one generation attempt.
+type schemaAttempt struct {
+	seq     *Sequence
+	content string
+	tokens  []int
+}
+
+// retryWithSchema runs attempt until its output validates against schema or
+// maxRetries retries have been made. It returns the first valid attempt, or
+// otherwise the best invalid one (the latest attempt that parsed as JSON, else
+// the latest attempt) together with its validation error. Errors returned by
+// attempt itself abort the loop.
+func retryWithSchema(schema map[string]any, maxRetries int, attempt func(n int) (*schemaAttempt, error)) (*schemaAttempt, int, error, error) {
+	var best *schemaAttempt
+	var bestErr error
+
+	for n := 0; n <= maxRetries; n++ {
+		result, err := attempt(n)
+		if err != nil {
+			return nil, n, nil, err
+		}
+
+		schemaErr := validateJSONSchema(schema, result.content)
+		if schemaErr == nil {
+			return result, n, nil, nil
+		}
+
+		slog.Debug("json_schema validation failed", "attempt", n, "error", schemaErr)
+		if best == nil || json.Valid([]byte(result.content)) || !json.Valid([]byte(best.content)) {
+			best, bestErr = result, schemaErr
+		}
+	}
+
+	return best, maxRetries, bestErr, nil
+}
+
+// runSchemaAttempt creates a sequence for req sampled with seed (nil for a
+// random one), waits for a free slot and collects its entire output. A
+// cancelled ctx stops the sequence and returns the context error.
+func (s *Server) runSchemaAttempt(ctx context.Context, w http.ResponseWriter, req *CompletionRequest, samplingParams llama.SamplingParams, seed *uint32) (*schemaAttempt, error) {
+	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
+		numPredict:      req.NumPredict,
+		stop:            req.Stop,
+		numKeep:         req.NumKeep,
+		samplingParams:  &samplingParams,
+		seed:            seed,
+		embedding:       false,
+		streamTokenIds:  req.StreamTokenIds,
+		allowedTokens:   req.AllowedTokens,
+		tokenHealing:    req.TokenHealing,
+		returnPrompt:    req.ReturnPromptText,
+		sessionID:       req.SessionID,
+		requestID:       req.RequestID,
+		priority:        req.Priority,
+		stopAlternative: req.ReturnStopAlternative,
+		lora:            req.Lora,
+		maxNewlines:     req.MaxNewlines,
+		cacheTTL:        time.Duration(req.CacheTTLMs) * time.Millisecond,
+		tempSchedule:    req.TemperatureSchedule,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new sequence: %w", err)
+	}
+
+	if err := s.acquirePrioritySlot(w, ctx, req.Priority); err != nil {
+		return nil, err
+	}
+
+	if err := s.assignSequence(seq, req.CachePrompt); err != nil {
+		return nil, err
+	}
+
+	w.Header().Set("X-Request-Id", seq.id)
+
+	result := &schemaAttempt{seq: seq}
+	var content []byte
+	for {
+		select {
+		case <-ctx.Done():
+			close(seq.quit)
+			return nil, ctx.Err()
+		case resp, ok := <-seq.responses:
+			if !ok {
+				result.content = string(content)
+				return result, nil
+			}
+			content = append(content, resp.content...)
+			result.tokens = append(result.tokens, resp.tokens...)
+		}
+	}
+}
+
+// schemaCompletion serves a /completion request carrying a json_schema. The
+// output is only sent once an attempt validates or retries are exhausted, so
+// the client receives a single content frame followed by the final frame.
+func (s *Server) schemaCompletion(w http.ResponseWriter, r *http.Request, stream *streamWriter, req *CompletionRequest, samplingParams llama.SamplingParams) {
+	var schema map[string]any
+	if err := json.Unmarshal(req.JSONSchema, &schema); err != nil {
+		http.Error(w, fmt.Sprintf("invalid json_schema: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.MaxRetries < 0 {
+		http.Error(w, "max_retries must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	result, retries, schemaErr, err := retryWithSchema(schema, req.MaxRetries, func(n int) (*schemaAttempt, error) {
+		return s.runSchemaAttempt(r.Context(), w, req, samplingParams, choiceSeed(requestSeed(&req.Seed), n))
+	})
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting completion request due to client closing the connection")
+			return
+		}
+
+		http.Error(w, err.Error(), sequenceErrorStatus(err))
+		return
+	}
+
+	seq := result.seq
+	response := CompletionResponse{
+		Index:           1, // follows the single content frame
+		Stop:            true,
+		FinishReason:    seq.doneReason.String(),
+		PromptText:      seq.promptText,
+		StopAlternative: seq.stopAlternative,
+		StopFlags:       stopFlags(seq.doneReason, seq.hitStopWord),
+		Seed:            seq.seed,
+		SchemaRetries:   retries,
+		Timings: sequenceTimings(seq),
+	}
+	if schemaErr != nil {
+		response.SchemaError = schemaErr.Error()
+	}
+
+	defer stream.Flush()
+	if err := stream.Encode(&CompletionResponse{Content: result.content, Tokens: result.tokens}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := stream.Encode(&response); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}}
+		}
+	}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := []string{
+		`{"name": "Ada", "age": 36}`,
+		`{"name": "Ada", "age": 36, "tags": ["a", "b"]}`,
+	}
+	for _, output := range valid {
+		if err := validateJSONSchema(schema, output); err != nil {
+			t.Errorf("expected %s to validate, got %v", output, err)
+		}
+	}
+
+	invalid := []string{
+		`not json`,
+		`{"name": "Ada"}`,
+		`{"name": "Ada", "age": 36.5}`,
+		`{"name": "Ada", "age": -1}`,
+		`{"name": "", "age": 36}`,
+		`{"name": "Ada", "age": 36, "tags": ["c"]}`,
+		`{"name": "Ada", "age": 36, "extra": true}`,
+	}
+	for _, output := range invalid {
+		if err := validateJSONSchema(schema, output); !errors.Is(err, errSchemaViolation) {
+			t.Errorf("expected %s to be rejected, got %v", output, err)
+		}
+	}
+}
+
+func TestRetryWithSchema(t *testing.T) {
+	schema := map[string]any{"type": "object", "required": []any{"answer"}}
+
+	// the model violates the schema on the first two attempts
+	outputs := []string{`The answer is 4`, `{"result": 4}`, `{"answer": 4}`}
+	var seen []int
+	attempt := func(n int) (*schemaAttempt, error) {
+		seen = append(seen, n)
+		return &schemaAttempt{content: outputs[n]}, nil
+	}
+
+	result, retries, schemaErr, err := retryWithSchema(schema, 3, attempt)
+	if err != nil || schemaErr != nil {
+		t.Fatalf("unexpected errors: %v, %v", err, schemaErr)
+	}
+	if result.content != `{"answer": 4}` || retries != 2 || len(seen) != 3 {
+		t.Errorf("expected success on the third attempt, got %q after %d retries", result.content, retries)
+	}
+
+	// once retries are exhausted the best attempt is the one that parsed as JSON
+	seen = nil
+	result, retries, schemaErr, err = retryWithSchema(schema, 1, attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(schemaErr, errSchemaViolation) {
+		t.Errorf("expected a schema violation, got %v", schemaErr)
+	}
+	if result.content != `{"result": 4}` || retries != 1 || len(seen) != 2 {
+		t.Errorf("expected best attempt %q after 1 retry, got %q after %d", `{"result": 4}`, result.content, retries)
+	}
+
+	// attempt errors abort without retrying
+	seen = nil
+	failure := errors.New("slot unavailable")
+	_, _, _, err = retryWithSchema(schema, 3, func(n int) (*schemaAttempt, error) {
+		seen = append(seen, n)
+		return nil, failure
+	})
+	if !errors.Is(err, failure) || len(seen) != 1 {
+		t.Errorf("expected the attempt error to abort, got %v after %d attempts", err, len(seen))
+	}
+}
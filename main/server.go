@@ -39,13 +39,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"regexp"
+	"runtime"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 	"net/http"
 	"golang.org/x/sync/semaphore"
 	"llm-server/llama"
@@ -57,11 +63,22 @@ import (
 func main() {
 
 	config := setupFlags()
+	AesKeyUsage.SetThreshold(config.aesKeyWarn)
 	server := createServer(config)
+	templates, err := loadPromptTemplates(config.templatesDir)
+	if err != nil {
+		log.Fatalf("failed to load prompt templates: %v", err)
+	}
+	server.templates = templates
+	server.promptFormat, err = loadPromptFormat(config.promptTemplate, config.promptStop)
+	if err != nil {
+		log.Fatalf("failed to load prompt template: %v", err)
+	}
 	tensorSplitFloats := createTensorSplitFloats(config)
 	modelParams := createModelParameters(config, tensorSplitFloats, server)
 	
 	server.ready.Add(1)
+	server.loadStart = time.Now()
 	go server.loadModel(
 		modelParams, 
 		config.model, 
@@ -73,8 +90,10 @@ func main() {
 		config.multiUserCache)
 
 	server.cond = sync.NewCond(&server.mu)
-	ctx, _ := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go server.run(ctx)
+	go server.expireCacheSlots(ctx)
 
 	addr := "127.0.0.1:" + strconv.Itoa(config.port)
 	listener, err := net.Listen("tcp", addr)
@@ -86,24 +105,50 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", server.health)
+	mux.HandleFunc("/health/detailed", server.healthDetailed)
+	mux.HandleFunc("/stats", server.stats)
+	mux.HandleFunc("/metrics", server.metrics)
+	mux.HandleFunc("/models", server.models)
+	mux.HandleFunc("GET /model", server.modelDetails)
+	mux.HandleFunc("/tokens/special", server.specialTokensHandler)
+	mux.HandleFunc("/tokenize", server.tokenizeHandler)
+	mux.HandleFunc("/detokenize", server.detokenizeHandler)
 	mux.HandleFunc("/embedding", server.embeddings)
+	mux.HandleFunc("/embedding/stream", server.streamEmbedding)
 	mux.HandleFunc("/completion", server.completion)
+	mux.HandleFunc("/completion/status", server.completionStatus)
+	mux.HandleFunc("/completion/resume", server.completionResume)
+	mux.HandleFunc("/completion/prepare", server.prepare)
+	mux.HandleFunc("/completion/append", server.appendPrompt)
+	mux.HandleFunc("/completion/run", server.completionRun)
 	mux.HandleFunc("/secure/completion", server.securecompletion)
 	mux.HandleFunc("/generate", server.generate)
+	mux.HandleFunc("/v1/chat/completions", server.chatCompletions)
 	mux.HandleFunc("/secure/generate", server.secureGenerate)
+	mux.HandleFunc("/cancel", server.cancel)
+	mux.HandleFunc("/sessions/{id}/cancel", server.cancelSession)
+	mux.HandleFunc("/params/schema", server.paramsSchema)
+	mux.HandleFunc("GET /lora", server.listLora)
+	mux.HandleFunc("POST /lora", server.loadLora)
+	mux.HandleFunc("DELETE /lora", server.clearLora)
+
+	registerDebugRoutes(mux, server, config)
 
 	mux.HandleFunc("/aes/key", AesKeyHandler)
 	mux.HandleFunc("/aes/encrypt", AesEncryptHandler)
+	mux.HandleFunc("/aes/encrypt/batch", AesEncryptBatchHandler)
 	mux.HandleFunc("/aes/decrypt", AesDecryptHandler)
 	mux.HandleFunc("/rsa/keys", RsaKeysHandler)
+	mux.HandleFunc("DELETE /rsa/keys", RsaRotateKeysHandler)
 	mux.HandleFunc("/rsa/encrypt", RsaEncryptHandler)
+	mux.HandleFunc("/rsa/encrypt/batch", RsaEncryptBatchHandler)
 	mux.HandleFunc("/rsa/decrypt", RsaDecryptHandler)
 
 	httpServer := http.Server{
-		Handler: mux,
+		Handler: accessLog(requireAPIKey(config.apiKey, safeErrors(config.errorVerbosity, mux))),
 	}
 
-	privateKey, publicKey, err := RsaKeys()
+	privateKey, publicKey, err := RsaKeys(defaultRsaKeyBits)
 	if err != nil {
 		log.Fatal("Error generating RSA keys", err)
 		return
@@ -112,10 +157,32 @@ func main() {
 	log.Println("-----BEGIN PUBLIC KEY-----\n" + publicKey + "\n-----END PUBLIC KEY-----")
 	KeyStore.Set("privateKey", privateKey)
 
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	drained := make(chan struct{})
+	go func() {
+		<-signals.Done()
+		stop() // a second signal terminates immediately
+		log.Println("Shutting down, draining in-flight requests")
+		server.shutdown(&httpServer, config.shutdownTimeout)
+		server.stopDecoding(cancel)
+		close(drained)
+	}()
+
 	log.Println("Server listening on", addr)
-	if err := httpServer.Serve(listener); err != nil {
+	if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal("server error:", err)
 	}
+	<-drained
+}
+
+// registerDebugRoutes adds the debug endpoints enabled by config, which are
+// not served by default.
+func registerDebugRoutes(mux *http.ServeMux, server *Server, config *Config) {
+	if config.debugLogits {
+		mux.HandleFunc("/completion/logits", server.logits)
+	}
 }
 
 // setupFlags defines and parses all command-line flags for configuring the server,
@@ -127,43 +194,128 @@ func setupFlags() *Config {
 	//mac-12, cpu-3, h100-160
 	threads := 12
 
-    config := &Config{}
+    config := &Config{overflow: defaultOverflowPolicies(), eogTokens: tokenSet{}, batchFill: BatchFillRoundRobin, errorVerbosity: ErrorVerbosityFull}
     flag.StringVar(&config.model, "model", "models/modelfile", "Path to model binary file")
     flag.IntVar(&config.kvSize, "kv-size", 8192, "Context (or KV cache) size")
     flag.IntVar(&config.batchSize, "batch-size", 512, "Batch size")
     flag.IntVar(&config.parallel, "parallel", 4, "Number of sequences to handle simultaneously")
+    flag.IntVar(&config.embeddingParallel, "embedding-parallel", 0, "Additional sequence slots reserved for embedding requests (0 shares the --parallel slots)")
     flag.IntVar(&config.port, "port", 60000, "Port to expose the server on")
     flag.IntVar(&config.mainGPU, "main-gpu", 0, "Main GPU")
-    flag.StringVar(&config.tensorSplit, "tensor-split", "", "Fraction of the model to offload to each GPU, comma-separated list of proportions")
+    flag.StringVar(&config.tensorSplit, "tensor-split", "", "Fraction of the model to offload to each GPU, comma-separated list of proportions, or auto to balance by free VRAM")
     flag.BoolVar(&config.noMmap, "no-mmap", false, "Do not memory-map model (slower load but may reduce pageouts if not using mlock)")
     flag.BoolVar(&config.mlock, "mlock", false, "Force system to keep model in RAM rather than swapping or compressing")
     flag.StringVar(&config.ppath, "mmproj", "", "Path to projector binary file")
+    flag.BoolVar(&config.strictContext, "strict-context", false, "Fail to start if the per-sequence context (kv-size / slots) exceeds the model's trained context length, instead of warning")
     flag.BoolVar(&config.flashAttention, "flash-attn", true, "Enable flash attention")
+    flag.StringVar(&config.basePrompt, "base-prompt", "", "Path to a common prompt prefix (e.g. a system prompt) decoded once at startup and shared by all slots")
+    flag.StringVar(&config.templatesDir, "templates", "", "Directory of Go text/template prompt templates, referenced by requests by file name without extension")
+    flag.StringVar(&config.promptTemplate, "prompt-template", "", "Chat format for /generate and the secure endpoints: llama3 (default), chatml, mistral, gemma, or a Go text/template file using {{.System}} and {{.Prompt}}")
+    flag.StringVar(&config.promptStop, "prompt-stop", "", "Stop sequence added to requests formatted with --prompt-template (defaults to the built-in format's turn-end marker, e.g. <|eot_id|> for llama3)")
     flag.BoolVar(&config.multiUserCache, "multiuser-cache", false, "Optimize input cache algorithm for multiple users")
-    flag.Var(&config.lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
+    flag.IntVar(&config.cacheMatchTolerance, "cache-match-tolerance", 0, "Trailing cached tokens that may differ from a prompt while still reusing the slot (multiuser-cache only)")
+    flag.Float64Var(&config.shiftRatio, "shift-ratio", defaultShiftRatio, "Fraction of the context (after num_keep) to free each time a sequence fills its context and is shifted, between 0 and 1 exclusive")
+    flag.Var(&config.lpaths, "lora", "Path to lora layer file, optionally with a scale as path:scale (default 1.0; can be specified multiple times)")
     flag.IntVar(&config.gpuLayers, "gpu-layers", gpuLayers, "Number of layers to offload to GPU")
     flag.IntVar(&config.threads, "threads", threads, "Number of threads to use during generation")
+    flag.BoolVar(&config.utf8Hold, "utf8-hold", false, "Hold partial UTF-8 characters for the next streamed chunk instead of discarding them")
+    flag.IntVar(&config.flushBytes, "flush-bytes", 0, "Bytes of streamed output to buffer before flushing to the client (0 flushes every token)")
+    flag.DurationVar(&config.flushLatency, "flush-latency", 50*time.Millisecond, "Maximum time buffered streaming output may wait before being flushed")
+    flag.Uint64Var(&config.aesKeyWarn, "aes-key-usage-warn", defaultAesKeyUsageWarn, "Log a warning each time one AES key has encrypted this many messages (0 disables)")
+    flag.BoolVar(&config.rsaPKCS1Fallback, "rsa-pkcs1-fallback", false, "Accept symmetric keys wrapped with RSA PKCS #1 v1.5 on the secure endpoints when OAEP decryption fails")
+    flag.BoolVar(&config.debugLogits, "debug-logits", false, "Expose the /completion/logits debug endpoint returning full vocabulary logits")
+    flag.Var(config.eogTokens, "eog-tokens", "Additional end-of-generation token IDs, comma-separated (can be specified multiple times)")
+    flag.Var(config.overflow, "overflow-policy", "Prompt overflow policy per request type, e.g. embedding=error,completion=truncate")
+    flag.Var(&config.batchFill, "batch-fill", "How a decode batch is shared between sequences: round_robin, fair (equal share per sequence) or priority (fewest pending inputs first)")
+    flag.Float64Var(&config.maxGlobalTPS, "max-global-tps", 0, "Maximum generated tokens per second across all sequences; the decode loop is throttled above it (0 disables)")
+    flag.IntVar(&config.decodeRetries, "decode-retries", 3, "Times to retry a batch whose decode failed transiently (aborted, out of compute memory or no KV cache slot) before failing its sequences")
+    flag.DurationVar(&config.decodeRetryDelay, "decode-retry-delay", 10*time.Millisecond, "Delay before the first decode retry, doubled for each further retry")
+    flag.IntVar(&config.resultCacheSize, "result-cache-size", 0, "Number of deterministic (temperature 0) completion results to cache (0 disables)")
+    flag.StringVar(&config.webhookURL, "webhook-url", "", "URL to POST sequence lifecycle events to (disabled if empty)")
+    flag.Float64Var(&config.defaultTemperature, "default-temperature", float64(DefaultOptions().Temperature), "Sampling temperature used when a request does not set one")
+    flag.Float64Var(&config.defaultTopP, "default-top-p", float64(DefaultOptions().TopP), "Top-p used when a request does not set one")
+    flag.IntVar(&config.defaultTopK, "default-top-k", DefaultOptions().TopK, "Top-k used when a request does not set one")
+    flag.StringVar(&config.apiKey, "api-key", "", "Require this key as an Authorization: Bearer token on every endpoint except /health (disabled if empty)")
+    flag.Var(&config.errorVerbosity, "error-verbosity", "Detail in server error responses: full returns internal error text, safe returns a generic message and logs the detail")
+    flag.DurationVar(&config.shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for in-flight requests on SIGINT/SIGTERM before aborting them")
+    flag.IntVar(&config.maxImages, "max-images", 0, "Maximum images per request (0 uses the vision model default: 4 for mllama, 8 for clip)")
+    flag.IntVar(&config.imageCacheSize, "image-cache-size", defaultImageCacheSize, "Number of image embeddings to cache for reuse across requests (values below 1 use the default)")
     flag.Parse()
+
+    if config.threads <= 0 {
+        config.threads = runtime.NumCPU()
+    }
+    if err := validateOptions(config.requestDefaults()); err != nil {
+        log.Fatalf("invalid default sampling options: %v", err)
+    }
+    if err := validateShiftRatio(config.shiftRatio); err != nil {
+        log.Fatalf("invalid --shift-ratio: %v", err)
+    }
     return config
 }
 
 // createServer creates a new Server instance with the specified batch size, parallelism,
 // and internal semaphore pool used to coordinate concurrent sequence execution.
 func createServer(config *Config) (*Server) {
-	
+
+	var embeddingSem *semaphore.Weighted
+	if config.embeddingParallel > 0 {
+		embeddingSem = semaphore.NewWeighted(int64(config.embeddingParallel))
+	}
+
 	return &Server{
-		batchSize: config.batchSize,
-		parallel:  config.parallel,
-		seqs:      make([] *Sequence, config.parallel),
-		seqsSem:   semaphore.NewWeighted(int64(config.parallel)),
-		status:    ServerStatusLoadingModel,
+		batchSize:    config.batchSize,
+		parallel:     config.parallel,
+		seqs:         make([] *Sequence, config.parallel+max(config.embeddingParallel, 0)),
+		seqsSem:      semaphore.NewWeighted(int64(config.parallel)),
+		status:       ServerStatusLoadingModel,
+		maxImages:    config.maxImages,
+		imageCacheSize: config.imageCacheSize,
+		webhook:      NewWebhook(config.webhookURL),
+		flushBytes:   config.flushBytes,
+		flushLatency: config.flushLatency,
+		overflow:     config.overflow,
+		batchFill:    config.batchFill,
+		eogTokens:    config.eogTokens,
+
+		cacheMatchTolerance: config.cacheMatchTolerance,
+		shiftRatio:          config.shiftRatio,
+		utf8Hold:            config.utf8Hold,
+		threads:             config.threads,
+		embeddingParallel:   max(config.embeddingParallel, 0),
+		embeddingSem:        embeddingSem,
+		results:             NewResultCache(config.resultCacheSize),
+		pacer:               newTokenPacer(config.maxGlobalTPS),
+		decodeRetries:       config.decodeRetries,
+		decodeRetryDelay:    config.decodeRetryDelay,
+		basePromptPath:      config.basePrompt,
+		defaults:            config.requestDefaults(),
+		modelPath:           config.model,
+		strictContext:       config.strictContext,
+		flashAttnRequested:  config.flashAttention,
+		rsaPKCS1Fallback:    config.rsaPKCS1Fallback,
 	}	
 }
 
+// requestDefaults returns DefaultOptions with the sampling defaults given on the
+// command line applied. Requests still override any field they set explicitly.
+func (c *Config) requestDefaults() Options {
+	opts := DefaultOptions()
+	opts.Temperature = float32(c.defaultTemperature)
+	opts.TopP = float32(c.defaultTopP)
+	opts.TopK = c.defaultTopK
+	return opts
+}
+
 // createTensorSplitFloats parses the --tensor-split argument and converts it to
 // a slice of float32 values used for multi-GPU tensor partitioning.
+// The special value "auto" balances the split across the detected GPUs.
 func createTensorSplitFloats(config *Config) ([]float32) {
 
+	if config.tensorSplit == "auto" {
+		return balanceTensorSplit(llama.GPUDevices)
+	}
+
 	var tensorSplitFloats []float32
 	if config.tensorSplit != "" {
 		stringFloats := regexp.MustCompile(",").Split(config.tensorSplit, -1)
@@ -177,6 +329,33 @@ func createTensorSplitFloats(config *Config) ([]float32) {
 	return tensorSplitFloats
 }
 
+// balanceTensorSplit computes a tensor split proportional to the free VRAM
+// reported for each device. It returns nil when fewer than two GPUs are
+// detected, leaving the model on the main GPU.
+func balanceTensorSplit(devices deviceInfoProvider) ([]float32) {
+
+	gpus := devices()
+	if len(gpus) < 2 {
+		return nil
+	}
+
+	var totalFree uint64
+	for _, gpu := range gpus {
+		totalFree += gpu.FreeMemory
+	}
+	if totalFree == 0 {
+		return nil
+	}
+
+	tensorSplitFloats := make([]float32, 0, len(gpus))
+	for _, gpu := range gpus {
+		tensorSplitFloats = append(tensorSplitFloats, float32(float64(gpu.FreeMemory)/float64(totalFree)))
+	}
+
+	log.Println("Auto tensor split across", len(gpus), "GPUs:", tensorSplitFloats)
+	return tensorSplitFloats
+}
+
 // createModelParameters constructs llama.ModelParams using parsed flags and tensor split values.
 // It includes a progress callback to update model load status for external monitoring.
 func createModelParameters(config *Config, tensorSplitFloats []float32, server *Server) (llama.ModelParams) {
@@ -0,0 +1,90 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"math"
+	"testing"
+
+	"llm-server/llama"
+)
+
+func TestBalanceTensorSplit(t *testing.T) {
+	cases := []struct {
+		name    string
+		devices []llama.DeviceInfo
+		want    []float32
+	}{
+		{
+			name: "no gpus",
+			want: nil,
+		},
+		{
+			name:    "single gpu",
+			devices: []llama.DeviceInfo{{Name: "gpu0", FreeMemory: 8 << 30}},
+			want:    nil,
+		},
+		{
+			name: "equal gpus",
+			devices: []llama.DeviceInfo{
+				{Name: "gpu0", FreeMemory: 8 << 30},
+				{Name: "gpu1", FreeMemory: 8 << 30},
+			},
+			want: []float32{0.5, 0.5},
+		},
+		{
+			name: "proportional to free vram",
+			devices: []llama.DeviceInfo{
+				{Name: "gpu0", FreeMemory: 24 << 30},
+				{Name: "gpu1", FreeMemory: 8 << 30},
+				{Name: "gpu2", FreeMemory: 16 << 30},
+			},
+			want: []float32{0.5, 1.0 / 6, 1.0 / 3},
+		},
+		{
+			name: "no free memory",
+			devices: []llama.DeviceInfo{
+				{Name: "gpu0"},
+				{Name: "gpu1"},
+			},
+			want: nil,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := balanceTensorSplit(func() []llama.DeviceInfo { return tc.devices })
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if math.Abs(float64(got[i]-tc.want[i])) > 1e-6 {
+					t.Errorf("split[%d]: expected %v, got %v", i, tc.want[i], got[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"time"
+	"log/slog"
+	"net/http"
+)
+
+// shutdownFinalFrameGrace is how long handlers of aborted sequences get to
+// write their final frame before the remaining connections are closed.
+const shutdownFinalFrameGrace = 2 * time.Second
+
+// shutdown stops the HTTP server from accepting new connections and waits up
+// to timeout for in-flight requests to finish. Sequences still live after that
+// are aborted with StopReasonShutdown, so streaming clients receive a final
+// frame carrying `finish_reason:"shutdown"` instead of a dropped connection.
+func (s *Server) shutdown(httpServer *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := httpServer.Shutdown(ctx)
+
+	// prefill sequences have no handler waiting on them, so they may still be
+	// live even when every request finished in time
+	if n := s.abortSequences(StopReasonShutdown); n > 0 {
+		slog.Warn("aborted sequences still running at shutdown", "count", n)
+	}
+	if err == nil {
+		return
+	}
+
+	graceCtx, graceCancel := context.WithTimeout(context.Background(), shutdownFinalFrameGrace)
+	defer graceCancel()
+
+	if err := httpServer.Shutdown(graceCtx); err != nil {
+		httpServer.Close()
+	}
+}
+
+// stopDecoding cancels the decode loop's context and wakes processBatch if it
+// is waiting for sequences, so that run returns.
+func (s *Server) stopDecoding(cancel context.CancelFunc) {
+	cancel()
+
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// abortSequences removes every live sequence with the given reason, closing
+// its response channels so waiting handlers send their final frame. It returns
+// how many sequences were removed.
+func (s *Server) abortSequences(reason StopReason) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for i, seq := range s.seqs {
+		if seq != nil {
+			removeSequence(s, i, reason)
+			n++
+		}
+	}
+
+	return n
+}
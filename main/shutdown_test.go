@@ -0,0 +1,125 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestShutdownAbortsLiveSequences(t *testing.T) {
+	s := &Server{
+		seqs:    make([]*Sequence, 2),
+		seqsSem: semaphore.NewWeighted(2),
+	}
+	if err := s.seqsSem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	seq := &Sequence{
+		responses:           make(chan response, 10),
+		quit:                make(chan bool, 1),
+		embedding:           make(chan []float32, 1),
+		cache:               &InputCacheSlot{InUse: true},
+		pendingResponses:    []string{"partial "},
+		startProcessingTime: time.Now(),
+	}
+	s.seqs[0] = seq
+
+	// the handler streams until the sequence is removed, then sends the
+	// finish reason as its final frame
+	started := make(chan struct{})
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		for resp := range seq.responses {
+			io.WriteString(w, resp.content)
+		}
+		io.WriteString(w, seq.doneReason.String())
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go httpServer.Serve(listener)
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	s.shutdown(httpServer, 50*time.Millisecond)
+
+	if got := <-body; got != "partial shutdown" {
+		t.Errorf("expected final frame after partial output, got %q", got)
+	}
+	if s.seqs[0] != nil || seq.cache.InUse {
+		t.Error("expected sequence slot and cache to be released")
+	}
+	if !s.seqsSem.TryAcquire(2) {
+		t.Error("expected semaphore slot to be released")
+	}
+}
+
+func TestStopDecodingWakesIdleRun(t *testing.T) {
+	s := &Server{
+		batchSize: 8,
+		seqs:      make([]*Sequence, 1),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	// let run block waiting for a sequence
+	time.Sleep(20 * time.Millisecond)
+	s.stopDecoding(cancel)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected run to return after shutdown")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file exposes counters describing how the streaming path holds back
+// output, to help diagnose streaming latency. Output is delayed when the pending
+// text ends with a prefix of a stop sequence or with a partial UTF-8 character,
+// and a stop sequence that ends mid-token forces that token to be cut.
+//
+// It also keeps the inference counters scraped from /metrics: requests served,
+// tokens generated, the generation speed of finished sequences, and how often
+// the KV cache filled up and was defragmented.
+
+import(
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+	"encoding/json"
+	"net/http"
+)
+
+// streamCounters counts streaming hold-backs since the server started.
+type streamCounters struct {
+	StopSuffixDelays       atomic.Uint64
+	IncompleteUnicodeHolds atomic.Uint64
+	MidTokenTruncations    atomic.Uint64
+}
+
+// StreamStats is the process-wide set of streaming counters.
+var StreamStats = &streamCounters{}
+
+// tokensPerSecondBuckets are the upper bounds of the generation speed
+// histogram, in tokens per second.
+var tokensPerSecondBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// inferenceCounters counts inference work since the server started.
+type inferenceCounters struct {
+	Requests        atomic.Uint64 // completion requests received
+	TokensGenerated atomic.Uint64
+	KvCacheFull     atomic.Uint64 // decodes that found no KV cache slot
+	KvCacheDefrags  atomic.Uint64
+	TokensPerSecond histogram // generation speed of each finished sequence
+}
+
+// InferenceStats is the process-wide set of inference counters.
+var InferenceStats = &inferenceCounters{TokensPerSecond: histogram{bounds: tokensPerSecondBuckets}}
+
+// ObserveTimings records the generation speed of a finished sequence. Sequences
+// that generated nothing, such as embeddings, are not recorded.
+func (c *inferenceCounters) ObserveTimings(timings Timings) {
+	if timings.PredictedN == 0 || timings.PredictedMS <= 0 {
+		return
+	}
+	c.TokensPerSecond.Observe(float64(timings.PredictedN) / (timings.PredictedMS / 1000))
+}
+
+// histogram is a Prometheus style histogram with fixed bucket bounds.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // observations per bucket, the last one past every bound
+	sum    float64
+}
+
+// Observe adds a value to the first bucket whose bound it doesn't exceed.
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.bounds)+1)
+	}
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+}
+
+// count returns the number of observations.
+func (h *histogram) count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var n uint64
+	for _, c := range h.counts {
+		n += c
+	}
+	return n
+}
+
+// write formats the histogram in the Prometheus text format, with cumulative
+// bucket counts.
+func (h *histogram) write(w io.Writer, name string, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var count uint64
+	for i, bound := range h.bounds {
+		if h.counts != nil {
+			count += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, count)
+	}
+	if h.counts != nil {
+		count += h.counts[len(h.bounds)]
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+// StatsResponse is returned by the /stats endpoint.
+type StatsResponse struct {
+	Streaming  StreamingStats  `json:"streaming"`
+	Throughput ThroughputStats `json:"throughput"`
+}
+
+// ThroughputStats reports the rate tokens are being generated at across all
+// sequences, averaged over the last WindowSeconds.
+type ThroughputStats struct {
+	TokensPerSecond float64 `json:"tokens_per_second"`
+	WindowSeconds   float64 `json:"window_seconds"`
+}
+
+// StreamingStats is a snapshot of StreamStats.
+type StreamingStats struct {
+	StopSuffixDelays       uint64 `json:"stop_suffix_delays"`
+	IncompleteUnicodeHolds uint64 `json:"incomplete_unicode_holds"`
+	MidTokenTruncations    uint64 `json:"mid_token_truncations"`
+}
+
+// Snapshot returns the current counter values.
+func (c *streamCounters) Snapshot() StreamingStats {
+	return StreamingStats{
+		StopSuffixDelays:       c.StopSuffixDelays.Load(),
+		IncompleteUnicodeHolds: c.IncompleteUnicodeHolds.Load(),
+		MidTokenTruncations:    c.MidTokenTruncations.Load(),
+	}
+}
+
+// stats handles the `/stats` endpoint.
+//
+// Example response:
+// {
+//   "streaming": {
+//     "stop_suffix_delays": 120,
+//     "incomplete_unicode_holds": 7,
+//     "mid_token_truncations": 2
+//   },
+//   "throughput": {
+//     "tokens_per_second": 48.6,
+//     "window_seconds": 10
+//   }
+// }
+//
+//   - stop_suffix_delays: flushes delayed because output ended with a partial stop sequence
+//   - incomplete_unicode_holds: flushes delayed because output ended mid UTF-8 character
+//   - mid_token_truncations: stop sequences that ended inside a token, cutting it
+//   - tokens_per_second: tokens generated across all sequences, averaged over the window
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&StatsResponse{
+		Streaming: StreamStats.Snapshot(),
+		Throughput: ThroughputStats{
+			TokensPerSecond: s.throughput.PerSecond(time.Now()),
+			WindowSeconds:   throughputWindow.Seconds(),
+		},
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// metrics handles the `/metrics` endpoint, exposing the same values as /stats
+// in the Prometheus text format along with the inference counters and the
+// number of sequence slots running a request.
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	streaming := StreamStats.Snapshot()
+
+	s.mu.Lock()
+	var active int
+	for _, seq := range s.seqs {
+		if seq != nil {
+			active++
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP llm_server_tokens_per_second Tokens generated per second across all sequences, averaged over %s.\n", throughputWindow)
+	fmt.Fprintf(w, "# TYPE llm_server_tokens_per_second gauge\n")
+	fmt.Fprintf(w, "llm_server_tokens_per_second %g\n", s.throughput.PerSecond(time.Now()))
+	fmt.Fprintf(w, "# HELP llm_server_active_slots Sequence slots running a request.\n")
+	fmt.Fprintf(w, "# TYPE llm_server_active_slots gauge\n")
+	fmt.Fprintf(w, "llm_server_active_slots %d\n", active)
+	InferenceStats.TokensPerSecond.write(w, "llm_server_sequence_tokens_per_second", "Generation speed of finished sequences, from their timings.")
+	for _, counter := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"requests", "Completion requests received.", InferenceStats.Requests.Load()},
+		{"tokens_generated", "Tokens generated across all sequences.", InferenceStats.TokensGenerated.Load()},
+		{"kv_cache_full", "Batch decodes that found no free KV cache slot.", InferenceStats.KvCacheFull.Load()},
+		{"kv_cache_defrags", "KV cache defragmentations.", InferenceStats.KvCacheDefrags.Load()},
+		{"stop_suffix_delays", "Stream flushes delayed by a partial stop sequence.", streaming.StopSuffixDelays},
+		{"incomplete_unicode_holds", "Stream flushes delayed by a partial UTF-8 character.", streaming.IncompleteUnicodeHolds},
+		{"mid_token_truncations", "Stop sequences that ended inside a token.", streaming.MidTokenTruncations},
+	} {
+		fmt.Fprintf(w, "# HELP llm_server_%s_total %s\n", counter.name, counter.help)
+		fmt.Fprintf(w, "# TYPE llm_server_%s_total counter\n", counter.name)
+		fmt.Fprintf(w, "llm_server_%s_total %d\n", counter.name, counter.value)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStreamStatsCounters(t *testing.T) {
+	before := StreamStats.Snapshot()
+
+	// output ending with a prefix of a stop sequence is delayed
+	if !holdPending(&Sequence{stop: []string{"</answer>"}}, "42</ans") {
+		t.Error("expected partial stop sequence to hold output")
+	}
+
+	// output ending with an incomplete UTF-8 character is held
+	if !holdPending(&Sequence{}, "caf\xc3") {
+		t.Error("expected incomplete UTF-8 character to hold output")
+	}
+
+	// complete output is not held
+	if holdPending(&Sequence{stop: []string{"</answer>"}}, "42") {
+		t.Error("expected complete output to be flushed")
+	}
+
+	// a stop sequence ending inside a token cuts that token
+	if _, truncated := truncateStop([]string{"4", "2<", "/answer>"}, "</answer>"); !truncated {
+		t.Error("expected mid-token truncation")
+	}
+
+	w := httptest.NewRecorder()
+	(&Server{}).stats(w, httptest.NewRequest("GET", "/stats", nil))
+
+	var resp StatsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	after := resp.Streaming
+	if after.StopSuffixDelays != before.StopSuffixDelays+1 {
+		t.Errorf("expected stop suffix delays to increment, got %d -> %d", before.StopSuffixDelays, after.StopSuffixDelays)
+	}
+	if after.IncompleteUnicodeHolds != before.IncompleteUnicodeHolds+1 {
+		t.Errorf("expected unicode holds to increment, got %d -> %d", before.IncompleteUnicodeHolds, after.IncompleteUnicodeHolds)
+	}
+	if after.MidTokenTruncations != before.MidTokenTruncations+1 {
+		t.Errorf("expected mid-token truncations to increment, got %d -> %d", before.MidTokenTruncations, after.MidTokenTruncations)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := histogram{bounds: []float64{10, 100}}
+	for _, v := range []float64{5, 10, 50, 500} {
+		h.Observe(v)
+	}
+
+	var b strings.Builder
+	h.write(&b, "tps", "Speed.")
+	for _, line := range []string{
+		`tps_bucket{le="10"} 2`,
+		`tps_bucket{le="100"} 3`,
+		`tps_bucket{le="+Inf"} 4`,
+		"tps_sum 565",
+		"tps_count 4",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %q in\n%s", line, b.String())
+		}
+	}
+}
+
+func TestMetricsInferenceCounters(t *testing.T) {
+	tokens := InferenceStats.TokensGenerated.Load()
+	InferenceStats.TokensGenerated.Add(3)
+
+	// 100 tokens in 2s, and an embedding that generated nothing
+	before := InferenceStats.TokensPerSecond.count()
+	InferenceStats.ObserveTimings(Timings{PredictedN: 100, PredictedMS: 2000})
+	InferenceStats.ObserveTimings(Timings{PromptN: 8, PromptMS: 5})
+	if got := InferenceStats.TokensPerSecond.count(); got != before+1 {
+		t.Errorf("expected only the generating sequence to be observed, got %d -> %d", before, got)
+	}
+
+	w := httptest.NewRecorder()
+	(&Server{seqs: []*Sequence{{}, nil, {}}}).metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"llm_server_active_slots 2",
+		"llm_server_tokens_generated_total " + strconv.FormatUint(tokens+3, 10),
+		"# TYPE llm_server_sequence_tokens_per_second histogram",
+		`llm_server_sequence_tokens_per_second_bucket{le="+Inf"}`,
+		"# TYPE llm_server_requests_total counter",
+		"# TYPE llm_server_kv_cache_full_total counter",
+		"# TYPE llm_server_kv_cache_defrags_total counter",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected %q in /metrics output", line)
+		}
+	}
+}
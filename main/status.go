@@ -0,0 +1,122 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"encoding/json"
+	"net/http"
+)
+
+// completionStatus handles the `/completion/status?id=` endpoint, letting
+// clients that can't stream poll an in-flight request by the ID returned in
+// its `X-Request-Id` header. `prompt_processed` counts the prompt inputs in
+// the KV cache, including any reused from an earlier request, so for a long
+// prompt it climbs towards `prompt_tokens` while the status is "processing".
+//
+// Example response:
+// {
+//   "id": "9f2c1e4ab07d3c55",
+//   "status": "processing",
+//   "prompt_tokens": 12000,
+//   "prompt_processed": 4608,
+//   "predicted": 0
+// }
+//
+// Response codes:
+//   - 200 OK: The request is active
+//   - 400 Bad Request: No id was given
+//   - 404 Not Found: No active request with the given ID
+func (s *Server) completionStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	status, ok := s.requestStatus(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no active request with id %q", id), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&status); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// requestStatus reports the progress of the active request with the given ID.
+// It returns false if no such request is active.
+func (s *Server) requestStatus(id string) (CompletionStatusResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq, ok := s.requests[id]
+	if !ok {
+		return CompletionStatusResponse{}, false
+	}
+
+	status := CompletionStatusResponse{
+		ID:           id,
+		Status:       CompletionStatusProcessing,
+		PromptTokens: seq.numPromptInputs,
+		Predicted:    seq.numPredicted,
+	}
+	if seq.cache != nil {
+		status.PromptProcessed = min(len(seq.cache.Inputs), seq.numPromptInputs)
+	}
+	if !seq.startGenerationTime.IsZero() {
+		status.Status = CompletionStatusGenerating
+		status.PromptProcessed = seq.numPromptInputs
+	}
+
+	return status, true
+}
+
+// trackRequest makes seq findable by its request ID. The caller must hold s.mu.
+func (s *Server) trackRequest(seq *Sequence) {
+	if seq.id == "" {
+		return
+	}
+
+	if s.requests == nil {
+		s.requests = make(map[string]*Sequence)
+	}
+	s.requests[seq.id] = seq
+}
+
+// untrackRequest forgets seq's request ID. The caller must hold s.mu.
+func (s *Server) untrackRequest(seq *Sequence) {
+	if s.requests[seq.id] == seq {
+		delete(s.requests, seq.id)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestCompletionStatusProgress(t *testing.T) {
+	const promptLen, batchSize = 2000, 512
+
+	cache, err := NewInputCache(nil, 4096, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		seqs:    make([]*Sequence, 1),
+		seqsSem: semaphore.NewWeighted(1),
+		cache:   cache,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	prompt := make([]int, promptLen)
+	for i := range prompt {
+		prompt[i] = i
+	}
+	seq := newTestSequence(tokenInputs(prompt...))
+	seq.id = "req-1"
+	seq.numPromptInputs = promptLen
+
+	if err := s.seqsSem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.assignSequence(seq, false); err != nil {
+		t.Fatal(err)
+	}
+
+	poll := func(id string) (int, CompletionStatusResponse) {
+		w := httptest.NewRecorder()
+		s.completionStatus(w, httptest.NewRequest(http.MethodGet, "/completion/status?id="+id, nil))
+		var status CompletionStatusResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, status
+	}
+
+	// decode the prompt a batch at a time, as processBatch does
+	last := -1
+	for len(seq.inputs) > 0 {
+		code, status := poll("req-1")
+		if code != http.StatusOK || status.Status != CompletionStatusProcessing {
+			t.Fatalf("expected processing status, got %d %+v", code, status)
+		}
+		if status.PromptTokens != promptLen || status.PromptProcessed <= last {
+			t.Fatalf("expected progress past %d of %d, got %+v", last, promptLen, status)
+		}
+		last = status.PromptProcessed
+
+		n := min(batchSize, len(seq.inputs))
+		s.mu.Lock()
+		seq.cache.Inputs = append(seq.cache.Inputs, seq.inputs[:n]...)
+		seq.inputs = seq.inputs[n:]
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	seq.startGenerationTime = time.Now()
+	seq.numPredicted = 1
+	s.mu.Unlock()
+
+	code, status := poll("req-1")
+	if code != http.StatusOK || status.Status != CompletionStatusGenerating {
+		t.Fatalf("expected generating status, got %d %+v", code, status)
+	}
+	if status.PromptProcessed != promptLen || status.Predicted != 1 {
+		t.Errorf("expected whole prompt processed and 1 predicted, got %+v", status)
+	}
+
+	s.mu.Lock()
+	removeSequence(s, 0, StopReasonStop)
+	s.mu.Unlock()
+
+	if code, _ := poll("req-1"); code != http.StatusNotFound {
+		t.Errorf("expected 404 once the request finished, got %d", code)
+	}
+	if code, _ := poll(""); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without an id, got %d", code)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements buffered streaming for chunked completion responses.
+// Encoded frames are accumulated until a byte threshold is reached or a maximum
+// latency has elapsed, reducing flush overhead for fast models while bounding
+// how long output can sit in the buffer.
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"encoding/json"
+	"net/http"
+)
+
+// completionFormat is how completion frames are written to the client,
+// negotiated from the request's Accept header.
+type completionFormat int
+
+const (
+	formatNDJSON completionFormat = iota // one JSON object per line, streamed (the default)
+	formatSSE                            // Server-Sent Events, one "data:" event per frame
+	formatJSON                           // a single JSON object holding the whole completion
+)
+
+// sseDone is the event sent after the final frame in formatSSE
+const sseDone = "data: [DONE]\n\n"
+
+// negotiateFormat picks the completion format for an Accept header. The first
+// supported media type listed wins; anything else (including */* or no header)
+// gets the NDJSON stream.
+func negotiateFormat(accept string) completionFormat {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/x-ndjson":
+			return formatNDJSON
+		case "text/event-stream":
+			return formatSSE
+		case "application/json":
+			return formatJSON
+		}
+	}
+
+	return formatNDJSON
+}
+
+// ContentType returns the Content-Type header value for the format.
+func (f completionFormat) ContentType() string {
+	switch f {
+	case formatSSE:
+		return "text/event-stream"
+	case formatJSON:
+		return "application/json"
+	}
+	return "application/x-ndjson"
+}
+
+// streamWriter buffers encoded response frames and flushes them to the client
+// once `flushBytes` have accumulated or `maxLatency` has elapsed since the first
+// unflushed write. A `flushBytes` of zero or less flushes every frame.
+type streamWriter struct {
+	w          http.ResponseWriter
+	flusher    http.Flusher
+	buf        bytes.Buffer
+	flushBytes int
+	maxLatency time.Duration
+	timer      *time.Timer
+
+	format  completionFormat
+	choices int // final frames expected before "data: [DONE]", for n > 1
+	content  strings.Builder // output merged so far in formatJSON
+	tokens   []int
+	logprobs []TokenLogprob
+}
+
+// frameCounter numbers the frames of one streamed response from 0, so that
+// clients can detect dropped or reordered frames (e.g. behind a buffering proxy).
+type frameCounter int
+
+// next returns the index for the next frame.
+func (c *frameCounter) next() int {
+	n := int(*c)
+	*c++
+	return n
+}
+
+// newStreamWriter creates a streamWriter for the response using the server's
+// configured flush threshold and latency.
+func newStreamWriter(w http.ResponseWriter, flusher http.Flusher, flushBytes int, maxLatency time.Duration) *streamWriter {
+	return &streamWriter{
+		w:          w,
+		flusher:    flusher,
+		flushBytes: flushBytes,
+		maxLatency: maxLatency,
+	}
+}
+
+// Write appends an encoded frame to the buffer and starts the latency timer
+// if this is the first unflushed write.
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.buf.Len() == 0 && sw.maxLatency > 0 {
+		if sw.timer == nil {
+			sw.timer = time.NewTimer(sw.maxLatency)
+		} else {
+			sw.timer.Reset(sw.maxLatency)
+		}
+	}
+
+	return sw.buf.Write(p)
+}
+
+// Encode writes one response frame in the negotiated format. In formatSSE the
+// final frame, with its timings, is followed by a "data: [DONE]" event. In formatJSON the
+// content frames are merged and only the final frame is written, carrying the
+// whole output; other frames such as prompt usage are dropped, as the final
+// frame's timings report the same counts.
+func (sw *streamWriter) Encode(v any) error {
+	switch sw.format {
+	case formatSSE:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(sw, "data: %s\n\n", data); err != nil {
+			return err
+		}
+
+		// EventSource clients stop at the conventional terminal event,
+		// sent once every choice has ended
+		if resp, ok := v.(*CompletionResponse); ok && resp.Stop {
+			if sw.choices--; sw.choices <= 0 {
+				_, err = sw.Write([]byte(sseDone))
+			}
+		}
+		return err
+	case formatJSON:
+		resp, ok := v.(*CompletionResponse)
+		if !ok {
+			return nil
+		}
+
+		sw.content.WriteString(resp.Content)
+		sw.tokens = append(sw.tokens, resp.Tokens...)
+		sw.logprobs = append(sw.logprobs, resp.Logprobs...)
+		if !resp.Stop {
+			return nil
+		}
+
+		final := *resp
+		final.Index = 0
+		final.Content = sw.content.String()
+		final.Tokens = sw.tokens
+		final.Logprobs = sw.logprobs
+		return json.NewEncoder(sw).Encode(&final)
+	}
+
+	return json.NewEncoder(sw).Encode(v)
+}
+
+// MaybeFlush flushes the buffer if it has reached the byte threshold.
+func (sw *streamWriter) MaybeFlush() error {
+	if sw.buf.Len() >= sw.flushBytes {
+		return sw.Flush()
+	}
+
+	return nil
+}
+
+// Flush writes any buffered frames to the client and flushes the connection.
+func (sw *streamWriter) Flush() error {
+	if sw.timer != nil {
+		sw.timer.Stop()
+	}
+
+	if sw.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := sw.buf.WriteTo(sw.w)
+	sw.flusher.Flush()
+	return err
+}
+
+// Deadline returns a channel that fires when buffered output has waited
+// `maxLatency`. It returns nil (blocking forever in a select) when nothing
+// is buffered or the writer itself is nil.
+func (sw *streamWriter) Deadline() <-chan time.Time {
+	if sw == nil || sw.timer == nil || sw.buf.Len() == 0 {
+		return nil
+	}
+
+	return sw.timer.C
+}
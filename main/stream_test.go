@@ -0,0 +1,143 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingWriter records the size of the output written between flushes.
+type recordingWriter struct {
+	body    bytes.Buffer
+	pending int
+	flushes []int
+}
+
+func (w *recordingWriter) Header() http.Header        { return http.Header{} }
+func (w *recordingWriter) WriteHeader(statusCode int) {}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.pending += len(p)
+	return w.body.Write(p)
+}
+
+func (w *recordingWriter) Flush() {
+	w.flushes = append(w.flushes, w.pending)
+	w.pending = 0
+}
+
+func TestStreamWriterFlushThreshold(t *testing.T) {
+	rec := &recordingWriter{}
+	stream := newStreamWriter(rec, rec, 16, time.Hour)
+
+	frames := []string{"hello ", "world", ", this ", "is a ", "stream", "!"}
+	for _, frame := range frames {
+		if _, err := stream.Write([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.MaybeFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every threshold-triggered flush must carry at least flushBytes
+	for i, n := range rec.flushes {
+		if n < 16 {
+			t.Errorf("flush %d: expected at least 16 bytes, got %d", i, n)
+		}
+	}
+
+	if err := stream.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := rec.body.String(), strings.Join(frames, ""); got != want {
+		t.Errorf("expected content %q, got %q", want, got)
+	}
+}
+
+func TestStreamWriterLatencyDeadline(t *testing.T) {
+	rec := &recordingWriter{}
+	stream := newStreamWriter(rec, rec, 1024, 10*time.Millisecond)
+
+	if stream.Deadline() != nil {
+		t.Fatal("expected no deadline with an empty buffer")
+	}
+
+	stream.Write([]byte("tok"))
+	select {
+	case <-stream.Deadline():
+		stream.Flush()
+	case <-time.After(time.Second):
+		t.Fatal("latency deadline did not fire")
+	}
+
+	if len(rec.flushes) != 1 || rec.flushes[0] != 3 {
+		t.Errorf("expected a single 3 byte flush, got %v", rec.flushes)
+	}
+}
+
+func TestStreamWriterZeroThresholdFlushesEveryFrame(t *testing.T) {
+	rec := &recordingWriter{}
+	stream := newStreamWriter(rec, rec, 0, 0)
+
+	for _, frame := range []string{"a", "bc", "def"} {
+		stream.Write([]byte(frame))
+		stream.MaybeFlush()
+	}
+
+	if len(rec.flushes) != 3 {
+		t.Errorf("expected 3 flushes, got %v", rec.flushes)
+	}
+}
+
+func TestNilStreamWriterHasNoDeadline(t *testing.T) {
+	var stream *streamWriter
+	if stream.Deadline() != nil {
+		t.Error("expected nil deadline for a nil stream writer")
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := map[string]completionFormat{
+		"":                                       formatNDJSON,
+		"*/*":                                    formatNDJSON,
+		"text/event-stream":                      formatSSE,
+		"application/json":                       formatJSON,
+		"Application/JSON; charset=utf-8":        formatJSON,
+		"application/x-ndjson, application/json": formatNDJSON,
+		"text/html, text/event-stream;q=0.9":     formatSSE,
+	}
+	for accept, want := range cases {
+		if got := negotiateFormat(accept); got != want {
+			t.Errorf("Accept %q: expected format %d, got %d", accept, want, got)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements named prompt templates. Operators place Go text/template
+// files in the --templates directory at startup, and clients reference them by
+// file name (without extension) with a map of variables, so prompt engineering
+// lives on the server rather than in every client.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var errPromptTemplate = errors.New("invalid prompt template request")
+
+// promptTemplates maps template names to their parsed templates.
+type promptTemplates map[string]*template.Template
+
+// loadPromptTemplates parses every file in dir as a template named after the
+// file without its extension. An empty dir loads no templates.
+func loadPromptTemplates(dir string) (promptTemplates, error) {
+	templates := make(promptTemplates)
+	if dir == "" {
+		return templates, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", entry.Name(), err)
+		}
+		templates[name] = tmpl
+	}
+
+	return templates, nil
+}
+
+// renderPrompt returns the prompt for a request: prompt itself, or the named
+// template rendered with vars if name is set. Every variable the template uses
+// must be supplied.
+func (t promptTemplates) renderPrompt(prompt string, name string, vars map[string]any) (string, error) {
+	if name == "" {
+		return prompt, nil
+	}
+	if prompt != "" {
+		return "", fmt.Errorf("%w: prompt and template are mutually exclusive", errPromptTemplate)
+	}
+
+	tmpl, ok := t[name]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown template %q", errPromptTemplate, name)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("%w: %v", errPromptTemplate, err)
+	}
+
+	return b.String(), nil
+}
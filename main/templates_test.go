@@ -0,0 +1,113 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"encoding/json"
+	"net/http/httptest"
+)
+
+func writeTemplates(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRenderPromptTemplate(t *testing.T) {
+	templates, err := loadPromptTemplates(writeTemplates(t, map[string]string{
+		"summarize.tmpl": "Summarize in {{.words}} words:\n{{.text}}",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prompt, err := templates.renderPrompt("", "summarize", map[string]any{"text": "The cat sat.", "words": 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt != "Summarize in 5 words:\nThe cat sat." {
+		t.Errorf("unexpected rendered prompt %q", prompt)
+	}
+
+	if prompt, err := templates.renderPrompt("plain", "", nil); err != nil || prompt != "plain" {
+		t.Errorf("expected the prompt to pass through without a template, got %q (%v)", prompt, err)
+	}
+
+	for name, render := range map[string]func() (string, error){
+		"unknown template": func() (string, error) { return templates.renderPrompt("", "translate", nil) },
+		"missing variable": func() (string, error) {
+			return templates.renderPrompt("", "summarize", map[string]any{"text": "x"})
+		},
+		"prompt and template": func() (string, error) {
+			return templates.renderPrompt("hi", "summarize", map[string]any{"text": "x", "words": 1})
+		},
+	} {
+		if _, err := render(); !errors.Is(err, errPromptTemplate) {
+			t.Errorf("%s: expected errPromptTemplate, got %v", name, err)
+		}
+	}
+}
+
+func TestLoadPromptTemplatesRejectsInvalidTemplate(t *testing.T) {
+	if _, err := loadPromptTemplates(writeTemplates(t, map[string]string{"bad.tmpl": "{{.text"})); err == nil {
+		t.Error("expected a parse error")
+	}
+}
+
+func TestCompletionRendersTemplate(t *testing.T) {
+	templates, err := loadPromptTemplates(writeTemplates(t, map[string]string{"greet.tmpl": "Hello, {{.name}}!"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{results: NewResultCache(4), defaults: DefaultOptions(), templates: templates}
+
+	// the rendered prompt is what the request is keyed on
+	key, _ := s.results.Key(decodeCompletionRequest(t, `{"prompt": "Hello, Ada!", "temperature": 0}`))
+	s.results.Put(key, cachedResult{content: " Hi!", doneReason: StopReasonStop})
+
+	body := `{"template": "greet", "vars": {"name": "Ada"}, "temperature": 0}`
+	w := httptest.NewRecorder()
+	s.completion(w, httptest.NewRequest("POST", "/completion", strings.NewReader(body)))
+
+	var first CompletionResponse
+	if err := json.NewDecoder(w.Body).Decode(&first); err != nil {
+		t.Fatalf("expected a completion frame, got %q (%v)", w.Body.String(), err)
+	}
+	if first.Content != " Hi!" {
+		t.Errorf("expected the completion for the rendered prompt, got %q", first.Content)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// throughputWindow is the span the live tokens per second are averaged over
+	throughputWindow = 10 * time.Second
+
+	// throughputBuckets is how many slices of the window are kept; older
+	// slices are overwritten as the ring wraps around
+	throughputBuckets = 50
+)
+
+// tokenRate is a rolling count of the tokens generated across all sequences,
+// kept in a ring of throughputBuckets time slices covering throughputWindow.
+// The decode loop adds to it under s.mu while /stats and /metrics read it, so
+// it has its own lock. The zero value is ready to use.
+type tokenRate struct {
+	mu      sync.Mutex
+	first   time.Time // first token ever added, for a window that isn't full yet
+	buckets [throughputBuckets]struct {
+		slot  int64 // index of the time slice the count belongs to
+		count int
+	}
+}
+
+// bucketWidth is the time covered by one bucket of the ring.
+const bucketWidth = throughputWindow / throughputBuckets
+
+// Add accounts for n tokens generated at now.
+func (r *tokenRate) Add(n int, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.first.IsZero() {
+		r.first = now
+	}
+
+	slot := now.UnixNano() / int64(bucketWidth)
+	b := &r.buckets[slot%throughputBuckets]
+	if b.slot != slot {
+		b.slot, b.count = slot, 0
+	}
+	b.count += n
+}
+
+// PerSecond returns the tokens generated per second over the window ending at
+// now, or over the time since the first token if that is shorter.
+func (r *tokenRate) PerSecond(now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.first.IsZero() {
+		return 0
+	}
+
+	slot := now.UnixNano() / int64(bucketWidth)
+	total := 0
+	for _, b := range r.buckets {
+		if b.slot > slot-throughputBuckets && b.slot <= slot {
+			total += b.count
+		}
+	}
+
+	span := min(now.Sub(r.first), throughputWindow)
+	if span <= 0 {
+		return 0
+	}
+	return float64(total) / span.Seconds()
+}
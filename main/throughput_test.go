@@ -0,0 +1,69 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTokenRate(t *testing.T) {
+	var r tokenRate
+	start := time.Unix(1000, 0)
+
+	if got := r.PerSecond(start); got != 0 {
+		t.Errorf("expected 0 tokens/sec before any tokens, got %v", got)
+	}
+
+	// decode 10 tokens every 100ms for 2s, i.e. 100 tokens/sec
+	now := start
+	for range 20 {
+		now = now.Add(100 * time.Millisecond)
+		r.Add(10, now)
+	}
+
+	got := r.PerSecond(now)
+	if got <= 0 || math.Abs(got-100) > 10 {
+		t.Errorf("expected about 100 tokens/sec, got %v", got)
+	}
+
+	// keep decoding past the window at 50 tokens/sec
+	for range 200 {
+		now = now.Add(100 * time.Millisecond)
+		r.Add(5, now)
+	}
+
+	got = r.PerSecond(now)
+	if math.Abs(got-50) > 5 {
+		t.Errorf("expected about 50 tokens/sec once the window is full, got %v", got)
+	}
+
+	// the rate falls to 0 once generation has been idle for a whole window
+	if got := r.PerSecond(now.Add(throughputWindow + time.Second)); got != 0 {
+		t.Errorf("expected 0 tokens/sec after idling, got %v", got)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements the `/tokens/special` endpoint, which reports the
+// loaded model's special token IDs so clients can build prompts that match
+// what the server's tokenizer produces, and the `/tokenize` and `/detokenize`
+// endpoints, which let clients count and inspect tokens without inference.
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"encoding/json"
+	"net/http"
+)
+
+// specialVocab is the part of the model vocabulary the special tokens are read from.
+type specialVocab interface {
+	NumVocab() int
+	TokenBOS() int
+	TokenEOS() int
+	TokenEOT() int
+	TokenPad() int
+	AddBOSToken() bool
+	TokenIsEog(token int) bool
+	TokenIsControl(token int) bool
+	TokenToPiece(token int) string
+}
+
+// specialTokens reads the special tokens of vocab. extraEog holds the
+// --eog-tokens, which end generation in addition to the model's own. It checks
+// every token of the vocabulary, so it runs once when the model loads.
+func specialTokens(vocab specialVocab, extraEog tokenSet) SpecialTokensResponse {
+	resp := SpecialTokensResponse{
+		BOS:    vocab.TokenBOS(),
+		EOS:    vocab.TokenEOS(),
+		EOT:    vocab.TokenEOT(),
+		Pad:    vocab.TokenPad(),
+		AddBOS: vocab.AddBOSToken(),
+		EOG:    []int{},
+	}
+
+	for token := range vocab.NumVocab() {
+		_, extra := extraEog[token]
+		if extra || vocab.TokenIsEog(token) {
+			resp.EOG = append(resp.EOG, token)
+		}
+		if vocab.TokenIsControl(token) {
+			resp.Control = append(resp.Control, SpecialToken{ID: token, Piece: vocab.TokenToPiece(token)})
+		}
+	}
+
+	// --eog-tokens outside the vocabulary still stop generation
+	for token := range extraEog {
+		if !slices.Contains(resp.EOG, token) {
+			resp.EOG = append(resp.EOG, token)
+		}
+	}
+	slices.Sort(resp.EOG)
+
+	return resp
+}
+
+// specialTokensHandler handles the `/tokens/special` endpoint. IDs the model
+// does not define are -1. `eog` lists every token that ends generation and
+// `control` the control tokens, such as chat template markers, with their text.
+// It returns 503 until the model has loaded.
+//
+// Example response:
+// {
+//   "bos": 128000, "eos": 128009, "eot": 128009, "pad": -1, "add_bos": true,
+//   "eog": [128001, 128008, 128009],
+//   "control": [{"id": 128000, "piece": "<|begin_of_text|>"}, ...]
+// }
+func (s *Server) specialTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if s.status != ServerStatusReady {
+		http.Error(w, "model is not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&s.special); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// tokenizeContent splits req.Content into tokens with tokenize. Empty content gives
+// no tokens, or just the special ones if req.AddSpecial is set.
+func tokenizeContent(tokenize func(string, bool) ([]int, error), req TokenizeRequest) (TokenizeResponse, error) {
+	tokens, err := tokenize(req.Content, req.AddSpecial)
+	if err != nil {
+		return TokenizeResponse{}, err
+	}
+	if tokens == nil {
+		tokens = []int{}
+	}
+	return TokenizeResponse{Tokens: tokens, Count: len(tokens)}, nil
+}
+
+// pieceVocab is the part of the model vocabulary tokens are converted to text with.
+type pieceVocab interface {
+	NumVocab() int
+	TokenToPiece(token int) string
+}
+
+// detokenizeTokens concatenates the text of tokens. It fails on IDs outside the
+// vocabulary rather than passing them to the model.
+func detokenizeTokens(vocab pieceVocab, tokens []int) (string, error) {
+	var sb strings.Builder
+	for _, token := range tokens {
+		if token < 0 || token >= vocab.NumVocab() {
+			return "", fmt.Errorf("token %d is outside the vocabulary of %d tokens", token, vocab.NumVocab())
+		}
+		sb.WriteString(vocab.TokenToPiece(token))
+	}
+	return sb.String(), nil
+}
+
+// tokenizeHandler handles the `/tokenize` endpoint, so clients can check a
+// prompt against the context size before submitting it. Special token text
+// such as chat template markers is parsed into the special tokens, as it is
+// for completions. It returns 503 until the model has loaded.
+//
+// Example request:
+// {"content": "Hello world", "add_special": true}
+//
+// Example response:
+// {"tokens": [128000, 9906, 1917], "count": 3}
+func (s *Server) tokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if s.status != ServerStatusReady {
+		http.Error(w, "model is not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	resp, err := tokenizeContent(func(text string, addSpecial bool) ([]int, error) {
+		return s.lc.Model().Tokenize(text, addSpecial, true)
+	}, req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to tokenize content: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// detokenizeHandler handles the `/detokenize` endpoint, which converts token
+// IDs back into text. An empty list gives empty content. It returns 400 for
+// IDs outside the vocabulary and 503 until the model has loaded.
+//
+// Example request:
+// {"tokens": [9906, 1917]}
+//
+// Example response:
+// {"content": "Hello world"}
+func (s *Server) detokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req DetokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if s.status != ServerStatusReady {
+		http.Error(w, "model is not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	content, err := detokenizeTokens(s.model, req.Tokens)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&DetokenizeResponse{Content: content}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
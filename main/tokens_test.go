@@ -0,0 +1,135 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// fakeVocab is a small vocabulary whose tokenizer is wordTokenizer, which
+// prepends token 1 when adding special tokens.
+type fakeVocab struct {
+	wordTokenizer
+}
+
+func (fakeVocab) NumVocab() int     { return 8 }
+func (fakeVocab) TokenBOS() int     { return 1 }
+func (fakeVocab) TokenEOS() int     { return 2 }
+func (fakeVocab) TokenEOT() int     { return 3 }
+func (fakeVocab) TokenPad() int     { return -1 }
+func (fakeVocab) AddBOSToken() bool { return true }
+
+func (fakeVocab) TokenIsEog(token int) bool     { return token == 2 || token == 3 }
+func (fakeVocab) TokenIsControl(token int) bool { return token >= 1 && token <= 3 }
+func (fakeVocab) TokenToPiece(token int) string {
+	return []string{"", "<s>", "</s>", "<|eot|>"}[min(token, 3)]
+}
+
+func TestSpecialTokens(t *testing.T) {
+	vocab := &fakeVocab{wordTokenizer{vocab: make(map[string]int)}}
+
+	resp := specialTokens(vocab, tokenSet{7: {}, 100: {}})
+
+	// the reported BOS is the token tokenization prepends
+	tokens, err := vocab.Tokenize("hello world", resp.AddBOS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) == 0 || tokens[0] != resp.BOS {
+		t.Errorf("expected tokenization to start with BOS %d, got %v", resp.BOS, tokens)
+	}
+
+	if resp.EOS != 2 || resp.EOT != 3 || resp.Pad != -1 {
+		t.Errorf("unexpected special tokens %+v", resp)
+	}
+	if !slices.Equal(resp.EOG, []int{2, 3, 7, 100}) {
+		t.Errorf("expected the model's and --eog-tokens end tokens, got %v", resp.EOG)
+	}
+	if len(resp.Control) != 3 || resp.Control[0] != (SpecialToken{ID: 1, Piece: "<s>"}) {
+		t.Errorf("unexpected control tokens %+v", resp.Control)
+	}
+}
+
+func TestSpecialTokensHandlerServesLoadedList(t *testing.T) {
+	vocab := &fakeVocab{wordTokenizer{vocab: make(map[string]int)}}
+
+	// the handler has no model to query, only the list read at load
+	s := &Server{status: ServerStatusReady, special: specialTokens(vocab, tokenSet{})}
+	w := httptest.NewRecorder()
+	s.specialTokensHandler(w, httptest.NewRequest(http.MethodGet, "/tokens/special", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var resp SpecialTokensResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.BOS != 1 || !slices.Equal(resp.EOG, []int{2, 3}) || len(resp.Control) != 3 {
+		t.Errorf("expected the special tokens read at load, got %+v", resp)
+	}
+}
+
+func TestTokenizeRoundTrip(t *testing.T) {
+	vocab := &fakeVocab{wordTokenizer{vocab: make(map[string]int)}}
+
+	resp, err := tokenizeContent(vocab.Tokenize, TokenizeRequest{Content: "hello", AddSpecial: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(resp.Tokens, []int{1, 2}) || resp.Count != 2 {
+		t.Errorf("unexpected tokenization %+v", resp)
+	}
+
+	// empty content tokenizes to an empty list, not null
+	resp, err = tokenizeContent(vocab.Tokenize, TokenizeRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Tokens == nil || resp.Count != 0 {
+		t.Errorf("expected no tokens for empty content, got %+v", resp)
+	}
+
+	content, err := detokenizeTokens(vocab, []int{1, 3})
+	if err != nil || content != "<s><|eot|>" {
+		t.Errorf("expected <s><|eot|>, got %q (%v)", content, err)
+	}
+
+	content, err = detokenizeTokens(vocab, nil)
+	if err != nil || content != "" {
+		t.Errorf("expected empty content for no tokens, got %q (%v)", content, err)
+	}
+
+	for _, token := range []int{-1, 8} {
+		if _, err := detokenizeTokens(vocab, []int{token}); err == nil {
+			t.Errorf("expected error for token %d outside the vocabulary", token)
+		}
+	}
+}
@@ -32,8 +32,16 @@ package main
 // and model runtime control, including batching, KV cache coordination, and stop detection.
 
 import(
+	"errors"
+	"fmt"
+	"encoding/json"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"golang.org/x/sync/semaphore"
 	"llm-server/llama"
@@ -57,6 +65,36 @@ type Config struct {
     flashAttention bool
     multiUserCache bool
     lpaths         multiLPath
+    maxImages      int
+    imageCacheSize int
+    webhookURL     string
+    flushBytes     int
+    flushLatency   time.Duration
+    overflow       overflowPolicies
+    eogTokens      tokenSet
+    debugLogits    bool
+    aesKeyWarn     uint64
+    rsaPKCS1Fallback bool
+    cacheMatchTolerance int
+    shiftRatio     float64
+    templatesDir   string
+    promptTemplate string
+    promptStop string
+    utf8Hold       bool
+    embeddingParallel int
+    resultCacheSize   int
+    basePrompt        string
+    defaultTemperature float64
+    defaultTopP        float64
+    defaultTopK        int
+    strictContext      bool
+    maxGlobalTPS       float64
+    decodeRetries      int
+    decodeRetryDelay   time.Duration
+    batchFill          BatchFill
+    shutdownTimeout    time.Duration
+    apiKey             string
+    errorVerbosity     ErrorVerbosity
 }
 
 // Server represents the global state of the inference engine, including:
@@ -64,9 +102,13 @@ type Config struct {
 type Server struct {
 	ready sync.WaitGroup
 	model *llama.Model
+	pieces []string // text of each vocabulary token, indexed by token ID
+	special SpecialTokensResponse // served by /tokens/special, read once at load
 	image *ImageContext
 	status ServerStatus
+	loadErr error
 	progress float32
+	loadStart time.Time
 	parallel int
 	batchSize int
 	mu sync.Mutex
@@ -74,33 +116,115 @@ type Server struct {
 	lc *llama.Context
 	seqs []*Sequence
 	seqsSem *semaphore.Weighted
+	seqsQueue slotQueue // requests waiting for seqsSem, by priority
+	embeddingParallel int
+	embeddingSem *semaphore.Weighted // nil when embeddings share seqsSem
+	embeddingQueue slotQueue // requests waiting for embeddingSem
+	results *ResultCache
+	pacer *tokenPacer // caps generated tokens per second across all sequences, nil for no cap
+	throughput tokenRate // generated tokens per second for /stats and /metrics
+	decodeRetries int
+	decodeRetryDelay time.Duration // doubled after each retry
+	sessions map[string]map[int]struct{} // session ID -> indices in seqs, guarded by mu
+	resumable resumeStreams // frames of requests started with resumable, by request ID
+	inflight inflightRequests // identical deterministic requests sharing a sequence, by request hash
+	requests map[string]*Sequence // request ID -> active sequence, guarded by mu
+	shuttingDown bool // wakes processBatch so run can return, guarded by mu
+	promptsMu sync.Mutex
+	prompts map[string]*preparedPrompt // prompts being submitted in chunks, guarded by promptsMu
+	embeddingStreamsMu sync.Mutex
+	embeddingStreams map[string]*embeddingStream // guarded by embeddingStreamsMu
+	loras []*llama.LoraAdapter // guarded by mu, like the other lora fields, as /lora can change them
+	loraPaths []string // file each adapter in loras was loaded from
+	loraDefaults []float32 // load-time scales, used by requests without a lora option
+	loraScales []float32 // scales currently applied to lc, guarded by mu
+	loraGeneration int // incremented whenever /lora changes the loaded adapters
+	loraSwapping bool // set while a /lora change waits for running sequences to finish
+	basePromptPath string
+	templates promptTemplates // named prompt templates from --templates
+	promptFormat *promptFormat // chat format from --prompt-template
+	modelPath string
+	strictContext bool
+	trainedCtx int // context length the model was trained with, set at load
+	flashAttnRequested bool // --flash-attn
+	flashAttn bool // whether the context actually uses flash attention, set at load
+	tokenEmbeddings bool // whether the context keeps per-token embeddings, set at load
+	queued atomic.Int32
 	cache *InputCache
 	nextSeq int
+	batchFill BatchFill // how processBatch divides a batch between sequences
+	maxImages int
+	imageCacheSize int // embeddings cached by the image context, from --image-cache-size
+	defaults Options // request options used for fields a request omits
+	webhook *Webhook
+	flushBytes int
+	flushLatency time.Duration
+	overflow overflowPolicies
+	eogTokens tokenSet
+	cacheMatchTolerance int
+	shiftRatio float64 // fraction of the context freed by each context shift, from --shift-ratio
+	utf8Hold bool
+	threads int
+	rsaPKCS1Fallback bool // accept PKCS #1 v1.5 wrapped keys on the secure endpoints
 }
 
 // Sequence represents one request sequence being handled by the model.
 // It tracks state such as predicted tokens, pending inputs, sampled responses, etc.
 type Sequence struct {
+	id string
+	sessionID string
+	priority int // request priority, higher is served first
+	started bool
 	iBatch int
 	numPredicted int
 	inputs []input
 	pendingInputs []input
 	pendingResponses []string
+	pendingTokens []int
 	cache *InputCacheSlot
 	crossAttention bool
-	responses chan string
+	responses chan response
 	quit chan bool
 	numPredict int
 	samplingCtx *llama.SamplingContext
-	embedding chan []float32
+	seed *uint32 // resolved sampling seed, nil for sequences that do not sample
+	embedding chan []float32 // also carries the logit vector for logits-only sequences
 	stop []string
 	numKeep int
 	embeddingOnly bool
-	doneReason string
+	logitsOnly bool
+	prefillOnly bool // decodes a chunk of a prepared prompt into its reserved cache slot
+	prefilled chan struct{} // if set, closed once the prompt is decoded or the sequence is removed
+	doneReason StopReason
 	startProcessingTime time.Time
 	startGenerationTime time.Time
+	tokenizeDuration    time.Duration
+	numCached           int
+	holdPartialUTF8     bool
+	heldBytes           string
 	numDecoded          int
 	numPromptInputs     int
+	numTruncatedFrom    int // prompt length before it was truncated to fit the context, 0 if it fit
+	streamTokenIds      bool
+	allowedTokens       []int
+	tokenEmbeddings     bool
+	pendingBatchIdx     []int
+	tokenEmbeds         [][]float32
+	healingPrefix       string
+	healingTokens       []int
+	promptText          string
+	wantStopAlternative bool
+	lora                []float32
+	loraGeneration      int // Server.loraGeneration when lora was resolved
+	stopAlternative     *TokenAlternative
+	hitStopWord         bool // doneReason is StopReasonStop because a stop sequence matched
+	maxNewlines         int  // stop at this many generated newlines, 0 for no limit
+	numNewlines         int
+	cacheTTL            time.Duration // expire the cache slot this long after the sequence finishes, 0 for never
+	tempSchedule        *TemperatureSchedule // sampled at tempSchedule.At(0), logits rescaled per token
+	cacheSelection      CacheSelection       // how the cache slot was chosen, see return_cache_selection
+	logprobs            int                  // report sampled token logprobs with this many top alternatives, 0 for none
+	pendingLogprobs     []TokenLogprob
 }
 
 // input is a single unit of model input: either a token (int) or embedding vector.
@@ -110,15 +234,108 @@ type input struct {
 	embed []float32
 }
 
+// response is a single chunk flushed from a sequence to its HTTP handler.
+// It carries either decoded text or, when token ID streaming is enabled,
+// the raw sampled token IDs for client-side detokenization.
+type response struct {
+	content  string
+	tokens   []int
+	logprobs []TokenLogprob
+}
+
 // EmbeddingRequest is used for POST /embedding, sending a prompt and cache flag.
+// TokenEmbeddings additionally requests one embedding vector per input token.
+// Precision, if set, rounds each returned value to that many decimal places.
+// ExpectedDim, if non-zero, is the embedding dimension the client requires.
 type EmbeddingRequest struct {
-	Content     string `json:"content"`
-	CachePrompt bool   `json:"cache_prompt"`
+	Content         string `json:"content"`
+	CachePrompt     bool   `json:"cache_prompt"`
+	TokenEmbeddings bool   `json:"token_embeddings"`
+	Precision       *int   `json:"precision,omitempty"`
+	ExpectedDim     int    `json:"expected_dim,omitempty"`
 }
 
-// EmbeddingResponse contains the vector embedding returned for a given prompt.
+// EmbeddingResponse contains the vector embedding returned for a given prompt,
+// the per-token embedding matrix when token embeddings were requested, and the
+// number of prompt tokens reused from the KV cache.
 type EmbeddingResponse struct {
-	Embedding []float32 `json:"embedding"`
+	Embedding       Embedding   `json:"embedding"`
+	TokenEmbeddings []Embedding `json:"token_embeddings,omitempty"`
+	CachedTokens    int         `json:"cached_tokens"`
+}
+
+// Embedding is an embedding vector encoded as a JSON array with at most
+// Precision decimal places per value, or at full float32 precision if
+// Precision is nil.
+type Embedding struct {
+	Values    []float32
+	Precision *int
+}
+
+// EmbeddingStreamRequest is used for POST /embedding/stream to add text to a
+// stream, starting a new stream if StreamID is empty.
+type EmbeddingStreamRequest struct {
+	StreamID string `json:"stream_id"`
+	Content  string `json:"content"`
+}
+
+// EmbeddingStreamResponse is the embedding of all text received on a stream so
+// far. CachedTokens of its Tokens were reused from the previous update.
+type EmbeddingStreamResponse struct {
+	StreamID     string    `json:"stream_id"`
+	Embedding    []float32 `json:"embedding"`
+	CachedTokens int       `json:"cached_tokens"`
+	Tokens       int       `json:"tokens"`
+}
+
+// CompletionStatus values reported by GET /completion/status.
+const (
+	CompletionStatusProcessing = "processing"
+	CompletionStatusGenerating = "generating"
+)
+
+// CompletionStatusResponse is returned by GET /completion/status with the
+// progress of an in-flight request.
+type CompletionStatusResponse struct {
+	ID              string `json:"id"`
+	Status          string `json:"status"`
+	PromptTokens    int    `json:"prompt_tokens"`
+	PromptProcessed int    `json:"prompt_processed"`
+	Predicted       int    `json:"predicted"`
+}
+
+// CancelRequest is used for POST /cancel to stop an in-flight request by ID.
+// RequestID is accepted as an alias for ID.
+type CancelRequest struct {
+	ID        string `json:"id"`
+	RequestID string `json:"request_id"`
+}
+
+// LogitsRequest is used for POST /completion/logits, a debug endpoint that
+// decodes a prompt and returns the raw next-token logits.
+type LogitsRequest struct {
+	Prompt      string `json:"prompt"`
+	CachePrompt bool   `json:"cache_prompt"`
+}
+
+// LogitsResponse contains the logit for every token in the vocabulary.
+type LogitsResponse struct {
+	NumVocab int       `json:"n_vocab"`
+	Logits   []float32 `json:"logits"`
+}
+
+// AppendRequest is used for POST /completion/append to add a chunk of text to
+// a prompt created by /completion/prepare.
+type AppendRequest struct {
+	PromptID string `json:"prompt_id"`
+	Content  string `json:"content"`
+}
+
+// PreparedPromptResponse is returned by /completion/prepare and
+// /completion/append. Tokens counts the prompt tokens decoded so far.
+type PreparedPromptResponse struct {
+	PromptID string `json:"prompt_id"`
+	Tokens   int    `json:"tokens"`
 }
 
 // NewSequenceParams configures a new sequence with decoding rules,
@@ -128,7 +345,24 @@ type NewSequenceParams struct {
 	stop           []string
 	numKeep        int
 	samplingParams *llama.SamplingParams
+	seed           *uint32 // sampling seed, nil to draw a random one
 	embedding      bool
+	streamTokenIds  bool
+	allowedTokens   []int
+	tokenEmbeddings bool
+	tokenHealing    bool
+	logitsOnly      bool
+	returnPrompt    bool
+	sessionID       string
+	requestID       string
+	priority        int
+	stopAlternative bool
+	lora            []LoraRequest
+	maxNewlines     int
+	cacheTTL        time.Duration
+	tempSchedule    *TemperatureSchedule
+	logprobs        int
+	truncate        *bool // overrides the --overflow-policy for the request type if set
 }
 
 // CompletionRequest is used for POST /completion and /secure/completion endpoints.
@@ -139,9 +373,155 @@ type CompletionRequest struct {
 	Grammar     string      `json:"grammar"`
 	CachePrompt bool        `json:"cache_prompt"`
 
+	// CacheTTLMs clears the prompt cached for this request from the KV cache
+	// once its slot has been idle this many milliseconds, bounding how long a
+	// sensitive prompt is retained; 0 keeps it until the slot is reused
+	CacheTTLMs int `json:"cache_ttl_ms"`
+
+	// StreamTokenIds streams raw sampled token IDs instead of decoded text
+	StreamTokenIds bool `json:"stream_token_ids"`
+
+	// AllowedTokens restricts sampling to the given token IDs
+	AllowedTokens []int `json:"allowed_tokens"`
+
+	// TokenHealing backs up the last prompt token and constrains the first
+	// generated token to complete it. With allowed_tokens, the first token
+	// must also be one of those. Not supported with stream_token_ids, since
+	// the first streamed ID would repeat the backed-up text
+	TokenHealing bool `json:"token_healing"`
+
+	// ReturnPromptText includes the detokenized prompt in the final response
+	// so clients can verify that tokenization round-trips
+	ReturnPromptText bool `json:"return_prompt_text"`
+
+	// ReturnStopAlternative reports the runner-up to the token sampled at the
+	// step where generation stopped
+	ReturnStopAlternative bool `json:"return_stop_alternative"`
+
+	// Logprobs reports the log probability of each sampled token along with
+	// the Logprobs most likely tokens at that step; 0 disables it
+	Logprobs int `json:"logprobs"`
+
+	// ReturnCacheSelection reports which cache slot the prompt was loaded
+	// into and whether it was reused, forked or evicted
+	ReturnCacheSelection bool `json:"return_cache_selection"`
+
+	// SessionID groups requests so they can be cancelled together via
+	// /sessions/{id}/cancel
+	SessionID string `json:"session_id"`
+
+	// Priority orders requests waiting for a sequence slot and gives running
+	// sequences batch capacity before those of lower priority; default 0
+	Priority int `json:"priority"`
+
+	// RequestID replaces the generated X-Request-Id, so a client can cancel
+	// the request via /cancel without waiting for the response headers. It
+	// must not be in use by another active request
+	RequestID string `json:"request_id"`
+
+	// Truncate overrides the --overflow-policy for a prompt longer than the
+	// context: false rejects it with 413 and the token counts, true drops the
+	// oldest inputs after num_keep
+	Truncate *bool `json:"truncate,omitempty"`
+
+	// StripPromptEcho removes a leading repetition of the prompt's tail from
+	// the generated output
+	StripPromptEcho bool `json:"strip_prompt_echo"`
+
+	// N generates this many completions of the prompt in parallel, each
+	// streamed with its choice index; each takes one of the --parallel slots
+	N int `json:"n"`
+
+	// Filters names output filters (see filters.go) applied in order to the
+	// generated text
+	Filters []string `json:"filters"`
+
+	// MaxNewlines stops generation at the Nth newline in the output, which is
+	// not included; the final frame reports finish_reason "newline"
+	MaxNewlines int `json:"max_newlines"`
+
+	// PromptID runs generation on a prompt submitted through
+	// /completion/prepare and /completion/append instead of Prompt
+	PromptID string `json:"prompt_id"`
+
+	// Template renders the prompt from the named --templates file with Vars,
+	// instead of sending Prompt
+	Template string         `json:"template"`
+	Vars     map[string]any `json:"vars"`
+
+	// TemperatureSchedule varies the temperature per generated token and
+	// replaces Temperature
+	TemperatureSchedule *TemperatureSchedule `json:"temperature_schedule"`
+
+	// PrefixUsage sends a PromptUsage frame before any generated content
+	PrefixUsage bool `json:"prefix_usage"`
+
+	// EmptyFrame sends a content frame with empty content and the
+	// finish_reason before the final frame when generation produced no
+	// content, for clients that expect at least one content frame. With
+	// n > 1 this applies to each choice
+	EmptyFrame bool `json:"empty_frame"`
+
+	// Resumable keeps the request generating for a while if the client
+	// disconnects, so it can reconnect via /completion/resume with the
+	// resume_token of the last frame it received
+	Resumable bool `json:"resumable"`
+
+	// JSONSchema validates the finished output; failed attempts are re-run
+	// with an incremented seed up to MaxRetries times
+	JSONSchema json.RawMessage `json:"json_schema"`
+	MaxRetries int             `json:"max_retries"`
+
+	// NumThreads must match the server's --threads if set, since the thread
+	// count is shared by all sequences decoded in the same batch
+	NumThreads int `json:"n_threads"`
+
 	Options
 }
 
+// completionAliases maps field names other clients use to the canonical
+// CompletionRequest field names they are accepted as.
+var completionAliases = map[string]string{
+	"max_tokens":         "n_predict",
+	"num_predict":        "n_predict",
+	"temp":               "temperature",
+	"repetition_penalty": "repeat_penalty",
+	"stop_sequences":     "stop",
+	"random_seed":        "seed",
+}
+
+// UnmarshalJSON decodes a completion request, accepting the aliases in
+// completionAliases. Setting both a field and one of its aliases is an error,
+// as is setting two aliases of the same field. Fields missing from data keep
+// their current values, so defaults can be set before decoding.
+func (r *CompletionRequest) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	for alias, canonical := range completionAliases {
+		value, ok := fields[alias]
+		if !ok {
+			continue
+		}
+		if _, ok := fields[canonical]; ok {
+			return fmt.Errorf("%q is set both directly and through the alias %q", canonical, alias)
+		}
+		fields[canonical] = value
+		delete(fields, alias)
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	// decode through a type without this method
+	type completionRequest CompletionRequest
+	return json.Unmarshal(data, (*completionRequest)(r))
+}
+
 // Options defines all model inference settings such as sampling behavior,
 // temperature, penalties, and Mirostat tuning values.
 type Options struct {
@@ -165,6 +545,17 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta"`
 	PenalizeNewline  bool     `json:"penalize_nl"`
 	Stop             []string `json:"stop"`
+
+	// Lora selects the loaded adapters (by --lora index) and scales for this
+	// request; adapters not listed are disabled
+	Lora []LoraRequest `json:"lora"`
+}
+
+// LoraRequest activates the adapter loaded by the id-th --lora flag at the
+// given scale.
+type LoraRequest struct {
+	ID    int     `json:"id"`
+	Scale float32 `json:"scale"`
 }
 
 // Runner defines lower-level execution parameters related to batch size,
@@ -192,7 +583,8 @@ type ImageData struct {
 }
 
 // DefaultOptions returns a baseline set of decoding options with commonly tuned values.
-// These are overridden per request via the `Options` field in CompletionRequest.
+// These are overridden per request via the `Options` field in CompletionRequest,
+// and at startup by the --default-temperature, --default-top-p and --default-top-k flags.
 func DefaultOptions() Options {
 	return Options{
 		// options set on request to runner
@@ -231,44 +623,458 @@ func DefaultOptions() Options {
 // CompletionResponse is the streaming or final response returned by the model.
 // It includes the generated text, stop flags, timing, and optionally model metadata.
 type CompletionResponse struct {
+	Index   int    `json:"index"`
+	Choice  *int   `json:"choice,omitempty"` // which of a request's n completions the frame belongs to
 	Content string `json:"content"`
+	Tokens  []int  `json:"tokens,omitempty"`
 	Stop    bool   `json:"stop"`
 
+	// Logprobs has an entry per sampled token in Content, if requested
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+
+	FinishReason string  `json:"finish_reason,omitempty"`
+	PromptText   string  `json:"prompt_text,omitempty"`
 	Model        string  `json:"model,omitempty"`
 	Prompt       string  `json:"prompt,omitempty"`
-	StoppedLimit bool    `json:"stopped_limit,omitempty"`
 	PredictedN   int     `json:"predicted_n,omitempty"`
 	PredictedMS  float64 `json:"predicted_ms,omitempty"`
 	PromptN      int     `json:"prompt_n,omitempty"`
 	PromptMS     float64 `json:"prompt_ms,omitempty"`
 
+	StopAlternative *TokenAlternative `json:"stop_alternative,omitempty"`
+	CacheSelection  *CacheSelection   `json:"cache_selection,omitempty"`
+
+	StopFlags
+
+	// Seed is the sampling seed the sequence actually used, with a requested
+	// seed of -1 resolved to the random seed that was drawn
+	Seed *uint32 `json:"seed,omitempty"`
+
+	// ResumeToken is the resume_from that continues after this frame, set
+	// for resumable requests
+	ResumeToken int `json:"resume_token,omitempty"`
+
+	// PromptTokens is the number of prompt tokens processed, as in the
+	// prefix_usage frame. Truncated is set when the prompt was longer than the
+	// context and lost inputs to fit, with PromptTokensOriginal its length
+	// before truncation
+	PromptTokens         int  `json:"prompt_tokens"`
+	Truncated            bool `json:"truncated,omitempty"`
+	PromptTokensOriginal int  `json:"prompt_tokens_original,omitempty"`
+
+	// ComputeUnits approximates the compute the request used, for billing
+	// and quotas, see computeUnits
+	ComputeUnits float64 `json:"compute_units,omitempty"`
+
+	ResultCached  bool   `json:"result_cached,omitempty"`
+	SchemaError   string `json:"schema_error,omitempty"`
+	SchemaRetries int    `json:"schema_retries,omitempty"`
+
 	Timings Timings `json:"timings"`
 }
 
+// GenerateResponse is the complete response returned by /generate and /secure/generate.
+type GenerateResponse struct {
+	Message struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"message"`
+	Model              string `json:"model"`
+	CreatedAt          string `json:"created_at"`
+	DoneReason         string `json:"done_reason"`
+	Done               bool   `json:"done"`
+	TotalDuration      int64  `json:"total_duration"`
+	LoadDuration       int64  `json:"load_duration"`
+	PromptEvalCount    int    `json:"prompt_eval_count"`
+	PromptEvalDuration int64  `json:"prompt_eval_duration"`
+	EvalCount          int    `json:"eval_count"`
+	EvalDuration       int64  `json:"eval_duration"`
+	Seed               *uint32 `json:"seed,omitempty"`
+}
+
+// TokenLogprob is the log probability of a sampled token under the logits it
+// was sampled from, after allowed_tokens masking and temperature scheduling but
+// before the sampler's own transforms. TopLogprobs lists the most likely
+// tokens at the same step.
+type TokenLogprob struct {
+	ID          int            `json:"id"`
+	Token       string         `json:"token"`
+	Logprob     float32        `json:"logprob"`
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
+// TokenAlternative describes the token that came closest to being chosen
+// instead of the one sampled when generation stopped (an end-of-generation
+// token or the token completing a stop sequence). Probabilities are the
+// model's softmax over the raw logits, before sampling transforms such as
+// temperature, so clients can judge how close the decision was.
+type TokenAlternative struct {
+	Token       int     `json:"token"`
+	Piece       string  `json:"piece"`
+	Prob        float32 `json:"prob"`
+	SampledProb float32 `json:"sampled_prob"`
+}
+
+// PromptUsage is the initial frame streamed by /completion when "prefix_usage"
+// is set, reporting the prompt size before generation begins.
+type PromptUsage struct {
+	Index        int `json:"index"`
+	PromptTokens int `json:"prompt_tokens"`
+}
+
+// GenerateDelta is an incremental frame streamed by /generate when "stream" is set.
+type GenerateDelta struct {
+	Delta string `json:"delta"`
+}
+
 // Timings captures performance measurements for prompt and token generation.
 type Timings struct {
 	PredictedN  int     `json:"predicted_n"`
 	PredictedMS float64 `json:"predicted_ms"`
 	PromptN     int     `json:"prompt_n"`
 	PromptMS    float64 `json:"prompt_ms"`
+	TokenizeMS  float64 `json:"tokenize_ms"`
+}
+
+// ModelsResponse is returned by /models and describes the loaded model.
+type ModelsResponse struct {
+	Models []ModelInfo `json:"models"`
+}
+
+// ModelInfo describes a loaded model. TrainedContext is the context length
+// the model was trained with and Context the context each sequence slot gets.
+// FlashAttention is whether the context uses flash attention, which may be
+// off even though FlashAttnRequested is set.
+type ModelInfo struct {
+	ID                 string `json:"id"`
+	Path               string `json:"path"`
+	TrainedContext     int    `json:"n_ctx_train"`
+	Context            int    `json:"n_ctx"`
+	FlashAttention     bool   `json:"flash_attn"`
+	FlashAttnRequested bool   `json:"flash_attn_requested"`
+}
+
+// ModelDetails is returned by GET /model and describes the model as loaded
+// rather than as configured. Context is the context each sequence slot gets,
+// and Loras lists the paths of the applied LoRA adapters in id order.
+type ModelDetails struct {
+	Path           string   `json:"path"`
+	EmbeddingSize  int      `json:"n_embd"`
+	Context        int      `json:"n_ctx"`
+	TrainedContext int      `json:"n_ctx_train"`
+	VocabSize      int      `json:"n_vocab"`
+	AddBOS         bool     `json:"add_bos"`
+	Vision         bool     `json:"vision"`
+	VisionArch     string   `json:"vision_arch,omitempty"`
+	Loras          []string `json:"loras"`
 }
 
 // HealthResponse is returned by the /health endpoint to report server readiness and progress.
+// While the model is loading it also reports the time spent loading so far
+// and, once progress has been made, a rough estimate of the time remaining.
+// SlotsBusy of SlotsTotal sequence slots are running requests, and
+// QueueWaiting requests are waiting for one.
 type HealthResponse struct {
-	Status   string  `json:"status"`
-	Progress float32 `json:"progress"`
+	Status       string  `json:"status"`
+	Progress     float32 `json:"progress"`
+	ElapsedMS    int64   `json:"elapsed_ms,omitempty"`
+	EtaMS        int64   `json:"eta_ms,omitempty"`
+	Error        string  `json:"error,omitempty"`
+	SlotsTotal   int     `json:"slots_total"`
+	SlotsBusy    int     `json:"slots_busy"`
+	QueueWaiting int     `json:"queue_waiting"`
+}
+
+// DetailedHealthResponse is returned by /health/detailed. It extends the
+// /health fields with GPU and host memory so orchestrators can make scheduling
+// decisions. Memory values are in bytes and zero when not available.
+type DetailedHealthResponse struct {
+	HealthResponse
+
+	GPUs   []GPUMemory `json:"gpus"`
+	Memory HostMemory  `json:"memory"`
+}
+
+// GPUMemory reports the memory of a single GPU device.
+type GPUMemory struct {
+	Name  string `json:"name"`
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	Used  uint64 `json:"used"`
+}
+
+// HostMemory reports system memory and the server process's Go runtime usage.
+type HostMemory struct {
+	Total       uint64 `json:"total"`
+	Available   uint64 `json:"available"`
+	ProcessHeap uint64 `json:"process_heap"`
+	ProcessSys  uint64 `json:"process_sys"`
+}
+
+// deviceInfoProvider reports the GPU devices available for tensor splitting
+// and detailed health reporting.
+// It is satisfied by llama.GPUDevices and can be replaced in tests.
+type deviceInfoProvider func() []llama.DeviceInfo
+
+// PromptTooLongResponse is the body of the 413 returned for a completion
+// prompt that does not fit the context and may not be truncated.
+type PromptTooLongResponse struct {
+	Error        string `json:"error"`
+	PromptTokens int    `json:"prompt_tokens"`
+	ContextLimit int    `json:"context_limit"`
+}
+
+// SpecialTokensResponse lists the model's special token IDs, -1 where the
+// model has none.
+type SpecialTokensResponse struct {
+	BOS     int            `json:"bos"`
+	EOS     int            `json:"eos"`
+	EOT     int            `json:"eot"`
+	Pad     int            `json:"pad"`
+	AddBOS  bool           `json:"add_bos"`
+	EOG     []int          `json:"eog"`
+	Control []SpecialToken `json:"control"`
+}
+
+// SpecialToken is a special token and its text.
+type SpecialToken struct {
+	ID    int    `json:"id"`
+	Piece string `json:"piece"`
+}
+
+// TokenizeRequest is the body of the /tokenize endpoint. AddSpecial adds the
+// tokens the model expects at the start of a prompt, such as BOS.
+type TokenizeRequest struct {
+	Content    string `json:"content"`
+	AddSpecial bool   `json:"add_special"`
+}
+
+// TokenizeResponse is returned by the /tokenize endpoint.
+type TokenizeResponse struct {
+	Tokens []int `json:"tokens"`
+	Count  int   `json:"count"`
+}
+
+// DetokenizeRequest is the body of the /detokenize endpoint.
+type DetokenizeRequest struct {
+	Tokens []int `json:"tokens"`
+}
+
+// DetokenizeResponse is returned by the /detokenize endpoint.
+type DetokenizeResponse struct {
+	Content string `json:"content"`
+}
+
+// tokenSet is a set of token IDs that can be set from the command line as a
+// comma-separated list, e.g. --eog-tokens 128001,128009. The flag may be
+// specified multiple times.
+type tokenSet map[int]struct{}
+
+func (t tokenSet) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		token, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || token < 0 {
+			return fmt.Errorf("invalid token id %q", field)
+		}
+		t[token] = struct{}{}
+	}
+	return nil
+}
+
+func (t tokenSet) String() string {
+	tokens := make([]string, 0, len(t))
+	for _, token := range slices.Sorted(maps.Keys(t)) {
+		tokens = append(tokens, strconv.Itoa(token))
+	}
+	return strings.Join(tokens, ",")
+}
+
+// Contains reports whether the token is in the set.
+func (t tokenSet) Contains(token int) bool {
+	_, ok := t[token]
+	return ok
+}
+
+// OverflowPolicy controls how NewSequence handles a prompt that is longer
+// than the per-sequence context window.
+type OverflowPolicy string
+
+const (
+	// OverflowTruncate keeps the first numKeep inputs and drops the oldest
+	// inputs after them until the prompt fits.
+	OverflowTruncate OverflowPolicy = "truncate"
+	// OverflowError rejects the request.
+	OverflowError OverflowPolicy = "error"
+)
+
+const (
+	requestTypeCompletion = "completion"
+	requestTypeEmbedding  = "embedding"
+)
+
+// overflowPolicies maps a request type ("completion" or "embedding") to its
+// overflow policy and can be set from the command line as a comma-separated
+// list, e.g. --overflow-policy embedding=error,completion=truncate.
+type overflowPolicies map[string]OverflowPolicy
+
+// defaultOverflowPolicies truncates completion prompts but rejects embedding
+// prompts, since a truncated embedding silently describes different text.
+func defaultOverflowPolicies() overflowPolicies {
+	return overflowPolicies{
+		requestTypeCompletion: OverflowTruncate,
+		requestTypeEmbedding:  OverflowError,
+	}
 }
 
-// multiLPath allows specifying multiple --lora arguments via CLI flags.
-type multiLPath []string
+func (p overflowPolicies) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		requestType, policy, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return fmt.Errorf("invalid overflow policy %q, expected type=policy", entry)
+		}
+
+		if requestType != requestTypeCompletion && requestType != requestTypeEmbedding {
+			return fmt.Errorf("unknown request type %q", requestType)
+		}
+
+		switch OverflowPolicy(policy) {
+		case OverflowTruncate, OverflowError:
+			p[requestType] = OverflowPolicy(policy)
+		default:
+			return fmt.Errorf("unknown overflow policy %q", policy)
+		}
+	}
+
+	return nil
+}
+
+func (p overflowPolicies) String() string {
+	entries := make([]string, 0, len(p))
+	for requestType, policy := range p {
+		entries = append(entries, requestType+"="+string(policy))
+	}
+	slices.Sort(entries)
+	return strings.Join(entries, ",")
+}
+
+// For returns the policy for the given request type, defaulting to truncation.
+func (p overflowPolicies) For(embedding bool) OverflowPolicy {
+	requestType := requestTypeCompletion
+	if embedding {
+		requestType = requestTypeEmbedding
+	}
+
+	if policy, ok := p[requestType]; ok {
+		return policy
+	}
+
+	return OverflowTruncate
+}
 
+// StopReason records why a sequence was removed from the active batch.
+// Its string form is reported as `finish_reason` in completion responses.
+type StopReason int
+
+const (
+	// StopReasonNone is used when an embedding-only sequence completes; it is
+	// never reported to completion clients.
+	StopReasonNone StopReason = iota
+	// StopReasonStop means an end-of-generation token or stop sequence was hit.
+	StopReasonStop
+	// StopReasonLimit means the num_predict token limit was reached.
+	StopReasonLimit
+	// StopReasonConnection means the client disconnected mid-generation.
+	StopReasonConnection
+	// StopReasonError means generation was aborted by an internal error.
+	StopReasonError
+	// StopReasonCancelled means the request was cancelled through /cancel.
+	StopReasonCancelled
+	// StopReasonNewline means the max_newlines limit was reached.
+	StopReasonNewline
+	// StopReasonShutdown means the server shut down before generation finished.
+	StopReasonShutdown
+)
+
+// String converts a StopReason into its API value.
+func (r StopReason) String() string {
+	switch r {
+	case StopReasonStop:
+		return "stop"
+	case StopReasonLimit:
+		return "limit"
+	case StopReasonConnection:
+		return "connection"
+	case StopReasonError:
+		return "error"
+	case StopReasonCancelled:
+		return "cancelled"
+	case StopReasonNewline:
+		return "newline"
+	case StopReasonShutdown:
+		return "shutdown"
+	default:
+		return ""
+	}
+}
+
+// StopFlags tells a client which condition ended generation. At most one is
+// set; none are for other stop reasons such as cancellation or max_newlines.
+type StopFlags struct {
+	StoppedEOS   bool `json:"stopped_eos,omitempty"`
+	StoppedWord  bool `json:"stopped_word,omitempty"`
+	StoppedLimit bool `json:"stopped_limit,omitempty"`
+}
+
+// stopFlags derives the StopFlags for a finished sequence. StopReasonStop
+// covers both an end-of-generation token and a stop sequence, so hitStopWord
+// tells them apart.
+func stopFlags(reason StopReason, hitStopWord bool) StopFlags {
+	return StopFlags{
+		StoppedEOS:   reason == StopReasonStop && !hitStopWord,
+		StoppedWord:  reason == StopReasonStop && hitStopWord,
+		StoppedLimit: reason == StopReasonLimit,
+	}
+}
+
+// multiLPath allows specifying multiple --lora arguments via CLI flags, each
+// a path with an optional `:scale` suffix (e.g. adapter.gguf:0.7).
+type multiLPath []loraPath
+
+// loraPath is an adapter file and the scale it is loaded with.
+type loraPath struct {
+	path  string
+	scale float32
+}
+
+// Set adds an adapter. A suffix after the last colon that isn't a number is
+// kept as part of the path, so paths containing colons need no scale.
 func (m *multiLPath) Set(value string) error {
-	*m = append(*m, value)
+	lora := loraPath{path: value, scale: 1.0}
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		if scale, err := strconv.ParseFloat(value[i+1:], 32); err == nil {
+			if math.IsNaN(scale) || math.IsInf(scale, 0) {
+				return fmt.Errorf("lora scale must be finite, got %q", value[i+1:])
+			}
+			lora = loraPath{path: value[:i], scale: float32(scale)}
+		}
+	}
+	if lora.path == "" {
+		return errors.New("lora path must not be empty")
+	}
+
+	*m = append(*m, lora)
 	return nil
 }
 
 func (m *multiLPath) String() string {
-	return strings.Join(*m, ", ")
+	paths := make([]string, len(*m))
+	for i, lora := range *m {
+		paths[i] = lora.path
+		if lora.scale != 1.0 {
+			paths[i] += ":" + strconv.FormatFloat(float64(lora.scale), 'g', -1, 32)
+		}
+	}
+	return strings.Join(paths, ", ")
 }
 
 const (
@@ -0,0 +1,171 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import "testing"
+
+func TestStopReasonString(t *testing.T) {
+	cases := []struct {
+		reason StopReason
+		want   string
+	}{
+		{StopReasonNone, ""},
+		{StopReasonStop, "stop"},
+		{StopReasonLimit, "limit"},
+		{StopReasonConnection, "connection"},
+		{StopReasonError, "error"},
+		{StopReasonCancelled, "cancelled"},
+		{StopReasonNewline, "newline"},
+		{StopReasonShutdown, "shutdown"},
+		{StopReason(99), ""},
+	}
+
+	for _, tc := range cases {
+		if got := tc.reason.String(); got != tc.want {
+			t.Errorf("StopReason(%d): expected %q, got %q", tc.reason, tc.want, got)
+		}
+	}
+}
+
+func TestStopFlagsExactlyOne(t *testing.T) {
+	cases := []struct {
+		name        string
+		reason      StopReason
+		hitStopWord bool
+		want        StopFlags
+	}{
+		{"eos", StopReasonStop, false, StopFlags{StoppedEOS: true}},
+		{"stop word", StopReasonStop, true, StopFlags{StoppedWord: true}},
+		{"limit", StopReasonLimit, false, StopFlags{StoppedLimit: true}},
+	}
+
+	for _, tc := range cases {
+		got := stopFlags(tc.reason, tc.hitStopWord)
+		if got != tc.want {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.want, got)
+		}
+		set := 0
+		for _, flag := range []bool{got.StoppedEOS, got.StoppedWord, got.StoppedLimit} {
+			if flag {
+				set++
+			}
+		}
+		if set != 1 {
+			t.Errorf("%s: expected exactly one flag set, got %d", tc.name, set)
+		}
+	}
+
+	if got := stopFlags(StopReasonCancelled, false); got != (StopFlags{}) {
+		t.Errorf("cancelled: expected no flags, got %+v", got)
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	policies := defaultOverflowPolicies()
+	if got := policies.For(true); got != OverflowError {
+		t.Errorf("embedding default: expected %q, got %q", OverflowError, got)
+	}
+	if got := policies.For(false); got != OverflowTruncate {
+		t.Errorf("completion default: expected %q, got %q", OverflowTruncate, got)
+	}
+
+	if err := policies.Set("embedding=truncate, completion=error"); err != nil {
+		t.Fatal(err)
+	}
+	if got := policies.For(true); got != OverflowTruncate {
+		t.Errorf("embedding: expected %q, got %q", OverflowTruncate, got)
+	}
+	if got := policies.For(false); got != OverflowError {
+		t.Errorf("completion: expected %q, got %q", OverflowError, got)
+	}
+	if got := policies.String(); got != "completion=error,embedding=truncate" {
+		t.Errorf("unexpected string form %q", got)
+	}
+
+	for _, invalid := range []string{"embedding", "chat=error", "completion=shift"} {
+		if err := policies.Set(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestTokenSet(t *testing.T) {
+	tokens := tokenSet{}
+	if err := tokens.Set("128009, 2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Set("32000"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []int{2, 128009, 32000} {
+		if !tokens.Contains(token) {
+			t.Errorf("expected token %d in set", token)
+		}
+	}
+	if tokens.Contains(1) {
+		t.Error("unexpected token 1 in set")
+	}
+	if got := tokens.String(); got != "2,32000,128009" {
+		t.Errorf("unexpected string form %q", got)
+	}
+
+	for _, invalid := range []string{"abc", "-1", "1,,2"} {
+		if err := tokens.Set(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestMultiLPathScale(t *testing.T) {
+	var lpaths multiLPath
+	for _, value := range []string{"adapter.gguf:0.7", "plain.gguf", `C:\loras\style.gguf`, `C:\loras\style.gguf:-0.5`} {
+		if err := lpaths.Set(value); err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+	}
+
+	want := multiLPath{
+		{path: "adapter.gguf", scale: 0.7},
+		{path: "plain.gguf", scale: 1.0},
+		{path: `C:\loras\style.gguf`, scale: 1.0},
+		{path: `C:\loras\style.gguf`, scale: -0.5},
+	}
+	for i := range want {
+		if lpaths[i] != want[i] {
+			t.Errorf("entry %d: expected %+v, got %+v", i, want[i], lpaths[i])
+		}
+	}
+	if got := lpaths.String(); got != `adapter.gguf:0.7, plain.gguf, C:\loras\style.gguf, C:\loras\style.gguf:-0.5` {
+		t.Errorf("unexpected string form %q", got)
+	}
+
+	for _, invalid := range []string{":0.5", "adapter.gguf:NaN", "adapter.gguf:Inf"} {
+		if err := lpaths.Set(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// This file implements optional lifecycle webhooks. When `--webhook-url` is set,
+// the server POSTs a JSON event when a sequence starts processing, when its first
+// token is sampled, and when it completes. Events are queued and delivered by a
+// background goroutine so that the decode loop is never blocked on the network.
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	WebhookEventStarted    = "started"
+	WebhookEventFirstToken = "first_token"
+	WebhookEventCompleted  = "completed"
+)
+
+const (
+	webhookQueueSize  = 256
+	webhookMaxRetries = 3
+	webhookBackoff    = 100 * time.Millisecond
+	webhookTimeout    = 5 * time.Second
+)
+
+// WebhookEvent is the JSON payload delivered to the configured webhook URL.
+type WebhookEvent struct {
+	Event      string  `json:"event"`
+	RequestID  string  `json:"request_id"`
+	Timestamp  string  `json:"timestamp"`
+	ElapsedMS  float64 `json:"elapsed_ms"`
+	Reason     string  `json:"reason,omitempty"`
+	PromptN    int     `json:"prompt_n"`
+	PredictedN int     `json:"predicted_n"`
+}
+
+// Webhook delivers lifecycle events to an external receiver through a bounded
+// queue. A nil *Webhook is valid and silently discards all events.
+type Webhook struct {
+	url    string
+	client *http.Client
+	events chan WebhookEvent
+}
+
+// NewWebhook creates a webhook for the given URL and starts its delivery loop.
+// It returns nil if no URL is configured.
+func NewWebhook(url string) *Webhook {
+	if url == "" {
+		return nil
+	}
+
+	h := &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		events: make(chan WebhookEvent, webhookQueueSize),
+	}
+	go h.run()
+
+	return h
+}
+
+// SequenceEvent queues a lifecycle event for the given sequence without blocking.
+// Events are dropped with a warning if the queue is full.
+func (h *Webhook) SequenceEvent(event string, seq *Sequence, reason string) {
+	if h == nil {
+		return
+	}
+
+	select {
+	case h.events <- WebhookEvent{
+		Event:      event,
+		RequestID:  seq.id,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339Nano),
+		ElapsedMS:  float64(time.Since(seq.startProcessingTime).Microseconds()) / 1000,
+		Reason:     reason,
+		PromptN:    seq.numPromptInputs,
+		PredictedN: seq.numPredicted,
+	}:
+	default:
+		slog.Warn("webhook queue full, dropping event", "event", event, "request_id", seq.id)
+	}
+}
+
+// run delivers queued events in order, retrying failed deliveries with
+// exponential backoff before giving up on an event.
+func (h *Webhook) run() {
+	for event := range h.events {
+		backoff := webhookBackoff
+		for attempt := 0; ; attempt++ {
+			err := h.post(event)
+			if err == nil {
+				break
+			}
+
+			if attempt >= webhookMaxRetries {
+				slog.Warn("failed to deliver webhook event", "event", event.Event, "request_id", event.RequestID, "error", err)
+				break
+			}
+
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// post sends a single event to the webhook URL.
+func (h *Webhook) post(event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+/**
+ *
+ * MIT License
+ *
+ * Copyright (c) 2025 Rayan Raghuram
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliversSequenceEvents(t *testing.T) {
+	received := make(chan WebhookEvent, 8)
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first delivery to exercise the retry path
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("failed to decode event: %v", err)
+		}
+		received <- event
+	}))
+	defer receiver.Close()
+
+	hook := NewWebhook(receiver.URL)
+	seq := &Sequence{id: "abc123", startProcessingTime: time.Now(), numPromptInputs: 5}
+
+	hook.SequenceEvent(WebhookEventStarted, seq, "")
+	seq.numPredicted = 1
+	hook.SequenceEvent(WebhookEventFirstToken, seq, "")
+	seq.numPredicted = 3
+	hook.SequenceEvent(WebhookEventCompleted, seq, "stop")
+
+	want := []string{WebhookEventStarted, WebhookEventFirstToken, WebhookEventCompleted}
+	for _, name := range want {
+		select {
+		case event := <-received:
+			if event.Event != name {
+				t.Fatalf("expected event %q, got %q", name, event.Event)
+			}
+			if event.RequestID != "abc123" {
+				t.Errorf("expected request id abc123, got %q", event.RequestID)
+			}
+			if name == WebhookEventCompleted && (event.Reason != "stop" || event.PredictedN != 3) {
+				t.Errorf("unexpected completed event: %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q event", name)
+		}
+	}
+}
+
+func TestNilWebhookDiscardsEvents(t *testing.T) {
+	var hook *Webhook
+	hook.SequenceEvent(WebhookEventStarted, &Sequence{}, "")
+
+	if NewWebhook("") != nil {
+		t.Error("expected nil webhook without a URL")
+	}
+}